@@ -0,0 +1,43 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+)
+
+// Error declarations
+var (
+	ErrAppendOnly = errors.New("Storage backend is append-only, removing data requires admin credentials")
+)
+
+// AppendOnlyBackend is implemented by storage backends which can refuse to
+// overwrite or delete stored data.
+type AppendOnlyBackend interface {
+	// AppendOnly returns true if data can be added, but not removed
+	AppendOnly() bool
+}
+
+// IsAppendOnly returns true if be refuses to remove data.
+func IsAppendOnly(be Backend) bool {
+	if a, ok := be.(AppendOnlyBackend); ok {
+		return a.AppendOnly()
+	}
+	return false
+}
+
+// AppendOnly returns true if any of the backends refuses to remove data, so
+// snapshots can't be removed from the repository.
+func (backend *BackendManager) AppendOnly() bool {
+	for _, be := range backend.Backends {
+		if IsAppendOnly(*be) {
+			return true
+		}
+	}
+	return false
+}
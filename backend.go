@@ -69,6 +69,8 @@ var (
 	ErrAvailableSpaceUnknown   = errors.New("Available space is unknown or undefined")
 	ErrAvailableSpaceUnlimited = errors.New("Available space is unlimited")
 	ErrInvalidUsername         = errors.New("Username wrong or missing")
+	ErrUnauthorized            = errors.New("Storage backend refused the credentials")
+	ErrInsufficientStorage     = errors.New("Storage backend is out of space")
 
 	backends = []BackendFactory{}
 )
@@ -0,0 +1,130 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState describes whether a backend is currently being used.
+type CircuitState uint8
+
+// Circuit breaker states
+const (
+	CircuitClosed   CircuitState = iota // backend is healthy and used normally
+	CircuitOpen                         // backend failed repeatedly and is skipped
+	CircuitHalfOpen                     // backend is probed again after a cool-down
+)
+
+const (
+	// consecutive failures before a backend's circuit opens
+	circuitThreshold = 3
+	// time a backend with an open circuit gets skipped before it's probed again
+	circuitCooldown = 30 * time.Second
+	// weight of the latest sample in the latency moving average
+	latencySmoothing = 0.2
+)
+
+// String returns a user-friendly description of a circuit state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "offline"
+	case CircuitHalfOpen:
+		return "recovering"
+	default:
+		return "online"
+	}
+}
+
+// BackendHealth tracks the availability and latency of a single backend.
+type BackendHealth struct {
+	State       CircuitState
+	Failures    uint          // consecutive failures
+	Latency     time.Duration // moving average of successful operations
+	LastError   error
+	LastFailure time.Time
+	Degraded    bool // a write to this backend was skipped or failed, until a rebalance restored its data
+}
+
+// available returns true if the backend should be tried for an operation.
+// An open circuit turns half-open once the cool-down expired.
+func (h *BackendHealth) available() bool {
+	if h.State == CircuitOpen && time.Since(h.LastFailure) >= circuitCooldown {
+		h.State = CircuitHalfOpen
+	}
+
+	return h.State != CircuitOpen
+}
+
+// success records a successful operation and closes the circuit.
+func (h *BackendHealth) success(latency time.Duration) {
+	if h.Latency == 0 {
+		h.Latency = latency
+	} else {
+		h.Latency = time.Duration(latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(h.Latency))
+	}
+
+	h.State = CircuitClosed
+	h.Failures = 0
+	h.LastError = nil
+}
+
+// failure records a failed operation and opens the circuit if the backend
+// failed too often in a row, or if it was on probation.
+func (h *BackendHealth) failure(err error) {
+	h.Failures++
+	h.LastError = err
+	h.LastFailure = time.Now()
+
+	if h.State == CircuitHalfOpen || h.Failures >= circuitThreshold {
+		h.State = CircuitOpen
+	}
+}
+
+// probed records the outcome of an explicit health check. Unlike a failed
+// operation, a failed check opens the circuit right away. A successful check
+// doesn't clear the degraded flag, as the backend still misses data.
+func (h *BackendHealth) probed(err error, latency time.Duration) {
+	if err != nil {
+		h.failure(err)
+		h.State = CircuitOpen
+		return
+	}
+
+	h.success(latency)
+}
+
+// backendRegistry holds the per-backend state of a BackendManager and is
+// shared by all of its copies.
+type backendRegistry struct {
+	sync.Mutex
+	backends map[*Backend]*BackendHealth
+	labels   map[*Backend]map[string]string
+	weights  map[*Backend]float64
+}
+
+func newBackendRegistry() *backendRegistry {
+	return &backendRegistry{
+		backends: make(map[*Backend]*BackendHealth),
+		labels:   make(map[*Backend]map[string]string),
+		weights:  make(map[*Backend]float64),
+	}
+}
+
+// of returns the health of a backend. The registry must be locked.
+func (r *backendRegistry) of(be *Backend) *BackendHealth {
+	h, ok := r.backends[be]
+	if !ok {
+		h = &BackendHealth{}
+		r.backends[be] = h
+	}
+
+	return h
+}
@@ -7,7 +7,12 @@
 
 package knoxite
 
-import "errors"
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
 
 const (
 	retries = 3
@@ -17,7 +22,21 @@ const (
 type BackendManager struct {
 	Backends []*Backend
 
-	lastUsedBackend int
+	// FailureTolerance is the amount of backends which may fail while
+	// writing metadata before the write gets aborted.
+	FailureTolerance uint
+
+	// VerifyWrites verifies every stored chunk part, either by reading it
+	// back or by comparing a server-side checksum, and uploads it again if
+	// it doesn't match.
+	VerifyWrites bool
+
+	// SharedFailureDomains permits storing parts of the same chunk in the
+	// same failure domain, if the labels of the backends don't leave enough
+	// failure domains for all parts.
+	SharedFailureDomains bool
+
+	state *backendRegistry
 }
 
 // Error declarations
@@ -31,13 +50,45 @@ var (
 	ErrStoreSnapshotFailed   = errors.New("Storing snapshot failed")
 	ErrStoreChunkIndexFailed = errors.New("Storing chunk-index failed")
 	ErrStoreRepositoryFailed = errors.New("Storing repository failed")
+	ErrBackendUnavailable    = errors.New("Storage backend is unavailable")
 )
 
-// AddBackend adds a backend.
+// NewBackendManager returns a BackendManager without any backends. All copies
+// of it share the health and labels of the backends.
+func NewBackendManager() BackendManager {
+	return BackendManager{state: newBackendRegistry()}
+}
+
+// AddBackend adds a backend. A zero BackendManager gets its registry when the
+// first backend gets added, before it can be used concurrently.
 func (backend *BackendManager) AddBackend(be *Backend) {
+	if backend.state == nil {
+		backend.state = newBackendRegistry()
+	}
 	backend.Backends = append(backend.Backends, be)
 }
 
+// RemoveBackend removes a backend. Copies of the BackendManager made before
+// the removal still contain it.
+func (backend *BackendManager) RemoveBackend(be *Backend) {
+	backends := []*Backend{}
+	for _, b := range backend.Backends {
+		if b != be {
+			backends = append(backends, b)
+		}
+	}
+
+	backend.Backends = backends
+}
+
+// Wrap replaces every backend with the Backend returned by wrap, e.g. to add
+// rate-limiting. The health and labels of the backends are retained.
+func (backend *BackendManager) Wrap(wrap func(be Backend) Backend) {
+	for _, be := range backend.Backends {
+		*be = wrap(*be)
+	}
+}
+
 // Locations returns the urls for all backends.
 func (backend *BackendManager) Locations() []string {
 	paths := []string{}
@@ -48,131 +99,421 @@ func (backend *BackendManager) Locations() []string {
 	return paths
 }
 
-// LoadChunk loads a Chunk from backends.
-func (backend *BackendManager) LoadChunk(chunk Chunk, part uint) ([]byte, error) {
+// Health returns the current health status of a backend.
+func (backend *BackendManager) Health(be *Backend) BackendHealth {
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	h := reg.of(be)
+	h.available()
+	return *h
+}
+
+// DegradedBackends returns all backends which are currently offline or
+// which missed a write.
+func (backend *BackendManager) DegradedBackends() []*Backend {
+	bes := []*Backend{}
 	for _, be := range backend.Backends {
-		for i := 0; i < retries; i++ {
-			b, err := (*be).LoadChunk(chunk.Hash, part, chunk.DataParts)
-			if err == nil {
-				return b, err
-			}
+		h := backend.Health(be)
+		if h.Degraded || h.State != CircuitClosed {
+			bes = append(bes, be)
 		}
 	}
 
-	return []byte{}, ErrLoadChunkFailed
+	return bes
 }
 
-// StoreChunk stores a single Chunk on backends.
-func (backend *BackendManager) StoreChunk(chunk Chunk) (size uint64, err error) {
-	for i, data := range *chunk.Data {
-		// Use storage backends in a round robin fashion to store chunks
-		backend.lastUsedBackend++
-		if backend.lastUsedBackend+1 > len(backend.Backends) {
-			backend.lastUsedBackend = 0
+// CheckBackends probes all backends by reading the repository's metadata
+// from each of them, updating their health status. Backends failing the
+// probe are marked offline, those passing it are considered healthy again.
+// Backends which missed writes stay degraded until their data got restored.
+func (backend *BackendManager) CheckBackends() {
+	for _, be := range backend.Backends {
+		start := time.Now()
+		_, err := (*be).LoadRepository()
+		if isNotFound(err) {
+			err = nil
 		}
 
-		be := backend.Backends[backend.lastUsedBackend]
+		reg := backend.registry()
+		reg.Lock()
+		reg.of(be).probed(err, time.Since(start))
+		reg.Unlock()
+	}
+}
 
-		var n uint64
-		var err error
-		for j := 0; j < retries; j++ {
-			n, err = (*be).StoreChunk(chunk.Hash, uint(i), chunk.DataParts, data)
-			if err != nil {
-				// retry
-				continue
-			}
+// registry returns the health registry shared by all copies of the
+// BackendManager.
+func (backend *BackendManager) registry() *backendRegistry {
+	return backend.state
+}
+
+// available returns true if be should be used for the next operation.
+func (backend *BackendManager) available(be *Backend) bool {
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	return reg.of(be).available()
+}
+
+// unavailableError returns the error that made a backend unavailable.
+func (backend *BackendManager) unavailableError(be *Backend) error {
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	if err := reg.of(be).LastError; err != nil {
+		return err
+	}
+	return ErrBackendUnavailable
+}
+
+// markDegraded flags a backend which missed a write. The flag is stored in the
+// repository's metadata by Repository.Save.
+func (backend *BackendManager) markDegraded(be *Backend) {
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	reg.of(be).Degraded = true
+}
+
+// clearDegraded clears the degraded flag of all backends, once their data got
+// restored.
+func (backend *BackendManager) clearDegraded() {
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	for _, be := range backend.Backends {
+		reg.of(be).Degraded = false
+	}
+}
+
+// track runs op on be and records its outcome in the backend's health.
+func (backend *BackendManager) track(be *Backend, op func(b Backend) error) error {
+	start := time.Now()
+	err := op(*be)
 
-			if n > size {
-				size = n
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	if err != nil && !isNotFound(err) {
+		reg.of(be).failure(err)
+	} else {
+		reg.of(be).success(time.Since(start))
+	}
+	return err
+}
+
+// isNotFound returns true if err only indicates missing data, which doesn't
+// affect a backend's health.
+func isNotFound(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// try runs op on be, retrying as long as the backend remains available.
+func (backend *BackendManager) try(be *Backend, op func(b Backend) error) error {
+	var err error
+	for i := 0; i < retries; i++ {
+		if i > 0 {
+			if !backend.available(be) {
+				break
 			}
-			break
+			currentMetrics().Inc(MetricBackendRetries, "backend", (*be).Location())
 		}
-		if err != nil {
-			return 0, err
+
+		err = backend.track(be, op)
+		if err == nil {
+			return nil
 		}
 	}
 
-	return size, nil
+	return err
 }
 
-// DeleteChunk deletes a single Chunk.
-func (backend *BackendManager) DeleteChunk(shasum string, part, totalParts uint) error {
+// readOrder returns all backends ordered by health and observed latency.
+// Backends which are currently offline are only used as a last resort.
+func (backend *BackendManager) readOrder() []*Backend {
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	online := []*Backend{}
+	offline := []*Backend{}
 	for _, be := range backend.Backends {
-		for i := 0; i < retries; i++ {
-			err := (*be).DeleteChunk(shasum, part, totalParts)
-			if err == nil {
-				return nil
-			}
+		if reg.of(be).available() {
+			online = append(online, be)
+		} else {
+			offline = append(offline, be)
 		}
 	}
 
-	return ErrDeleteChunkFailed
+	sort.SliceStable(online, func(i, j int) bool {
+		hi, hj := reg.of(online[i]), reg.of(online[j])
+		if hi.State != hj.State {
+			return hi.State < hj.State
+		}
+		return hi.Latency < hj.Latency
+	})
+
+	return append(online, offline...)
 }
 
-// LoadSnapshot loads a snapshot.
-func (backend *BackendManager) LoadSnapshot(id string) ([]byte, error) {
-	for _, be := range backend.Backends {
-		for i := 0; i < retries; i++ {
-			b, err := (*be).LoadSnapshot(id)
-			if err == nil {
-				return b, err
-			}
+// load reads data from the healthiest backend able to deliver it.
+func (backend *BackendManager) load(op func(b Backend) ([]byte, error), failErr error) ([]byte, error) {
+	for _, be := range backend.readOrder() {
+		var b []byte
+		err := backend.try(be, func(be Backend) error {
+			var lerr error
+			b, lerr = op(be)
+			return lerr
+		})
+		if err == nil {
+			return b, nil
 		}
 	}
 
-	return []byte{}, ErrLoadSnapshotFailed
+	return []byte{}, failErr
 }
 
-// SaveSnapshot stores a snapshot on all storage backends.
-func (backend *BackendManager) SaveSnapshot(id string, b []byte) error {
+// write runs op on be. Backends which are known to be unavailable are
+// skipped if skippable is true, otherwise they get probed once.
+func (backend *BackendManager) write(be *Backend, op func(b Backend) error, skippable bool) error {
+	if skippable && !backend.available(be) {
+		return backend.unavailableError(be)
+	}
+
+	return backend.try(be, op)
+}
+
+// writeAll runs op on all backends. Backends which fail are marked as
+// degraded, the write only fails if more backends than the configured
+// failure tolerance could not be written to.
+func (backend *BackendManager) writeAll(op func(b Backend) error) error {
+	var lastErr error
+	failed := 0
 	for _, be := range backend.Backends {
-		var err error
-		for i := 0; i < retries; i++ {
-			err = (*be).SaveSnapshot(id, b)
-			if err == nil {
-				break
-			}
-		}
-		if err != nil {
-			return err
+		skippable := uint(failed) < backend.FailureTolerance
+		if err := backend.write(be, op, skippable); err != nil {
+			backend.markDegraded(be)
+			lastErr = err
+			failed++
 		}
 	}
 
+	if failed > 0 && (uint(failed) > backend.FailureTolerance || failed == len(backend.Backends)) {
+		return lastErr
+	}
 	return nil
 }
 
-// LoadChunkIndex loads the chunk-index.
-func (backend *BackendManager) LoadChunkIndex() ([]byte, error) {
+// Backend returns the backend with the given location.
+func (backend *BackendManager) Backend(location string) *Backend {
 	for _, be := range backend.Backends {
-		for i := 0; i < retries; i++ {
-			b, err := (*be).LoadChunkIndex()
-			if err == nil {
-				return b, err
-			}
+		if (*be).Location() == location {
+			return be
 		}
 	}
 
-	return []byte{}, ErrLoadChunkIndexFailed
+	return nil
 }
 
-// SaveChunkIndex stores the chunk-index on all storage backends.
-func (backend *BackendManager) SaveChunkIndex(b []byte) error {
-	for _, be := range backend.Backends {
-		var err error
-		for i := 0; i < retries; i++ {
-			err = (*be).SaveChunkIndex(b)
-			if err == nil {
+// LoadChunk loads a Chunk from backends. If the location of the part is
+// known, its backend is tried first.
+func (backend *BackendManager) LoadChunk(chunk Chunk, part uint) ([]byte, error) {
+	load := func(be Backend) ([]byte, error) {
+		return be.LoadChunk(chunk.Hash, part, chunk.DataParts)
+	}
+
+	if be := backend.partBackend(chunk, part); be != nil {
+		var b []byte
+		err := backend.try(be, func(be Backend) error {
+			var lerr error
+			b, lerr = load(be)
+			return lerr
+		})
+		if err == nil {
+			return b, nil
+		}
+	}
+
+	return backend.load(load, ErrLoadChunkFailed)
+}
+
+// partBackend returns the backend storing a part of a chunk, or nil if its
+// location is unknown.
+func (backend *BackendManager) partBackend(chunk Chunk, part uint) *Backend {
+	if part >= uint(len(chunk.Locations)) || chunk.Locations[part] == "" {
+		return nil
+	}
+
+	return backend.Backend(chunk.Locations[part])
+}
+
+// StoreChunk stores a single Chunk on backends and records the location of
+// each part in the chunk. Every part of the chunk gets stored on a different
+// backend and failure domain, unless the chunk already carries the locations
+// of a previously stored copy. As long as no more parts than the chunk's
+// parity parts could not be stored, the chunk is still considered to be
+// stored successfully.
+func (backend *BackendManager) StoreChunk(chunk *Chunk) (size uint64, err error) {
+	size, _, err = backend.storeChunk(chunk)
+	return size, err
+}
+
+// storeChunk stores a Chunk like StoreChunk and also returns how many parts
+// had to be uploaded again after failing verification.
+func (backend *BackendManager) storeChunk(chunk *Chunk) (size uint64, reuploads uint64, err error) {
+	size, reuploads, _, err = backend.storeQueriedChunk(chunk, nil)
+	return size, reuploads, err
+}
+
+// storeQueriedChunk stores a Chunk like storeChunk, skipping all parts which
+// queryChunks found to be stored already. It also reports whether parts of
+// the chunk had to share a failure domain.
+func (backend *BackendManager) storeQueriedChunk(chunk *Chunk, stored map[storedPart]bool) (size uint64, reuploads uint64, shared bool, err error) {
+	pl, err := backend.placeChunk(*chunk)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	locations := make([]string, len(*chunk.Data))
+	defer func() {
+		chunk.Locations = locations
+	}()
+
+	missing := uint(0)
+	for i, data := range *chunk.Data {
+		var n uint64
+		part := uint(i)
+		store := func(b Backend) error {
+			var serr error
+			if !backend.VerifyWrites && stored[storedPart{b.Location(), chunk.Hash, part, chunk.DataParts}] {
+				n = 0
+				return nil
+			}
+			if backend.VerifyWrites {
+				var r uint64
+				n, r, serr = storeVerifiedChunk(b, chunk.Hash, part, chunk.DataParts, data)
+				reuploads += r
+			} else {
+				n, serr = b.StoreChunk(chunk.Hash, part, chunk.DataParts, data)
+			}
+			return serr
+		}
+
+		be := pl.backends[i]
+		perr := backend.write(be, store, missing < chunk.ParityParts)
+		for perr != nil {
+			backend.markDegraded(be)
+
+			// try to fall back to a backend in another failure domain
+			if be = pl.replace(backend, i); be == nil {
 				break
 			}
+			perr = backend.write(be, store, false)
 		}
-		if err != nil {
-			return err
+		if perr != nil {
+			missing++
+			if missing > chunk.ParityParts {
+				return 0, reuploads, pl.shared, perr
+			}
+			continue
+		}
+
+		locations[i] = (*be).Location()
+		if n > size {
+			size = n
+		}
+	}
+
+	return size, reuploads, pl.shared, nil
+}
+
+// placeChunk returns the placement for a chunk's parts, preferring the
+// locations already recorded in the chunk.
+func (backend *BackendManager) placeChunk(chunk Chunk) (*placement, error) {
+	parts := len(*chunk.Data)
+	if len(chunk.Locations) != parts {
+		return backend.place(chunk.Hash, parts)
+	}
+
+	p := &placement{}
+	for i := range chunk.Locations {
+		be := backend.partBackend(chunk, uint(i))
+		if be == nil {
+			return backend.place(chunk.Hash, parts)
+		}
+		p.backends = append(p.backends, be)
+	}
+	for _, be := range backend.rank(chunk.Hash) {
+		if !backend.conflicts(be, p.backends) {
+			p.spares = append(p.spares, be)
+		}
+	}
+
+	return p, nil
+}
+
+// DeleteChunk deletes a single part of a Chunk. If the location of the part
+// is unknown, it gets deleted from all backends.
+func (backend *BackendManager) DeleteChunk(chunk Chunk, part uint) error {
+	del := func(b Backend) error {
+		return b.DeleteChunk(chunk.Hash, part, chunk.DataParts)
+	}
+
+	if be := backend.partBackend(chunk, part); be != nil {
+		if err := backend.try(be, del); err != nil {
+			return ErrDeleteChunkFailed
 		}
+		return nil
 	}
 
+	deleted := false
+	for _, be := range backend.readOrder() {
+		if err := backend.try(be, del); err == nil {
+			deleted = true
+		}
+	}
+
+	if !deleted {
+		return ErrDeleteChunkFailed
+	}
 	return nil
 }
 
+// LoadSnapshot loads a snapshot.
+func (backend *BackendManager) LoadSnapshot(id string) ([]byte, error) {
+	return backend.load(func(be Backend) ([]byte, error) {
+		return be.LoadSnapshot(id)
+	}, ErrLoadSnapshotFailed)
+}
+
+// SaveSnapshot stores a snapshot on all storage backends.
+func (backend *BackendManager) SaveSnapshot(id string, b []byte) error {
+	return backend.writeAll(func(be Backend) error {
+		return be.SaveSnapshot(id, b)
+	})
+}
+
+// LoadChunkIndex loads the chunk-index.
+func (backend *BackendManager) LoadChunkIndex() ([]byte, error) {
+	return backend.load(func(be Backend) ([]byte, error) {
+		return be.LoadChunkIndex()
+	}, ErrLoadChunkIndexFailed)
+}
+
+// SaveChunkIndex stores the chunk-index on all storage backends.
+func (backend *BackendManager) SaveChunkIndex(b []byte) error {
+	return backend.writeAll(func(be Backend) error {
+		return be.SaveChunkIndex(b)
+	})
+}
+
 // InitRepository creates a new repository.
 func (backend *BackendManager) InitRepository() error {
 	for _, be := range backend.Backends {
@@ -187,32 +528,14 @@ func (backend *BackendManager) InitRepository() error {
 
 // LoadRepository reads the metadata for a repository.
 func (backend *BackendManager) LoadRepository() ([]byte, error) {
-	for _, be := range backend.Backends {
-		for i := 0; i < retries; i++ {
-			b, err := (*be).LoadRepository()
-			if err == nil {
-				return b, err
-			}
-		}
-	}
-
-	return []byte{}, ErrLoadRepositoryFailed
+	return backend.load(func(be Backend) ([]byte, error) {
+		return be.LoadRepository()
+	}, ErrLoadRepositoryFailed)
 }
 
 // SaveRepository stores the metadata for a repository.
 func (backend *BackendManager) SaveRepository(b []byte) error {
-	for _, be := range backend.Backends {
-		var err error
-		for i := 0; i < retries; i++ {
-			err = (*be).SaveRepository(b)
-			if err == nil {
-				break
-			}
-		}
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return backend.writeAll(func(be Backend) error {
+		return be.SaveRepository(b)
+	})
 }
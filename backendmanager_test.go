@@ -0,0 +1,322 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var errBackendDown = errors.New("backend is down")
+
+// failingBackend wraps a Backend and fails all operations while down.
+type failingBackend struct {
+	Backend
+	down  bool
+	calls int
+}
+
+func (b *failingBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	b.calls++
+	if b.down {
+		return nil, errBackendDown
+	}
+	return b.Backend.LoadChunk(shasum, part, totalParts)
+}
+
+func (b *failingBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	b.calls++
+	if b.down {
+		return 0, errBackendDown
+	}
+	return b.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func (b *failingBackend) SaveSnapshot(id string, data []byte) error {
+	b.calls++
+	if b.down {
+		return errBackendDown
+	}
+	return b.Backend.SaveSnapshot(id, data)
+}
+
+func (b *failingBackend) LoadRepository() ([]byte, error) {
+	b.calls++
+	if b.down {
+		return nil, errBackendDown
+	}
+	return b.Backend.LoadRepository()
+}
+
+func newTestBackendManager(t *testing.T, count int) (*BackendManager, []*failingBackend, func()) {
+	bm := &BackendManager{}
+	fbs := []*failingBackend{}
+	dirs := []string{}
+
+	for i := 0; i < count; i++ {
+		dir, err := ioutil.TempDir("", "knoxite")
+		if err != nil {
+			t.Fatalf("Failed creating temporary dir for repository: %s", err)
+		}
+		dirs = append(dirs, dir)
+
+		be, err := BackendFromURL(dir)
+		if err != nil {
+			t.Fatalf("Failed creating backend: %s", err)
+		}
+		if err = be.InitRepository(); err != nil {
+			t.Fatalf("Failed initializing backend: %s", err)
+		}
+
+		fb := &failingBackend{Backend: be}
+		fbs = append(fbs, fb)
+
+		var b Backend = fb
+		bm.AddBackend(&b)
+	}
+
+	return bm, fbs, func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func TestBackendManagerLoadFailover(t *testing.T) {
+	bm, fbs, cleanup := newTestBackendManager(t, 2)
+	defer cleanup()
+
+	data := []byte("this is a chunk")
+	chunk := Chunk{
+		Hash:      Hash(data, HashHighway256),
+		DataParts: 1,
+	}
+	for _, fb := range fbs {
+		if _, err := fb.StoreChunk(chunk.Hash, 0, 1, data); err != nil {
+			t.Fatalf("Failed storing chunk: %s", err)
+		}
+	}
+
+	fbs[0].down = true
+	fbs[0].calls = 0
+	for i := 0; i < 5; i++ {
+		b, err := bm.LoadChunk(chunk, 0)
+		if err != nil {
+			t.Fatalf("Expected chunk to be loaded from healthy backend, got %s", err)
+		}
+		if string(b) != string(data) {
+			t.Errorf("Data mismatch: expected %s, got %s", data, b)
+		}
+	}
+
+	if fbs[0].calls != circuitThreshold {
+		t.Errorf("Expected failing backend to be skipped after %d calls, got %d calls", circuitThreshold, fbs[0].calls)
+	}
+	if h := bm.Health(bm.Backends[0]); h.State != CircuitOpen {
+		t.Errorf("Expected circuit of failing backend to be open, got %s", h.State)
+	}
+	if h := bm.Health(bm.Backends[1]); h.State != CircuitClosed {
+		t.Errorf("Expected circuit of healthy backend to be closed, got %s", h.State)
+	}
+}
+
+func TestBackendManagerDegradedWrite(t *testing.T) {
+	bm, fbs, cleanup := newTestBackendManager(t, 3)
+	defer cleanup()
+
+	fbs[1].down = true
+	if err := bm.SaveSnapshot("snapshot", []byte("data")); err != errBackendDown {
+		t.Errorf("Expected %v without failure tolerance, got %v", errBackendDown, err)
+	}
+
+	bm.FailureTolerance = 1
+	if err := bm.SaveSnapshot("snapshot", []byte("data")); err != nil {
+		t.Errorf("Expected degraded write to succeed, got %v", err)
+	}
+
+	degraded := bm.DegradedBackends()
+	if len(degraded) != 1 || degraded[0] != bm.Backends[1] {
+		t.Errorf("Expected exactly the failing backend to be degraded, got %d backends", len(degraded))
+	}
+
+	fbs[2].down = true
+	if err := bm.SaveSnapshot("snapshot", []byte("data")); err == nil {
+		t.Error("Expected write to fail when exceeding the failure tolerance")
+	}
+}
+
+func TestBackendManagerCheckBackends(t *testing.T) {
+	bm, fbs, cleanup := newTestBackendManager(t, 2)
+	defer cleanup()
+
+	// a single failed probe takes the backend offline
+	fbs[0].down = true
+	bm.CheckBackends()
+	if h := bm.Health(bm.Backends[0]); h.State != CircuitOpen || h.LastError != errBackendDown {
+		t.Errorf("Expected failing backend to be offline, got %s: %v", h.State, h.LastError)
+	}
+	if h := bm.Health(bm.Backends[1]); h.State != CircuitClosed {
+		t.Errorf("Expected healthy backend to be online, got %s", h.State)
+	}
+
+	bm.FailureTolerance = 1
+	if err := bm.SaveSnapshot("snapshot", []byte("data")); err != nil {
+		t.Fatalf("Expected degraded write to succeed, got %v", err)
+	}
+	degraded := bm.DegradedBackends()
+	if len(degraded) != 1 || degraded[0] != bm.Backends[0] {
+		t.Errorf("Expected exactly the failing backend to be degraded, got %d backends", len(degraded))
+	}
+
+	// the recovered backend still misses the snapshot
+	fbs[0].down = false
+	bm.CheckBackends()
+	if h := bm.Health(bm.Backends[0]); h.State != CircuitClosed || !h.Degraded {
+		t.Errorf("Expected recovered backend to be online and still degraded, got %s (degraded: %v)", h.State, h.Degraded)
+	}
+	if degraded := bm.DegradedBackends(); len(degraded) != 1 {
+		t.Errorf("Expected 1 degraded backend, got %d", len(degraded))
+	}
+}
+
+func TestRepositoryDegradedBackends(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dirs, cleanup := newTestRepositoryDirs(t, 2)
+	defer cleanup()
+	storeTestSnapshot(t, dirs, testPassword)
+
+	r, err := OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	missed := r.BackendManager().Backends[1]
+	r.BackendManager().markDegraded(missed)
+	if err = r.Save(); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+
+	// backends which missed writes are still degraded after reopening the
+	// repository and probing its backends
+	r, err = OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	r.BackendManager().CheckBackends()
+	degraded := r.BackendManager().DegradedBackends()
+	if len(degraded) != 1 || (*degraded[0]).Location() != (*missed).Location() {
+		t.Fatalf("Expected %s to be degraded, got %d backends", (*missed).Location(), len(degraded))
+	}
+
+	// until a rebalance restored their data
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+	progress, err := RebalanceRepo(&r, &index, 1, false)
+	if err != nil {
+		t.Fatalf("Failed rebalancing repository: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Fatalf("Failed rebalancing chunk: %s", p.Error)
+		}
+	}
+	r, err = OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	if degraded := r.BackendManager().DegradedBackends(); len(degraded) != 0 {
+		t.Errorf("Expected no degraded backends after rebalancing, got %d", len(degraded))
+	}
+}
+
+func TestBackendManagerDegradedStoreChunk(t *testing.T) {
+	bm, fbs, cleanup := newTestBackendManager(t, 3)
+	defer cleanup()
+
+	data := []byte("this is a chunk with parity")
+	pars, err := redundantData(data, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := Chunk{
+		Data:        &pars,
+		DataParts:   2,
+		ParityParts: 1,
+		Size:        len(data),
+		Hash:        Hash(data, HashHighway256),
+	}
+
+	fbs[0].down = true
+	if _, err := bm.StoreChunk(&chunk); err != nil {
+		t.Errorf("Expected chunk to be stored despite one failing backend, got %v", err)
+	}
+
+	fbs[1].down = true
+	if _, err := bm.StoreChunk(&chunk); err == nil {
+		t.Error("Expected storing to fail with more failing backends than parity parts")
+	}
+}
+
+func TestBackendManagerLocations(t *testing.T) {
+	bm, fbs, cleanup := newTestBackendManager(t, 3)
+	defer cleanup()
+
+	data := []byte("this is a chunk with known locations")
+	pars, err := redundantData(data, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := Chunk{
+		Data:        &pars,
+		DataParts:   2,
+		ParityParts: 1,
+		Size:        len(data),
+		Hash:        Hash(data, HashHighway256),
+	}
+
+	if _, err = bm.StoreChunk(&chunk); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if len(chunk.Locations) != 3 {
+		t.Fatalf("Expected 3 locations, got %d", len(chunk.Locations))
+	}
+
+	for i, location := range chunk.Locations {
+		be := bm.Backend(location)
+		if be == nil {
+			t.Fatalf("Unknown location %s for part %d", location, i)
+		}
+
+		for _, fb := range fbs {
+			fb.calls = 0
+		}
+		if _, err = bm.LoadChunk(chunk, uint(i)); err != nil {
+			t.Errorf("Failed loading part %d: %s", i, err)
+		}
+		for j, fb := range fbs {
+			expected := 0
+			if bm.Backends[j] == be {
+				expected = 1
+			}
+			if fb.calls != expected {
+				t.Errorf("Expected part %d to be loaded from its location only", i)
+			}
+		}
+
+		if err = bm.DeleteChunk(chunk, uint(i)); err != nil {
+			t.Errorf("Failed deleting part %d: %s", i, err)
+		}
+		if _, err = (*be).LoadChunk(chunk.Hash, uint(i), chunk.DataParts); err == nil {
+			t.Errorf("Expected part %d to be deleted from %s", i, location)
+		}
+	}
+}
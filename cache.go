@@ -0,0 +1,296 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"container/list"
+	"encoding/hex"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// checksumSize is the size of the checksum following the data of an entry.
+const checksumSize = 32
+
+// DiskCache is a size-limited, persistent cache on the local disk. When full,
+// the least recently used entries get evicted. Every entry is stored with a
+// checksum, so corrupted entries are never returned.
+type DiskCache struct {
+	path    string
+	maxSize uint64
+
+	mu      sync.Mutex
+	size    uint64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size uint64
+}
+
+// NewDiskCache opens or creates a cache at path, holding up to maxSize bytes.
+// Entries of a previously used cache are retained in their former order.
+func NewDiskCache(path string, maxSize uint64) (*DiskCache, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		path:    path,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	type file struct {
+		key     string
+		size    uint64
+		modTime time.Time
+	}
+	files := []file{}
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if filepath.Ext(p) == ".tmp" {
+			// left over by an interrupted write
+			return os.Remove(p)
+		}
+
+		key, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		size := uint64(0)
+		if info.Size() > checksumSize {
+			size = uint64(info.Size() - checksumSize)
+		}
+		files = append(files, file{filepath.ToSlash(key), size, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	for _, f := range files {
+		c.entries[f.key] = c.lru.PushBack(&cacheEntry{f.key, f.size})
+		c.size += f.size
+	}
+	c.evict(0)
+
+	return c, nil
+}
+
+// Size returns the amount of cached data in bytes.
+func (c *DiskCache) Size() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+func (c *DiskCache) file(key string) string {
+	return filepath.Join(c.path, filepath.FromSlash(key))
+}
+
+// Get returns a cached entry and marks it as recently used. Entries not
+// matching their checksum get removed.
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := c.file(key)
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(b) < checksumSize ||
+		hex.EncodeToString(b[len(b)-checksumSize:]) != Hash(b[:len(b)-checksumSize], HashHighway256) {
+		c.mu.Lock()
+		// the entry may have been replaced in the meantime
+		if c.entries[key] == e {
+			c.remove(e)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	// the modification time persists the usage order
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return b[:len(b)-checksumSize], true
+}
+
+// Put adds an entry to the cache, evicting other entries if necessary.
+// Entries larger than the cache itself are ignored.
+func (c *DiskCache) Put(key string, data []byte) error {
+	size := uint64(len(data))
+	if size > c.maxSize {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.evict(size)
+
+	path := c.file(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	sum, err := hex.DecodeString(Hash(data, HashHighway256))
+	if err != nil {
+		return err
+	}
+	tmp := path + "." + strconv.FormatInt(time.Now().UnixNano(), 16) + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data[:len(data):len(data)], sum...), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, size})
+	c.size += size
+	return nil
+}
+
+// Delete removes an entry from the cache.
+func (c *DiskCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// evict removes the least recently used entries until another n bytes fit.
+// The cache must be locked.
+func (c *DiskCache) evict(n uint64) {
+	for c.size+n > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes an entry. The cache must be locked.
+func (c *DiskCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	_ = os.Remove(c.file(entry.key))
+}
+
+// CachedBackend wraps a Backend and keeps the chunks it loads in a DiskCache.
+// Stored chunks bypass the cache, so a backup doesn't evict the data which is
+// actually being read. Only the data as it's stored on the backend gets
+// cached, so it remains encrypted. Snapshots, the chunk-index and repository
+// metadata can be changed by other clients, e.g. when they rebalance the
+// repository, and are never cached.
+//
+// A DiskCache can be shared by several backends, each of them using its own
+// set of entries.
+type CachedBackend struct {
+	Backend
+	cache  *DiskCache
+	prefix string
+}
+
+// NewCachedBackend returns a Backend cached by cache.
+func NewCachedBackend(be Backend, cache *DiskCache) *CachedBackend {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(be.Location()))
+
+	return &CachedBackend{
+		Backend: be,
+		cache:   cache,
+		prefix:  strconv.FormatUint(h.Sum64(), 16) + "/",
+	}
+}
+
+func (backend *CachedBackend) chunkKey(shasum string, part, totalParts uint) string {
+	return backend.prefix + "chunks/" + shasum[0:2] + "/" + shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+}
+
+// load returns a cached entry or loads and caches it. Cached entries are only
+// used if verify accepts them.
+func (backend *CachedBackend) load(key string, verify func(b []byte) bool, op func() ([]byte, error)) ([]byte, error) {
+	if b, ok := backend.cache.Get(key); ok {
+		if verify == nil || verify(b) {
+			return b, nil
+		}
+		backend.cache.Delete(key)
+	}
+
+	b, err := op()
+	if err != nil {
+		return b, err
+	}
+	_ = backend.cache.Put(key, b)
+
+	return b, nil
+}
+
+// LoadChunk loads a Chunk. Cached chunks which haven't been split into
+// several parts get verified against their hash.
+func (backend *CachedBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	var verify func(b []byte) bool
+	if part == 0 && totalParts == 1 {
+		verify = func(b []byte) bool {
+			return Hash(b, HashHighway256) == shasum
+		}
+	}
+
+	return backend.load(backend.chunkKey(shasum, part, totalParts), verify, func() ([]byte, error) {
+		return backend.Backend.LoadChunk(shasum, part, totalParts)
+	})
+}
+
+// DeleteChunk deletes a single Chunk.
+func (backend *CachedBackend) DeleteChunk(shasum string, part, totalParts uint) error {
+	backend.cache.Delete(backend.chunkKey(shasum, part, totalParts))
+	return backend.Backend.DeleteChunk(shasum, part, totalParts)
+}
+
+// VerifyChunk verifies a stored Chunk. The verification bypasses the cache,
+// so a broken upload never gets cached.
+func (backend *CachedBackend) VerifyChunk(shasum string, part, totalParts uint, data []byte) error {
+	backend.cache.Delete(backend.chunkKey(shasum, part, totalParts))
+	return VerifyStoredChunk(backend.Backend, shasum, part, totalParts, data)
+}
+
+// AppendOnly returns true if the backend refuses to remove data.
+func (backend *CachedBackend) AppendOnly() bool {
+	return IsAppendOnly(backend.Backend)
+}
+
+// HasChunks reports which chunk parts are stored on the backend.
+func (backend *CachedBackend) HasChunks(parts []ChunkPart) ([]bool, error) {
+	return QueryChunks(backend.Backend, parts)
+}
@@ -0,0 +1,169 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite.cache")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for cache: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewDiskCache(dir, 30)
+	if err != nil {
+		t.Fatalf("Failed creating cache: %s", err)
+	}
+
+	data := []byte("0123456789")
+	for _, key := range []string{"a", "b", "c"} {
+		if err = c.Put(key, data); err != nil {
+			t.Fatalf("Failed adding %s to cache: %s", key, err)
+		}
+	}
+
+	// a becomes the most recently used entry, so b gets evicted
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Expected a to be cached")
+	}
+	_ = c.Put("d", data)
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	if c.Size() != 30 {
+		t.Errorf("Expected cache size of 30, got %d", c.Size())
+	}
+
+	// entries larger than the cache don't get cached
+	_ = c.Put("e", make([]byte, 31))
+	if _, ok := c.Get("e"); ok {
+		t.Error("Expected oversized entry not to be cached")
+	}
+
+	// reopening the cache with a smaller size evicts the oldest entries
+	c, err = NewDiskCache(dir, 20)
+	if err != nil {
+		t.Fatalf("Failed opening cache: %s", err)
+	}
+	if c.Size() != 20 {
+		t.Errorf("Expected cache size of 20, got %d", c.Size())
+	}
+	if b, ok := c.Get("d"); !ok || string(b) != string(data) {
+		t.Error("Expected d to remain cached")
+	}
+}
+
+func TestDiskCacheCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite.cache")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for cache: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("Failed creating cache: %s", err)
+	}
+	if err = c.Put("a", []byte("0123456789")); err != nil {
+		t.Fatalf("Failed adding a to cache: %s", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "a"), os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteAt([]byte("x"), 0)
+	f.Close()
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected corrupted entry not to be returned")
+	}
+	if c.Size() != 0 {
+		t.Errorf("Expected corrupted entry to be removed, got cache size of %d", c.Size())
+	}
+}
+
+func TestCachedBackend(t *testing.T) {
+	bm, fbs, cleanup := newTestBackendManager(t, 1)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "knoxite.cache")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for cache: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("Failed creating cache: %s", err)
+	}
+	bm.Wrap(func(be Backend) Backend {
+		return NewCachedBackend(be, c)
+	})
+	be := *bm.Backends[0]
+
+	data := []byte("this is an encrypted chunk")
+	shasum := Hash(data, HashHighway256)
+	if _, err = be.StoreChunk(shasum, 0, 1, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if c.Size() != 0 {
+		t.Error("Expected stored chunk not to be cached")
+	}
+
+	fbs[0].calls = 0
+	for i := 0; i < 3; i++ {
+		b, err := be.LoadChunk(shasum, 0, 1)
+		if err != nil {
+			t.Fatalf("Failed loading chunk: %s", err)
+		}
+		if string(b) != string(data) {
+			t.Errorf("Data mismatch: expected %s, got %s", data, b)
+		}
+	}
+	if fbs[0].calls != 1 {
+		t.Errorf("Expected chunk to be loaded from backend once, got %d calls", fbs[0].calls)
+	}
+
+	// a cached chunk not matching its hash gets loaded again
+	cb := be.(*CachedBackend)
+	_ = c.Put(cb.chunkKey(shasum, 0, 1), []byte("this is a different chunk"))
+	if b, err := be.LoadChunk(shasum, 0, 1); err != nil || string(b) != string(data) {
+		t.Errorf("Expected chunk to be loaded from backend, got %s: %v", b, err)
+	}
+	if fbs[0].calls != 2 {
+		t.Errorf("Expected mismatching chunk to be loaded from backend, got %d calls", fbs[0].calls)
+	}
+
+	if err = be.DeleteChunk(shasum, 0, 1); err != nil {
+		t.Fatalf("Failed deleting chunk: %s", err)
+	}
+	if _, err = be.LoadChunk(shasum, 0, 1); err == nil {
+		t.Error("Expected deleted chunk not to be served from cache")
+	}
+
+	// snapshots get rewritten by other clients, e.g. during a rebalance
+	if err = be.SaveSnapshot("snapshot", []byte("snapshot")); err != nil {
+		t.Fatalf("Failed saving snapshot: %s", err)
+	}
+	if _, err = be.LoadSnapshot("snapshot"); err != nil {
+		t.Fatalf("Failed loading snapshot: %s", err)
+	}
+	if err = cb.Backend.SaveSnapshot("snapshot", []byte("rebalanced snapshot")); err != nil {
+		t.Fatalf("Failed saving snapshot: %s", err)
+	}
+	if b, err := be.LoadSnapshot("snapshot"); err != nil || string(b) != "rebalanced snapshot" {
+		t.Errorf("Expected the rewritten snapshot to be loaded, got %s: %v", b, err)
+	}
+}
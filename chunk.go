@@ -29,6 +29,7 @@ type Chunk struct {
 	DecryptedHash string    `json:"decrypted_hash"`
 	Hash          string    `json:"hash"`
 	Num           uint      `json:"num"`
+	Locations     []string  `json:"locations,omitempty"` // storage backend of each part
 }
 
 // ChunkResult is used to transfer either a chunk or an error down the channel.
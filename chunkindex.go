@@ -13,11 +13,13 @@ import (
 
 // A ChunkIndexItem links a chunk with one or many snapshots.
 type ChunkIndexItem struct {
-	Hash        string   `json:"hash"`
-	DataParts   uint     `json:"data_parts"`
-	ParityParts uint     `json:"parity_parts"`
-	Size        int      `json:"size"`
-	Snapshots   []string `json:"snapshots"`
+	Hash        string      `json:"hash"`
+	DataParts   uint        `json:"data_parts"`
+	ParityParts uint        `json:"parity_parts"`
+	Size        int         `json:"size"`
+	Snapshots   []string    `json:"snapshots"`
+	Locations   []string    `json:"locations,omitempty"` // storage backend of each part
+	Stale       []StalePart `json:"stale,omitempty"`     // superseded parts waiting to be deleted
 }
 
 // A ChunkIndex links chunks with snapshots.
@@ -56,19 +58,28 @@ func OpenChunkIndex(repository *Repository) (ChunkIndex, error) {
 
 // Save writes a chunk-index.
 func (index *ChunkIndex) Save(repository *Repository) error {
-	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
+	b, err := index.encode(repository)
 	if err != nil {
 		return err
 	}
-	b, err := pipe.Encode(index)
+	return repository.backend.SaveChunkIndex(b)
+}
+
+// encode returns the chunk-index as it gets stored on the backends.
+func (index *ChunkIndex) encode(repository *Repository) ([]byte, error) {
+	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return repository.backend.SaveChunkIndex(b)
+	return pipe.Encode(index)
 }
 
 // Pack deletes unreferenced chunks and removes them from the index.
 func (index *ChunkIndex) Pack(repository *Repository) (freedSize uint64, err error) {
+	if repository.backend.AppendOnly() {
+		return 0, ErrAppendOnly
+	}
+
 	chunks := make(map[string]*ChunkIndexItem)
 
 	for _, chunk := range index.Chunks {
@@ -77,18 +88,62 @@ func (index *ChunkIndex) Pack(repository *Repository) (freedSize uint64, err err
 			fmt.Printf("Chunk %s is no longer referenced by any snapshot. Deleting!\n", chunk.Hash)
 
 			for i := uint(0); i < chunk.DataParts+chunk.ParityParts; i++ {
-				err = repository.backend.DeleteChunk(chunk.Hash, i, chunk.DataParts)
+				err = repository.backend.DeleteChunk(chunk.Chunk(), i)
 				if err != nil {
 					return
 				}
 				freedSize += uint64(chunk.Size)
 			}
-		} else {
-			chunks[chunk.Hash] = chunk
 		}
+
+		chunks[chunk.Hash] = chunk
 	}
 
 	index.Chunks = chunks
+	size, err := index.DeleteStaleParts(repository)
+	freedSize += size
+	if err != nil {
+		return
+	}
+
+	for hash, chunk := range chunks {
+		if len(chunk.Snapshots) == 0 {
+			delete(chunks, hash)
+		}
+	}
+	return
+}
+
+// DeleteStaleParts deletes all parts of chunks which have been superseded,
+// e.g. by a rebalance. Parts on storage backends which are no longer part of
+// the repository get dropped from the index.
+func (index *ChunkIndex) DeleteStaleParts(repository *Repository) (freedSize uint64, err error) {
+	for _, chunk := range index.Chunks {
+		stale := []StalePart{}
+		for _, part := range chunk.Stale {
+			if part.TotalParts == chunk.DataParts && part.Part < uint(len(chunk.Locations)) &&
+				chunk.Locations[part.Part] == part.Location {
+				// the part is in use again
+				continue
+			}
+
+			be := repository.backend.Backend(part.Location)
+			if be == nil {
+				continue
+			}
+
+			derr := (*be).DeleteChunk(chunk.Hash, part.Part, part.TotalParts)
+			if derr != nil && !isNotFound(derr) {
+				stale = append(stale, part)
+				err = derr
+				continue
+			}
+			freedSize += chunk.PartSize()
+		}
+
+		chunk.Stale = stale
+	}
+
 	return
 }
 
@@ -115,6 +170,7 @@ func (index *ChunkIndex) AddArchive(archive *Archive, snapshot string) {
 		c, ok := index.Chunks[chunk.Hash]
 		if ok {
 			c.Snapshots = append(c.Snapshots, snapshot)
+			c.mergeLocations(chunk)
 		} else {
 			chunkItem := ChunkIndexItem{
 				Hash:        chunk.Hash,
@@ -122,12 +178,81 @@ func (index *ChunkIndex) AddArchive(archive *Archive, snapshot string) {
 				ParityParts: chunk.ParityParts,
 				Size:        chunk.Size,
 				Snapshots:   []string{snapshot},
+				Locations:   chunk.Locations,
 			}
 			index.Chunks[chunk.Hash] = &chunkItem
 		}
 	}
 }
 
+// mergeLocations records where the parts of a newly stored copy of the chunk
+// went. A part which got stored on another backend this time leaves its old
+// copy behind as stale.
+func (item *ChunkIndexItem) mergeLocations(chunk Chunk) {
+	if chunk.DataParts != item.DataParts || chunk.ParityParts != item.ParityParts {
+		return
+	}
+
+	// the locations may be shared with the chunks of other archives
+	locations := make([]string, len(item.Locations))
+	copy(locations, item.Locations)
+	for i, location := range chunk.Locations {
+		if location == "" {
+			continue
+		}
+		for len(locations) <= i {
+			locations = append(locations, "")
+		}
+		if old := locations[i]; old != "" && old != location {
+			item.Stale = append(item.Stale, StalePart{
+				Part:       uint(i),
+				TotalParts: item.DataParts,
+				Location:   old,
+			})
+		}
+		locations[i] = location
+	}
+
+	item.Locations = locations
+}
+
+// Chunk returns the chunk's metadata.
+func (item *ChunkIndexItem) Chunk() Chunk {
+	return Chunk{
+		Hash:        item.Hash,
+		DataParts:   item.DataParts,
+		ParityParts: item.ParityParts,
+		Size:        item.Size,
+		Locations:   item.Locations,
+	}
+}
+
+// PartSize returns the storage size of a single part of the chunk.
+func (item *ChunkIndexItem) PartSize() uint64 {
+	if item.DataParts <= 1 {
+		return uint64(item.Size)
+	}
+
+	return uint64((item.Size + int(item.DataParts) - 1) / int(item.DataParts))
+}
+
+// StorageByLocation returns how much data is stored on each storage backend.
+// Data with an unknown location is accounted for with an empty location.
+func (index *ChunkIndex) StorageByLocation() map[string]uint64 {
+	usage := make(map[string]uint64)
+	for _, chunk := range index.Chunks {
+		for i := uint(0); i < chunk.DataParts+chunk.ParityParts; i++ {
+			location := ""
+			if i < uint(len(chunk.Locations)) {
+				location = chunk.Locations[i]
+			}
+			usage[location] += chunk.PartSize()
+		}
+	}
+
+	return usage
+}
+
 // RemoveSnapshot removes all references to snapshot from the chunk-index.
 func (index *ChunkIndex) RemoveSnapshot(snapshot string) {
 	for _, chunk := range index.Chunks {
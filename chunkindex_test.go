@@ -10,6 +10,7 @@ package knoxite
 import (
 	"io/ioutil"
 	"os"
+	"strconv"
 	"testing"
 )
 
@@ -99,3 +100,149 @@ func TestChunkIndexPack(t *testing.T) {
 		t.Errorf("Packing chunk index failed: %s", err)
 	}
 }
+
+func TestChunkIndexStorageByLocation(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	snapshot, _ := NewSnapshot("test_snapshot")
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Errorf("Failed opening chunk-index: %s", err)
+		return
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	progress := snapshot.Add(wd, []string{"snapshot.go"}, []string{}, r, &index, CompressionNone, EncryptionAES, 1, 1)
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+
+	usage := index.StorageByLocation()
+	if _, ok := usage[""]; ok {
+		t.Error("Expected the locations of all chunks to be known")
+	}
+	if usage[dir] < snapshot.Stats.StorageSize {
+		t.Errorf("Expected at least %d bytes to be stored in %s, got %d", snapshot.Stats.StorageSize, dir, usage[dir])
+	}
+}
+
+// appendOnlyBackend refuses to remove data.
+type appendOnlyBackend struct {
+	Backend
+}
+
+func (backend *appendOnlyBackend) AppendOnly() bool {
+	return true
+}
+
+func TestChunkIndexPackAppendOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, "this_is_a_password")
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Errorf("Failed opening chunk-index: %s", err)
+		return
+	}
+
+	// wrappers keep the backend append-only
+	r.BackendManager().Wrap(func(be Backend) Backend {
+		return NewInstrumentedBackend(&appendOnlyBackend{be}, NewMetrics())
+	})
+	if !r.BackendManager().AppendOnly() {
+		t.Error("Expected repository to be append-only")
+	}
+
+	_, err = index.Pack(&r)
+	if err != ErrAppendOnly {
+		t.Errorf("Expected %v, got %v", ErrAppendOnly, err)
+	}
+}
+
+func TestChunkIndexMergeLocations(t *testing.T) {
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "knoxite")
+		if err != nil {
+			t.Fatalf("Failed creating temporary dir for repository: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+
+	r, err := NewRepository(dirs[0], "this_is_a_password")
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	be, err := BackendFromURL(dirs[1])
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+	if err = be.InitRepository(); err != nil {
+		t.Fatalf("Failed initializing backend: %s", err)
+	}
+	r.BackendManager().AddBackend(&be)
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+
+	// the same chunk gets stored on another backend the second time, e.g.
+	// because the first one was offline
+	data := []byte("this is an encrypted chunk")
+	hash := Hash(data, HashHighway256)
+	for i, dir := range dirs {
+		chunk := Chunk{
+			Data:      &[][]byte{data},
+			DataParts: 1,
+			Size:      len(data),
+			Hash:      hash,
+			Locations: []string{dir},
+		}
+		if _, err := r.BackendManager().StoreChunk(&chunk); err != nil {
+			t.Fatalf("Failed storing chunk: %s", err)
+		}
+		index.AddArchive(&Archive{Chunks: []Chunk{chunk}}, strconv.Itoa(i))
+	}
+
+	item := index.Chunks[hash]
+	if len(item.Locations) != 1 || item.Locations[0] != dirs[1] {
+		t.Errorf("Expected the chunk to be located in %s, got %v", dirs[1], item.Locations)
+	}
+	if len(item.Stale) != 1 || item.Stale[0].Location != dirs[0] {
+		t.Errorf("Expected the copy in %s to be stale, got %v", dirs[0], item.Stale)
+	}
+
+	if _, err := index.DeleteStaleParts(&r); err != nil {
+		t.Fatalf("Failed deleting stale parts: %s", err)
+	}
+	for i, dir := range dirs {
+		local, err := BackendFromURL(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = local.LoadChunk(hash, 0, 1)
+		if exists := err == nil; exists != (i == 1) {
+			t.Errorf("Expected the chunk to exist in %s: %t, got error %v", dir, i == 1, err)
+		}
+	}
+}
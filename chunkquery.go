@@ -0,0 +1,190 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"sync"
+)
+
+// chunkBatchSize is how many chunks get checked for existing copies with a
+// single query.
+const chunkBatchSize = 32
+
+// ChunkPart identifies a single part of a chunk.
+type ChunkPart struct {
+	Shasum     string
+	Part       uint
+	TotalParts uint
+	Size       uint64
+}
+
+// ChunkQuerier is implemented by storage backends which can check for many
+// stored chunks at once, e.g. with a single request.
+type ChunkQuerier interface {
+	// HasChunks reports for each part whether it is stored with the given
+	// size. A part reported as missing may still exist, it then gets stored
+	// like any other part
+	HasChunks(parts []ChunkPart) ([]bool, error)
+}
+
+// BackendFilesystemLister is implemented by BackendFilesystems which can
+// list the files in a dir.
+type BackendFilesystemLister interface {
+	// ListFiles returns the sizes of all files in a dir by their name
+	ListFiles(path string) (map[string]uint64, error)
+}
+
+// QueryChunks reports for each part whether it is stored on be. Backends
+// which don't implement ChunkQuerier report all parts as missing.
+func QueryChunks(be Backend, parts []ChunkPart) ([]bool, error) {
+	if q, ok := be.(ChunkQuerier); ok {
+		return q.HasChunks(parts)
+	}
+	return make([]bool, len(parts)), nil
+}
+
+// storedPart identifies a part stored on a backend.
+type storedPart struct {
+	location   string
+	shasum     string
+	part       uint
+	totalParts uint
+}
+
+// queryChunks checks which parts of chunks are already stored on the
+// backends they would be stored on, with one query per backend. Chunks need
+// to carry the locations of previously stored copies.
+func (backend *BackendManager) queryChunks(chunks []Chunk) map[storedPart]bool {
+	type query struct {
+		be    *Backend
+		parts []ChunkPart
+	}
+	queries := make(map[*Backend]*query)
+
+	for _, chunk := range chunks {
+		pl, err := backend.placeChunk(chunk)
+		if err != nil {
+			continue
+		}
+
+		for i, data := range *chunk.Data {
+			be := pl.backends[i]
+			q, ok := queries[be]
+			if !ok {
+				q = &query{be: be}
+				queries[be] = q
+			}
+			q.parts = append(q.parts, ChunkPart{
+				Shasum:     chunk.Hash,
+				Part:       uint(i),
+				TotalParts: chunk.DataParts,
+				Size:       uint64(len(data)),
+			})
+		}
+	}
+
+	stored := make(map[storedPart]bool)
+	for _, q := range queries {
+		if !backend.available(q.be) {
+			continue
+		}
+
+		found, err := QueryChunks(*q.be, q.parts)
+		if err != nil {
+			// the parts simply get stored as usual
+			continue
+		}
+		location := (*q.be).Location()
+		for i, p := range q.parts {
+			if i < len(found) && found[i] {
+				stored[storedPart{location, p.Shasum, p.Part, p.TotalParts}] = true
+			}
+		}
+	}
+
+	return stored
+}
+
+// fileListings caches the listings of dirs on a BackendFilesystem.
+type fileListings struct {
+	sync.Mutex
+	dirs map[string]map[string]uint64
+}
+
+func newFileListings() *fileListings {
+	return &fileListings{
+		dirs: make(map[string]map[string]uint64),
+	}
+}
+
+// lookup returns the size of a file. ok is false if the dir hasn't been
+// listed yet.
+func (l *fileListings) lookup(dir, name string) (size uint64, exists bool, ok bool) {
+	if l == nil {
+		return 0, false, false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	files, ok := l.dirs[dir]
+	if !ok {
+		return 0, false, false
+	}
+	size, exists = files[name]
+	return size, exists, true
+}
+
+// list lists a dir, unless it has been listed before.
+func (l *fileListings) list(lister BackendFilesystemLister, dir string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	_, ok := l.dirs[dir]
+	l.Unlock()
+	if ok {
+		return nil
+	}
+
+	files, err := lister.ListFiles(dir)
+	if err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		files = make(map[string]uint64)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.dirs[dir]; !ok {
+		l.dirs[dir] = files
+	}
+	return nil
+}
+
+// set updates a file in a listed dir. A negative size removes the file.
+func (l *fileListings) set(dir, name string, size int64) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	files, ok := l.dirs[dir]
+	if !ok {
+		return
+	}
+	if size < 0 {
+		delete(files, name)
+		return
+	}
+	files[name] = uint64(size)
+}
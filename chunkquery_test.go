@@ -0,0 +1,189 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStorageFilesystemHasChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for repository: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	be, err := BackendFromURL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := be.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("this is an encrypted chunk")
+	shasum := Hash(data, HashHighway256)
+	if _, err := be.StoreChunk(shasum, 0, 2, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+
+	parts := []ChunkPart{
+		{Shasum: shasum, Part: 0, TotalParts: 2, Size: uint64(len(data))},
+		{Shasum: shasum, Part: 0, TotalParts: 2, Size: 1},
+		{Shasum: shasum, Part: 1, TotalParts: 2, Size: uint64(len(data))},
+		{Shasum: Hash([]byte("missing"), HashHighway256), Part: 0, TotalParts: 1, Size: 1},
+	}
+	found, err := QueryChunks(be, parts)
+	if err != nil {
+		t.Fatalf("Failed querying chunks: %s", err)
+	}
+	if expected := []bool{true, false, false, false}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %v, got %v", expected, found)
+	}
+
+	// the cached listing stays up to date
+	if _, err := be.StoreChunk(shasum, 1, 2, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if err := be.DeleteChunk(shasum, 0, 2); err != nil {
+		t.Fatalf("Failed deleting chunk: %s", err)
+	}
+	found, err = QueryChunks(be, parts)
+	if err != nil {
+		t.Fatalf("Failed querying chunks: %s", err)
+	}
+	if expected := []bool{false, false, true, false}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %v, got %v", expected, found)
+	}
+	if n, err := be.StoreChunk(shasum, 1, 2, data); err != nil || n != 0 {
+		t.Errorf("Expected stored chunk to be skipped, got %d bytes, error %v", n, err)
+	}
+}
+
+func TestSnapshotQueryChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for repository: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, "this_is_a_password")
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+
+	m := NewMetrics()
+	r.BackendManager().Wrap(func(be Backend) Backend {
+		return NewInstrumentedBackend(be, m)
+	})
+	location := (*r.BackendManager().Backends[0]).Location()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed getting working dir: %s", err)
+	}
+	add := func() *Snapshot {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		progress := snapshot.Add(wd, []string{"snapshot_test.go", "snapshot.go"}, []string{}, r, &index, CompressionNone, EncryptionAES, 1, 0)
+		for p := range progress {
+			if p.Error != nil {
+				t.Errorf("Failed adding to snapshot: %s", p.Error)
+			}
+		}
+		return snapshot
+	}
+
+	add()
+	stores := m.Counter(MetricBackendOperations, "backend", location, "operation", "store_chunk", "result", "success")
+	if stores == 0 {
+		t.Fatal("Expected chunks to be stored")
+	}
+
+	// chunks which are already stored don't get uploaded again
+	snapshot := add()
+	if v := m.Counter(MetricBackendOperations, "backend", location, "operation", "store_chunk", "result", "success"); v != stores {
+		t.Errorf("Expected no further chunks to be stored, got %v", v-stores)
+	}
+	if v := m.Counter(MetricBackendOperations, "backend", location, "operation", "has_chunks", "result", "success"); v == 0 {
+		t.Error("Expected chunks to be queried")
+	}
+	if snapshot.Stats.StorageSize != 0 {
+		t.Errorf("Expected storage size 0, got %d", snapshot.Stats.StorageSize)
+	}
+}
+
+// statCountingFilesystem counts the Stat calls on a BackendFilesystem. It
+// can't list dirs, even if the wrapped BackendFilesystem can.
+type statCountingFilesystem struct {
+	BackendFilesystem
+	stats int
+}
+
+func (fs *statCountingFilesystem) Stat(path string) (uint64, error) {
+	fs.stats++
+	return fs.BackendFilesystem.Stat(path)
+}
+
+type listingFilesystem struct {
+	*statCountingFilesystem
+	BackendFilesystemLister
+}
+
+func TestStorageFilesystemHasChunksStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for repository: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := &StorageLocal{}
+	counter := &statCountingFilesystem{BackendFilesystem: local}
+
+	tests := []struct {
+		name  string
+		fs    BackendFilesystem
+		stats int
+	}{
+		// the part only gets checked by StoreChunk
+		{"stat-only", counter, 1},
+		// the listing already tells the part is missing
+		{"listing", &listingFilesystem{counter, local}, 0},
+	}
+	for _, tt := range tests {
+		be, err := NewStorageFilesystem(dir, tt.fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter.stats = 0
+
+		data := []byte("this is an encrypted chunk " + tt.name)
+		shasum := Hash(data, HashHighway256)
+		found, err := be.HasChunks([]ChunkPart{
+			{Shasum: shasum, Part: 0, TotalParts: 1, Size: uint64(len(data))},
+		})
+		if err != nil {
+			t.Fatalf("Failed querying chunks: %s", err)
+		}
+		if found[0] {
+			t.Errorf("%s: Expected chunk to be missing", tt.name)
+		}
+		if _, err := be.StoreChunk(shasum, 0, 1, data); err != nil {
+			t.Fatalf("Failed storing chunk: %s", err)
+		}
+		if counter.stats != tt.stats {
+			t.Errorf("%s: Expected %d Stat calls for a new chunk, got %d", tt.name, tt.stats, counter.stats)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	shutdown "github.com/klauspost/shutdown2"
+	"github.com/spf13/cobra"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/utils"
+)
+
+// Error declarations
+var (
+	ErrAnnexNotPrepared  = errors.New("remote has not been prepared")
+	ErrAnnexNoRepository = errors.New("no repository configured, set repository=<url>")
+	ErrAnnexNoPassword   = errors.New("no password available, set KNOXITE_PASSWORD")
+	ErrAnnexUnexpected   = errors.New("unexpected reply from git-annex")
+	ErrAnnexKeyNotFound  = errors.New("key is not stored in the repository")
+)
+
+const (
+	// annexVolumeName is the name of the volume created for annexed keys
+	annexVolumeName = "git-annex"
+	// annexCredsSetting is the setting the repository password is stored as
+	annexCredsSetting = "password"
+)
+
+var (
+	annexCmd = &cobra.Command{
+		Use:   "annex-remote",
+		Short: "git-annex special remote",
+		Long: "The annex-remote command implements git-annex's external special remote\n" +
+			"protocol on stdin/stdout and stores annexed keys in a volume of a repository.\n" +
+			"Install it as git-annex-remote-knoxite and run:\n\n" +
+			"  KNOXITE_PASSWORD=... git annex initremote knoxite type=external externaltype=knoxite \\\n" +
+			"      encryption=none repository=<url> [volume=<id>] [compression=<algo>] [tolerance=<n>]",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return executeAnnexRemote(os.Stdin, os.Stdout)
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(annexCmd)
+}
+
+// annexRemote is a git-annex special remote, storing each key as an archive
+// in a volume of a repository.
+type annexRemote struct {
+	in  *bufio.Scanner
+	out io.Writer
+
+	repository  knoxite.Repository
+	chunkIndex  knoxite.ChunkIndex
+	volume      *knoxite.Volume
+	compression uint16
+	encryption  uint16
+	tolerance   uint
+	prepared    bool
+
+	// snapshots of the volume, loaded on demand
+	snapshots map[string]*knoxite.Snapshot
+	// snapshot holds the keys stored during this session
+	snapshot *knoxite.Snapshot
+}
+
+func executeAnnexRemote(in io.Reader, out io.Writer) error {
+	// the protocol owns stdout, everything else gets printed on stderr
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	r := &annexRemote{
+		in:  bufio.NewScanner(in),
+		out: out,
+	}
+	r.in.Buffer(nil, 1<<20)
+	return r.serve()
+}
+
+// serve answers the requests of git-annex until it closes stdin.
+func (r *annexRemote) serve() error {
+	r.send("VERSION 1")
+	for r.in.Scan() {
+		request, args := splitAnnexLine(r.in.Text())
+		switch request {
+		case "EXTENSIONS":
+			r.send("EXTENSIONS")
+		case "INITREMOTE":
+			if err := r.initRemote(); err != nil {
+				r.send("INITREMOTE-FAILURE", err.Error())
+				continue
+			}
+			r.send("INITREMOTE-SUCCESS")
+		case "PREPARE":
+			if err := r.prepare(); err != nil {
+				r.send("PREPARE-FAILURE", err.Error())
+				continue
+			}
+			r.send("PREPARE-SUCCESS")
+		case "TRANSFER":
+			direction, rest := splitAnnexLine(args)
+			key, file := splitAnnexLine(rest)
+			var err error
+			switch direction {
+			case "STORE":
+				err = r.store(key, file)
+			case "RETRIEVE":
+				err = r.retrieve(key, file)
+			default:
+				r.send("UNSUPPORTED-REQUEST")
+				continue
+			}
+			if err != nil {
+				r.send("TRANSFER-FAILURE", direction, key, err.Error())
+				continue
+			}
+			r.send("TRANSFER-SUCCESS", direction, key)
+		case "CHECKPRESENT":
+			found, err := r.checkPresent(args)
+			switch {
+			case err != nil:
+				r.send("CHECKPRESENT-UNKNOWN", args, err.Error())
+			case found:
+				r.send("CHECKPRESENT-SUCCESS", args)
+			default:
+				r.send("CHECKPRESENT-FAILURE", args)
+			}
+		case "REMOVE":
+			if err := r.remove(args); err != nil {
+				r.send("REMOVE-FAILURE", args, err.Error())
+				continue
+			}
+			r.send("REMOVE-SUCCESS", args)
+		case "LISTCONFIGS":
+			r.send("CONFIG", "repository", "URL of the knoxite repository")
+			r.send("CONFIG", "volume", "ID of the volume storing the keys")
+			r.send("CONFIG", "compression", "compression algo to use: none (default), flate, gzip, lzma, zlib, zstd")
+			r.send("CONFIG", "tolerance", "failure tolerance against n backend failures")
+			r.send("CONFIGEND")
+		case "ERROR":
+			return fmt.Errorf("git-annex: %s", args)
+		default:
+			r.send("UNSUPPORTED-REQUEST")
+		}
+	}
+	return r.in.Err()
+}
+
+// send writes a line of the protocol.
+func (r *annexRemote) send(fields ...string) {
+	fmt.Fprintln(r.out, strings.Join(fields, " "))
+}
+
+// ask sends a request to git-annex and returns the value of its reply.
+func (r *annexRemote) ask(reply string, fields ...string) (string, error) {
+	r.send(fields...)
+	if !r.in.Scan() {
+		if err := r.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.ErrUnexpectedEOF
+	}
+	line := r.in.Text()
+	if line != reply && !strings.HasPrefix(line, reply+" ") {
+		return "", fmt.Errorf("%w: %s", ErrAnnexUnexpected, line)
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(line, reply), " "), nil
+}
+
+// config returns the value of a setting of the remote.
+func (r *annexRemote) config(setting string) (string, error) {
+	return r.ask("VALUE", "GETCONFIG", setting)
+}
+
+// password returns the password of the repository, either from the
+// credentials stored by git-annex or the environment.
+func (r *annexRemote) password() (string, error) {
+	creds, err := r.ask("CREDS", "GETCREDS", annexCredsSetting)
+	if err != nil {
+		return "", err
+	}
+	if _, password := splitAnnexLine(creds); password != "" {
+		return password, nil
+	}
+	if globalOpts.Password != "" {
+		return globalOpts.Password, nil
+	}
+	return "", ErrAnnexNoPassword
+}
+
+// initRemote sets up a repository for a new remote: it creates the volume
+// storing the keys and remembers the password.
+func (r *annexRemote) initRemote() error {
+	url, err := r.config("repository")
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		url = globalOpts.Repo
+	}
+	if url == "" {
+		return ErrAnnexNoRepository
+	}
+	password, err := r.password()
+	if err != nil {
+		return err
+	}
+	if err := r.configure(); err != nil {
+		return err
+	}
+
+	repository, err := openRepository(url, password)
+	if err != nil {
+		return err
+	}
+	volID, err := r.config("volume")
+	if err != nil {
+		return err
+	}
+	if volID != "" {
+		if _, err := repository.FindVolume(volID); err != nil {
+			return err
+		}
+	} else {
+		vol, err := knoxite.NewVolume(annexVolumeName, "")
+		if err != nil {
+			return err
+		}
+		if err := repository.AddVolume(vol); err != nil {
+			return err
+		}
+		if err := repository.Save(); err != nil {
+			return err
+		}
+		volID = vol.ID
+	}
+
+	r.send("SETCONFIG", "repository", url)
+	r.send("SETCONFIG", "volume", volID)
+	r.send("SETCREDS", annexCredsSetting, "knoxite", password)
+	return nil
+}
+
+// configure reads the settings for storing keys.
+func (r *annexRemote) configure() error {
+	compression, err := r.config("compression")
+	if err != nil {
+		return err
+	}
+	if r.compression, err = utils.CompressionTypeFromString(compression); err != nil {
+		return err
+	}
+	if r.encryption, err = utils.EncryptionTypeFromString(""); err != nil {
+		return err
+	}
+
+	tolerance, err := r.config("tolerance")
+	if err != nil {
+		return err
+	}
+	r.tolerance = 0
+	if tolerance != "" {
+		n, err := strconv.ParseUint(tolerance, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid tolerance %s: %w", tolerance, err)
+		}
+		r.tolerance = uint(n)
+	}
+	return nil
+}
+
+// prepare opens the repository of the remote.
+func (r *annexRemote) prepare() error {
+	url, err := r.config("repository")
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		return ErrAnnexNoRepository
+	}
+	volID, err := r.config("volume")
+	if err != nil {
+		return err
+	}
+	password, err := r.password()
+	if err != nil {
+		return err
+	}
+	if err := r.configure(); err != nil {
+		return err
+	}
+
+	r.repository, err = openRepository(url, password)
+	if err != nil {
+		return err
+	}
+	if len(r.repository.BackendManager().Backends)-int(r.tolerance) <= 0 {
+		return ErrRedundancyAmount
+	}
+	r.repository.BackendManager().FailureTolerance = r.tolerance
+	r.volume, err = r.repository.FindVolume(volID)
+	if err != nil {
+		return err
+	}
+	r.chunkIndex, err = knoxite.OpenChunkIndex(&r.repository)
+	if err != nil {
+		return err
+	}
+
+	r.snapshots = nil
+	r.snapshot = nil
+	r.prepared = true
+	return nil
+}
+
+// load loads all snapshots of the volume.
+func (r *annexRemote) load() error {
+	if !r.prepared {
+		return ErrAnnexNotPrepared
+	}
+	if r.snapshots != nil {
+		return nil
+	}
+
+	snapshots := make(map[string]*knoxite.Snapshot)
+	for _, id := range r.volume.Snapshots {
+		snapshot, err := r.volume.LoadSnapshot(id, &r.repository)
+		if err != nil {
+			return err
+		}
+		snapshots[id] = snapshot
+	}
+	r.snapshots = snapshots
+	return nil
+}
+
+// find returns the snapshots holding a key.
+func (r *annexRemote) find(key string) ([]*knoxite.Snapshot, error) {
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	var snapshots []*knoxite.Snapshot
+	for _, id := range r.volume.Snapshots {
+		if _, ok := r.snapshots[id].Archives[key]; ok {
+			snapshots = append(snapshots, r.snapshots[id])
+		}
+	}
+	return snapshots, nil
+}
+
+// save writes the metadata of the repository.
+func (r *annexRemote) save() error {
+	// we don't want these calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	if err := r.chunkIndex.Save(&r.repository); err != nil {
+		return err
+	}
+	return r.repository.Save()
+}
+
+// store adds a file to the snapshot of this session.
+func (r *annexRemote) store(key, file string) error {
+	snapshots, err := r.find(key)
+	if err != nil || len(snapshots) > 0 {
+		return err
+	}
+
+	if r.snapshot == nil {
+		snapshot, err := knoxite.NewSnapshot(annexVolumeName)
+		if err != nil {
+			return err
+		}
+		r.snapshot = snapshot
+	}
+	tol := uint(len(r.repository.BackendManager().Backends) - int(r.tolerance))
+	if _, err := r.snapshot.AddFile(file, key, r.repository, &r.chunkIndex,
+		r.compression, r.encryption, tol, r.tolerance); err != nil {
+		return err
+	}
+
+	if err := r.snapshot.Save(&r.repository); err != nil {
+		return err
+	}
+	if _, ok := r.snapshots[r.snapshot.ID]; !ok {
+		if err := r.volume.AddSnapshot(r.snapshot.ID); err != nil {
+			return err
+		}
+		r.snapshots[r.snapshot.ID] = r.snapshot
+	}
+	return r.save()
+}
+
+// retrieve restores the content of a key to a file.
+func (r *annexRemote) retrieve(key, file string) error {
+	snapshots, err := r.find(key)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return ErrAnnexKeyNotFound
+	}
+
+	b, _, err := knoxite.DecodeArchiveData(r.repository, *snapshots[0].Archives[key])
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0600)
+}
+
+// checkPresent returns whether a key is stored in the repository.
+func (r *annexRemote) checkPresent(key string) (bool, error) {
+	snapshots, err := r.find(key)
+	return len(snapshots) > 0, err
+}
+
+// remove deletes a key from all snapshots holding it and deletes the chunks
+// no longer referenced.
+func (r *annexRemote) remove(key string) error {
+	snapshots, err := r.find(key)
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	if r.repository.BackendManager().AppendOnly() {
+		return knoxite.ErrAppendOnly
+	}
+
+	for _, snapshot := range snapshots {
+		archive := snapshot.Archives[key]
+		delete(snapshot.Archives, key)
+		snapshot.Stats.Files--
+		snapshot.Stats.Size -= archive.Size
+		snapshot.Stats.StorageSize -= archive.StorageSize
+
+		r.chunkIndex.RemoveSnapshot(snapshot.ID)
+		if len(snapshot.Archives) == 0 {
+			if err := r.volume.RemoveSnapshot(snapshot.ID); err != nil {
+				return err
+			}
+			delete(r.snapshots, snapshot.ID)
+			if snapshot == r.snapshot {
+				r.snapshot = nil
+			}
+			continue
+		}
+
+		for _, archive := range snapshot.Archives {
+			r.chunkIndex.AddArchive(archive, snapshot.ID)
+		}
+		if err := snapshot.Save(&r.repository); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.chunkIndex.Pack(&r.repository); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+// splitAnnexLine splits the first word off a line of the protocol.
+func splitAnnexLine(line string) (string, string) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) < 2 {
+		return fields[0], ""
+	}
+	return fields[0], fields[1]
+}
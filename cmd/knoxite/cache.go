@@ -0,0 +1,47 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"fmt"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/config"
+)
+
+// applyCache enables the local cache configured for the current alias.
+func applyCache(r *knoxite.Repository) error {
+	rep, ok := cfg.Repositories[globalOpts.Alias]
+	if !ok || rep.Cache == nil || rep.Cache.Size == "" {
+		return nil
+	}
+
+	size, err := humanize.ParseBytes(rep.Cache.Size)
+	if err != nil {
+		return fmt.Errorf("invalid cache size for alias %s: %v", globalOpts.Alias, err)
+	}
+
+	path := rep.Cache.Path
+	if path == "" {
+		if path, err = config.DefaultCachePath(globalOpts.Alias); err != nil {
+			return err
+		}
+	}
+
+	cache, err := knoxite.NewDiskCache(path, size)
+	if err != nil {
+		return fmt.Errorf("opening cache at %s failed: %v", path, err)
+	}
+
+	r.BackendManager().Wrap(func(be knoxite.Backend) knoxite.Backend {
+		return knoxite.NewCachedBackend(be, cache)
+	})
+	return nil
+}
@@ -33,6 +33,7 @@ var (
 			}
 
 			configureStoreOpts(cmd, &cloneOpts)
+			useSpool = cloneOpts.Spool
 			return executeClone(args[0], args[1:], cloneOpts)
 		},
 	}
@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 
+	humanize "github.com/dustin/go-humanize"
 	"github.com/knoxite/knoxite/cmd/knoxite/config"
 	"github.com/muesli/gotable"
 	"github.com/spf13/cobra"
@@ -148,6 +149,57 @@ func executeConfigSet(option string, values []string) error {
 		repo.StoreExcludes = values
 	case "restore_excludes":
 		repo.RestoreExcludes = values
+	case "spool":
+		spool, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return fmt.Errorf("Failed to convert %s to bool for the %s option: %v", values[0], opt, err)
+		}
+		repo.Spool = spool
+	case "verify_writes":
+		verify, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return fmt.Errorf("Failed to convert %s to bool for the %s option: %v", values[0], opt, err)
+		}
+		repo.VerifyWrites = verify
+	case "shared_failure_domains":
+		shared, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return fmt.Errorf("Failed to convert %s to bool for the %s option: %v", values[0], opt, err)
+		}
+		repo.SharedFailureDomains = shared
+	case "spool_path":
+		repo.SpoolPath = values[0]
+	case "cache_size", "cache_path":
+		if repo.Cache == nil {
+			repo.Cache = &config.CacheConfig{}
+		}
+		if opt == "cache_path" {
+			repo.Cache.Path = values[0]
+		} else {
+			if _, err := humanize.ParseBytes(values[0]); err != nil {
+				return fmt.Errorf("Failed to convert %s to a size for the %s option: %v", values[0], opt, err)
+			}
+			repo.Cache.Size = values[0]
+		}
+	case "upload_limit", "download_limit", "request_limit":
+		if repo.RateLimit == nil {
+			repo.RateLimit = &config.RateLimitConfig{}
+		}
+		switch opt {
+		case "upload_limit":
+			repo.RateLimit.Upload = values[0]
+		case "download_limit":
+			repo.RateLimit.Download = values[0]
+		default:
+			requests, err := strconv.ParseFloat(values[0], 64)
+			if err != nil {
+				return fmt.Errorf("Failed to convert %s to a number for the %s option: %v", values[0], opt, err)
+			}
+			repo.RateLimit.Requests = requests
+		}
+		if _, err := newRateLimiter(*repo.RateLimit); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("Unknown configuration option: %s", opt)
 	}
@@ -202,5 +254,6 @@ func executeConfigConvert(source string, target string) error {
 
 	// copy over the repo configs and save the target
 	tar.Repositories = scr.Repositories
+	tar.Backends = scr.Backends
 	return tar.Save()
 }
@@ -37,12 +37,58 @@ type RepoConfig struct {
 	Encryption      string   `json:"encryption"`
 	StoreExcludes   []string `json:"store_excludes"`
 	RestoreExcludes []string `json:"restore_excludes"`
+	// RateLimit is shared by all storage backends of the repository
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+	Cache     *CacheConfig     `json:"cache,omitempty"`
+	// Spool stores snapshots in a local spool first, see 'knoxite upload'
+	Spool     bool   `json:"spool,omitempty"`
+	SpoolPath string `json:"spool_path,omitempty"`
+	// VerifyWrites verifies every chunk after storing it
+	VerifyWrites bool `json:"verify_writes,omitempty"`
+	// SharedFailureDomains stores parts of a chunk in the same failure domain
+	// if there aren't enough independent backends
+	SharedFailureDomains bool `json:"shared_failure_domains,omitempty"`
+}
+
+// The CacheConfig struct contains the settings of a local cache for the data
+// loaded from a repository.
+type CacheConfig struct {
+	// Path defaults to a directory named after the alias in the user's cache dir
+	Path string `json:"path,omitempty"`
+	// Size accepts sizes like "10GiB"
+	Size string `json:"size"`
+}
+
+// The BackendConfig struct contains the settings for a single storage backend.
+type BackendConfig struct {
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+}
+
+// The RateLimitConfig struct contains bandwidth and request-rate limits.
+// Bandwidths are per second and accept sizes like "512KiB" or "2MB".
+type RateLimitConfig struct {
+	Upload    string              `json:"upload,omitempty"`
+	Download  string              `json:"download,omitempty"`
+	Requests  float64             `json:"requests,omitempty"`
+	Schedules []RateLimitSchedule `json:"schedules,omitempty"`
+}
+
+// The RateLimitSchedule struct contains limits, which override the default
+// limits between From and To, given as local time of day like "22:00".
+type RateLimitSchedule struct {
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Upload   string  `json:"upload,omitempty"`
+	Download string  `json:"download,omitempty"`
+	Requests float64 `json:"requests,omitempty"`
 }
 
 type Config struct {
 	Repositories map[string]RepoConfig `json:"repositories"`
-	backend      ConfigBackend
-	url          *url.URL
+	// Backends contains settings per storage backend URL
+	Backends map[string]BackendConfig `json:"backends,omitempty"`
+	backend  ConfigBackend
+	url      *url.URL
 }
 
 // ConfigBackend is the interface implemented by the configuration backends.
@@ -69,6 +115,7 @@ func (c *Config) Load() error {
 		return err
 	}
 	c.Repositories = config.Repositories
+	c.Backends = config.Backends
 	return nil
 }
 
@@ -136,6 +183,23 @@ func New(url string) (*Config, error) {
 	return config, nil
 }
 
+// DefaultCachePath returns Knoxite's default cache path for an alias.
+func DefaultCachePath(alias string) (string, error) {
+	userScope := gap.NewScope(gap.User, appName)
+	path, err := userScope.CacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(path, alias), nil
+}
+
+// DefaultSpoolPath returns Knoxite's default spool path for a repository.
+func DefaultSpoolPath(name string) (string, error) {
+	userScope := gap.NewScope(gap.User, appName)
+	return userScope.DataPath(filepath.Join("spool", name))
+}
+
 // DefaultPath returns Knoxite's default config path.
 //
 // The path returned is OS dependant. If there's an error
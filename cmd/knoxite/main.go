@@ -13,6 +13,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"syscall"
 
 	shutdown "github.com/klauspost/shutdown2"
@@ -20,23 +21,31 @@ import (
 
 	"github.com/knoxite/knoxite/cmd/knoxite/config"
 	_ "github.com/knoxite/knoxite/storage/azure"
+	_ "github.com/knoxite/knoxite/storage/azureblob"
 	_ "github.com/knoxite/knoxite/storage/backblaze"
 	_ "github.com/knoxite/knoxite/storage/dropbox"
 	_ "github.com/knoxite/knoxite/storage/ftp"
 	_ "github.com/knoxite/knoxite/storage/googlecloud"
+	_ "github.com/knoxite/knoxite/storage/googledrive"
 	_ "github.com/knoxite/knoxite/storage/http"
 	_ "github.com/knoxite/knoxite/storage/mega"
+	_ "github.com/knoxite/knoxite/storage/oci"
+	_ "github.com/knoxite/knoxite/storage/rclone"
+	_ "github.com/knoxite/knoxite/storage/rest"
 	_ "github.com/knoxite/knoxite/storage/s3"
 	_ "github.com/knoxite/knoxite/storage/sftp"
+	_ "github.com/knoxite/knoxite/storage/tar"
 	_ "github.com/knoxite/knoxite/storage/webdav"
 )
 
 // GlobalOptions holds all those options that can be set for every command.
 type GlobalOptions struct {
-	Repo      string
-	Alias     string
-	Password  string
-	ConfigURL string
+	Repo            string
+	Alias           string
+	Password        string
+	ConfigURL       string
+	MetricsTextfile string
+	MetricsListen   string
 }
 
 var (
@@ -67,18 +76,29 @@ func main() {
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.Alias, "alias", "R", "", "Repository alias to backup to/restore from")
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.Password, "password", "p", "", "Password to use for data encryption")
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.ConfigURL, "configURL", "C", config.DefaultPath(), "Path to the configuration file")
+	RootCmd.PersistentFlags().StringVar(&globalOpts.MetricsTextfile, "metrics-textfile", "", "Write metrics to this file in the Prometheus textfile format")
+	RootCmd.PersistentFlags().StringVar(&globalOpts.MetricsListen, "metrics-listen", "", "Serve metrics on this address at /metrics")
 
 	globalOpts.Repo = os.Getenv("KNOXITE_REPOSITORY")
 	globalOpts.Password = os.Getenv("KNOXITE_PASSWORD")
 
-	if err := RootCmd.Execute(); err != nil {
+	// git-annex runs special remotes as git-annex-remote-<type>
+	if filepath.Base(os.Args[0]) == "git-annex-remote-knoxite" {
+		RootCmd.SetArgs(append([]string{annexCmd.Name()}, os.Args[1:]...))
+	}
+
+	err := RootCmd.Execute()
+	if merr := writeMetrics(); merr != nil {
+		fmt.Println(merr)
+	}
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
+	cobra.OnInitialize(initConfig, initMetrics)
 	if CommitSHA != "" {
 		vt := RootCmd.VersionTemplate()
 		RootCmd.SetVersionTemplate(vt[:len(vt)-1] + " (" + CommitSHA + ")\n")
@@ -0,0 +1,135 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/muesli/gotable"
+
+	"github.com/knoxite/knoxite"
+)
+
+// metrics collects the backend and pipeline metrics of the current command.
+var metrics = knoxite.NewMetrics()
+
+// initMetrics enables the collection of metrics and starts serving them, if
+// requested.
+func initMetrics() {
+	knoxite.SetMetrics(metrics)
+
+	if globalOpts.MetricsListen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.ListenAndServe(globalOpts.MetricsListen, mux); err != nil {
+			log.Printf("serving metrics failed: %v\n", err)
+		}
+	}()
+}
+
+// applyMetrics records the operations of all storage backends. It wraps the
+// backends before any rate-limits, caches or spools get applied, so only the
+// actual backend operations get recorded.
+func applyMetrics(r *knoxite.Repository) {
+	r.BackendManager().Wrap(func(be knoxite.Backend) knoxite.Backend {
+		return knoxite.NewInstrumentedBackend(be, metrics)
+	})
+}
+
+// writeMetrics writes the collected metrics to the configured textfile.
+func writeMetrics() error {
+	if globalOpts.MetricsTextfile == "" {
+		return nil
+	}
+
+	if err := metrics.WriteTextfile(globalOpts.MetricsTextfile); err != nil {
+		return fmt.Errorf("writing metrics to %s failed: %v", globalOpts.MetricsTextfile, err)
+	}
+	return nil
+}
+
+// printMetricsSummary prints a summary of all backend operations and pipeline
+// processors.
+func printMetricsSummary() {
+	ops := metrics.Histograms(knoxite.MetricBackendDuration)
+	if len(ops) == 0 {
+		return
+	}
+
+	fmt.Println()
+	tab := gotable.NewTable([]string{"Backend", "Operation", "Count", "Errors", "Avg Time", "Data"},
+		[]int64{-32, -16, 7, 7, 10, 10}, "")
+	locations := []string{}
+	for _, op := range ops {
+		location, operation := op.Labels["backend"], op.Labels["operation"]
+		errors := metrics.Counter(knoxite.MetricBackendOperations, "backend", location, "operation", operation, "result", "error") +
+			metrics.Counter(knoxite.MetricBackendOperations, "backend", location, "operation", operation, "result", "not_found")
+		if len(locations) == 0 || locations[len(locations)-1] != location {
+			locations = append(locations, location)
+		}
+		data := metrics.Counter(knoxite.MetricBackendBytes, "backend", location, "operation", operation)
+
+		tab.AppendRow([]interface{}{
+			location,
+			operation,
+			fmt.Sprintf("%d", op.Count),
+			fmt.Sprintf("%.0f", errors),
+			averageDuration(op).String(),
+			knoxite.SizeToString(uint64(data)),
+		})
+	}
+	_ = tab.Print()
+
+	for _, location := range locations {
+		if retries := metrics.Counter(knoxite.MetricBackendRetries, "backend", location); retries > 0 {
+			fmt.Printf("Retried %.0f operations on %s\n", retries, location)
+		}
+	}
+
+	procs := metrics.Histograms(knoxite.MetricPipelineDuration)
+	if len(procs) == 0 {
+		return
+	}
+
+	fmt.Println()
+	tab = gotable.NewTable([]string{"Processor", "Count", "Avg Time", "Data In", "Data Out", "Throughput"},
+		[]int64{-12, 7, 10, 10, 10, 12}, "")
+	for _, proc := range procs {
+		name := proc.Labels["processor"]
+		in := metrics.Counter(knoxite.MetricPipelineBytes, "processor", name, "direction", "in")
+		out := metrics.Counter(knoxite.MetricPipelineBytes, "processor", name, "direction", "out")
+		throughput := ""
+		if proc.Sum > 0 {
+			throughput = knoxite.SizeToString(uint64(in/proc.Sum)) + "/s"
+		}
+
+		tab.AppendRow([]interface{}{
+			name,
+			fmt.Sprintf("%d", proc.Count),
+			averageDuration(proc).String(),
+			knoxite.SizeToString(uint64(in)),
+			knoxite.SizeToString(uint64(out)),
+			throughput,
+		})
+	}
+	_ = tab.Print()
+}
+
+func averageDuration(h knoxite.HistogramSummary) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return (time.Duration(h.Sum*float64(time.Second)) / time.Duration(h.Count)).Round(time.Microsecond)
+}
@@ -0,0 +1,115 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/config"
+)
+
+// applyRateLimits throttles the storage backends of a repository with the
+// rate limits configured for the current alias and for each backend's URL.
+func applyRateLimits(r *knoxite.Repository) error {
+	var shared *knoxite.RateLimiter
+	if rep, ok := cfg.Repositories[globalOpts.Alias]; ok && rep.RateLimit != nil {
+		var err error
+		if shared, err = newRateLimiter(*rep.RateLimit); err != nil {
+			return fmt.Errorf("invalid rate limit for alias %s: %v", globalOpts.Alias, err)
+		}
+	}
+
+	var err error
+	r.BackendManager().Wrap(func(be knoxite.Backend) knoxite.Backend {
+		if bc, ok := cfg.Backends[be.Location()]; ok && bc.RateLimit != nil {
+			l, lerr := newRateLimiter(*bc.RateLimit)
+			if lerr != nil {
+				err = fmt.Errorf("invalid rate limit for %s: %v", be.Location(), lerr)
+				return be
+			}
+			be = knoxite.NewRateLimitedBackend(be, l)
+		}
+		if shared != nil {
+			be = knoxite.NewRateLimitedBackend(be, shared)
+		}
+
+		return be
+	})
+
+	return err
+}
+
+// newRateLimiter returns a RateLimiter for a rate limit configuration.
+func newRateLimiter(c config.RateLimitConfig) (*knoxite.RateLimiter, error) {
+	limit, err := parseRateLimit(c.Upload, c.Download, c.Requests)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := []knoxite.RateLimitSchedule{}
+	for _, s := range c.Schedules {
+		from, err := parseTimeOfDay(s.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseTimeOfDay(s.To)
+		if err != nil {
+			return nil, err
+		}
+		l, err := parseRateLimit(s.Upload, s.Download, s.Requests)
+		if err != nil {
+			return nil, err
+		}
+
+		schedules = append(schedules, knoxite.RateLimitSchedule{
+			From:  from,
+			To:    to,
+			Limit: l,
+		})
+	}
+
+	return knoxite.NewRateLimiter(limit, schedules...), nil
+}
+
+func parseRateLimit(upload, download string, requests float64) (knoxite.RateLimit, error) {
+	limit := knoxite.RateLimit{
+		Requests: requests,
+	}
+	if requests < 0 {
+		return limit, fmt.Errorf("request limit can't be negative")
+	}
+
+	var err error
+	if upload != "" {
+		if limit.Upload, err = humanize.ParseBytes(upload); err != nil {
+			return limit, err
+		}
+	}
+	if download != "" {
+		if limit.Download, err = humanize.ParseBytes(download); err != nil {
+			return limit, err
+		}
+	}
+
+	return limit, nil
+}
+
+// parseTimeOfDay parses a time like "22:00" and returns the duration since
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s, expected hh:mm", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -11,8 +11,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	shutdown "github.com/klauspost/shutdown2"
+	"github.com/muesli/goprogressbar"
 	"github.com/muesli/gotable"
 	"github.com/spf13/cobra"
 
@@ -20,7 +23,16 @@ import (
 	"github.com/knoxite/knoxite/cmd/knoxite/utils"
 )
 
+// RebalanceOptions holds all the options that can be set for the 'repo rebalance' command.
+type RebalanceOptions struct {
+	FailureTolerance uint
+	DryRun           bool
+}
+
 var (
+	repoAddLabels []string
+	rebalanceOpts = RebalanceOptions{}
+
 	repoCmd = &cobra.Command{
 		Use:   "repo",
 		Short: "manage repository",
@@ -67,7 +79,58 @@ var (
 			if len(args) != 1 {
 				return fmt.Errorf("add needs a URL to be added")
 			}
-			return executeRepoAdd(args[0])
+			return executeRepoAdd(args[0], repoAddLabels)
+		},
+	}
+	repoLabelCmd = &cobra.Command{
+		Use:   "label <url> [key=value] [...]",
+		Short: "set the labels of a storage backend",
+		Long: `The label command sets the labels of a storage backend, e.g. its region or provider.
+Backends sharing a label never store parts of the same chunk, storing a chunk fails if there
+aren't enough independent backends. Pass --shared-failure-domains to store to spread its parts
+over the least used failure domains instead.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("label needs the URL of a storage backend")
+			}
+			return executeRepoLabel(args[0], args[1:])
+		},
+	}
+	repoRebalanceCmd = &cobra.Command{
+		Use:   "rebalance",
+		Short: "redistribute data across all storage backends",
+		Long: `The rebalance command redistributes all stored data across the repository's storage backends,
+so it can tolerate the configured amount of backend failures. Run it after adding storage backends.
+An interrupted rebalance can be resumed by running it again.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if rep, ok := cfg.Repositories[globalOpts.Alias]; ok && !cmd.Flags().Changed("tolerance") {
+				rebalanceOpts.FailureTolerance = rep.Tolerance
+			}
+			return executeRepoRebalance(rebalanceOpts)
+		},
+	}
+	repoRemoveCmd = &cobra.Command{
+		Use:   "remove <url>",
+		Short: "remove a storage backend from a repository",
+		Long: `The remove command moves all data off a storage backend and removes it from a repository.
+Data which can't be read from the backend anymore gets reconstructed from its parity parts.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("remove needs the URL of a storage backend")
+			}
+			return executeRepoRemove(args[0])
+		},
+	}
+	repoReplaceCmd = &cobra.Command{
+		Use:   "replace <old-url> <new-url>",
+		Short: "replace a storage backend of a repository",
+		Long: `The replace command moves all data from a storage backend to a new one and removes the old backend from a repository.
+Data which can't be read from the old backend anymore gets reconstructed from its parity parts.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("replace needs the URLs of the old and the new storage backend")
+			}
+			return executeRepoReplace(args[0], args[1])
 		},
 	}
 	repoPackCmd = &cobra.Command{
@@ -85,7 +148,14 @@ func init() {
 	repoCmd.AddCommand(repoChangePasswordCmd)
 	repoCmd.AddCommand(repoCatCmd)
 	repoCmd.AddCommand(repoInfoCmd)
+	repoAddCmd.Flags().StringArrayVarP(&repoAddLabels, "label", "l", []string{}, "label of the storage backend, e.g. provider=aws or region=eu")
 	repoCmd.AddCommand(repoAddCmd)
+	repoCmd.AddCommand(repoLabelCmd)
+	repoRebalanceCmd.Flags().UintVarP(&rebalanceOpts.FailureTolerance, "tolerance", "t", 0, "failure tolerance against n backend failures")
+	repoRebalanceCmd.Flags().BoolVar(&rebalanceOpts.DryRun, "dry-run", false, "only show which chunks would be rebalanced")
+	repoCmd.AddCommand(repoRebalanceCmd)
+	repoCmd.AddCommand(repoRemoveCmd)
+	repoCmd.AddCommand(repoReplaceCmd)
 	repoCmd.AddCommand(repoPackCmd)
 	RootCmd.AddCommand(repoCmd)
 }
@@ -127,7 +197,12 @@ func executeRepoChangePassword() error {
 	return nil
 }
 
-func executeRepoAdd(url string) error {
+func executeRepoAdd(url string, labelArgs []string) error {
+	labels, err := parseLabels(labelArgs)
+	if err != nil {
+		return err
+	}
+
 	// acquire a shutdown lock. we don't want these next calls to be interrupted
 	lock := shutdown.Lock()
 	if lock == nil {
@@ -151,6 +226,7 @@ func executeRepoAdd(url string) error {
 	}
 
 	r.BackendManager().AddBackend(&backend)
+	r.BackendManager().SetLabels(&backend, labels)
 
 	err = r.Save()
 	if err != nil {
@@ -160,6 +236,38 @@ func executeRepoAdd(url string) error {
 	return nil
 }
 
+func executeRepoLabel(url string, labelArgs []string) error {
+	labels, err := parseLabels(labelArgs)
+	if err != nil {
+		return err
+	}
+
+	// acquire a shutdown lock. we don't want these next calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+
+	be := r.BackendManager().Backend(url)
+	if be == nil {
+		return fmt.Errorf("%w: %s", knoxite.ErrBackendNotFound, url)
+	}
+	r.BackendManager().SetLabels(be, labels)
+
+	err = r.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Labeled %s: %s\n", url, formatLabels(labels))
+	return nil
+}
+
 func executeRepoCat() error {
 	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
 	if err != nil {
@@ -198,27 +306,239 @@ func executeRepoPack() error {
 	return nil
 }
 
+func executeRepoRebalance(opts RebalanceOptions) error {
+	// acquire a shutdown lock. we don't want these next calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	index, err := knoxite.OpenChunkIndex(&r)
+	if err != nil {
+		return err
+	}
+
+	progress, err := knoxite.RebalanceRepo(&r, &index, opts.FailureTolerance, opts.DryRun)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		chunks := 0
+		var size uint64
+		for p := range progress {
+			if p.Error != nil {
+				fmt.Printf("Checking chunk %s failed: %v\n", p.Hash, p.Error)
+				continue
+			}
+
+			action := "move"
+			if p.Action == knoxite.RebalanceReencode {
+				action = "re-encode"
+			}
+			fmt.Printf("Would %s chunk %s: %d parts, %s\n", action, p.Hash, p.Parts, knoxite.SizeToString(p.Size))
+			chunks++
+			size += p.Size
+		}
+
+		fmt.Printf("Rebalance would write %s for %d chunks\n", knoxite.SizeToString(size), chunks)
+		return nil
+	}
+
+	if errs := showMigrationProgress("Rebalance", progress); errs > 0 {
+		return fmt.Errorf("rebalance failed for %d chunks, run it again to resume", errs)
+	}
+	return nil
+}
+
+func executeRepoRemove(url string) error {
+	// acquire a shutdown lock. we don't want these next calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	index, err := knoxite.OpenChunkIndex(&r)
+	if err != nil {
+		return err
+	}
+
+	progress, err := knoxite.RemoveRepoBackend(&r, &index, url)
+	if err != nil {
+		return err
+	}
+	if errs := showMigrationProgress("Migration", progress); errs > 0 {
+		return fmt.Errorf("removing %s failed, run it again to resume", url)
+	}
+
+	fmt.Printf("Removed %s from repository\n", url)
+	return nil
+}
+
+func executeRepoReplace(oldURL, newURL string) error {
+	// acquire a shutdown lock. we don't want these next calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	index, err := knoxite.OpenChunkIndex(&r)
+	if err != nil {
+		return err
+	}
+
+	backend, err := knoxite.BackendFromURL(newURL)
+	if err != nil {
+		return err
+	}
+
+	// the replacement may already have been initialized by an interrupted run
+	err = backend.InitRepository()
+	if err != nil && err != knoxite.ErrRepositoryExists {
+		return err
+	}
+
+	progress, err := knoxite.ReplaceRepoBackend(&r, &index, oldURL, &backend)
+	if err != nil {
+		return err
+	}
+	if errs := showMigrationProgress("Migration", progress); errs > 0 {
+		return fmt.Errorf("replacing %s failed, run it again to resume", oldURL)
+	}
+
+	fmt.Printf("Replaced %s with %s\n", oldURL, backend.Location())
+	return nil
+}
+
+// showMigrationProgress prints the progress of moving chunks between storage
+// backends and returns the amount of errors.
+func showMigrationProgress(name string, progress chan knoxite.RebalanceProgress) int {
+	pb := &goprogressbar.ProgressBar{Total: 1000, Width: 40}
+	errs := 0
+	chunks := 0
+	var size uint64
+	var left knoxite.RebalanceProgress
+	for p := range progress {
+		if p.Action == knoxite.RebalanceLeftover {
+			left = p
+			continue
+		}
+		if p.Error != nil {
+			fmt.Println()
+			if p.Hash != "" {
+				fmt.Printf("Migrating chunk %s failed: %v\n", p.Hash, p.Error)
+			} else {
+				fmt.Printf("%s failed: %v\n", name, p.Error)
+			}
+			errs++
+			continue
+		}
+
+		chunks++
+		size += p.Size
+		pb.Total = int64(p.Total)
+		pb.Current = int64(p.Done)
+		pb.PrependText = fmt.Sprintf("%d / %d chunks", p.Done, p.Total)
+		pb.Text = knoxite.SizeToString(size) + " written"
+		pb.LazyPrint()
+	}
+
+	fmt.Println()
+	fmt.Printf("%s done: %d chunks, %s written, %d errors\n", name, chunks, knoxite.SizeToString(size), errs)
+	if left.Parts > 0 {
+		fmt.Printf("%d chunk parts (%s) and a copy of the repository's metadata remain on the old storage backend, wipe it to free up its space\n",
+			left.Parts, knoxite.SizeToString(left.Size))
+	}
+	return errs
+}
+
 func executeRepoInfo() error {
 	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
 	if err != nil {
 		return err
 	}
 
-	tab := gotable.NewTable([]string{"Storage URL", "Available Space"},
-		[]int64{-48, 15},
+	index, err := knoxite.OpenChunkIndex(&r)
+	if err != nil {
+		return err
+	}
+	usage := index.StorageByLocation()
+
+	tab := gotable.NewTable([]string{"Storage URL", "Used Space", "Available Space", "Status", "Labels"},
+		[]int64{-48, 15, 15, 12, -24},
 		"No backends found.")
 
+	r.BackendManager().CheckBackends()
 	for _, be := range r.BackendManager().Backends {
 		space, _ := (*be).AvailableSpace()
 		tab.AppendRow([]interface{}{
 			(*be).Location(),
-			knoxite.SizeToString(space)})
+			knoxite.SizeToString(usage[(*be).Location()]),
+			knoxite.SizeToString(space),
+			r.BackendManager().Health(be).State.String(),
+			formatLabels(r.BackendManager().Labels(be))})
 	}
 
 	_ = tab.Print()
+
+	if unknown, ok := usage[""]; ok {
+		fmt.Printf("\n%s of data stored before locations were tracked\n", knoxite.SizeToString(unknown))
+	}
+
+	if degraded := r.BackendManager().DegradedBackends(); len(degraded) > 0 {
+		fmt.Println("\nDegraded backends:")
+		for _, be := range degraded {
+			h := r.BackendManager().Health(be)
+			if h.LastError == nil {
+				fmt.Printf("  %s: missed writes, run 'knoxite repo rebalance' to restore them\n", (*be).Location())
+				continue
+			}
+			fmt.Printf("  %s: %v\n", (*be).Location(), h.LastError)
+		}
+	}
 	return nil
 }
 
+// parseLabels parses a list of key=value pairs.
+func parseLabels(args []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("invalid label %s, expected key=value", arg)
+		}
+		labels[parts[0]] = parts[1]
+	}
+
+	return labels, nil
+}
+
+// formatLabels returns a sorted, human-readable list of labels.
+func formatLabels(labels map[string]string) string {
+	l := []string{}
+	for k, v := range labels {
+		l = append(l, k+"="+v)
+	}
+	sort.Strings(l)
+
+	return strings.Join(l, ",")
+}
+
 func openRepository(path, password string) (knoxite.Repository, error) {
 	if password == "" {
 		var err error
@@ -228,7 +548,19 @@ func openRepository(path, password string) (knoxite.Repository, error) {
 		}
 	}
 
-	return knoxite.OpenRepository(path, password)
+	r, err := knoxite.OpenRepository(path, password)
+	if err != nil {
+		return r, err
+	}
+
+	applyMetrics(&r)
+	if err = applyRateLimits(&r); err != nil {
+		return r, err
+	}
+	if err = applyCache(&r); err != nil {
+		return r, err
+	}
+	return r, applySpool(&r)
 }
 
 func newRepository(path, password string) (knoxite.Repository, error) {
@@ -116,6 +116,7 @@ func executeRestore(snapshotID, target string, opts RestoreOptions) error {
 		}
 		fmt.Println()
 		fmt.Println("Restore done:", stats.String())
+		printMetricsSummary()
 		return nil
 	}
 
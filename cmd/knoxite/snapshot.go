@@ -58,6 +58,9 @@ func executeSnapshotRemove(snapshotID string) error {
 	if err != nil {
 		return err
 	}
+	if repository.BackendManager().AppendOnly() {
+		return knoxite.ErrAppendOnly
+	}
 	chunkIndex, err := knoxite.OpenChunkIndex(&repository)
 	if err != nil {
 		return err
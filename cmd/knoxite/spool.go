@@ -0,0 +1,81 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"os"
+	"strconv"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/config"
+)
+
+// useSpool gets set by commands writing to a repository's spool.
+var useSpool bool
+
+// spoolPath returns the path of the current repository's spool.
+func spoolPath() (string, error) {
+	path := ""
+	if rep, ok := cfg.Repositories[globalOpts.Alias]; ok {
+		path = rep.SpoolPath
+	}
+	if path == "" {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(globalOpts.Repo))
+
+		var err error
+		if path, err = config.DefaultSpoolPath(strconv.FormatUint(h.Sum64(), 16)); err != nil {
+			return "", err
+		}
+	}
+
+	return path, nil
+}
+
+// applySpool makes all writes to a repository go to its spool, when spooling
+// has been requested. As long as the spool isn't empty, the repository is
+// always read through it and other commands can't modify it.
+func applySpool(r *knoxite.Repository) error {
+	path, err := spoolPath()
+	if err != nil {
+		return err
+	}
+	if _, serr := os.Stat(path); !useSpool && os.IsNotExist(serr) {
+		return nil
+	}
+
+	spool, err := knoxite.OpenSpool(path)
+	if err != nil {
+		return err
+	}
+	if !useSpool {
+		files, _, err := spool.Pending()
+		if err != nil || files == 0 {
+			return err
+		}
+	}
+
+	r.BackendManager().Wrap(func(be knoxite.Backend) knoxite.Backend {
+		wrap := knoxite.NewSpooledBackend
+		if !useSpool {
+			wrap = knoxite.NewSpoolReader
+		}
+		sb, serr := wrap(be, spool)
+		if serr != nil {
+			err = serr
+			return be
+		}
+		return sb
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.Reload()
+}
@@ -36,6 +36,9 @@ type StoreOptions struct {
 	Encryption       string
 	FailureTolerance uint
 	Excludes         []string
+	Spool            bool
+	VerifyWrites     bool
+	SharedDomains    bool
 }
 
 var (
@@ -54,6 +57,7 @@ var (
 			}
 
 			configureStoreOpts(cmd, &storeOpts)
+			useSpool = storeOpts.Spool
 			return executeStore(args[0], args[1:], storeOpts)
 		},
 	}
@@ -77,6 +81,15 @@ func configureStoreOpts(cmd *cobra.Command, opts *StoreOptions) {
 		if !cmd.Flags().Changed("excludes") {
 			opts.Excludes = rep.StoreExcludes
 		}
+		if !cmd.Flags().Changed("spool") {
+			opts.Spool = rep.Spool
+		}
+		if !cmd.Flags().Changed("verify-writes") {
+			opts.VerifyWrites = rep.VerifyWrites
+		}
+		if !cmd.Flags().Changed("shared-failure-domains") {
+			opts.SharedDomains = rep.SharedFailureDomains
+		}
 	}
 }
 
@@ -86,6 +99,9 @@ func initStoreFlags(f func() *pflag.FlagSet, opts *StoreOptions) {
 	f().StringVarP(&opts.Encryption, "encryption", "e", "", "encryption algo to use: aes (default), none")
 	f().UintVarP(&opts.FailureTolerance, "tolerance", "t", 0, "failure tolerance against n backend failures")
 	f().StringArrayVarP(&opts.Excludes, "excludes", "x", []string{}, "list of excludes")
+	f().BoolVar(&opts.Spool, "spool", false, "store the snapshot in a local spool, to be uploaded by 'knoxite upload'")
+	f().BoolVar(&opts.VerifyWrites, "verify-writes", false, "verify every stored chunk and upload it again if it doesn't match")
+	f().BoolVar(&opts.SharedDomains, "shared-failure-domains", false, "store parts of a chunk in the same failure domain if there aren't enough independent backends")
 }
 
 func init() {
@@ -115,6 +131,9 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 	}
 
 	tol := uint(len(repository.BackendManager().Backends) - int(opts.FailureTolerance))
+	repository.BackendManager().FailureTolerance = opts.FailureTolerance
+	repository.BackendManager().VerifyWrites = opts.VerifyWrites
+	repository.BackendManager().SharedFailureDomains = opts.SharedDomains
 
 	startTime := time.Now()
 	progress := snapshot.Add(wd, targets, opts.Excludes, *repository, chunkIndex,
@@ -177,6 +196,9 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 	}
 
 	fmt.Printf("\nSnapshot %s created: %s\n", snapshot.ID, snapshot.Stats.String())
+	if opts.Spool {
+		fmt.Println("The snapshot has been spooled, run 'knoxite upload' to upload it")
+	}
 	return nil
 }
 
@@ -237,5 +259,17 @@ func executeStore(volumeID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
-	return repository.Save()
+	err = repository.Save()
+	if err != nil {
+		return err
+	}
+	if len(repository.Degraded) > 0 {
+		fmt.Println("Storage backends which missed writes, run 'knoxite repo rebalance' to restore them:")
+		for _, location := range repository.Degraded {
+			fmt.Printf("  %s\n", location)
+		}
+	}
+
+	printMetricsSummary()
+	return nil
 }
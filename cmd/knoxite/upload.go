@@ -0,0 +1,116 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	shutdown "github.com/klauspost/shutdown2"
+	"github.com/muesli/goprogressbar"
+	"github.com/spf13/cobra"
+
+	"github.com/knoxite/knoxite"
+)
+
+// UploadOptions holds all the options that can be set for the 'upload' command.
+type UploadOptions struct {
+	Interval     time.Duration
+	VerifyWrites bool
+}
+
+var (
+	uploadOpts = UploadOptions{}
+
+	uploadCmd = &cobra.Command{
+		Use:   "upload",
+		Short: "upload spooled snapshots",
+		Long: `The upload command uploads the snapshots stored with 'store --spool' to the repository's storage backends.
+An interrupted upload can be resumed by running it again.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if rep, ok := cfg.Repositories[globalOpts.Alias]; ok && !cmd.Flags().Changed("verify-writes") {
+				uploadOpts.VerifyWrites = rep.VerifyWrites
+			}
+			return executeUpload(uploadOpts)
+		},
+	}
+)
+
+func init() {
+	uploadCmd.Flags().DurationVar(&uploadOpts.Interval, "interval", 0, "keep running and upload the spool in this interval, e.g. 10m")
+	uploadCmd.Flags().BoolVar(&uploadOpts.VerifyWrites, "verify-writes", false, "verify every uploaded chunk and upload it again if it doesn't match")
+	RootCmd.AddCommand(uploadCmd)
+}
+
+func executeUpload(opts UploadOptions) error {
+	// we want to be notified during the first phase of a shutdown
+	cancel := shutdown.First()
+
+	useSpool = true
+	for {
+		if err := uploadSpool(opts); err != nil {
+			if opts.Interval == 0 {
+				return err
+			}
+			fmt.Println(err)
+		}
+		if opts.Interval == 0 {
+			return nil
+		}
+
+		select {
+		case n := <-cancel:
+			close(n)
+			return nil
+		case <-time.After(opts.Interval):
+		}
+	}
+}
+
+func uploadSpool(opts UploadOptions) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repository.BackendManager().VerifyWrites = opts.VerifyWrites
+
+	progress, err := knoxite.UploadSpool(&repository)
+	if err != nil {
+		return err
+	}
+
+	pb := &goprogressbar.ProgressBar{Total: 1000, Width: 40}
+	errs := 0
+	files := 0
+	var size uint64
+	for p := range progress {
+		if p.Error != nil {
+			fmt.Println()
+			fmt.Printf("Uploading %s to %s failed: %v\n", p.Name, p.Location, p.Error)
+			errs++
+			continue
+		}
+
+		files++
+		size += p.Size
+		pb.Total = int64(p.Total)
+		pb.Current = int64(p.Done)
+		pb.PrependText = fmt.Sprintf("%d / %d files", p.Done, p.Total)
+		pb.Text = knoxite.SizeToString(size) + " uploaded"
+		pb.LazyPrint()
+	}
+
+	if files > 0 || errs > 0 {
+		fmt.Println()
+	}
+	fmt.Printf("Upload done: %d files, %s uploaded, %d errors\n", files, knoxite.SizeToString(size), errs)
+	if errs > 0 {
+		return fmt.Errorf("upload failed for %d files, run it again to resume", errs)
+	}
+	return nil
+}
@@ -87,6 +87,7 @@ func executeVerifyRepo(opts VerifyOptions) error {
 
 		fmt.Println()
 		fmt.Printf("Verify done: %d errors\n", len(errors))
+		printMetricsSummary()
 		return nil
 	}
 	return err
@@ -131,6 +132,7 @@ func executeVerifyVolume(volumeId string, opts VerifyOptions) error {
 
 		fmt.Println()
 		fmt.Printf("Verify done: %d errors\n", len(errors))
+		printMetricsSummary()
 		return nil
 	}
 	return err
@@ -175,6 +177,7 @@ func executeVerifySnapshot(volumeId string, snapshotId string, opts VerifyOption
 
 		fmt.Println()
 		fmt.Printf("Verify done: %d errors\n", len(errors))
+		printMetricsSummary()
 		return nil
 	}
 	return err
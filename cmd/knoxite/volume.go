@@ -106,6 +106,9 @@ func executeVolumeRemove(volumeID string) error {
 	if err != nil {
 		return err
 	}
+	if repo.BackendManager().AppendOnly() {
+		return knoxite.ErrAppendOnly
+	}
 
 	chunkIndex, err := knoxite.OpenChunkIndex(&repo)
 	if err != nil {
@@ -0,0 +1,477 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Error declarations
+var (
+	ErrInvalidName   = errors.New("Invalid file name")
+	ErrMissingUpload = errors.New("Request contains no uploadfile")
+	ErrAppendOnly    = errors.New("Server is in append-only mode, this requires admin credentials")
+)
+
+// appendOnlyHeader marks responses refusing a change in append-only mode, so
+// clients can tell them apart from other permission errors.
+const appendOnlyHeader = "Knoxite-Append-Only"
+
+// maxQuerySize limits the size of a request checking for stored chunks.
+const maxQuerySize = 4 << 20
+
+// nameRe matches the names of chunks and snapshots which are safe to use as a
+// file name.
+var nameRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// Server serves the repositories of its users to knoxite's http storage
+// backend. Every user's repository is stored in a directory named after the
+// user within Root.
+//
+// In append-only mode chunks and snapshots can't be overwritten or deleted,
+// unless the request has been authenticated with the user's admin password
+// from Admins. Previous versions of the repository and the chunk-index get
+// kept in the repository's versions dir.
+type Server struct {
+	Root       string
+	Users      *Users
+	Admins     *Users
+	AppendOnly bool
+	Logger     *log.Logger
+
+	mux *http.ServeMux
+}
+
+// account is the authenticated user of a request.
+type account struct {
+	name  string
+	admin bool
+}
+
+type accountKey struct{}
+
+func withAccount(ctx context.Context, acc account) context.Context {
+	return context.WithValue(ctx, accountKey{}, acc)
+}
+
+func accountFromContext(ctx context.Context) account {
+	acc, _ := ctx.Value(accountKey{}).(account)
+	return acc
+}
+
+// mode describes the server's restrictions for the authenticated user.
+type mode struct {
+	AppendOnly bool `json:"append_only"`
+	Admin      bool `json:"admin"`
+}
+
+// NewServer returns a Server storing its repositories in root.
+func NewServer(root string, users *Users, logger *log.Logger) *Server {
+	s := &Server{
+		Root:   root,
+		Users:  users,
+		Logger: logger,
+		mux:    http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/upload", s.upload)
+	s.mux.HandleFunc("/download/", s.chunk)
+	s.mux.HandleFunc("/repository", s.repository)
+	s.mux.HandleFunc("/chunkindex", s.chunkIndex)
+	s.mux.HandleFunc("/snapshot", s.uploadSnapshot)
+	s.mux.HandleFunc("/snapshot/", s.downloadSnapshot)
+	s.mux.HandleFunc("/exists", s.exists)
+	s.mux.HandleFunc("/mode", s.mode)
+
+	return s
+}
+
+// ServeHTTP authenticates and logs a request before dispatching it.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lw := &logWriter{ResponseWriter: w, status: http.StatusOK}
+
+	acc, ok := s.authenticate(lw, r)
+	if ok {
+		s.mux.ServeHTTP(lw, r.WithContext(withAccount(r.Context(), acc)))
+	}
+
+	s.Logger.Printf("remote=%s user=%q admin=%t method=%s path=%q status=%d bytes=%d duration=%s",
+		r.RemoteAddr, acc.name, acc.admin, r.Method, r.URL.Path, lw.status, lw.bytes, time.Since(start))
+}
+
+// authenticate checks the request's credentials and makes sure the user's
+// repository dir exists.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (account, bool) {
+	user, password, ok := r.BasicAuth()
+	acc := account{name: user}
+	if ok && !s.Users.Authenticate(user, password) {
+		acc.admin = s.Admins != nil && s.Admins.Authenticate(user, password)
+		ok = acc.admin
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="knoxite"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return acc, false
+	}
+
+	for _, dir := range []string{"chunks", "snapshots", "versions"} {
+		if err := os.MkdirAll(filepath.Join(s.Root, user, dir), 0700); err != nil {
+			s.fail(w, err)
+			return acc, false
+		}
+	}
+
+	return acc, true
+}
+
+// restricted returns true if the request may not overwrite or delete data.
+func (s *Server) restricted(r *http.Request) bool {
+	return s.AppendOnly && !accountFromContext(r.Context()).admin
+}
+
+// path returns the path of a file within the user's repository. name must
+// not contain any path separators.
+func (s *Server) path(r *http.Request, dir, name string) (string, error) {
+	if !nameRe.MatchString(name) {
+		return "", ErrInvalidName
+	}
+
+	return filepath.Join(s.Root, accountFromContext(r.Context()).name, dir, name), nil
+}
+
+// mode tells clients whether they may remove data.
+func (s *Server) mode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(mode{
+		AppendOnly: s.AppendOnly,
+		Admin:      accountFromContext(r.Context()).admin,
+	})
+}
+
+// upload stores a chunk.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.receive(w, r, "chunks", "", writeOptions{keep: true, create: s.restricted(r)})
+}
+
+// chunk serves or deletes a chunk.
+func (s *Server) chunk(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/download/")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serve(w, r, "chunks", name)
+	case http.MethodDelete:
+		if s.restricted(r) {
+			refuse(w)
+			return
+		}
+		s.remove(w, r, "chunks", name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// chunkQuery is a single entry of a query for stored chunks.
+type chunkQuery struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// exists reports for a list of chunks whether they are stored with the
+// given size.
+func (s *Server) exists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var query []chunkQuery
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQuerySize)).Decode(&query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	found := make([]bool, len(query))
+	for i, q := range query {
+		path, err := s.path(r, "chunks", q.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fi, err := os.Stat(path)
+		found[i] = err == nil && fi.Mode().IsRegular() && fi.Size() == q.Size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(found)
+}
+
+// repository serves or stores the repository.
+func (s *Server) repository(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serve(w, r, "", "repository.knoxite")
+	case http.MethodPost:
+		s.receive(w, r, "", "repository.knoxite", s.metadataOptions())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// chunkIndex serves or stores the chunk-index.
+func (s *Server) chunkIndex(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serve(w, r, "", "chunkindex")
+	case http.MethodPost:
+		s.receive(w, r, "", "chunkindex", s.metadataOptions())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadSnapshot stores a snapshot.
+func (s *Server) uploadSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.receive(w, r, "snapshots", "", writeOptions{create: s.restricted(r)})
+}
+
+// downloadSnapshot serves a snapshot.
+func (s *Server) downloadSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.serve(w, r, "snapshots", strings.TrimPrefix(r.URL.Path, "/snapshot/"))
+}
+
+// serve sends a file to the client.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, dir, name string) {
+	path, err := s.path(r, dir, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	if fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// metadataOptions returns how the repository and the chunk-index get
+// written. In append-only mode their previous versions are kept.
+func (s *Server) metadataOptions() writeOptions {
+	if s.AppendOnly {
+		return writeOptions{versions: "versions"}
+	}
+	return writeOptions{}
+}
+
+// receive stores the uploadfile of a multipart request in dir. Unless a name
+// is given, the uploaded file name is used.
+//
+// For chunks it responds with http.StatusCreated when the chunk has been
+// written and with http.StatusOK when an existing chunk has been kept.
+func (s *Server) receive(w http.ResponseWriter, r *http.Request, dir, name string, opts writeOptions) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(w, ErrMissingUpload.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "uploadfile" {
+			continue
+		}
+
+		if name == "" {
+			name = part.FileName()
+		}
+		path, err := s.path(r, dir, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if opts.versions != "" {
+			opts.versions = filepath.Join(s.Root, accountFromContext(r.Context()).name, opts.versions)
+		}
+		created, err := writeFile(path, part, opts)
+		if os.IsExist(err) {
+			refuse(w)
+			return
+		}
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+		if opts.keep && created {
+			w.WriteHeader(http.StatusCreated)
+		}
+		return
+	}
+}
+
+// remove deletes a file.
+func (s *Server) remove(w http.ResponseWriter, r *http.Request, dir, name string) {
+	path, err := s.path(r, dir, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		s.fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refuse responds to a request changing data in append-only mode.
+func refuse(w http.ResponseWriter) {
+	w.Header().Set(appendOnlyHeader, "true")
+	http.Error(w, ErrAppendOnly.Error(), http.StatusForbidden)
+}
+
+// fail responds with the status matching err. Details of unexpected errors
+// only get logged.
+func (s *Server) fail(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	case errors.Is(err, syscall.ENOSPC):
+		http.Error(w, "insufficient storage", http.StatusInsufficientStorage)
+	default:
+		s.Logger.Printf("level=error err=%q", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// writeOptions control how writeFile treats existing files.
+type writeOptions struct {
+	// keep an existing file with the same size
+	keep bool
+	// never replace an existing file
+	create bool
+	// dir the previous version of a file gets moved to
+	versions string
+}
+
+// writeFile atomically writes the data read from r to path. It returns false
+// if an existing file has been kept, and an error satisfying os.IsExist if
+// the file exists and can't be replaced.
+func writeFile(path string, r io.Reader, opts writeOptions) (bool, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if opts.keep {
+		if fi, err := os.Stat(path); err == nil && fi.Size() == n {
+			return false, nil
+		}
+	}
+	if opts.create {
+		// linking fails if the file already exists
+		return true, os.Link(f.Name(), path)
+	}
+	if opts.versions != "" {
+		version := filepath.Join(opts.versions, filepath.Base(path)+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+		if err := os.Link(path, version); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	return true, os.Rename(f.Name(), path)
+}
+
+// logWriter records the status and size of a response.
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (lw *logWriter) WriteHeader(status int) {
+	lw.status = status
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *logWriter) Write(b []byte) (int, error) {
+	n, err := lw.ResponseWriter.Write(b)
+	lw.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,322 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/knoxite/knoxite"
+	_ "github.com/knoxite/knoxite/storage/http"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, string, func()) {
+	dir, err := ioutil.TempDir("", "knoxite.server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewUsers()
+	for _, name := range []string{"alice", "bob"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(name+"-secret"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := users.Add(name, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(NewServer(dir, users, log.New(ioutil.Discard, "", 0)))
+	return ts, dir, func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func do(t *testing.T, ts *httptest.Server, user, method, path string, data []byte, name string) int {
+	var body bytes.Buffer
+	contentType := ""
+	if data != nil {
+		mw := multipart.NewWriter(&body)
+		w, err := mw.CreateFormFile("uploadfile", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(data)
+		mw.Close()
+		contentType = mw.FormDataContentType()
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if user != "" {
+		// users authenticate with their default password, unless another
+		// one is given as user:password
+		password := user + "-secret"
+		if i := strings.Index(user, ":"); i >= 0 {
+			user, password = user[:i], user[i+1:]
+		}
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAuthentication(t *testing.T) {
+	ts, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if status := do(t, ts, "", "GET", "/repository", nil, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without credentials, got %d", http.StatusUnauthorized, status)
+	}
+	if status := do(t, ts, "mallory", "GET", "/repository", nil, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for unknown user, got %d", http.StatusUnauthorized, status)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/repository", nil)
+	req.SetBasicAuth("alice", "bob-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong password, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	if status := do(t, ts, "alice", "GET", "/repository", nil, ""); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for missing repository, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	ts, dir, cleanup := newTestServer(t)
+	defer cleanup()
+
+	data := []byte("chunk")
+	if status := do(t, ts, "alice", "POST", "/upload", data, "abcd.0_1"); status != http.StatusCreated {
+		t.Errorf("Expected status %d for new chunk, got %d", http.StatusCreated, status)
+	}
+	if status := do(t, ts, "alice", "POST", "/upload", data, "abcd.0_1"); status != http.StatusOK {
+		t.Errorf("Expected status %d for existing chunk, got %d", http.StatusOK, status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice", "chunks", "abcd.0_1")); err != nil {
+		t.Errorf("Chunk has not been stored: %s", err)
+	}
+
+	// users can't access each other's repositories
+	if status := do(t, ts, "bob", "GET", "/download/abcd.0_1", nil, ""); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for another user's chunk, got %d", http.StatusNotFound, status)
+	}
+
+	if status := do(t, ts, "alice", "DELETE", "/download/abcd.0_1", nil, ""); status != http.StatusNoContent {
+		t.Errorf("Expected status %d for deleted chunk, got %d", http.StatusNoContent, status)
+	}
+	if status := do(t, ts, "alice", "GET", "/download/abcd.0_1", nil, ""); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for deleted chunk, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestPathTampering(t *testing.T) {
+	ts, dir, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, name := range []string{"..", ".hidden"} {
+		if status := do(t, ts, "alice", "POST", "/snapshot", []byte("x"), name); status != http.StatusBadRequest {
+			t.Errorf("Expected status %d for upload of %q, got %d", http.StatusBadRequest, name, status)
+		}
+	}
+
+	// uploads can't escape the snapshots dir
+	_ = do(t, ts, "alice", "POST", "/snapshot", []byte("x"), "../../bob/repository.knoxite")
+	if _, err := os.Stat(filepath.Join(dir, "bob", "repository.knoxite")); !os.IsNotExist(err) {
+		t.Errorf("Upload escaped the user's repository: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice", "repository.knoxite")); !os.IsNotExist(err) {
+		t.Errorf("Upload escaped the snapshots dir: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status := do(t, ts, "alice", "GET", "/snapshot/..%2f..%2fsecret", nil, ""); status == http.StatusOK {
+		t.Errorf("Expected tampered path to be rejected, got %d", status)
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	ts, dir, cleanup := newTestServer(t)
+	defer cleanup()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("alice-admin"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := ts.Config.Handler.(*Server)
+	srv.Admins = NewUsers()
+	if err := srv.Admins.Add("alice", hash); err != nil {
+		t.Fatal(err)
+	}
+	srv.AppendOnly = true
+
+	if status := do(t, ts, "alice", "POST", "/upload", []byte("chunk"), "abcd.0_1"); status != http.StatusCreated {
+		t.Errorf("Expected status %d for new chunk, got %d", http.StatusCreated, status)
+	}
+	if status := do(t, ts, "alice", "POST", "/upload", []byte("chunk"), "abcd.0_1"); status != http.StatusOK {
+		t.Errorf("Expected status %d for existing chunk, got %d", http.StatusOK, status)
+	}
+	if status := do(t, ts, "alice", "POST", "/upload", []byte("overwritten"), "abcd.0_1"); status != http.StatusForbidden {
+		t.Errorf("Expected status %d for overwritten chunk, got %d", http.StatusForbidden, status)
+	}
+	if status := do(t, ts, "alice", "DELETE", "/download/abcd.0_1", nil, ""); status != http.StatusForbidden {
+		t.Errorf("Expected status %d for deleted chunk, got %d", http.StatusForbidden, status)
+	}
+	if status := do(t, ts, "alice:alice-admin", "DELETE", "/download/abcd.0_1", nil, ""); status != http.StatusNoContent {
+		t.Errorf("Expected admin to delete chunk, got status %d", status)
+	}
+
+	if status := do(t, ts, "alice", "POST", "/snapshot", []byte("snapshot"), "1234"); status != http.StatusOK {
+		t.Errorf("Expected status %d for new snapshot, got %d", http.StatusOK, status)
+	}
+	if status := do(t, ts, "alice", "POST", "/snapshot", []byte("tampered"), "1234"); status != http.StatusForbidden {
+		t.Errorf("Expected status %d for overwritten snapshot, got %d", http.StatusForbidden, status)
+	}
+
+	// the repository and the chunk-index are versioned
+	for i := 0; i < 3; i++ {
+		if status := do(t, ts, "alice", "POST", "/repository", []byte("repository"), "repository.knoxite"); status != http.StatusOK {
+			t.Errorf("Expected status %d for repository, got %d", http.StatusOK, status)
+		}
+	}
+	versions, err := ioutil.ReadDir(filepath.Join(dir, "alice", "versions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("Expected 2 previous versions of the repository, got %d", len(versions))
+	}
+
+	// the client knows whether it may remove data
+	be, err := knoxite.BackendFromURL(strings.Replace(ts.URL, "http://", "http://alice:alice-secret@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !knoxite.IsAppendOnly(be) {
+		t.Error("Expected backend to be append-only")
+	}
+	if err := be.DeleteChunk("abcd", 0, 1); err != knoxite.ErrAppendOnly {
+		t.Errorf("Expected %v, got %v", knoxite.ErrAppendOnly, err)
+	}
+
+	be, err = knoxite.BackendFromURL(strings.Replace(ts.URL, "http://", "http://alice:alice-admin@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if knoxite.IsAppendOnly(be) {
+		t.Error("Expected admin to be able to remove data")
+	}
+}
+
+func TestExists(t *testing.T) {
+	ts, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	be, err := knoxite.BackendFromURL(strings.Replace(ts.URL, "http://", "http://alice:alice-secret@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("chunk")
+	if _, err := be.StoreChunk("abcd", 0, 1, data); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := knoxite.QueryChunks(be, []knoxite.ChunkPart{
+		{Shasum: "abcd", Part: 0, TotalParts: 1, Size: uint64(len(data))},
+		{Shasum: "abcd", Part: 0, TotalParts: 1, Size: 1},
+		{Shasum: "efgh", Part: 0, TotalParts: 1, Size: uint64(len(data))},
+	})
+	if err != nil {
+		t.Fatalf("Failed querying chunks: %s", err)
+	}
+	if len(found) != 3 || !found[0] || found[1] || found[2] {
+		t.Errorf("Expected [true false false], got %v", found)
+	}
+
+	if status := do(t, ts, "alice", "POST", "/exists", nil, ""); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for empty query, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	entry, err := HashPassword("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = HashPassword("../alice", "secret"); err != ErrInvalidUsername {
+		t.Errorf("Expected %v, got %v", ErrInvalidUsername, err)
+	}
+
+	f, err := ioutil.TempFile("", "knoxite.users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("# users\n\n" + entry + "\n")
+	f.Close()
+
+	users, err := LoadUsers(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.Authenticate("alice", "secret") {
+		t.Error("Expected valid credentials to authenticate")
+	}
+	if users.Authenticate("alice", "wrong") {
+		t.Error("Expected wrong password to be rejected")
+	}
+
+	// a changed password invalidates the previous login
+	hash, err := bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Add("alice", hash); err != nil {
+		t.Fatal(err)
+	}
+	if users.Authenticate("alice", "secret") || !users.Authenticate("alice", "changed") {
+		t.Error("Expected only the changed password to authenticate")
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadUsers(f.Name()); err == nil {
+		t.Error("Expected error for invalid users file")
+	}
+}
@@ -1,201 +1,151 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+// The knoxite server stores repositories for knoxite's http storage backend.
+//
+// Users are configured in a users file, containing a username and a bcrypt
+// hashed password per line. Entries can be created with:
+//
+//	server -hash-password alice >> users
+//
+// Every user's repository is stored in a directory named after the user
+// within the storage root.
+//
+// With -append-only, data can only be added to the repositories. Deleting
+// chunks, e.g. with 'repo pack', requires the user's admin password from the
+// admins file, which has the same format as the users file.
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
-const storagePath = "/tmp/knoxite.storage"
-
-func authPath(w http.ResponseWriter, r *http.Request) (string, error) {
-	auth, _, ok := r.BasicAuth()
-	if !ok {
-		w.WriteHeader(http.StatusUnauthorized)
-		return "", errors.New("Security alert: no auth set")
-	}
-
-	// check for relative path attacks
-	if strings.Index(r.URL.Path, "../") >= 0 {
-		w.WriteHeader(http.StatusUnauthorized)
-		return "", errors.New("Security alert: url path tampering")
-	}
-	if strings.Index(auth, "../") >= 0 {
-		w.WriteHeader(http.StatusUnauthorized)
-		return "", errors.New("Security alert: auth code tampering")
-	}
-
-	dir := filepath.Join(storagePath, auth)
-	src, err := os.Stat(dir)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return "", errors.New("Invalid auth code: unknown user")
-	}
-	if !src.IsDir() {
-		w.WriteHeader(http.StatusUnauthorized)
-		return "", errors.New("Invalid auth code: not a dir")
-	}
+var (
+	root         = flag.String("root", "", "directory the repositories are stored in")
+	listen       = flag.String("listen", ":42024", "address to listen on")
+	usersFile    = flag.String("users", "", "file containing the users and their bcrypt hashed passwords")
+	adminsFile   = flag.String("admins", "", "file containing the admin passwords of the users")
+	appendOnly   = flag.Bool("append-only", false, "only allow adding data, unless authenticated as admin")
+	tlsCert      = flag.String("tls-cert", "", "TLS certificate file")
+	tlsKey       = flag.String("tls-key", "", "TLS key file")
+	insecure     = flag.Bool("insecure", false, "serve plain HTTP without TLS")
+	hashPassword = flag.String("hash-password", "", "read a password from stdin and print a users file entry for this user")
+)
 
-	return dir, nil
-}
+// shutdownTimeout is how long running requests may take after the server
+// got asked to shut down.
+const shutdownTimeout = 30 * time.Second
 
-// upload logic.
-func upload(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Receiving upload")
-	if r.Method == "POST" {
-		path, err := authPath(w, r)
-		if err != nil {
-			fmt.Println("ERROR:", err)
-			return
-		}
+func main() {
+	flag.Parse()
 
-		r.ParseMultipartForm(32 << 20)
-		file, handler, err := r.FormFile("uploadfile")
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	if *hashPassword != "" {
+		if err := printUserEntry(*hashPassword); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		defer file.Close()
-		fmt.Fprintf(w, "%v", handler.Header)
-		f, err := os.OpenFile(filepath.Join(path, "chunks", handler.Filename), os.O_WRONLY|os.O_CREATE, 0600)
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		defer f.Close()
-		io.Copy(f, file)
-
-		fmt.Println("Stored chunk", filepath.Join(path, "chunks", handler.Filename))
-	}
-}
-
-// download logic.
-func download(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Serving chunk", r.URL.Path[10:])
-
-	path, err := authPath(w, r)
-	if err != nil {
-		fmt.Println("ERROR:", err)
 		return
 	}
 
-	if r.Method == "GET" {
-		http.ServeFile(w, r, filepath.Join(path, "chunks", r.URL.Path[10:]))
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	if err := run(logger); err != nil {
+		logger.Fatalf("level=fatal err=%q", err)
 	}
 }
 
-// uploadRepo logic.
-func uploadRepo(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Receiving repository")
-
-	path, err := authPath(w, r)
-	if err != nil {
-		fmt.Println("ERROR:", err)
-		return
+func run(logger *log.Logger) error {
+	if *root == "" {
+		return errors.New("no storage root specified, use -root")
 	}
-
-	r.ParseMultipartForm(32 << 20)
-	file, handler, err := r.FormFile("uploadfile")
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if *usersFile == "" {
+		return errors.New("no users file specified, use -users")
 	}
-	defer file.Close()
-	fmt.Fprintf(w, "%v", handler.Header)
-	f, err := os.OpenFile(filepath.Join(path, "repository.knoxite"), os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("-tls-cert and -tls-key have to be used together")
+	}
+	if *tlsCert == "" && !*insecure {
+		return errors.New("no TLS certificate specified, use -tls-cert and -tls-key or -insecure")
 	}
-	defer f.Close()
-	io.Copy(f, file)
-
-	fmt.Println("Stored repository", filepath.Join(path, "repository.knoxite"))
-}
-
-// downloadRepo logic.
-func downloadRepo(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Serving repository")
 
-	path, err := authPath(w, r)
+	users, err := LoadUsers(*usersFile)
 	if err != nil {
-		fmt.Println("ERROR:", err)
-		return
+		return err
+	}
+	var admins *Users
+	if *adminsFile != "" {
+		if admins, err = LoadUsers(*adminsFile); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*root, 0700); err != nil {
+		return err
 	}
 
-	http.ServeFile(w, r, filepath.Join(path, "repository.knoxite"))
-}
+	handler := NewServer(*root, users, logger)
+	handler.Admins = admins
+	handler.AppendOnly = *appendOnly
 
-func repository(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		downloadRepo(w, r)
-	case "POST":
-		uploadRepo(w, r)
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ErrorLog:          logger,
 	}
-}
 
-// uploadSnapshot logic.
-func uploadSnapshot(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Receiving snapshot")
+	// shut down gracefully, letting running requests finish
+	done := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		s := <-sig
+		logger.Printf("level=info msg=\"shutting down\" signal=%s", s)
 
-	path, err := authPath(w, r)
-	if err != nil {
-		fmt.Println("ERROR:", err)
-		return
-	}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
 
-	r.ParseMultipartForm(32 << 20)
-	file, handler, err := r.FormFile("uploadfile")
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	logger.Printf("level=info msg=\"listening\" addr=%s tls=%t append_only=%t root=%q", *listen, *tlsCert != "", *appendOnly, *root)
+	if *tlsCert != "" {
+		err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = srv.ListenAndServe()
 	}
-	defer file.Close()
-	fmt.Fprintf(w, "%v", handler.Header)
-	f, err := os.OpenFile(filepath.Join(path, "snapshots", handler.Filename), os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if err != http.ErrServerClosed {
+		return err
 	}
-	defer f.Close()
-	io.Copy(f, file)
 
-	fmt.Println("Stored snapshot", filepath.Join(path, "snapshots", handler.Filename))
+	return <-done
 }
 
-// downloadRepo logic.
-func downloadSnapshot(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Serving snapshot", r.URL.Path[10:])
-
-	path, err := authPath(w, r)
-	if err != nil {
-		fmt.Println("ERROR:", err)
-		return
+// printUserEntry reads a password from stdin and prints a users file entry.
+func printUserEntry(name string) error {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
 	}
 
-	http.ServeFile(w, r, filepath.Join(path, "snapshots", r.URL.Path[10:]))
-}
-
-func main() {
-	http.HandleFunc("/upload", upload)
-	http.HandleFunc("/download/", download)
-	http.HandleFunc("/repository", repository)
-	http.HandleFunc("/snapshot", uploadSnapshot)
-	http.HandleFunc("/snapshot/", downloadSnapshot)
-	err := http.ListenAndServe(":42024", nil) // setting listening port
+	entry, err := HashPassword(name, strings.TrimRight(password, "\r\n"))
 	if err != nil {
-		log.Fatal("ListenAndServe:", err)
+		return err
 	}
+	fmt.Println(entry)
+	return nil
 }
@@ -0,0 +1,97 @@
+// +build backend
+
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/knoxite/knoxite/storage"
+	_ "github.com/knoxite/knoxite/storage/http"
+)
+
+var (
+	backendTest *storage.BackendTest
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "knoxite.server")
+	if err != nil {
+		panic(err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	users := NewUsers()
+	if err := users.Add("knoxite", hash); err != nil {
+		panic(err)
+	}
+	ts := httptest.NewServer(NewServer(dir, users, log.New(ioutil.Discard, "", 0)))
+
+	backendTest = &storage.BackendTest{
+		URL:         strings.Replace(ts.URL, "http://", "http://knoxite:secret@", 1),
+		Protocols:   []string{"http", "https"},
+		Description: "HTTP(S) Storage",
+		TearDown: func(tb *storage.BackendTest) {
+			ts.Close()
+			os.RemoveAll(dir)
+		},
+	}
+
+	storage.RunBackendTester(backendTest, m)
+}
+
+func TestStorageNewBackend(t *testing.T) {
+	backendTest.NewBackendTest(t)
+}
+
+func TestStorageLocation(t *testing.T) {
+	backendTest.LocationTest(t)
+}
+
+func TestStorageProtocols(t *testing.T) {
+	backendTest.ProtocolsTest(t)
+}
+
+func TestStorageDescription(t *testing.T) {
+	backendTest.DescriptionTest(t)
+}
+
+func TestStorageInitRepository(t *testing.T) {
+	backendTest.InitRepositoryTest(t)
+}
+
+func TestStorageSaveRepository(t *testing.T) {
+	backendTest.SaveRepositoryTest(t)
+}
+
+func TestAvailableSpace(t *testing.T) {
+	backendTest.AvailableSpaceTest(t)
+}
+
+func TestStorageSaveSnapshot(t *testing.T) {
+	backendTest.SaveSnapshotTest(t)
+}
+
+func TestStorageStoreChunk(t *testing.T) {
+	backendTest.StoreChunkTest(t)
+}
+
+func TestStorageDeleteChunk(t *testing.T) {
+	backendTest.DeleteChunkTest(t)
+}
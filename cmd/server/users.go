@@ -0,0 +1,149 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Error declarations
+var (
+	ErrInvalidUsersFile = errors.New("Invalid users file")
+	ErrInvalidUsername  = errors.New("Invalid username, only letters, digits, '.', '_' and '-' are allowed")
+)
+
+// usernameRe matches the names which are safe to use as a directory name.
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// dummyHash gets compared for unknown users, so they can't be told apart from
+// wrong passwords by timing.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("knoxite"), bcrypt.DefaultCost)
+
+// Users holds the bcrypt hashed passwords of all users allowed to access the
+// server.
+type Users struct {
+	hashes map[string][]byte
+
+	// successful logins, so not every request with the right password has
+	// to pay for bcrypt
+	mu       sync.Mutex
+	verified map[string]verifiedPassword
+}
+
+// verifiedPassword is the checksum of a password which matched hash.
+type verifiedPassword struct {
+	hash []byte
+	sum  [sha256.Size]byte
+}
+
+// LoadUsers reads a users file. Every line contains a username and a bcrypt
+// hash, separated by a colon, as written by htpasswd -B. Empty lines and
+// lines starting with # are ignored.
+func LoadUsers(path string) (*Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := NewUsers()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: %v in line %d", path, ErrInvalidUsersFile, n)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s: %v in line %d: %v", path, ErrInvalidUsersFile, n, err)
+		}
+		if err := users.Add(fields[0], []byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%s: %v in line %d", path, err, n)
+		}
+	}
+
+	return users, scanner.Err()
+}
+
+// NewUsers returns an empty set of users.
+func NewUsers() *Users {
+	return &Users{
+		hashes:   make(map[string][]byte),
+		verified: make(map[string]verifiedPassword),
+	}
+}
+
+// Add adds a user with a bcrypt hashed password.
+func (u *Users) Add(name string, hash []byte) error {
+	if !usernameRe.MatchString(name) {
+		return ErrInvalidUsername
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hashes[name] = hash
+	delete(u.verified, name)
+	return nil
+}
+
+// Authenticate returns true if the password is valid for the user. Only a
+// password matching the user's last successful login skips bcrypt, every
+// other password gets checked against the hash.
+func (u *Users) Authenticate(name, password string) bool {
+	sum := sha256.Sum256([]byte(password))
+
+	u.mu.Lock()
+	hash, ok := u.hashes[name]
+	verified, cached := u.verified[name]
+	u.mu.Unlock()
+
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	if cached && bytes.Equal(verified.hash, hash) &&
+		subtle.ConstantTimeCompare(sum[:], verified.sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	u.mu.Lock()
+	u.verified[name] = verifiedPassword{hash: hash, sum: sum}
+	u.mu.Unlock()
+	return true
+}
+
+// HashPassword returns a users file entry for name and password.
+func HashPassword(name, password string) (string, error) {
+	if !usernameRe.MatchString(name) {
+		return "", ErrInvalidUsername
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return name + ":" + string(hash), nil
+}
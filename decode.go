@@ -120,7 +120,9 @@ func decodeChunk(repository Repository, archive Archive, chunk Chunk, b []byte)
 	return b, nil
 }
 
-func loadChunk(repository Repository, archive Archive, chunk Chunk) ([]byte, error) {
+// loadRawChunk loads the still encrypted data of a chunk from backend,
+// reconstructing it from its parity parts if necessary.
+func loadRawChunk(backend *BackendManager, chunk Chunk) ([]byte, error) {
 	if chunk.ParityParts > 0 {
 		enc, err := reedsolomon.New(int(chunk.DataParts), int(chunk.ParityParts))
 		if err != nil {
@@ -133,7 +135,7 @@ func loadChunk(repository Repository, archive Archive, chunk Chunk) ([]byte, err
 		// try to load all parts until we can successfully combine/reconstruct the chunk
 		for i := 0; i < int(chunk.DataParts+chunk.ParityParts); i++ {
 			var cerr error
-			pars[i], cerr = repository.backend.LoadChunk(chunk, uint(i))
+			pars[i], cerr = backend.LoadChunk(chunk, uint(i))
 			if cerr != nil {
 				pars[i] = nil
 				parsMissing++
@@ -159,14 +161,18 @@ func loadChunk(repository Repository, archive Archive, chunk Chunk) ([]byte, err
 					continue
 				}
 				_ = w.Flush()
-				return decodeChunk(repository, archive, chunk, b.Bytes())
+				return b.Bytes(), nil
 			}
 		}
 
 		return []byte{}, &DataReconstructionError{chunk, parsFound, chunk.DataParts - parsFound}
 	}
 
-	b, err := repository.backend.LoadChunk(chunk, 0)
+	return backend.LoadChunk(chunk, 0)
+}
+
+func loadChunk(repository Repository, archive Archive, chunk Chunk) ([]byte, error) {
+	b, err := loadRawChunk(&repository.backend, chunk)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -293,6 +299,7 @@ func DecodeArchiveData(repository Repository, arc Archive) ([]byte, Stats, error
 			} else {
 				cd, err = loadChunk(repository, arc, chunk)
 				if err != nil {
+					mutex.Unlock()
 					return b, stats, err
 				}
 				cache[chunk.Hash] = cd
@@ -326,6 +333,7 @@ func readArchiveChunk(repository Repository, arc Archive, chunkNum uint) (*[]byt
 	if !ok {
 		cd, err = loadChunk(repository, arc, chunk)
 		if err != nil {
+			mutex.Unlock()
 			return &b, err
 		}
 		cache[chunk.Hash] = cd
@@ -0,0 +1,58 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDecodeMissingChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, "this_is_a_password")
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	arc := Archive{
+		Path: "missing",
+		Type: File,
+		Size: 1,
+		Chunks: []Chunk{
+			{Hash: "0123456789abcdef", DataParts: 1, OriginalSize: 1},
+		},
+	}
+
+	// a failed load must not leave the chunk cache locked
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2; i++ {
+			if _, _, err := DecodeArchiveData(r, arc); err == nil {
+				t.Errorf("Expected decoding a missing chunk to fail")
+			}
+			if _, err := readArchiveChunk(r, arc, 0); err == nil {
+				t.Errorf("Expected reading a missing chunk to fail")
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Decoding got stuck after a missing chunk")
+	}
+}
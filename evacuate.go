@@ -0,0 +1,277 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Error declarations
+var (
+	ErrBackendNotFound = errors.New("Storage backend is not part of the repository")
+	ErrLastBackend     = errors.New("Can't remove the only storage backend of a repository")
+)
+
+// RemoveRepoBackend moves all chunk parts stored on the backend at location to
+// the remaining backends, reconstructing them from their parity parts if the
+// backend isn't accessible anymore. The backend only gets removed from the
+// repository once all chunks have been migrated and verified. Its data doesn't
+// get deleted, the parts left behind are reported by a final progress with
+// the RebalanceLeftover action.
+func RemoveRepoBackend(repository *Repository, index *ChunkIndex, location string) (chan RebalanceProgress, error) {
+	if repository.backend.AppendOnly() {
+		return nil, ErrAppendOnly
+	}
+	be := repository.backend.Backend(location)
+	if be == nil {
+		return nil, ErrBackendNotFound
+	}
+	if len(repository.backend.Backends) == 1 {
+		return nil, ErrLastBackend
+	}
+
+	return evacuateBackend(repository, index, be, nil), nil
+}
+
+// ReplaceRepoBackend moves all chunk parts stored on the backend at location
+// to replacement, which gets added to the repository if necessary. Like
+// RemoveRepoBackend, the old backend only gets removed from the repository
+// once all chunks have been migrated and verified.
+func ReplaceRepoBackend(repository *Repository, index *ChunkIndex, location string, replacement *Backend) (chan RebalanceProgress, error) {
+	if repository.backend.AppendOnly() {
+		return nil, ErrAppendOnly
+	}
+	be := repository.backend.Backend(location)
+	if be == nil {
+		return nil, ErrBackendNotFound
+	}
+	if target := repository.backend.Backend((*replacement).Location()); target != nil {
+		replacement = target
+	} else {
+		repository.backend.AddBackend(replacement)
+	}
+	if replacement == be {
+		return nil, errors.New("Can't replace a storage backend with itself")
+	}
+
+	return evacuateBackend(repository, index, be, replacement), nil
+}
+
+// evacuateBackend migrates all chunk parts from be to target, or to the most
+// preferred remaining backends if target is nil.
+func evacuateBackend(repository *Repository, index *ChunkIndex, be, target *Backend) chan RebalanceProgress {
+	// migrated parts only get written to the remaining backends. Metadata
+	// still gets written to be as well, until all chunks have been migrated
+	remaining := repository.backend
+	remaining.RemoveBackend(be)
+
+	hashes := []string{}
+	for hash := range index.Chunks {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	prog := make(chan RebalanceProgress)
+	go func() {
+		defer close(prog)
+
+		failed := 0
+		changed := 0
+		left := RebalanceProgress{Action: RebalanceLeftover, Done: len(hashes), Total: len(hashes)}
+		for i, hash := range hashes {
+			p, parts, err := evacuateChunk(&repository.backend, &remaining, index.Chunks[hash], be, target)
+			left.Parts += parts
+			left.Size += uint64(parts) * index.Chunks[hash].PartSize()
+			if err != nil {
+				failed++
+				prog <- RebalanceProgress{Hash: hash, Done: i + 1, Total: len(hashes), Error: err}
+				continue
+			}
+			if p == nil {
+				continue
+			}
+
+			p.Done = i + 1
+			p.Total = len(hashes)
+			prog <- *p
+
+			changed++
+			if changed%rebalanceSaveInterval == 0 {
+				if err := saveEvacuationIndex(repository, &remaining, index, be); err != nil {
+					prog <- RebalanceProgress{Error: err}
+					return
+				}
+			}
+		}
+
+		if err := saveEvacuationIndex(repository, &remaining, index, be); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+		if failed > 0 {
+			prog <- RebalanceProgress{Error: fmt.Errorf("%d chunks could not be migrated, %s has not been removed", failed, (*be).Location())}
+			return
+		}
+		repository.backend.RemoveBackend(be)
+
+		// a replacement needs a copy of all snapshots
+		if err := updateSnapshotChunks(repository, index, target != nil); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+		if err := repository.Save(); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+		if _, err := index.DeleteStaleParts(repository); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+		if err := index.Save(repository); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+		if left.Parts > 0 {
+			prog <- left
+		}
+	}()
+
+	return prog
+}
+
+// saveEvacuationIndex writes the chunk-index to the remaining backends and to
+// be, which stays part of the repository until all chunks have been
+// migrated. be may well be inaccessible, that's why it gets evacuated, so
+// failing to write to it only marks it as degraded.
+func saveEvacuationIndex(repository *Repository, remaining *BackendManager, index *ChunkIndex, be *Backend) error {
+	data, err := index.encode(repository)
+	if err != nil {
+		return err
+	}
+	if err := remaining.SaveChunkIndex(data); err != nil {
+		return err
+	}
+
+	err = repository.backend.write(be, func(b Backend) error {
+		return b.SaveChunkIndex(data)
+	}, true)
+	if err != nil {
+		repository.backend.markDegraded(be)
+	}
+	return nil
+}
+
+// evacuateChunk migrates the parts of a chunk stored on be. Parts which
+// can't be found anywhere get rebuilt from the other parts. Chunks are read
+// via full and verified via remaining, which doesn't contain be. It returns
+// nil if no part of the chunk has to be migrated, as well as the amount of
+// parts stored on be.
+func evacuateChunk(full, remaining *BackendManager, item *ChunkIndexItem, be, target *Backend) (*RebalanceProgress, uint, error) {
+	holders := locateChunkParts(full, item)
+
+	locations := make([]string, len(holders))
+	affected := []int{}
+	left := uint(0)
+	for i, bes := range holders {
+		if containsBackend(bes, be) {
+			left++
+		}
+		for _, b := range bes {
+			if b != be {
+				locations[i] = (*b).Location()
+				break
+			}
+		}
+		if locations[i] == "" {
+			affected = append(affected, i)
+		}
+	}
+	if len(affected) == 0 {
+		if !equalLocations(item.Locations, locations) {
+			item.Locations = locations
+		}
+		return nil, left, nil
+	}
+
+	b, err := loadVerifiedChunk(full, item.Chunk())
+	if err != nil {
+		return nil, left, err
+	}
+	shards := [][]byte{b}
+	if item.ParityParts > 0 {
+		if shards, err = redundantData(b, int(item.DataParts), int(item.ParityParts)); err != nil {
+			return nil, left, err
+		}
+	}
+
+	p := &RebalanceProgress{
+		Hash:   item.Hash,
+		Action: RebalanceMove,
+	}
+	for _, i := range affected {
+		dst := target
+		if dst == nil || !containsBackend(holders[i], be) {
+			dst = evacuationTarget(remaining, item.Hash, locations, i)
+		}
+
+		part := uint(i)
+		data := shards[i]
+		err = remaining.write(dst, func(b Backend) error {
+			_, serr := b.StoreChunk(item.Hash, part, item.DataParts, data)
+			return serr
+		}, false)
+		if err != nil {
+			return nil, left, err
+		}
+
+		locations[i] = (*dst).Location()
+		p.Parts++
+		p.Size += uint64(len(data))
+	}
+
+	// make sure the chunk can be restored without be
+	chunk := item.Chunk()
+	chunk.Locations = locations
+	if _, err = loadVerifiedChunk(remaining, chunk); err != nil {
+		return nil, left, err
+	}
+
+	item.Locations = locations
+	return p, left, nil
+}
+
+// evacuationTarget returns the most preferred backend for a part, which
+// doesn't share a failure domain with the backends of the other parts. If
+// there is no such backend, the part has to share one.
+func evacuationTarget(backend *BackendManager, shasum string, locations []string, part int) *Backend {
+	others := []*Backend{}
+	for i, location := range locations {
+		if i == part {
+			continue
+		}
+		if b := backend.Backend(location); b != nil {
+			others = append(others, b)
+		}
+	}
+
+	ranked := backend.rank(shasum)
+	for _, b := range ranked {
+		if !backend.conflicts(b, others) {
+			return b
+		}
+	}
+	for _, b := range ranked {
+		if !containsBackend(others, b) {
+			return b
+		}
+	}
+
+	return ranked[0]
+}
@@ -0,0 +1,270 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveReplaceRepoBackend(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dirs, cleanup := newTestRepositoryDirs(t, 4)
+	defer cleanup()
+	snapshotID := storeTestSnapshot(t, dirs[:3], testPassword)
+
+	r, err := OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+	progress, err := RebalanceRepo(&r, &index, 1, false)
+	if err != nil {
+		t.Fatalf("Failed rebalancing repository: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Fatalf("Failed rebalancing chunk: %s", p.Error)
+		}
+	}
+
+	if _, err = RemoveRepoBackend(&r, &index, "/invalid"); err != ErrBackendNotFound {
+		t.Errorf("Expected %v, got %v", ErrBackendNotFound, err)
+	}
+
+	// the removed backend lost all its chunks, so they need to be
+	// reconstructed from the remaining backends
+	removed := (*r.BackendManager().Backends[1]).Location()
+	if err = os.RemoveAll(filepath.Join(dirs[1], "chunks")); err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err = RemoveRepoBackend(&r, &index, removed)
+	if err != nil {
+		t.Fatalf("Failed removing backend: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed migrating chunk: %s", p.Error)
+		}
+	}
+
+	replaced := (*r.BackendManager().Backends[1]).Location()
+	for _, location := range r.Paths {
+		if location == removed {
+			t.Errorf("Expected %s to be removed from repository", removed)
+		}
+	}
+	verifyTestSnapshot(t, dirs[0], testPassword, snapshotID)
+
+	be, err := BackendFromURL(dirs[3])
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+	if err = be.InitRepository(); err != nil {
+		t.Fatalf("Failed initializing backend: %s", err)
+	}
+	progress, err = ReplaceRepoBackend(&r, &index, replaced, &be)
+	if err != nil {
+		t.Fatalf("Failed replacing backend: %s", err)
+	}
+	left := RebalanceProgress{}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed migrating chunk: %s", p.Error)
+		}
+		if p.Action == RebalanceLeftover {
+			left = p
+		}
+	}
+	// the parts on the replaced backend don't get deleted, but reported
+	if left.Parts == 0 || left.Size == 0 {
+		t.Errorf("Expected the parts left on %s to be reported", replaced)
+	}
+
+	for _, item := range index.Chunks {
+		for _, location := range item.Locations {
+			if location == removed || location == replaced {
+				t.Errorf("Expected no part of chunk %s to remain on %s", item.Hash, location)
+			}
+		}
+	}
+
+	// the replacement needs to carry all metadata
+	verifyTestSnapshot(t, dirs[3], testPassword, snapshotID)
+
+	if len(r.BackendManager().Backends) != 2 {
+		t.Fatalf("Expected 2 backends, got %d", len(r.BackendManager().Backends))
+	}
+	progress, err = RemoveRepoBackend(&r, &index, (*r.BackendManager().Backends[0]).Location())
+	if err != nil {
+		t.Fatalf("Failed removing backend: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed migrating chunk: %s", p.Error)
+		}
+	}
+	verifyTestSnapshot(t, dirs[3], testPassword, snapshotID)
+
+	_, err = RemoveRepoBackend(&r, &index, (*r.BackendManager().Backends[0]).Location())
+	if err != ErrLastBackend {
+		t.Errorf("Expected %v, got %v", ErrLastBackend, err)
+	}
+}
+
+func TestEvacuateAppendOnly(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 2)
+	defer cleanup()
+
+	var be Backend = &appendOnlyBackend{Backend: *bm.Backends[0]}
+	r := Repository{}
+	r.backend.AddBackend(&be)
+	r.backend.AddBackend(bm.Backends[1])
+	index := ChunkIndex{Chunks: make(map[string]*ChunkIndexItem)}
+
+	if _, err := RemoveRepoBackend(&r, &index, be.Location()); err != ErrAppendOnly {
+		t.Errorf("Expected %v, got %v", ErrAppendOnly, err)
+	}
+	if _, err := ReplaceRepoBackend(&r, &index, be.Location(), bm.Backends[1]); err != ErrAppendOnly {
+		t.Errorf("Expected %v, got %v", ErrAppendOnly, err)
+	}
+}
+
+func TestEvacuateMissingParts(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dirs, cleanup := newTestRepositoryDirs(t, 4)
+	defer cleanup()
+	snapshotID := storeTestSnapshot(t, dirs, testPassword)
+
+	r, err := OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+	progress, err := RebalanceRepo(&r, &index, 1, false)
+	if err != nil {
+		t.Fatalf("Failed rebalancing repository: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Fatalf("Failed rebalancing chunk: %s", p.Error)
+		}
+	}
+
+	// lose a part on another backend, and with it its location
+	removed := r.BackendManager().Backends[1]
+	var lost *ChunkIndexItem
+	part := 0
+	for _, item := range index.Chunks {
+		for i, location := range item.Locations {
+			if location != (*removed).Location() {
+				lost, part = item, i
+				break
+			}
+		}
+		if lost != nil {
+			break
+		}
+	}
+	if lost == nil {
+		t.Fatal("Expected a chunk with a part on another backend")
+	}
+	holder := r.BackendManager().Backend(lost.Locations[part])
+	if err = (*holder).DeleteChunk(lost.Hash, uint(part), lost.DataParts); err != nil {
+		t.Fatal(err)
+	}
+	lost.Locations[part] = ""
+
+	progress, err = RemoveRepoBackend(&r, &index, (*removed).Location())
+	if err != nil {
+		t.Fatalf("Failed removing backend: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed migrating chunk: %s", p.Error)
+		}
+	}
+
+	// the lost part got rebuilt from the other parts
+	location := lost.Locations[part]
+	be := r.BackendManager().Backend(location)
+	if be == nil {
+		t.Fatalf("Expected the lost part to be stored again, got location %q", location)
+	}
+	if _, err = (*be).LoadChunk(lost.Hash, uint(part), lost.DataParts); err != nil {
+		t.Errorf("Expected the lost part to be stored on %s, got %s", location, err)
+	}
+	verifyTestSnapshot(t, dirs[0], testPassword, snapshotID)
+}
+
+func TestEvacuateFailure(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dirs, cleanup := newTestRepositoryDirs(t, 2)
+	defer cleanup()
+	storeTestSnapshot(t, dirs, testPassword)
+
+	r, err := OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+
+	// a chunk which can't be restored can't be migrated either
+	for _, item := range index.Chunks {
+		if err = (*r.BackendManager().Backends[0]).DeleteChunk(item.Hash, 0, item.DataParts); err != nil {
+			t.Fatal(err)
+		}
+		item.Locations = nil
+		break
+	}
+
+	removed := (*r.BackendManager().Backends[1]).Location()
+	progress, err := RemoveRepoBackend(&r, &index, removed)
+	if err != nil {
+		t.Fatalf("Failed removing backend: %s", err)
+	}
+	failed := false
+	for p := range progress {
+		failed = failed || p.Error != nil
+	}
+	if !failed {
+		t.Error("Expected the evacuation to fail")
+	}
+
+	// the backend stays part of the repository, with an up to date index
+	if r.BackendManager().Backend(removed) == nil {
+		t.Errorf("Expected %s to remain part of the repository", removed)
+	}
+	indexes := [][]byte{}
+	for _, dir := range dirs {
+		b, err := ioutil.ReadFile(filepath.Join(dir, chunksDirname, ChunkIndexFilename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, b)
+	}
+	if !bytes.Equal(indexes[0], indexes[1]) {
+		t.Error("Expected the chunk-index to be saved to all backends")
+	}
+}
@@ -0,0 +1,453 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric names
+const (
+	MetricBackendDuration   = "knoxite_backend_operation_duration_seconds"
+	MetricBackendOperations = "knoxite_backend_operations_total"
+	MetricBackendBytes      = "knoxite_backend_bytes_total"
+	MetricBackendRetries    = "knoxite_backend_retries_total"
+	MetricBackendReuploads  = "knoxite_backend_reuploads_total"
+	MetricPipelineDuration  = "knoxite_pipeline_duration_seconds"
+	MetricPipelineBytes     = "knoxite_pipeline_bytes_total"
+)
+
+// metricBuckets are the upper bounds of the histogram buckets in seconds.
+var metricBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var metricHelp = map[string]string{
+	MetricBackendDuration:   "Duration of storage backend operations.",
+	MetricBackendOperations: "Storage backend operations by result.",
+	MetricBackendBytes:      "Bytes transferred to and from storage backends.",
+	MetricBackendRetries:    "Retried storage backend operations.",
+	MetricBackendReuploads:  "Chunk parts uploaded again after failing verification.",
+	MetricPipelineDuration:  "Duration of pipeline processors.",
+	MetricPipelineBytes:     "Bytes passed through pipeline processors.",
+}
+
+// activeMetrics holds the Metrics all operations get recorded in.
+var activeMetrics atomic.Value
+
+// SetMetrics enables recording of metrics in m. Passing nil disables it.
+func SetMetrics(m *Metrics) {
+	activeMetrics.Store(m)
+}
+
+// currentMetrics returns the enabled Metrics, or nil.
+func currentMetrics() *Metrics {
+	m, _ := activeMetrics.Load().(*Metrics)
+	return m
+}
+
+// Metrics is a registry of counters and histograms. All its methods are safe
+// to call on a nil Metrics, which simply records nothing.
+type Metrics struct {
+	sync.Mutex
+	counters   map[string]map[string]*counter
+	histograms map[string]map[string]*histogram
+}
+
+type counter struct {
+	labels []string // pairs of label names and values
+	value  float64
+}
+
+type histogram struct {
+	labels  []string // pairs of label names and values
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// HistogramSummary is a snapshot of a single histogram.
+type HistogramSummary struct {
+	Labels map[string]string
+	Count  uint64
+	Sum    float64
+}
+
+// NewMetrics returns a new, empty Metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:   make(map[string]map[string]*counter),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// Add adds v to a counter. labels are pairs of label names and values.
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	key := renderLabels(labels)
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]*counter)
+	}
+	c, ok := m.counters[name][key]
+	if !ok {
+		c = &counter{labels: labels}
+		m.counters[name][key] = c
+	}
+	c.value += v
+}
+
+// Inc increments a counter by one.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Observe records a duration in a histogram.
+func (m *Metrics) Observe(name string, d time.Duration, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	key := renderLabels(labels)
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	h, ok := m.histograms[name][key]
+	if !ok {
+		h = &histogram{labels: labels, buckets: make([]uint64, len(metricBuckets))}
+		m.histograms[name][key] = h
+	}
+
+	s := d.Seconds()
+	for i, le := range metricBuckets {
+		if s <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += s
+}
+
+// Counter returns the value of a counter.
+func (m *Metrics) Counter(name string, labels ...string) float64 {
+	if m == nil {
+		return 0
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	if c, ok := m.counters[name][renderLabels(labels)]; ok {
+		return c.value
+	}
+	return 0
+}
+
+// Histograms returns a snapshot of all histograms named name, ordered by
+// their labels.
+func (m *Metrics) Histograms(name string) []HistogramSummary {
+	if m == nil {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	keys := sortedKeys(m.histograms[name])
+	hs := []HistogramSummary{}
+	for _, key := range keys {
+		h := m.histograms[name][key]
+		labels := make(map[string]string)
+		for i := 0; i+1 < len(h.labels); i += 2 {
+			labels[h.labels[i]] = h.labels[i+1]
+		}
+		hs = append(hs, HistogramSummary{labels, h.count, h.sum})
+	}
+	return hs
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	var buf bytes.Buffer
+	for _, name := range sortedKeys(m.counters) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s counter\n", name, metricHelp[name], name)
+		for _, key := range sortedKeys(m.counters[name]) {
+			fmt.Fprintf(&buf, "%s%s %s\n", name, braced(key), formatFloat(m.counters[name][key].value))
+		}
+	}
+	for _, name := range sortedKeys(m.histograms) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s histogram\n", name, metricHelp[name], name)
+		for _, key := range sortedKeys(m.histograms[name]) {
+			h := m.histograms[name][key]
+			for i, le := range metricBuckets {
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, braced(joinLabels(key, "le=\""+formatFloat(le)+"\"")), h.buckets[i])
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, braced(joinLabels(key, "le=\"+Inf\"")), h.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", name, braced(key), formatFloat(h.sum))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, braced(key), h.count)
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ServeHTTP serves all metrics to Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = m.WritePrometheus(w)
+}
+
+// WriteTextfile atomically writes all metrics to path, e.g. for the textfile
+// collector of the Prometheus node exporter.
+func (m *Metrics) WriteTextfile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = m.WritePrometheus(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// renderLabels renders pairs of label names and values.
+func renderLabels(labels []string) string {
+	s := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s = append(s, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return strings.Join(s, ",")
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]map[string]*counter:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*counter:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// processorName returns the name a pipeline processor gets recorded as.
+func processorName(proc PipelineProcessor) string {
+	switch proc.(type) {
+	case Compressor:
+		return "compress"
+	case Decompressor:
+		return "decompress"
+	case Encryptor:
+		return "encrypt"
+	case Decryptor:
+		return "decrypt"
+	}
+	return strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", proc), "knoxite."))
+}
+
+// InstrumentedBackend wraps a Backend and records the duration, result and
+// transferred bytes of its operations.
+type InstrumentedBackend struct {
+	Backend
+	metrics *Metrics
+}
+
+// NewInstrumentedBackend returns a Backend recording its operations in metrics.
+func NewInstrumentedBackend(be Backend, metrics *Metrics) *InstrumentedBackend {
+	return &InstrumentedBackend{
+		Backend: be,
+		metrics: metrics,
+	}
+}
+
+// record records an operation started at start.
+func (backend *InstrumentedBackend) record(op string, start time.Time, err error, n int) {
+	location := backend.Location()
+	backend.metrics.Observe(MetricBackendDuration, time.Since(start), "backend", location, "operation", op)
+
+	result := "success"
+	if err != nil {
+		result = "error"
+		if isNotFound(err) {
+			result = "not_found"
+		}
+	}
+	backend.metrics.Inc(MetricBackendOperations, "backend", location, "operation", op, "result", result)
+
+	if err == nil && n > 0 {
+		backend.metrics.Add(MetricBackendBytes, float64(n), "backend", location, "operation", op)
+	}
+}
+
+// LoadChunk loads a Chunk.
+func (backend *InstrumentedBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	start := time.Now()
+	b, err := backend.Backend.LoadChunk(shasum, part, totalParts)
+	backend.record("load_chunk", start, err, len(b))
+	return b, err
+}
+
+// StoreChunk stores a single Chunk.
+func (backend *InstrumentedBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	start := time.Now()
+	n, err := backend.Backend.StoreChunk(shasum, part, totalParts, data)
+	backend.record("store_chunk", start, err, int(n))
+	return n, err
+}
+
+// DeleteChunk deletes a single Chunk.
+func (backend *InstrumentedBackend) DeleteChunk(shasum string, part, totalParts uint) error {
+	start := time.Now()
+	err := backend.Backend.DeleteChunk(shasum, part, totalParts)
+	backend.record("delete_chunk", start, err, 0)
+	return err
+}
+
+// LoadSnapshot loads a snapshot.
+func (backend *InstrumentedBackend) LoadSnapshot(id string) ([]byte, error) {
+	start := time.Now()
+	b, err := backend.Backend.LoadSnapshot(id)
+	backend.record("load_snapshot", start, err, len(b))
+	return b, err
+}
+
+// VerifyChunk verifies a stored Chunk.
+func (backend *InstrumentedBackend) VerifyChunk(shasum string, part, totalParts uint, data []byte) error {
+	if v, ok := backend.Backend.(ChunkVerifier); ok {
+		start := time.Now()
+		err := v.VerifyChunk(shasum, part, totalParts, data)
+		if err != ErrChecksumUnavailable {
+			backend.record("verify_chunk", start, err, 0)
+			return err
+		}
+	}
+
+	return readBackChunk(backend, shasum, part, totalParts, data)
+}
+
+// AppendOnly returns true if the backend refuses to remove data.
+func (backend *InstrumentedBackend) AppendOnly() bool {
+	return IsAppendOnly(backend.Backend)
+}
+
+// HasChunks reports which chunk parts are stored on the backend.
+func (backend *InstrumentedBackend) HasChunks(parts []ChunkPart) ([]bool, error) {
+	if _, ok := backend.Backend.(ChunkQuerier); !ok {
+		return make([]bool, len(parts)), nil
+	}
+
+	start := time.Now()
+	found, err := QueryChunks(backend.Backend, parts)
+	backend.record("has_chunks", start, err, 0)
+	return found, err
+}
+
+// SaveSnapshot stores a snapshot.
+func (backend *InstrumentedBackend) SaveSnapshot(id string, data []byte) error {
+	start := time.Now()
+	err := backend.Backend.SaveSnapshot(id, data)
+	backend.record("save_snapshot", start, err, len(data))
+	return err
+}
+
+// LoadChunkIndex reads the chunk-index.
+func (backend *InstrumentedBackend) LoadChunkIndex() ([]byte, error) {
+	start := time.Now()
+	b, err := backend.Backend.LoadChunkIndex()
+	backend.record("load_chunk_index", start, err, len(b))
+	return b, err
+}
+
+// SaveChunkIndex stores the chunk-index.
+func (backend *InstrumentedBackend) SaveChunkIndex(data []byte) error {
+	start := time.Now()
+	err := backend.Backend.SaveChunkIndex(data)
+	backend.record("save_chunk_index", start, err, len(data))
+	return err
+}
+
+// LoadRepository reads the metadata for a repository.
+func (backend *InstrumentedBackend) LoadRepository() ([]byte, error) {
+	start := time.Now()
+	b, err := backend.Backend.LoadRepository()
+	backend.record("load_repository", start, err, len(b))
+	return b, err
+}
+
+// SaveRepository stores the metadata for a repository.
+func (backend *InstrumentedBackend) SaveRepository(data []byte) error {
+	start := time.Now()
+	err := backend.Backend.SaveRepository(data)
+	backend.record("save_repository", start, err, len(data))
+	return err
+}
@@ -0,0 +1,127 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstrumentedBackend(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 1)
+	defer cleanup()
+
+	m := NewMetrics()
+	bm.Wrap(func(be Backend) Backend {
+		return NewInstrumentedBackend(be, m)
+	})
+	be := *bm.Backends[0]
+	location := be.Location()
+
+	data := []byte("this is an encrypted chunk")
+	shasum := Hash(data, HashHighway256)
+	if _, err := be.StoreChunk(shasum, 0, 1, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := be.LoadChunk(shasum, 0, 1); err != nil {
+			t.Fatalf("Failed loading chunk: %s", err)
+		}
+	}
+	if _, err := be.LoadChunk("0000", 0, 1); err == nil {
+		t.Fatal("Expected loading a missing chunk to fail")
+	}
+
+	if v := m.Counter(MetricBackendOperations, "backend", location, "operation", "load_chunk", "result", "success"); v != 2 {
+		t.Errorf("Expected 2 successful loads, got %v", v)
+	}
+	if v := m.Counter(MetricBackendOperations, "backend", location, "operation", "load_chunk", "result", "not_found"); v != 1 {
+		t.Errorf("Expected 1 failed load, got %v", v)
+	}
+	if v := m.Counter(MetricBackendBytes, "backend", location, "operation", "load_chunk"); v != float64(2*len(data)) {
+		t.Errorf("Expected %d loaded bytes, got %v", 2*len(data), v)
+	}
+	if v := m.Counter(MetricBackendBytes, "backend", location, "operation", "store_chunk"); v != float64(len(data)) {
+		t.Errorf("Expected %d stored bytes, got %v", len(data), v)
+	}
+
+	hs := m.Histograms(MetricBackendDuration)
+	if len(hs) != 2 {
+		t.Fatalf("Expected 2 histograms, got %d", len(hs))
+	}
+	if hs[0].Labels["operation"] != "load_chunk" || hs[0].Count != 3 {
+		t.Errorf("Expected 3 load_chunk operations, got %d %s operations", hs[0].Count, hs[0].Labels["operation"])
+	}
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	m := NewMetrics()
+	SetMetrics(m)
+	defer SetMetrics(nil)
+
+	pipe, err := NewEncodingPipeline(CompressionGZip, EncryptionAES, "this_is_a_password")
+	if err != nil {
+		t.Fatalf("Failed creating pipeline: %s", err)
+	}
+	data := bytes.Repeat([]byte("knoxite"), 1000)
+	if _, err = pipe.Process(data); err != nil {
+		t.Fatalf("Failed processing data: %s", err)
+	}
+
+	if v := m.Counter(MetricPipelineBytes, "processor", "compress", "direction", "in"); v != float64(len(data)) {
+		t.Errorf("Expected %d bytes passed to compressor, got %v", len(data), v)
+	}
+	compressed := m.Counter(MetricPipelineBytes, "processor", "compress", "direction", "out")
+	if compressed == 0 || compressed >= float64(len(data)) {
+		t.Errorf("Expected compressed data to be smaller than %d bytes, got %v", len(data), compressed)
+	}
+	if v := m.Counter(MetricPipelineBytes, "processor", "encrypt", "direction", "in"); v != compressed {
+		t.Errorf("Expected %v bytes passed to encryptor, got %v", compressed, v)
+	}
+}
+
+func TestMetricsTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite.metrics")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewMetrics()
+	m.Inc(MetricBackendRetries, "backend", `dir:///tmp/"repo"`)
+	m.Observe(MetricPipelineDuration, 20*time.Millisecond, "processor", "encrypt")
+
+	path := filepath.Join(dir, "knoxite.prom")
+	if err = m.WriteTextfile(path); err != nil {
+		t.Fatalf("Failed writing metrics: %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed reading metrics: %s", err)
+	}
+
+	for _, line := range []string{
+		"# TYPE knoxite_backend_retries_total counter",
+		`knoxite_backend_retries_total{backend="dir:///tmp/\"repo\""} 1`,
+		"# TYPE knoxite_pipeline_duration_seconds histogram",
+		`knoxite_pipeline_duration_seconds_bucket{processor="encrypt",le="0.01"} 0`,
+		`knoxite_pipeline_duration_seconds_bucket{processor="encrypt",le="0.025"} 1`,
+		`knoxite_pipeline_duration_seconds_bucket{processor="encrypt",le="+Inf"} 1`,
+		`knoxite_pipeline_duration_seconds_sum{processor="encrypt"} 0.02`,
+		`knoxite_pipeline_duration_seconds_count{processor="encrypt"} 1`,
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, b)
+		}
+	}
+}
@@ -10,6 +10,7 @@ package knoxite
 import (
 	"bytes"
 	"encoding/gob"
+	"time"
 )
 
 // PipelineProcessor is a simple interface to process data.
@@ -59,11 +60,22 @@ func NewDecodingPipeline(compression, encryption uint16, password string) (Pipel
 // Process sends the data through all configured processors and returns the result.
 func (p *Pipeline) Process(data []byte) ([]byte, error) {
 	var err error
+	metrics := currentMetrics()
 	for _, proc := range p.Processors {
+		start := time.Now()
+		n := len(data)
+
 		data, err = proc.Process(data)
 		if err != nil {
 			break
 		}
+
+		if metrics != nil {
+			name := processorName(proc)
+			metrics.Observe(MetricPipelineDuration, time.Since(start), "processor", name)
+			metrics.Add(MetricPipelineBytes, float64(n), "processor", name, "direction", "in")
+			metrics.Add(MetricPipelineBytes, float64(len(data)), "processor", name, "direction", "out")
+		}
 	}
 
 	return data, err
@@ -0,0 +1,275 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// Error declarations
+var (
+	ErrPlacementFailed = errors.New("Not enough independent storage backends to place all parts of a chunk")
+)
+
+// maxPlacementSteps bounds the search for backends in distinct failure
+// domains, which is exponential in the number of backends in the worst case.
+const maxPlacementSteps = 1000
+
+// placement describes on which backends the parts of a chunk get stored.
+type placement struct {
+	backends []*Backend // one backend per part
+	spares   []*Backend // remaining candidates, in order of preference
+	shared   bool       // parts share failure domains
+}
+
+// SetLabels sets the labels of a backend, e.g. its region or provider.
+// Backends sharing a label (the same key with the same value) are considered
+// to be in the same failure domain and never store parts of the same chunk,
+// unless SharedFailureDomains permits it.
+func (backend *BackendManager) SetLabels(be *Backend, labels map[string]string) {
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	if len(labels) == 0 {
+		delete(reg.labels, be)
+		return
+	}
+	reg.labels[be] = labels
+}
+
+// Labels returns the labels of a backend.
+func (backend *BackendManager) Labels(be *Backend) map[string]string {
+	reg := backend.registry()
+	reg.Lock()
+	defer reg.Unlock()
+
+	return reg.labels[be]
+}
+
+// sameFailureDomain returns true if two sets of labels share a label.
+func sameFailureDomain(a, b map[string]string) bool {
+	for k, v := range a {
+		if w, ok := b[k]; ok && v == w {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weights returns the placement weights of all backends, which are based on
+// their available space. Backends with unknown or unlimited space get the
+// weight of the largest known backend.
+func (backend *BackendManager) weights() map[*Backend]float64 {
+	reg := backend.registry()
+	reg.Lock()
+	missing := []*Backend{}
+	for _, be := range backend.Backends {
+		if _, ok := reg.weights[be]; !ok {
+			missing = append(missing, be)
+		}
+	}
+	reg.Unlock()
+
+	spaces := make(map[*Backend]float64)
+	for _, be := range missing {
+		space, err := (*be).AvailableSpace()
+		if err != nil {
+			spaces[be] = 0
+			continue
+		}
+		spaces[be] = float64(space)
+	}
+
+	reg.Lock()
+	defer reg.Unlock()
+
+	for be, space := range spaces {
+		reg.weights[be] = space
+	}
+
+	max := 0.0
+	for _, be := range backend.Backends {
+		max = math.Max(max, reg.weights[be])
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	weights := make(map[*Backend]float64)
+	for _, be := range backend.Backends {
+		w := reg.weights[be]
+		if w == 0 {
+			w = max
+		}
+		weights[be] = w
+	}
+
+	return weights
+}
+
+// rank orders all backends for a chunk using weighted rendezvous hashing, so
+// the same chunk always ends up on the same backends. Backends which are
+// currently unavailable are ranked last.
+func (backend *BackendManager) rank(shasum string) []*Backend {
+	weights := backend.weights()
+
+	scores := make(map[*Backend]float64)
+	for _, be := range backend.Backends {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(shasum))
+		_, _ = h.Write([]byte((*be).Location()))
+
+		// map the hash onto (0, 1)
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		scores[be] = -weights[be] / math.Log(u)
+	}
+
+	ranked := make([]*Backend, len(backend.Backends))
+	copy(ranked, backend.Backends)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ai, aj := backend.available(ranked[i]), backend.available(ranked[j])
+		if ai != aj {
+			return ai
+		}
+		return scores[ranked[i]] > scores[ranked[j]]
+	})
+
+	return ranked
+}
+
+// place picks a distinct backend for each of the parts of a chunk, making sure
+// no two parts end up in the same failure domain. If the labels don't leave
+// enough failure domains, placing the chunk fails with ErrPlacementFailed, or
+// with SharedFailureDomains set, the remaining parts get spread over the least
+// used domains instead. Only when there are fewer backends than parts, some
+// backends have to store more than one part.
+func (backend *BackendManager) place(shasum string, parts int) (*placement, error) {
+	ranked := backend.rank(shasum)
+
+	p := &placement{}
+	budget := maxPlacementSteps
+	chosen := backend.choose(ranked, []*Backend{}, parts, &budget)
+	if len(chosen) == 0 {
+		return p, ErrPlacementFailed
+	}
+
+	for _, be := range ranked {
+		if !backend.conflicts(be, chosen) {
+			p.spares = append(p.spares, be)
+		}
+	}
+
+	if len(chosen) < parts && len(chosen) < len(backend.Backends) {
+		if !backend.SharedFailureDomains {
+			return p, ErrPlacementFailed
+		}
+		chosen = backend.spread(ranked, chosen, parts)
+		p.shared = true
+	}
+
+	p.backends = chosen
+	for i := 0; len(p.backends) < parts; i++ {
+		p.backends = append(p.backends, p.backends[i])
+	}
+	return p, nil
+}
+
+// choose returns the most preferred set of up to parts backends, which don't
+// share a failure domain with each other. The search gives up after budget
+// steps and returns the best set found so far.
+func (backend *BackendManager) choose(candidates, chosen []*Backend, parts int, budget *int) []*Backend {
+	best := chosen
+	for i, be := range candidates {
+		if len(chosen) == parts || *budget <= 0 {
+			break
+		}
+		if backend.conflicts(be, chosen) {
+			continue
+		}
+
+		*budget--
+		c := backend.choose(candidates[i+1:], append(chosen[:len(chosen):len(chosen)], be), parts, budget)
+		if len(c) == parts {
+			return c
+		}
+		if len(c) > len(best) {
+			best = c
+		}
+	}
+
+	return best
+}
+
+// spread adds backends to chosen until there is one for every part, picking
+// the backends sharing the fewest failure domains with those already chosen.
+func (backend *BackendManager) spread(ranked, chosen []*Backend, parts int) []*Backend {
+	chosen = append([]*Backend{}, chosen...)
+	for len(chosen) < parts {
+		var next *Backend
+		least := 0
+		for _, be := range ranked {
+			if containsBackend(chosen, be) {
+				continue
+			}
+
+			shared := 0
+			for _, other := range chosen {
+				if sameFailureDomain(backend.Labels(be), backend.Labels(other)) {
+					shared++
+				}
+			}
+			if next == nil || shared < least {
+				next, least = be, shared
+			}
+		}
+		if next == nil {
+			break
+		}
+		chosen = append(chosen, next)
+	}
+
+	return chosen
+}
+
+// replace swaps the backend of a part for the most preferred spare backend
+// which doesn't conflict with the backends of the other parts.
+func (p *placement) replace(backend *BackendManager, part int) *Backend {
+	others := []*Backend{}
+	for i, be := range p.backends {
+		if i != part {
+			others = append(others, be)
+		}
+	}
+
+	for i, spare := range p.spares {
+		if !backend.conflicts(spare, others) {
+			p.spares = append(p.spares[:i], p.spares[i+1:]...)
+			p.backends[part] = spare
+			return spare
+		}
+	}
+
+	return nil
+}
+
+// conflicts returns true if be shares a failure domain with any of bes.
+func (backend *BackendManager) conflicts(be *Backend, bes []*Backend) bool {
+	labels := backend.Labels(be)
+	for _, other := range bes {
+		if other == be || sameFailureDomain(labels, backend.Labels(other)) {
+			return true
+		}
+	}
+
+	return false
+}
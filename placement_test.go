@@ -0,0 +1,167 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPlacementDistinctBackends(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 4)
+	defer cleanup()
+
+	for i := 0; i < 100; i++ {
+		shasum := Hash([]byte(strconv.Itoa(i)), HashHighway256)
+		p, err := bm.place(shasum, 4)
+		if err != nil {
+			t.Fatalf("Failed placing chunk: %s", err)
+		}
+
+		seen := make(map[*Backend]bool)
+		for _, be := range p.backends {
+			if seen[be] {
+				t.Fatalf("Chunk %s has more than one part on backend %s", shasum, (*be).Location())
+			}
+			seen[be] = true
+		}
+
+		// placement needs to be stable for the same chunk
+		q, _ := bm.place(shasum, 4)
+		for j := range p.backends {
+			if p.backends[j] != q.backends[j] {
+				t.Fatalf("Placement of chunk %s is not stable", shasum)
+			}
+		}
+	}
+}
+
+func TestPlacementFailureDomains(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 3)
+	defer cleanup()
+
+	bm.SetLabels(bm.Backends[0], map[string]string{"provider": "aws", "region": "eu"})
+	bm.SetLabels(bm.Backends[1], map[string]string{"provider": "aws", "region": "us"})
+	bm.SetLabels(bm.Backends[2], map[string]string{"provider": "gcloud", "region": "us"})
+
+	// there aren't enough failure domains for three parts
+	if _, err := bm.place("0123456789abcdef", 3); err != ErrPlacementFailed {
+		t.Errorf("Expected %v, got %v", ErrPlacementFailed, err)
+	}
+
+	// unless they may share one, but they still end up on distinct backends
+	bm.SharedFailureDomains = true
+	p, err := bm.place("0123456789abcdef", 3)
+	if err != nil {
+		t.Fatalf("Failed placing chunk: %s", err)
+	}
+	seen := make(map[*Backend]bool)
+	for _, be := range p.backends {
+		seen[be] = true
+	}
+	if len(seen) != 3 || !p.shared {
+		t.Errorf("Expected parts to be spread over all backends, got %d backends", len(seen))
+	}
+	bm.SharedFailureDomains = false
+
+	// backends 0 and 2 are the only two not sharing a provider or region
+	for i := 0; i < 100; i++ {
+		shasum := Hash([]byte(strconv.Itoa(i)), HashHighway256)
+		p, err := bm.place(shasum, 2)
+		if err != nil {
+			t.Fatalf("Failed placing chunk: %s", err)
+		}
+		if p.shared || p.backends[0] == bm.Backends[1] || p.backends[1] == bm.Backends[1] {
+			t.Fatalf("Expected chunk %s not to be stored in the same failure domain twice", shasum)
+		}
+	}
+}
+
+func TestStoreChunkSharedDomains(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 2)
+	defer cleanup()
+
+	for _, be := range bm.Backends {
+		bm.SetLabels(be, map[string]string{"provider": "aws"})
+	}
+
+	data := []byte("this is an encrypted chunk")
+	chunk := Chunk{
+		Data:        &[][]byte{data, data},
+		DataParts:   1,
+		ParityParts: 1,
+		Size:        len(data),
+		Hash:        Hash(data, HashHighway256),
+	}
+	if _, _, _, err := bm.storeQueriedChunk(&chunk, nil); err != ErrPlacementFailed {
+		t.Errorf("Expected %v, got %v", ErrPlacementFailed, err)
+	}
+
+	// the caller learns about parts sharing a failure domain
+	bm.SharedFailureDomains = true
+	if _, _, shared, err := bm.storeQueriedChunk(&chunk, nil); err != nil || !shared {
+		t.Errorf("Expected the chunk to be stored in a shared failure domain, got %v: %v", shared, err)
+	}
+}
+
+func TestPlacementBoundedSearch(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 24)
+	defer cleanup()
+
+	// pairs of backends share a failure domain, so no 13 of them are
+	// independent and an exhaustive search would never finish
+	for i, be := range bm.Backends {
+		bm.SetLabels(be, map[string]string{"rack": strconv.Itoa(i / 2)})
+	}
+
+	if _, err := bm.place("0123456789abcdef", 13); err != ErrPlacementFailed {
+		t.Errorf("Expected %v, got %v", ErrPlacementFailed, err)
+	}
+
+	bm.SharedFailureDomains = true
+	p, err := bm.place("0123456789abcdef", 13)
+	if err != nil {
+		t.Fatalf("Failed placing chunk: %s", err)
+	}
+	seen := make(map[*Backend]bool)
+	domains := make(map[string]int)
+	for _, be := range p.backends {
+		seen[be] = true
+		domains[bm.Labels(be)["rack"]]++
+	}
+	if len(seen) != 13 {
+		t.Errorf("Expected parts on 13 distinct backends, got %d", len(seen))
+	}
+	if len(domains) != 12 {
+		t.Errorf("Expected parts to be spread over all 12 failure domains, got %d", len(domains))
+	}
+}
+
+func TestPlacementWeights(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 2)
+	defer cleanup()
+
+	reg := bm.registry()
+	reg.weights[bm.Backends[0]] = 1 << 40
+	reg.weights[bm.Backends[1]] = 1 << 30
+
+	counts := make(map[*Backend]int)
+	for i := 0; i < 1000; i++ {
+		shasum := Hash([]byte(strconv.Itoa(i)), HashHighway256)
+		p, err := bm.place(shasum, 1)
+		if err != nil {
+			t.Fatalf("Failed placing chunk: %s", err)
+		}
+		counts[p.backends[0]]++
+	}
+
+	if counts[bm.Backends[0]] < 10*counts[bm.Backends[1]] {
+		t.Errorf("Expected the larger backend to receive most chunks, got %d vs %d",
+			counts[bm.Backends[0]], counts[bm.Backends[1]])
+	}
+}
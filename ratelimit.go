@@ -0,0 +1,264 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit describes the bandwidth and request-rate limits of a backend.
+// Zero values mean unlimited.
+type RateLimit struct {
+	Upload   uint64  // bytes per second
+	Download uint64  // bytes per second
+	Requests float64 // requests per second
+}
+
+// RateLimitSchedule applies a RateLimit during a time of day. From and To
+// are durations since midnight, local time. A schedule with To before From
+// spans midnight.
+type RateLimitSchedule struct {
+	From  time.Duration
+	To    time.Duration
+	Limit RateLimit
+}
+
+// active returns true if the schedule applies at time t.
+func (s RateLimitSchedule) active(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if s.From <= s.To {
+		return d >= s.From && d < s.To
+	}
+
+	return d >= s.From || d < s.To
+}
+
+// tokenBucket allows a burst of up to one second worth of tokens. Taking more
+// tokens than available puts the bucket into debt, which has to be waited
+// for.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens and returns how long the caller needs to wait.
+func (b *tokenBucket) take(rate, n float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		b.rate = 0
+		return 0
+	}
+	if rate != b.rate || b.last.IsZero() {
+		// start with a full bucket whenever the limit changes
+		b.rate = rate
+		b.tokens = rate
+		b.last = now
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// RateLimiter throttles the requests and transfers of one or many backends.
+type RateLimiter struct {
+	Limit     RateLimit
+	Schedules []RateLimitSchedule
+
+	mu       sync.Mutex
+	upload   tokenBucket
+	download tokenBucket
+	requests tokenBucket
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter returns a new RateLimiter. The first matching schedule
+// overrides the default limit.
+func NewRateLimiter(limit RateLimit, schedules ...RateLimitSchedule) *RateLimiter {
+	return &RateLimiter{
+		Limit:     limit,
+		Schedules: schedules,
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+// Current returns the limit that applies right now.
+func (l *RateLimiter) Current() RateLimit {
+	return l.limitAt(l.now())
+}
+
+func (l *RateLimiter) limitAt(t time.Time) RateLimit {
+	for _, s := range l.Schedules {
+		if s.active(t) {
+			return s.Limit
+		}
+	}
+
+	return l.Limit
+}
+
+// request waits until another request is allowed.
+func (l *RateLimiter) request() {
+	l.mu.Lock()
+	now := l.now()
+	d := l.requests.take(l.limitAt(now).Requests, 1, now)
+	l.mu.Unlock()
+
+	l.sleep(d)
+}
+
+// sent waits until n more bytes may be uploaded.
+func (l *RateLimiter) sent(n int) {
+	l.mu.Lock()
+	now := l.now()
+	d := l.upload.take(float64(l.limitAt(now).Upload), float64(n), now)
+	l.mu.Unlock()
+
+	l.sleep(d)
+}
+
+// received waits until n more bytes may be downloaded.
+func (l *RateLimiter) received(n int) {
+	l.mu.Lock()
+	now := l.now()
+	d := l.download.take(float64(l.limitAt(now).Download), float64(n), now)
+	l.mu.Unlock()
+
+	l.sleep(d)
+}
+
+// RateLimitedBackend wraps a Backend and throttles all its requests and
+// transfers with a RateLimiter. Sharing a RateLimiter between backends
+// limits their combined usage.
+type RateLimitedBackend struct {
+	Backend
+	limiter *RateLimiter
+}
+
+// NewRateLimitedBackend returns a Backend throttled by limiter.
+func NewRateLimitedBackend(be Backend, limiter *RateLimiter) *RateLimitedBackend {
+	return &RateLimitedBackend{
+		Backend: be,
+		limiter: limiter,
+	}
+}
+
+// load throttles a download.
+func (backend *RateLimitedBackend) load(op func() ([]byte, error)) ([]byte, error) {
+	backend.limiter.request()
+	b, err := op()
+	backend.limiter.received(len(b))
+
+	return b, err
+}
+
+// save throttles an upload.
+func (backend *RateLimitedBackend) save(data []byte, op func() error) error {
+	backend.limiter.request()
+	backend.limiter.sent(len(data))
+
+	return op()
+}
+
+// LoadChunk loads a Chunk.
+func (backend *RateLimitedBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	return backend.load(func() ([]byte, error) {
+		return backend.Backend.LoadChunk(shasum, part, totalParts)
+	})
+}
+
+// StoreChunk stores a single Chunk.
+func (backend *RateLimitedBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (size uint64, err error) {
+	err = backend.save(data, func() error {
+		size, err = backend.Backend.StoreChunk(shasum, part, totalParts, data)
+		return err
+	})
+
+	return size, err
+}
+
+// DeleteChunk deletes a single Chunk.
+func (backend *RateLimitedBackend) DeleteChunk(shasum string, part, totalParts uint) error {
+	backend.limiter.request()
+	return backend.Backend.DeleteChunk(shasum, part, totalParts)
+}
+
+// VerifyChunk verifies a stored Chunk.
+func (backend *RateLimitedBackend) VerifyChunk(shasum string, part, totalParts uint, data []byte) error {
+	if v, ok := backend.Backend.(ChunkVerifier); ok {
+		backend.limiter.request()
+		if err := v.VerifyChunk(shasum, part, totalParts, data); err != ErrChecksumUnavailable {
+			return err
+		}
+	}
+
+	return readBackChunk(backend, shasum, part, totalParts, data)
+}
+
+// AppendOnly returns true if the backend refuses to remove data.
+func (backend *RateLimitedBackend) AppendOnly() bool {
+	return IsAppendOnly(backend.Backend)
+}
+
+// HasChunks reports which chunk parts are stored on the backend.
+func (backend *RateLimitedBackend) HasChunks(parts []ChunkPart) ([]bool, error) {
+	if _, ok := backend.Backend.(ChunkQuerier); ok {
+		backend.limiter.request()
+	}
+	return QueryChunks(backend.Backend, parts)
+}
+
+// LoadSnapshot loads a snapshot.
+func (backend *RateLimitedBackend) LoadSnapshot(id string) ([]byte, error) {
+	return backend.load(func() ([]byte, error) {
+		return backend.Backend.LoadSnapshot(id)
+	})
+}
+
+// SaveSnapshot stores a snapshot.
+func (backend *RateLimitedBackend) SaveSnapshot(id string, data []byte) error {
+	return backend.save(data, func() error {
+		return backend.Backend.SaveSnapshot(id, data)
+	})
+}
+
+// LoadChunkIndex reads the chunk-index.
+func (backend *RateLimitedBackend) LoadChunkIndex() ([]byte, error) {
+	return backend.load(backend.Backend.LoadChunkIndex)
+}
+
+// SaveChunkIndex stores the chunk-index.
+func (backend *RateLimitedBackend) SaveChunkIndex(data []byte) error {
+	return backend.save(data, func() error {
+		return backend.Backend.SaveChunkIndex(data)
+	})
+}
+
+// LoadRepository reads the metadata for a repository.
+func (backend *RateLimitedBackend) LoadRepository() ([]byte, error) {
+	return backend.load(backend.Backend.LoadRepository)
+}
+
+// SaveRepository stores the metadata for a repository.
+func (backend *RateLimitedBackend) SaveRepository(data []byte) error {
+	return backend.save(data, func() error {
+		return backend.Backend.SaveRepository(data)
+	})
+}
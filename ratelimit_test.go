@@ -0,0 +1,95 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter returns a RateLimiter with a fake clock, which only
+// advances while sleeping.
+func newTestRateLimiter(limit RateLimit, schedules ...RateLimitSchedule) (*RateLimiter, *time.Duration) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	slept := time.Duration(0)
+
+	l := NewRateLimiter(limit, schedules...)
+	l.now = func() time.Time {
+		return now
+	}
+	l.sleep = func(d time.Duration) {
+		now = now.Add(d)
+		slept += d
+	}
+
+	return l, &slept
+}
+
+func TestRateLimitedBackend(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 1)
+	defer cleanup()
+
+	l, slept := newTestRateLimiter(RateLimit{Upload: 1000, Requests: 2})
+	bm.Wrap(func(be Backend) Backend {
+		return NewRateLimitedBackend(be, l)
+	})
+	be := *bm.Backends[0]
+
+	// the first second worth of data passes without delay
+	data := make([]byte, 1000)
+	if _, err := be.StoreChunk("0123456789abcdef", 0, 1, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if *slept != 0 {
+		t.Errorf("Expected no delay, got %s", *slept)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := be.StoreChunk("0123456789abcdef", 0, 1, data); err != nil {
+			t.Fatalf("Failed storing chunk: %s", err)
+		}
+	}
+	if *slept != 3*time.Second {
+		t.Errorf("Expected a delay of 3s, got %s", *slept)
+	}
+
+	// downloads are unlimited, but requests are not
+	*slept = 0
+	for i := 0; i < 4; i++ {
+		if _, err := be.LoadChunk("0123456789abcdef", 0, 1); err != nil {
+			t.Fatalf("Failed loading chunk: %s", err)
+		}
+	}
+	if *slept != time.Second {
+		t.Errorf("Expected a delay of 1s, got %s", *slept)
+	}
+}
+
+func TestRateLimitSchedules(t *testing.T) {
+	night := RateLimit{Upload: 1 << 20}
+	l, _ := newTestRateLimiter(RateLimit{Upload: 1 << 10},
+		RateLimitSchedule{From: 22 * time.Hour, To: 6 * time.Hour, Limit: night},
+		RateLimitSchedule{From: 12 * time.Hour, To: 13 * time.Hour, Limit: RateLimit{}})
+
+	tt := []struct {
+		hour     int
+		expected RateLimit
+	}{
+		{23, night},
+		{2, night},
+		{6, RateLimit{Upload: 1 << 10}},
+		{12, RateLimit{}},
+		{21, RateLimit{Upload: 1 << 10}},
+	}
+	for _, test := range tt {
+		limit := l.limitAt(time.Date(2020, 1, 1, test.hour, 30, 0, 0, time.Local))
+		if limit != test.expected {
+			t.Errorf("Expected limit %+v at %d:30, got %+v", test.expected, test.hour, limit)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"sort"
+)
+
+// Rebalance actions
+const (
+	RebalanceMove     = iota // parts of a chunk get moved to other backends
+	RebalanceReencode        // a chunk gets re-encoded with different parity
+	RebalanceLeftover        // parts left behind on a removed backend
+)
+
+const (
+	// save the chunk-index after this many rebalanced chunks, so an
+	// interrupted rebalance can be resumed
+	rebalanceSaveInterval = 100
+)
+
+// Error declarations
+var (
+	ErrInvalidFailureTolerance = errors.New("Failure tolerance can't be equal or higher as the number of storage backends")
+)
+
+// StalePart references a part of a chunk which has been superseded and is
+// waiting to be deleted.
+type StalePart struct {
+	Part       uint   `json:"part"`
+	TotalParts uint   `json:"total_parts"`
+	Location   string `json:"location"`
+}
+
+// RebalanceProgress reports on a single rebalanced chunk.
+type RebalanceProgress struct {
+	Hash   string
+	Action int
+	Parts  uint   // amount of parts written
+	Size   uint64 // amount of data written
+	Done   int    // amount of chunks checked
+	Total  int    // amount of chunks in the index
+	Error  error
+}
+
+// RebalanceRepo redistributes the parts of all chunks, so every chunk can
+// tolerate the failure of tolerance backends. Chunks with a different parity
+// get re-encoded, parts sharing a backend or failure domain get moved. With
+// dryRun set, nothing gets written and only the required actions are
+// reported.
+//
+// Superseded parts only get deleted after all snapshots have been updated, so
+// an interrupted rebalance can safely be resumed by running it again. Once all
+// chunks have been rebalanced, backends which missed writes are no longer
+// considered degraded.
+func RebalanceRepo(repository *Repository, index *ChunkIndex, tolerance uint, dryRun bool) (chan RebalanceProgress, error) {
+	backends := uint(len(repository.backend.Backends))
+	if tolerance >= backends {
+		return nil, ErrInvalidFailureTolerance
+	}
+	if !dryRun && repository.backend.AppendOnly() {
+		return nil, ErrAppendOnly
+	}
+
+	dataParts, parityParts := backends-tolerance, tolerance
+	if parityParts == 0 {
+		dataParts = 1
+	}
+
+	hashes := []string{}
+	for hash := range index.Chunks {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	prog := make(chan RebalanceProgress)
+	go func() {
+		defer close(prog)
+
+		changed, failed := 0, 0
+		for i, hash := range hashes {
+			p, err := rebalanceChunk(&repository.backend, index.Chunks[hash], dataParts, parityParts, dryRun)
+			if err != nil {
+				prog <- RebalanceProgress{Hash: hash, Done: i + 1, Total: len(hashes), Error: err}
+				failed++
+				continue
+			}
+			if p == nil {
+				continue
+			}
+
+			p.Done = i + 1
+			p.Total = len(hashes)
+			prog <- *p
+
+			changed++
+			if !dryRun && changed%rebalanceSaveInterval == 0 {
+				if err := index.Save(repository); err != nil {
+					prog <- RebalanceProgress{Error: err}
+					return
+				}
+			}
+		}
+		if dryRun {
+			return
+		}
+
+		if err := index.Save(repository); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+		if err := updateSnapshotChunks(repository, index, false); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+		if _, err := index.DeleteStaleParts(repository); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+
+		// all chunks are in place now, only the following writes may still
+		// miss a backend
+		restored := failed == 0 && len(repository.Degraded) > 0
+		if restored {
+			repository.backend.clearDegraded()
+		}
+		if err := index.Save(repository); err != nil {
+			prog <- RebalanceProgress{Error: err}
+			return
+		}
+		if restored {
+			if err := repository.Save(); err != nil {
+				prog <- RebalanceProgress{Error: err}
+			}
+		}
+	}()
+
+	return prog, nil
+}
+
+// rebalanceChunk brings a single chunk into the desired layout. It returns
+// nil if the chunk already matches it.
+func rebalanceChunk(backend *BackendManager, item *ChunkIndexItem, dataParts, parityParts uint, dryRun bool) (*RebalanceProgress, error) {
+	holders := locateChunkParts(backend, item)
+
+	if item.DataParts != dataParts || item.ParityParts != parityParts {
+		p := &RebalanceProgress{
+			Hash:   item.Hash,
+			Action: RebalanceReencode,
+			Parts:  dataParts + parityParts,
+			Size:   item.PartSize() * uint64(item.DataParts) / uint64(dataParts) * uint64(dataParts+parityParts),
+		}
+		if dryRun {
+			return p, nil
+		}
+
+		return p, reencodeChunk(backend, item, holders, dataParts, parityParts)
+	}
+
+	// find the parts which already reside in distinct failure domains
+	total := item.DataParts + item.ParityParts
+	assigned := make([]*Backend, total)
+	taken := []*Backend{}
+	for i := uint(0); i < total; i++ {
+		for _, be := range holders[i] {
+			if !backend.conflicts(be, taken) {
+				assigned[i] = be
+				taken = append(taken, be)
+				break
+			}
+		}
+	}
+
+	p := &RebalanceProgress{
+		Hash:   item.Hash,
+		Action: RebalanceMove,
+	}
+	ranked := backend.rank(item.Hash)
+	for i := uint(0); i < total; i++ {
+		if assigned[i] != nil {
+			continue
+		}
+		for _, be := range ranked {
+			if !backend.conflicts(be, taken) {
+				assigned[i] = be
+				taken = append(taken, be)
+				break
+			}
+		}
+		if assigned[i] == nil {
+			return nil, ErrPlacementFailed
+		}
+
+		p.Parts++
+		p.Size += item.PartSize()
+	}
+
+	locations := make([]string, total)
+	for i, be := range assigned {
+		locations[i] = (*be).Location()
+	}
+	stale := staleParts(item, holders, locations, item.DataParts)
+	if p.Parts == 0 && len(stale) == 0 {
+		if !dryRun {
+			item.Locations = locations
+		}
+		return nil, nil
+	}
+	if dryRun {
+		return p, nil
+	}
+
+	chunk := item.Chunk()
+	var shards [][]byte
+	for i := uint(0); i < total; i++ {
+		if containsBackend(holders[i], assigned[i]) {
+			continue
+		}
+
+		// load the part from any backend holding it, or reconstruct it
+		var data []byte
+		err := errors.New("part is missing")
+		for _, be := range holders[i] {
+			if data, err = (*be).LoadChunk(item.Hash, i, item.DataParts); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			if shards == nil {
+				b, lerr := loadVerifiedChunk(backend, chunk)
+				if lerr != nil {
+					return nil, lerr
+				}
+				shards = [][]byte{b}
+				if item.ParityParts > 0 {
+					if shards, err = redundantData(b, int(item.DataParts), int(item.ParityParts)); err != nil {
+						return nil, err
+					}
+				}
+			}
+			data = shards[i]
+		}
+
+		part := i
+		err = backend.write(assigned[i], func(b Backend) error {
+			_, serr := b.StoreChunk(item.Hash, part, item.DataParts, data)
+			return serr
+		}, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	item.Locations = locations
+	item.Stale = append(item.Stale, stale...)
+	return p, nil
+}
+
+// reencodeChunk re-encodes a chunk with a different amount of data and
+// parity parts.
+func reencodeChunk(backend *BackendManager, item *ChunkIndexItem, holders [][]*Backend, dataParts, parityParts uint) error {
+	b, err := loadVerifiedChunk(backend, item.Chunk())
+	if err != nil {
+		return err
+	}
+
+	pars := [][]byte{b}
+	if parityParts > 0 {
+		pars, err = redundantData(b, int(dataParts), int(parityParts))
+		if err != nil {
+			return err
+		}
+	}
+
+	chunk := Chunk{
+		Data:        &pars,
+		DataParts:   dataParts,
+		ParityParts: parityParts,
+		Size:        item.Size,
+		Hash:        item.Hash,
+	}
+	if _, err = backend.StoreChunk(&chunk); err != nil {
+		return err
+	}
+
+	// Parts sharing their name with an old part on the same backend don't
+	// get marked as stale: with the same amount of data parts, Reed-Solomon
+	// produces identical data and parity parts.
+	stale := staleParts(item, holders, chunk.Locations, dataParts)
+
+	item.DataParts = dataParts
+	item.ParityParts = parityParts
+	item.Locations = chunk.Locations
+	item.Stale = append(item.Stale, stale...)
+	return nil
+}
+
+// loadVerifiedChunk loads the raw data of a chunk and makes sure it matches
+// the chunk's hash before it gets written anywhere else.
+func loadVerifiedChunk(backend *BackendManager, chunk Chunk) ([]byte, error) {
+	b, err := loadRawChunk(backend, chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	if hashsum := Hash(b, HashHighway256); hashsum != chunk.Hash {
+		return nil, &CheckSumError{"hash", chunk.Hash, hashsum}
+	}
+
+	return b, nil
+}
+
+// staleParts returns the currently held parts of a chunk, which are not part
+// of the chunk's new layout.
+func staleParts(item *ChunkIndexItem, holders [][]*Backend, locations []string, dataParts uint) []StalePart {
+	stale := []StalePart{}
+	for i, bes := range holders {
+		for _, be := range bes {
+			location := (*be).Location()
+			if dataParts == item.DataParts && i < len(locations) && locations[i] == location {
+				continue
+			}
+
+			stale = append(stale, StalePart{
+				Part:       uint(i),
+				TotalParts: item.DataParts,
+				Location:   location,
+			})
+		}
+	}
+
+	return stale
+}
+
+// locateChunkParts returns the backends holding each part of a chunk. Parts
+// with an unknown location are searched for on all backends.
+func locateChunkParts(backend *BackendManager, item *ChunkIndexItem) [][]*Backend {
+	chunk := item.Chunk()
+	holders := make([][]*Backend, item.DataParts+item.ParityParts)
+	for i := range holders {
+		if be := backend.partBackend(chunk, uint(i)); be != nil {
+			holders[i] = []*Backend{be}
+			continue
+		}
+
+		for _, be := range backend.Backends {
+			if _, err := (*be).LoadChunk(item.Hash, uint(i), item.DataParts); err == nil {
+				holders[i] = append(holders[i], be)
+			}
+		}
+	}
+
+	return holders
+}
+
+// updateSnapshotChunks updates the chunk metadata stored in all snapshots to
+// match the chunk-index. With all set, every snapshot gets saved again, even
+// if none of its chunks changed.
+func updateSnapshotChunks(repository *Repository, index *ChunkIndex, all bool) error {
+	for _, volume := range repository.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := openSnapshot(id, repository)
+			if err != nil {
+				return err
+			}
+
+			changed := all
+			for _, archive := range snapshot.Archives {
+				for i, chunk := range archive.Chunks {
+					item, ok := index.Chunks[chunk.Hash]
+					if !ok || (chunk.DataParts == item.DataParts &&
+						chunk.ParityParts == item.ParityParts &&
+						equalLocations(chunk.Locations, item.Locations)) {
+						continue
+					}
+
+					archive.Chunks[i].DataParts = item.DataParts
+					archive.Chunks[i].ParityParts = item.ParityParts
+					archive.Chunks[i].Locations = item.Locations
+					changed = true
+				}
+			}
+
+			if changed {
+				if err = snapshot.Save(repository); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func containsBackend(bes []*Backend, be *Backend) bool {
+	for _, b := range bes {
+		if b == be {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equalLocations(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
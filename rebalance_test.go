@@ -0,0 +1,205 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestRepositoryDirs returns count temporary dirs and a cleanup func.
+func newTestRepositoryDirs(t *testing.T, count int) ([]string, func()) {
+	dirs := []string{}
+	cleanup := func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		dir, err := ioutil.TempDir("", "knoxite")
+		if err != nil {
+			cleanup()
+			t.Fatalf("Failed creating temporary dir for repository: %s", err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	return dirs, cleanup
+}
+
+// storeTestSnapshot creates a repository on dirs[0], stores a snapshot in it
+// and then adds the remaining dirs as storage backends.
+func storeTestSnapshot(t *testing.T, dirs []string, password string) string {
+	r, err := NewRepository(dirs[0], password)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	vol, _ := NewVolume("test_name", "test_description")
+	_ = r.AddVolume(vol)
+	snapshot, _ := NewSnapshot("test_snapshot")
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+
+	wd, _ := os.Getwd()
+	progress := snapshot.Add(wd, []string{"snapshot.go"}, []string{}, r, &index, CompressionNone, EncryptionAES, 1, 0)
+	for p := range progress {
+		if p.Error != nil {
+			t.Fatalf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+
+	_ = snapshot.Save(&r)
+	_ = vol.AddSnapshot(snapshot.ID)
+	if err = index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+
+	for _, dir := range dirs[1:] {
+		be, err := BackendFromURL(dir)
+		if err != nil {
+			t.Fatalf("Failed creating backend: %s", err)
+		}
+		if err = be.InitRepository(); err != nil {
+			t.Fatalf("Failed initializing backend: %s", err)
+		}
+		r.BackendManager().AddBackend(&be)
+	}
+	if err = r.Save(); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+
+	return snapshot.ID
+}
+
+// verifyTestSnapshot restores a snapshot stored by storeTestSnapshot from a
+// freshly opened repository and verifies its content.
+func verifyTestSnapshot(t *testing.T, dir, password, id string) {
+	r, err := OpenRepository(dir, password)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	_, snapshot, err := r.FindSnapshot(id)
+	if err != nil {
+		t.Fatalf("Failed finding snapshot: %s", err)
+	}
+
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir for restore: %s", err)
+	}
+	defer os.RemoveAll(targetdir)
+
+	progress, err := DecodeSnapshot(r, snapshot, targetdir, []string{})
+	if err != nil {
+		t.Fatalf("Failed restoring snapshot: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring snapshot: %s", p.Error)
+		}
+	}
+
+	hash1, err := hashFile(filepath.Join(targetdir, "snapshot.go"))
+	if err != nil {
+		t.Fatalf("Failed generating shasum: %s", err)
+	}
+	hash2, _ := hashFile("snapshot.go")
+	if hash1 != hash2 {
+		t.Errorf("Failed verifying shasum: %s != %s", hash1, hash2)
+	}
+}
+
+func TestRebalanceRepo(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dirs, cleanup := newTestRepositoryDirs(t, 3)
+	defer cleanup()
+	snapshotID := storeTestSnapshot(t, dirs, testPassword)
+
+	r, err := OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+
+	if _, err = RebalanceRepo(&r, &index, 3, false); err != ErrInvalidFailureTolerance {
+		t.Errorf("Expected %v, got %v", ErrInvalidFailureTolerance, err)
+	}
+
+	// a dry-run must not change anything
+	progress, err := RebalanceRepo(&r, &index, 1, true)
+	if err != nil {
+		t.Fatalf("Failed rebalancing repository: %s", err)
+	}
+	changes := 0
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed rebalancing chunk: %s", p.Error)
+		}
+		if p.Action != RebalanceReencode {
+			t.Errorf("Expected chunk %s to be re-encoded", p.Hash)
+		}
+		changes++
+	}
+	if changes != len(index.Chunks) {
+		t.Errorf("Expected %d chunks to be rebalanced, got %d", len(index.Chunks), changes)
+	}
+	for _, item := range index.Chunks {
+		if item.ParityParts != 0 {
+			t.Fatalf("Expected dry-run not to modify chunk %s", item.Hash)
+		}
+	}
+
+	progress, err = RebalanceRepo(&r, &index, 1, false)
+	if err != nil {
+		t.Fatalf("Failed rebalancing repository: %s", err)
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed rebalancing chunk: %s", p.Error)
+		}
+	}
+
+	bm := r.BackendManager()
+	for _, item := range index.Chunks {
+		if item.DataParts != 2 || item.ParityParts != 1 {
+			t.Errorf("Expected chunk %s to be stored with 2+1 parts, got %d+%d", item.Hash, item.DataParts, item.ParityParts)
+		}
+		if len(item.Stale) > 0 {
+			t.Errorf("Expected stale parts of chunk %s to be deleted", item.Hash)
+		}
+
+		seen := make(map[string]bool)
+		for _, location := range item.Locations {
+			if seen[location] {
+				t.Errorf("Chunk %s has more than one part on backend %s", item.Hash, location)
+			}
+			seen[location] = true
+		}
+
+		if _, err := (*bm.Backends[0]).LoadChunk(item.Hash, 0, 1); err == nil {
+			t.Errorf("Expected old part of chunk %s to be deleted", item.Hash)
+		}
+	}
+
+	// running it again must not change anything
+	progress, _ = RebalanceRepo(&r, &index, 1, false)
+	for p := range progress {
+		t.Errorf("Expected chunk %s to be balanced already", p.Hash)
+	}
+
+	verifyTestSnapshot(t, dirs[0], testPassword, snapshotID)
+}
@@ -19,6 +19,10 @@ type Repository struct {
 	Volumes []*Volume `json:"volumes"`
 	Paths   []string  `json:"storage"`
 	Key     string    `json:"key"` // key for encrypting data stored with knoxite
+	// Labels of the storage backends, e.g. their region or provider
+	Labels map[string]map[string]string `json:"labels,omitempty"`
+	// Degraded lists the storage backends which missed writes
+	Degraded []string `json:"degraded,omitempty"`
 	// Owner   string    `json:"owner"`
 
 	backend  BackendManager
@@ -51,6 +55,7 @@ func NewRepository(path, password string) (Repository, error) {
 		Version:  RepositoryVersion,
 		password: password,
 		Key:      key,
+		backend:  NewBackendManager(),
 	}
 
 	backend, err := BackendFromURL(path)
@@ -79,6 +84,7 @@ func generateRandomKey(length int) (string, error) {
 func OpenRepository(path, password string) (Repository, error) {
 	repository := Repository{
 		password: password,
+		backend:  NewBackendManager(),
 	}
 
 	backend, err := BackendFromURL(path)
@@ -112,6 +118,12 @@ func OpenRepository(path, password string) (Repository, error) {
 			return repository, berr
 		}
 		repository.backend.AddBackend(&backend)
+		repository.backend.SetLabels(&backend, repository.Labels[url])
+		for _, degraded := range repository.Degraded {
+			if degraded == url {
+				repository.backend.markDegraded(&backend)
+			}
+		}
 	}
 
 	return repository, err
@@ -212,6 +224,18 @@ func (r *Repository) init() error {
 // Save writes a repository's metadata.
 func (r *Repository) Save() error {
 	r.Paths = r.backend.Locations()
+	r.Labels = make(map[string]map[string]string)
+	for _, be := range r.backend.Backends {
+		if labels := r.backend.Labels(be); len(labels) > 0 {
+			r.Labels[(*be).Location()] = labels
+		}
+	}
+	r.Degraded = []string{}
+	for _, be := range r.backend.Backends {
+		if r.backend.Health(be).Degraded {
+			r.Degraded = append(r.Degraded, (*be).Location())
+		}
+	}
 
 	pipe, err := NewEncodingPipeline(CompressionNone, EncryptionAES, r.password)
 	if err != nil {
@@ -224,6 +248,29 @@ func (r *Repository) Save() error {
 	return r.backend.SaveRepository(b)
 }
 
+// Reload reads a repository's metadata again from its backends, e.g. after
+// they have been wrapped by a spool.
+func (r *Repository) Reload() error {
+	b, err := r.backend.LoadRepository()
+	if err != nil {
+		return err
+	}
+
+	pipe, err := NewDecodingPipeline(CompressionNone, EncryptionAES, r.password)
+	if err != nil {
+		return err
+	}
+
+	repository := Repository{}
+	if err = pipe.Decode(b, &repository); err != nil {
+		return ErrOpenRepositoryFailed
+	}
+	r.Version = repository.Version
+	r.Volumes = repository.Volumes
+	r.Key = repository.Key
+	return nil
+}
+
 // Changes password of repository.
 func (r *Repository) ChangePassword(newPassword string) error {
 	r.password = newPassword
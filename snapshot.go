@@ -8,6 +8,7 @@
 package knoxite
 
 import (
+	"errors"
 	"math"
 	"os"
 	"path/filepath"
@@ -131,40 +132,26 @@ func (snapshot *Snapshot) Add(cwd string, paths []string, excludes []string, rep
 				archive.Encrypted = encrypt
 				archive.Compressed = compress
 
-				for cd := range chunkchan {
-					if cd.Error != nil {
-						p = newProgressError(err)
-						progress <- p
-						close(progress)
-						return
-					}
-					chunk := cd.Chunk
-					// fmt.Printf("\tSplit %s (#%d, %d bytes), compression: %s, encryption: %s, hash: %s\n", id.Path, cd.Num, cd.Size, CompressionText(cd.Compressed), EncryptionText(cd.Encrypted), cd.Hash)
-
-					// store this chunk
-					n, err := repository.backend.StoreChunk(chunk)
-					if err != nil {
-						p = newProgressError(err)
-						progress <- p
-						close(progress)
-						return
-					}
-
-					// release the memory, we don't need the data anymore
-					chunk.Data = &[][]byte{}
-
-					archive.Chunks = append(archive.Chunks, chunk)
-					archive.StorageSize += n
-
+				err = storeChunks(repository, chunkIndex, archive, chunkchan, func(chunk Chunk, size, reuploads uint64, shared bool) {
 					p.CurrentItemStats.StorageSize = archive.StorageSize
 					p.CurrentItemStats.Transferred += uint64(chunk.OriginalSize)
 					snapshot.Stats.Transferred += uint64(chunk.OriginalSize)
-					snapshot.Stats.StorageSize += n
+					snapshot.Stats.StorageSize += size
+					snapshot.Stats.Reuploads += reuploads
+					if shared {
+						snapshot.Stats.SharedDomains++
+					}
 
 					snapshot.mut.Lock()
 					p.TotalStatistics = snapshot.Stats
 					snapshot.mut.Unlock()
 					progress <- p
+				})
+				if err != nil {
+					p = newProgressError(err)
+					progress <- p
+					close(progress)
+					return
 				}
 			}
 
@@ -177,6 +164,121 @@ func (snapshot *Snapshot) Add(cwd string, paths []string, excludes []string, rep
 	return progress
 }
 
+// AddFile adds a single file to a Snapshot, storing it as an archive named
+// name instead of its path.
+func (snapshot *Snapshot) AddFile(path, name string, repository Repository, chunkIndex *ChunkIndex, compress, encrypt uint16, dataParts, parityParts uint) (*Archive, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isRegularFile(fi) {
+		return nil, &os.PathError{Op: "add", Path: path, Err: errors.New("not a regular file")}
+	}
+
+	archive := &Archive{
+		Path:       name,
+		Type:       File,
+		Mode:       fi.Mode(),
+		ModTime:    fi.ModTime().Unix(),
+		Size:       uint64(fi.Size()),
+		Encrypted:  encrypt,
+		Compressed: compress,
+	}
+	if statT, ok := toStatT(fi.Sys()); ok {
+		archive.UID = statT.uid()
+		archive.GID = statT.gid()
+	}
+
+	dataParts = uint(math.Max(1, float64(dataParts)))
+	chunkchan, err := chunkFile(path, compress, encrypt, repository.Key, int(dataParts), int(parityParts))
+	if err != nil {
+		return nil, err
+	}
+	err = storeChunks(repository, chunkIndex, archive, chunkchan, func(chunk Chunk, size, reuploads uint64, shared bool) {
+		snapshot.mut.Lock()
+		snapshot.Stats.Transferred += uint64(chunk.OriginalSize)
+		snapshot.Stats.StorageSize += size
+		snapshot.Stats.Reuploads += reuploads
+		if shared {
+			snapshot.Stats.SharedDomains++
+		}
+		snapshot.mut.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.mut.Lock()
+	snapshot.Stats.Size += archive.Size
+	snapshot.Stats.Files++
+	snapshot.mut.Unlock()
+
+	snapshot.AddArchive(archive)
+	chunkIndex.AddArchive(archive, snapshot.ID)
+	return archive, nil
+}
+
+// storeChunks stores the chunks of an archive on the repository's backends,
+// checking whole batches of chunks for already stored copies. stored gets
+// called for every chunk with its storage size, how many of its parts had to
+// be uploaded again and whether its parts share a failure domain. On errors
+// the remaining chunks get drained in the background, so the chunker can
+// finish and close the file.
+func storeChunks(repository Repository, chunkIndex *ChunkIndex, archive *Archive, chunks chan ChunkResult, stored func(chunk Chunk, size, reuploads uint64, shared bool)) (err error) {
+	defer func() {
+		if err != nil {
+			go func() {
+				for range chunks {
+				}
+			}()
+		}
+	}()
+
+	batch := []Chunk{}
+	store := func() error {
+		found := repository.backend.queryChunks(batch)
+		for _, chunk := range batch {
+			n, reuploads, shared, err := repository.backend.storeQueriedChunk(&chunk, found)
+			if err != nil {
+				return err
+			}
+
+			// release the memory, we don't need the data anymore
+			chunk.Data = &[][]byte{}
+
+			archive.Chunks = append(archive.Chunks, chunk)
+			archive.StorageSize += n
+			stored(chunk, n, reuploads, shared)
+		}
+
+		batch = []Chunk{}
+		return nil
+	}
+
+	for cd := range chunks {
+		if cd.Error != nil {
+			return cd.Error
+		}
+		chunk := cd.Chunk
+		// fmt.Printf("\tSplit %s (#%d, %d bytes), compression: %s, encryption: %s, hash: %s\n", id.Path, cd.Num, cd.Size, CompressionText(cd.Compressed), EncryptionText(cd.Encrypted), cd.Hash)
+
+		// store this chunk, next to its already stored copy if there is one
+		if item, ok := chunkIndex.Chunks[chunk.Hash]; ok &&
+			item.DataParts == chunk.DataParts && item.ParityParts == chunk.ParityParts {
+			chunk.Locations = item.Locations
+		}
+
+		batch = append(batch, chunk)
+		if len(batch) < chunkBatchSize {
+			continue
+		}
+		if err := store(); err != nil {
+			return err
+		}
+	}
+	return store()
+}
+
 // Clone clones a snapshot.
 func (snapshot *Snapshot) Clone() (*Snapshot, error) {
 	s, err := NewSnapshot(snapshot.Description)
@@ -10,10 +10,12 @@ package knoxite
 
 import (
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/minio/highwayhash"
 	"github.com/muesli/combinator"
@@ -294,3 +296,84 @@ func TestSnapshotFind(t *testing.T) {
 		t.Errorf("Failed finding latest snapshot: %s %s", err, snapshot.ID)
 	}
 }
+
+func TestSnapshotAddFile(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Errorf("Failed opening chunk-index: %s", err)
+		return
+	}
+	snapshot, _ := NewSnapshot("test_snapshot")
+
+	archive, err := snapshot.AddFile("snapshot.go", "SHA256E-s1--key", r, &index, CompressionZstd, EncryptionAES, 1, 0)
+	if err != nil {
+		t.Errorf("Failed adding file to snapshot: %s", err)
+		return
+	}
+	if snapshot.Archives["SHA256E-s1--key"] != archive {
+		t.Errorf("Expected the archive to be stored under its name, got %v", snapshot.Archives)
+	}
+	if snapshot.Stats.Files != 1 || snapshot.Stats.Size != archive.Size {
+		t.Errorf("Unexpected snapshot stats: %s", snapshot.Stats.String())
+	}
+	for _, chunk := range archive.Chunks {
+		if _, ok := index.Chunks[chunk.Hash]; !ok {
+			t.Errorf("Expected chunk %s to be indexed", chunk.Hash)
+		}
+	}
+
+	b, _, err := DecodeArchiveData(r, *archive)
+	if err != nil {
+		t.Errorf("Failed decoding archive: %s", err)
+		return
+	}
+	expected, _ := ioutil.ReadFile("snapshot.go")
+	if string(b) != string(expected) {
+		t.Errorf("Failed verifying decoded data")
+	}
+
+	if _, err := snapshot.AddFile(".", "dir", r, &index, CompressionNone, EncryptionAES, 1, 0); err == nil {
+		t.Errorf("Expected adding a dir to fail")
+	}
+}
+
+func TestStoreChunksDrainsOnError(t *testing.T) {
+	errChunk := errors.New("chunking failed")
+	chunks := make(chan ChunkResult)
+	done := make(chan struct{})
+	go func() {
+		chunks <- ChunkResult{Error: errChunk}
+		for i := 0; i < 3; i++ {
+			chunks <- ChunkResult{}
+		}
+		close(chunks)
+		close(done)
+	}()
+
+	archive := &Archive{}
+	err := storeChunks(Repository{}, &ChunkIndex{}, archive, chunks, func(Chunk, uint64, uint64, bool) {})
+	if err != errChunk {
+		t.Errorf("Expected %v, got %v", errChunk, err)
+	}
+
+	// the chunker must be able to finish
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the remaining chunks to be drained")
+	}
+}
@@ -0,0 +1,408 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Error declarations
+var (
+	ErrSpoolNotEnabled = errors.New("Repository is not using a spool")
+	ErrSpoolPending    = errors.New("Repository can't be modified before its spool has been uploaded")
+)
+
+// Upload phases. Chunks get uploaded to all backends first, so snapshots and
+// the repository metadata referencing them only become visible afterwards.
+const (
+	uploadChunks = iota
+	uploadSnapshots
+	uploadChunkIndex
+	uploadRepository
+)
+
+// Spool stages all data written to a repository in a local directory, from
+// where it gets uploaded to the actual storage backends later on.
+type Spool struct {
+	path string
+}
+
+// UploadProgress reports on the upload of a single spooled file.
+type UploadProgress struct {
+	Location string // storage backend the file got uploaded to
+	Name     string // name of the file within the repository
+	Size     uint64
+	Done     int // amount of files uploaded
+	Total    int // amount of files in the spool
+	Error    error
+}
+
+// OpenSpool opens or creates a spool at path.
+func OpenSpool(path string) (*Spool, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Spool{path: path}, nil
+}
+
+// Pending returns the amount and size of the files waiting to be uploaded.
+func (s *Spool) Pending() (files int, size uint64, err error) {
+	err = filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		files++
+		size += uint64(info.Size())
+		return nil
+	})
+
+	return
+}
+
+// SpooledBackend wraps a Backend and writes all data to a Spool instead.
+// Reads prefer the spooled data over the data stored on the backend.
+type SpooledBackend struct {
+	Backend
+	path     string
+	readOnly bool
+}
+
+// NewSpooledBackend returns a Backend spooled by spool.
+func NewSpooledBackend(be Backend, spool *Spool) (*SpooledBackend, error) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(be.Location()))
+	path := filepath.Join(spool.path, strconv.FormatUint(h.Sum64(), 16))
+
+	for _, dir := range []string{chunksDirname, snapshotsDirname} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SpooledBackend{
+		Backend: be,
+		path:    path,
+	}, nil
+}
+
+// NewSpoolReader returns a Backend reading through spool, e.g. to access
+// snapshots which haven't been uploaded yet. All writes get refused with
+// ErrSpoolPending, as they could neither go to the spool nor bypass it.
+func NewSpoolReader(be Backend, spool *Spool) (*SpooledBackend, error) {
+	backend, err := NewSpooledBackend(be, spool)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.readOnly = true
+	return backend, nil
+}
+
+func (backend *SpooledBackend) chunkFile(shasum string, part, totalParts uint) string {
+	return filepath.Join(backend.path, chunksDirname, SubDirForChunk(shasum),
+		shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
+}
+
+func (backend *SpooledBackend) snapshotFile(id string) string {
+	return filepath.Join(backend.path, snapshotsDirname, filepath.Base(id))
+}
+
+func (backend *SpooledBackend) chunkIndexFile() string {
+	return filepath.Join(backend.path, chunksDirname, ChunkIndexFilename)
+}
+
+func (backend *SpooledBackend) repositoryFile() string {
+	return filepath.Join(backend.path, RepoFilename)
+}
+
+// load reads a spooled file, or falls back to op if it hasn't been spooled.
+func (backend *SpooledBackend) load(path string, op func() ([]byte, error)) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return op()
+	}
+
+	return b, err
+}
+
+// save writes a file to the spool.
+func (backend *SpooledBackend) save(path string, data []byte) error {
+	if backend.readOnly {
+		return ErrSpoolPending
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadChunk loads a Chunk.
+func (backend *SpooledBackend) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
+	return backend.load(backend.chunkFile(shasum, part, totalParts), func() ([]byte, error) {
+		return backend.Backend.LoadChunk(shasum, part, totalParts)
+	})
+}
+
+// StoreChunk spools a single Chunk.
+func (backend *SpooledBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	err := backend.save(backend.chunkFile(shasum, part, totalParts), data)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(len(data)), nil
+}
+
+// DeleteChunk deletes a single Chunk from the spool and the backend.
+func (backend *SpooledBackend) DeleteChunk(shasum string, part, totalParts uint) error {
+	if backend.readOnly {
+		return ErrSpoolPending
+	}
+
+	err := os.Remove(backend.chunkFile(shasum, part, totalParts))
+	if err == nil {
+		// the chunk was never uploaded
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	return backend.Backend.DeleteChunk(shasum, part, totalParts)
+}
+
+// AppendOnly returns true if the backend refuses to remove data.
+func (backend *SpooledBackend) AppendOnly() bool {
+	return IsAppendOnly(backend.Backend)
+}
+
+// HasChunks reports which chunk parts are either spooled or already stored
+// on the backend.
+func (backend *SpooledBackend) HasChunks(parts []ChunkPart) ([]bool, error) {
+	found := make([]bool, len(parts))
+	missing := []int{}
+	query := []ChunkPart{}
+	for i, p := range parts {
+		if fi, err := os.Stat(backend.chunkFile(p.Shasum, p.Part, p.TotalParts)); err == nil && uint64(fi.Size()) == p.Size {
+			found[i] = true
+			continue
+		}
+		missing = append(missing, i)
+		query = append(query, p)
+	}
+	if len(query) == 0 {
+		return found, nil
+	}
+
+	stored, err := QueryChunks(backend.Backend, query)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range missing {
+		found[i] = j < len(stored) && stored[j]
+	}
+	return found, nil
+}
+
+// LoadSnapshot loads a snapshot.
+func (backend *SpooledBackend) LoadSnapshot(id string) ([]byte, error) {
+	return backend.load(backend.snapshotFile(id), func() ([]byte, error) {
+		return backend.Backend.LoadSnapshot(id)
+	})
+}
+
+// SaveSnapshot spools a snapshot.
+func (backend *SpooledBackend) SaveSnapshot(id string, data []byte) error {
+	return backend.save(backend.snapshotFile(id), data)
+}
+
+// LoadChunkIndex reads the chunk-index.
+func (backend *SpooledBackend) LoadChunkIndex() ([]byte, error) {
+	return backend.load(backend.chunkIndexFile(), backend.Backend.LoadChunkIndex)
+}
+
+// SaveChunkIndex spools the chunk-index.
+func (backend *SpooledBackend) SaveChunkIndex(data []byte) error {
+	return backend.save(backend.chunkIndexFile(), data)
+}
+
+// LoadRepository reads the metadata for a repository.
+func (backend *SpooledBackend) LoadRepository() ([]byte, error) {
+	return backend.load(backend.repositoryFile(), backend.Backend.LoadRepository)
+}
+
+// SaveRepository spools the metadata for a repository.
+func (backend *SpooledBackend) SaveRepository(data []byte) error {
+	return backend.save(backend.repositoryFile(), data)
+}
+
+// spooledFile is a file waiting to be uploaded.
+type spooledFile struct {
+	backend *SpooledBackend
+	path    string
+	upload  func(data []byte) error
+}
+
+// files returns the spooled files of an upload phase. Uploaded chunks get
+// verified if verify is true.
+func (backend *SpooledBackend) files(phase int, verify bool) ([]spooledFile, error) {
+	files := []spooledFile{}
+
+	switch phase {
+	case uploadChunks:
+		err := filepath.Walk(filepath.Join(backend.path, chunksDirname), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || path == backend.chunkIndexFile() || filepath.Ext(path) == ".tmp" {
+				return err
+			}
+
+			// chunk parts are named hash.part_totalParts
+			name := filepath.Base(path)
+			dot := strings.LastIndex(name, ".")
+			parts := strings.Split(name[dot+1:], "_")
+			if dot < 0 || len(parts) != 2 {
+				return nil
+			}
+			part, perr := strconv.ParseUint(parts[0], 10, 32)
+			totalParts, terr := strconv.ParseUint(parts[1], 10, 32)
+			if perr != nil || terr != nil {
+				return nil
+			}
+
+			shasum := name[:dot]
+			files = append(files, spooledFile{backend, path, func(data []byte) error {
+				var err error
+				if verify {
+					_, _, err = storeVerifiedChunk(backend.Backend, shasum, uint(part), uint(totalParts), data)
+				} else {
+					_, err = backend.Backend.StoreChunk(shasum, uint(part), uint(totalParts), data)
+				}
+				return err
+			}})
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return files, err
+		}
+
+	case uploadSnapshots:
+		infos, err := ioutil.ReadDir(filepath.Join(backend.path, snapshotsDirname))
+		if err != nil && !os.IsNotExist(err) {
+			return files, err
+		}
+		for _, info := range infos {
+			id := info.Name()
+			if info.IsDir() || filepath.Ext(id) == ".tmp" {
+				continue
+			}
+			files = append(files, spooledFile{backend, backend.snapshotFile(id), func(data []byte) error {
+				return backend.Backend.SaveSnapshot(id, data)
+			}})
+		}
+
+	case uploadChunkIndex:
+		if _, err := os.Stat(backend.chunkIndexFile()); err == nil {
+			files = append(files, spooledFile{backend, backend.chunkIndexFile(), backend.Backend.SaveChunkIndex})
+		}
+
+	case uploadRepository:
+		if _, err := os.Stat(backend.repositoryFile()); err == nil {
+			files = append(files, spooledFile{backend, backend.repositoryFile(), backend.Backend.SaveRepository})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+	return files, nil
+}
+
+// UploadSpool uploads all spooled data of a repository to its storage
+// backends. Spooled files get deleted once they have been uploaded, so an
+// interrupted upload can be resumed. Chunks get uploaded first, snapshots,
+// the chunk-index and lastly the repository metadata only once all chunks
+// have been uploaded successfully. With VerifyWrites enabled, the uploaded
+// chunks get verified on the backends.
+func UploadSpool(repository *Repository) (chan UploadProgress, error) {
+	backends := []*SpooledBackend{}
+	for _, be := range repository.backend.Backends {
+		if sb, ok := (*be).(*SpooledBackend); ok {
+			backends = append(backends, sb)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, ErrSpoolNotEnabled
+	}
+
+	phases := make([][]spooledFile, uploadRepository+1)
+	total := 0
+	for phase := range phases {
+		for _, sb := range backends {
+			files, err := sb.files(phase, repository.backend.VerifyWrites)
+			if err != nil {
+				return nil, err
+			}
+			phases[phase] = append(phases[phase], files...)
+			total += len(files)
+		}
+	}
+
+	prog := make(chan UploadProgress)
+	go func() {
+		defer close(prog)
+
+		done := 0
+		for _, files := range phases {
+			failed := false
+			for _, f := range files {
+				done++
+				p := UploadProgress{
+					Location: f.backend.Location(),
+					Name:     strings.TrimPrefix(filepath.ToSlash(f.path), filepath.ToSlash(f.backend.path)+"/"),
+					Done:     done,
+					Total:    total,
+				}
+
+				data, err := ioutil.ReadFile(f.path)
+				if err == nil {
+					p.Size = uint64(len(data))
+					if err = f.upload(data); err == nil {
+						err = os.Remove(f.path)
+					}
+				}
+				if err != nil {
+					failed = true
+					p.Error = err
+				}
+
+				prog <- p
+			}
+
+			if failed {
+				// keep the following phases spooled, so nothing references
+				// data which hasn't been uploaded yet
+				return
+			}
+		}
+	}()
+
+	return prog, nil
+}
@@ -0,0 +1,139 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSpoolUpload(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dirs, cleanup := newTestRepositoryDirs(t, 2)
+	defer cleanup()
+
+	r, err := NewRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	spool, err := OpenSpool(dirs[1])
+	if err != nil {
+		t.Fatalf("Failed opening spool: %s", err)
+	}
+
+	fb := &failingBackend{}
+	r.BackendManager().Wrap(func(be Backend) Backend {
+		fb.Backend = be
+		sb, err := NewSpooledBackend(fb, spool)
+		if err != nil {
+			t.Fatalf("Failed creating spooled backend: %s", err)
+		}
+		return sb
+	})
+
+	vol, _ := NewVolume("test_name", "test_description")
+	_ = r.AddVolume(vol)
+	snapshot, _ := NewSnapshot("test_snapshot")
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Fatalf("Failed opening chunk-index: %s", err)
+	}
+
+	// nothing reaches the backend while spooling
+	fb.down = true
+	wd, _ := os.Getwd()
+	progress := snapshot.Add(wd, []string{"snapshot.go"}, []string{}, r, &index, CompressionNone, EncryptionAES, 1, 0)
+	for p := range progress {
+		if p.Error != nil {
+			t.Fatalf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+	_ = snapshot.Save(&r)
+	_ = vol.AddSnapshot(snapshot.ID)
+	if err = index.Save(&r); err != nil {
+		t.Fatalf("Failed saving chunk-index: %s", err)
+	}
+	if err = r.Save(); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+	if fb.calls != 0 {
+		t.Errorf("Expected no calls to the backend while spooling, got %d", fb.calls)
+	}
+
+	// a failed upload must not make the snapshot visible
+	uploads, err := UploadSpool(&r)
+	if err != nil {
+		t.Fatalf("Failed uploading spool: %s", err)
+	}
+	failed := 0
+	for p := range uploads {
+		if p.Error != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Error("Expected upload to fail")
+	}
+	remote, err := OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	if _, _, err = remote.FindSnapshot(snapshot.ID); err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v before the upload completed, got %v", ErrSnapshotNotFound, err)
+	}
+
+	// other clients can read the spooled snapshot, but not modify the
+	// repository
+	reader, err := OpenRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	reader.BackendManager().Wrap(func(be Backend) Backend {
+		sb, err := NewSpoolReader(be, spool)
+		if err != nil {
+			t.Fatalf("Failed creating spool reader: %s", err)
+		}
+		return sb
+	})
+	if err = reader.Reload(); err != nil {
+		t.Fatalf("Failed reloading repository: %s", err)
+	}
+	if _, _, err = reader.FindSnapshot(snapshot.ID); err != nil {
+		t.Errorf("Expected spooled snapshot to be found, got %v", err)
+	}
+	if err = reader.Save(); err != ErrSpoolPending {
+		t.Errorf("Expected %v, got %v", ErrSpoolPending, err)
+	}
+	for _, chunk := range snapshot.Archives["snapshot.go"].Chunks {
+		if err = (*reader.BackendManager().Backends[0]).DeleteChunk(chunk.Hash, 0, chunk.DataParts); err != ErrSpoolPending {
+			t.Errorf("Expected %v, got %v", ErrSpoolPending, err)
+		}
+	}
+
+	fb.down = false
+	uploads, err = UploadSpool(&r)
+	if err != nil {
+		t.Fatalf("Failed uploading spool: %s", err)
+	}
+	for p := range uploads {
+		if p.Error != nil {
+			t.Errorf("Failed uploading %s: %s", p.Name, p.Error)
+		}
+	}
+
+	files, _, err := spool.Pending()
+	if err != nil {
+		t.Fatalf("Failed checking spool: %s", err)
+	}
+	if files != 0 {
+		t.Errorf("Expected spool to be empty, got %d files", files)
+	}
+
+	verifyTestSnapshot(t, dirs[0], testPassword, snapshot.ID)
+}
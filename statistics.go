@@ -20,6 +20,9 @@ type Stats struct {
 	StorageSize uint64 `json:"stored_size"`
 	Transferred uint64 `json:"transferred"`
 	Errors      uint64 `json:"errors"`
+	Reuploads   uint64 `json:"reuploads,omitempty"`
+	// SharedDomains counts the chunks with parts in the same failure domain
+	SharedDomains uint64 `json:"shared_domains,omitempty"`
 }
 
 // Add accumulates other into s.
@@ -31,6 +34,8 @@ func (s *Stats) Add(other Stats) {
 	s.StorageSize += other.StorageSize
 	s.Transferred += other.Transferred
 	s.Errors += other.Errors
+	s.Reuploads += other.Reuploads
+	s.SharedDomains += other.SharedDomains
 }
 
 // SizeToString prettifies sizes.
@@ -59,6 +64,14 @@ func SizeToString(size uint64) (str string) {
 
 // String returns human-readable Stats.
 func (s Stats) String() string {
-	return fmt.Sprintf("%d files, %d dirs, %d symlinks, %d errors, %v Original Size, %v Storage Size",
+	str := fmt.Sprintf("%d files, %d dirs, %d symlinks, %d errors, %v Original Size, %v Storage Size",
 		s.Files, s.Dirs, s.SymLinks, s.Errors, SizeToString(s.Size), SizeToString(s.StorageSize))
+	if s.Reuploads > 0 {
+		str += fmt.Sprintf(", %d re-uploaded parts", s.Reuploads)
+	}
+	if s.SharedDomains > 0 {
+		str += fmt.Sprintf(", %d chunks sharing failure domains", s.SharedDomains)
+	}
+
+	return str
 }
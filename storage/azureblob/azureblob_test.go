@@ -0,0 +1,110 @@
+// +build backend
+
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package azureblob
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+
+	"github.com/knoxite/knoxite/storage"
+)
+
+var (
+	backendTest *storage.BackendTest
+)
+
+// TestMain runs the tests against the container in KNOXITE_AZURE_BLOB_URL,
+// e.g. for Azurite with its well-known development account, whose key has to
+// be URL encoded:
+//
+//	KNOXITE_AZURE_BLOB_URL=azureblob://devstoreaccount1:<key>@127.0.0.1:10000/knoxite/test
+func TestMain(m *testing.M) {
+	// create a random prefix to avoid collisions
+	rnd := storage.RandomSuffix()
+
+	azurebloburl := os.Getenv("KNOXITE_AZURE_BLOB_URL")
+	if len(azurebloburl) == 0 {
+		panic("no backend configured")
+	}
+	u, err := url.Parse(azurebloburl)
+	if err != nil {
+		panic(err)
+	}
+	u.Path += rnd
+
+	backendTest = &storage.BackendTest{
+		URL:         u.String(),
+		Protocols:   []string{"azureblob"},
+		Description: "Azure blob storage",
+		TearDown: func(tb *storage.BackendTest) {
+			be := tb.Backend.(*AzureBlobStorage)
+			ctx := context.Background()
+			for marker := (azblob.Marker{}); marker.NotDone(); {
+				list, err := be.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+					Prefix: be.prefix + "/",
+				})
+				if err != nil {
+					panic(err)
+				}
+				for _, b := range list.Segment.BlobItems {
+					_, _ = be.container.NewBlobURL(b.Name).Delete(ctx,
+						azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+				}
+				marker = list.NextMarker
+			}
+		},
+	}
+
+	storage.RunBackendTester(backendTest, m)
+}
+
+func TestStorageNewBackend(t *testing.T) {
+	backendTest.NewBackendTest(t)
+}
+
+func TestStorageLocation(t *testing.T) {
+	backendTest.LocationTest(t)
+}
+
+func TestStorageProtocols(t *testing.T) {
+	backendTest.ProtocolsTest(t)
+}
+
+func TestStorageDescription(t *testing.T) {
+	backendTest.DescriptionTest(t)
+}
+
+func TestStorageInitRepository(t *testing.T) {
+	backendTest.InitRepositoryTest(t)
+}
+
+func TestStorageSaveRepository(t *testing.T) {
+	backendTest.SaveRepositoryTest(t)
+}
+
+func TestAvailableSpace(t *testing.T) {
+	backendTest.AvailableSpaceTest(t)
+}
+
+func TestStorageSaveSnapshot(t *testing.T) {
+	backendTest.SaveSnapshotTest(t)
+}
+
+func TestStorageStoreChunk(t *testing.T) {
+	backendTest.StoreChunkTest(t)
+}
+
+func TestStorageDeleteChunk(t *testing.T) {
+	backendTest.DeleteChunkTest(t)
+}
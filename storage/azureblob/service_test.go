@@ -0,0 +1,303 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package azureblob
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/storage"
+)
+
+const testKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+type testBlob struct {
+	data []byte
+	tier string
+}
+
+// testService is a minimal in-memory Azure blob service.
+type testService struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	containers map[string]map[string]*testBlob
+}
+
+func newTestService() *testService {
+	s := &testService{
+		containers: make(map[string]map[string]*testBlob),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *testService) url(path string, query string) string {
+	u := url.URL{
+		Scheme:   "azureblob",
+		User:     url.UserPassword("devstoreaccount1", testKey),
+		Host:     strings.TrimPrefix(s.Server.URL, "http://"),
+		Path:     path,
+		RawQuery: query,
+	}
+	return u.String()
+}
+
+func (s *testService) blob(container, name string) *testBlob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.containers[container][name]
+}
+
+func serviceError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte("<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>" + code + "</Code><Message>" + code + "</Message></Error>"))
+}
+
+func (s *testService) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// /account/container/blob
+	pp := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(pp) < 2 || pp[0] != "devstoreaccount1" {
+		serviceError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	q := r.URL.Query()
+	blobs, ok := s.containers[pp[1]]
+
+	if len(pp) == 2 {
+		switch {
+		case r.Method == http.MethodPut && q.Get("restype") == "container":
+			if ok {
+				serviceError(w, http.StatusConflict, "ContainerAlreadyExists")
+				return
+			}
+			s.containers[pp[1]] = make(map[string]*testBlob)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodGet && q.Get("comp") == "list":
+			if !ok {
+				serviceError(w, http.StatusNotFound, "ContainerNotFound")
+				return
+			}
+			s.list(w, blobs, q.Get("prefix"))
+		default:
+			serviceError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+		}
+		return
+	}
+
+	if !ok {
+		serviceError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	name := pp[2]
+	b := blobs[name]
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			serviceError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		blobs[name] = &testBlob{data: data, tier: r.Header.Get("x-ms-access-tier")}
+		sum := md5.Sum(data)
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead, http.MethodGet:
+		if b == nil {
+			serviceError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		if r.Method == http.MethodGet && b.tier == "Archive" {
+			serviceError(w, http.StatusConflict, "BlobArchived")
+			return
+		}
+		sum := md5.Sum(b.data)
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		w.Header().Set("ETag", "\"0x"+strconv.Itoa(len(b.data))+"\"")
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		if b.tier != "" {
+			w.Header().Set("x-ms-access-tier", b.tier)
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(b.data)
+		}
+	case http.MethodDelete:
+		if b == nil {
+			serviceError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		serviceError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func (s *testService) list(w http.ResponseWriter, blobs map[string]*testBlob, prefix string) {
+	type properties struct {
+		ContentLength int64 `xml:"Content-Length"`
+	}
+	type blob struct {
+		Name       string
+		Properties properties
+	}
+	result := struct {
+		XMLName    xml.Name `xml:"EnumerationResults"`
+		Blobs      []blob   `xml:"Blobs>Blob"`
+		NextMarker string
+	}{}
+
+	for name, b := range blobs {
+		if strings.HasPrefix(name, prefix) {
+			result.Blobs = append(result.Blobs, blob{Name: name, Properties: properties{int64(len(b.data))}})
+		}
+	}
+	sort.Slice(result.Blobs, func(i, j int) bool { return result.Blobs[i].Name < result.Blobs[j].Name })
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func newBackend(t *testing.T, rawurl string) *AzureBlobStorage {
+	be, err := knoxite.BackendFromURL(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return be.(*AzureBlobStorage)
+}
+
+func TestAzureBlob(t *testing.T) {
+	s := newTestService()
+	defer s.Close()
+
+	be := newBackend(t, s.url("/knoxite/repo", ""))
+	rt := storage.NewRoundTrip(1024)
+	rt.Store(t, be)
+	if s.blob("knoxite", "repo/"+knoxite.RepoFilename) == nil {
+		t.Errorf("Expected repository to be stored below the prefix")
+	}
+	rt.Load(t, be)
+	rt.Delete(t, be)
+
+	if _, err := be.AvailableSpace(); err != knoxite.ErrAvailableSpaceUnlimited {
+		t.Errorf("Expected %v, got %v", knoxite.ErrAvailableSpaceUnlimited, err)
+	}
+}
+
+func TestAccessTiers(t *testing.T) {
+	s := newTestService()
+	defer s.Close()
+
+	be := newBackend(t, s.url("/knoxite/repo", "tier=cool&chunktier=archive"))
+	if err := be.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SaveSnapshot("snapshot", []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.StoreChunk("abc", 0, 1, []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tier := range map[string]string{
+		"repo/" + knoxite.RepoFilename: "Cool",
+		"repo/snapshots/snapshot":      "Cool",
+		"repo/chunks/abc.0_1":          "Archive",
+	} {
+		if b := s.blob("knoxite", name); b == nil || b.tier != tier {
+			t.Errorf("Expected %s to be stored in tier %s", name, tier)
+		}
+	}
+
+	if _, err := be.LoadChunk("abc", 0, 1); err != ErrBlobArchived {
+		t.Errorf("Expected %v, got %v", ErrBlobArchived, err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	s := newTestService()
+	defer s.Close()
+
+	be := newBackend(t, s.url("/knoxite/repo", "quota=1KiB"))
+	if err := be.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.StoreChunk("abc", 0, 1, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// blobs outside the prefix don't count
+	other := newBackend(t, s.url("/knoxite/other", ""))
+	if _, err := other.StoreChunk("abc", 0, 1, make([]byte, 200)); err != nil {
+		t.Fatal(err)
+	}
+
+	space, err := be.AvailableSpace()
+	if err != nil || space != 1024-100 {
+		t.Errorf("Expected %d bytes of available space, got %d: %v", 1024-100, space, err)
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, rawurl := range []string{
+		"azureblob://blob.core.windows.net/container",
+		"azureblob://account@blob.core.windows.net/container",
+		"azureblob://account:" + url.QueryEscape(testKey) + "@blob.core.windows.net/",
+		"azureblob://account:" + url.QueryEscape(testKey) + "@blob.core.windows.net/container?tier=frozen",
+		"azureblob://account:" + url.QueryEscape(testKey) + "@blob.core.windows.net/container?tier=archive",
+		"azureblob://account:" + url.QueryEscape(testKey) + "@blob.core.windows.net/container?metatier=archive",
+		"azureblob://account:" + url.QueryEscape(testKey) + "@blob.core.windows.net/container?quota=lots",
+	} {
+		if _, err := knoxite.BackendFromURL(rawurl); err == nil {
+			t.Errorf("Expected an error for %s", rawurl)
+		}
+	}
+}
+
+func TestServiceURL(t *testing.T) {
+	key := url.QueryEscape(testKey)
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"azureblob://account:" + key + "@blob.core.windows.net/c", "https://account.blob.core.windows.net/c"},
+		{"azureblob://account:" + key + "@account.blob.core.windows.net/c/p", "https://account.blob.core.windows.net/c"},
+		{"azureblob://account:" + key + "@127.0.0.1:10000/c", "http://127.0.0.1:10000/account/c"},
+		{"azureblob://account@blob.core.windows.net/c?sas=sv%3D2019-12-12%26sig%3Dabc", "https://account.blob.core.windows.net/c?sv=2019-12-12&sig=abc"},
+	}
+
+	for _, tt := range tests {
+		be := newBackend(t, tt.url)
+		u := be.container.URL()
+		if u.String() != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, u.String())
+		}
+	}
+}
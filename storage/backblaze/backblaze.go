@@ -10,9 +10,12 @@ package backblaze
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 
@@ -138,6 +141,30 @@ func (backend *BackblazeStorage) StoreChunk(shasum string, part, totalParts uint
 	return uint64(file.ContentLength), nil
 }
 
+// VerifyChunk compares the SHA1 checksum B2 stores for a Chunk with data's.
+func (backend *BackblazeStorage) VerifyChunk(shasum string, part, totalParts uint, data []byte) error {
+	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+
+	files, err := backend.findLatestFileVersion(fileName)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return &os.PathError{Op: "stat", Path: fileName, Err: os.ErrNotExist}
+	}
+
+	// large files are uploaded in parts and have no checksum
+	if len(files[0].ContentSha1) != sha1.Size*2 {
+		return knoxite.ErrChecksumUnavailable
+	}
+	sum := sha1.Sum(data)
+	if !strings.EqualFold(files[0].ContentSha1, hex.EncodeToString(sum[:])) {
+		return knoxite.ErrChunkMismatch
+	}
+
+	return nil
+}
+
 // DeleteChunk deletes a single Chunk.
 func (backend *BackblazeStorage) DeleteChunk(shasum string, part, totalParts uint) error {
 	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
@@ -6,16 +6,29 @@
  *   For license see LICENSE
  */
 
+// Package ftp implements a storage backend for FTP servers.
+//
+// Besides plain ftp:// it supports FTP over TLS, either with implicit TLS on
+// a dedicated port (ftps://, port 990 by default) or upgraded with AUTH TLS
+// (ftpes://, port 21 by default). Server certificates always get verified.
+// The URL's query parameters configure the connections:
+//
+//	ca=path         PEM file with the CA certificates to verify the server with
+//	connections=4   how many connections transfer files in parallel
 package ftp
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net"
+	"net/textproto"
 	"net/url"
-	"path/filepath"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,15 +39,21 @@ import (
 
 // FTPStorage stores data on a remote FTP.
 type FTPStorage struct {
-	url   url.URL
-	ftp   *ftp.ServerConn
-	login bool
+	url  url.URL
+	pool *connPool
 	knoxite.StorageFilesystem
 }
 
 // Error declaration
 var (
 	ErrInvalidAuthentication = errors.New("Wrong Username or Password")
+	ErrInvalidCA             = errors.New("No CA certificates found in the ca file")
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	// defaultConnections is how many connections get opened by default
+	defaultConnections = 4
 )
 
 func init() {
@@ -43,34 +62,74 @@ func init() {
 
 // NewBackend establishes an FTP connection and returns a FTPStorage backend.
 func (*FTPStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
-	_, port, err := net.SplitHostPort(u.Host)
-	if err != nil || len(port) == 0 {
+	var port string
+	var tlsConfig *tls.Config
+	opts := []ftp.DialOption{ftp.DialWithTimeout(dialTimeout)}
+
+	q := u.Query()
+	switch u.Scheme {
+	case "ftp":
 		port = "ftp"
-		u.Host = net.JoinHostPort(u.Host, port)
+	case "ftps", "ftpes":
+		var err error
+		if tlsConfig, err = newTLSConfig(u.Hostname(), q.Get("ca")); err != nil {
+			return &FTPStorage{}, err
+		}
+		if u.Scheme == "ftps" {
+			port = "ftps"
+			opts = append(opts, ftp.DialWithTLS(tlsConfig))
+		} else {
+			port = "ftp"
+			opts = append(opts, ftp.DialWithExplicitTLS(tlsConfig))
+		}
+	default:
+		return &FTPStorage{}, knoxite.ErrInvalidRepositoryURL
 	}
 
-	// Starting a connection
-	con, err := ftp.DialTimeout(u.Host, 30*time.Second)
-	if err != nil {
-		return &FTPStorage{}, err
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
 	}
 
-	// Authenticate the client if desired
-	loggedIn := false
+	size := defaultConnections
+	if v := q.Get("connections"); v != "" {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil || size < 1 {
+			return &FTPStorage{}, knoxite.ErrInvalidRepositoryURL
+		}
+	}
+
+	// without credentials log in anonymously
+	username, password := "anonymous", "anonymous"
 	if u.User != nil && len(u.User.Username()) > 0 {
 		// Doesn't matter if pw exists
-		pw, _ := u.User.Password()
-		err = con.Login(u.User.Username(), pw)
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	pool := newConnPool(size, func() (*ftp.ServerConn, error) {
+		con, err := ftp.Dial(addr, opts...)
 		if err != nil {
-			return &FTPStorage{}, ErrInvalidAuthentication
+			return nil, err
+		}
+		if err := con.Login(username, password); err != nil {
+			_ = con.Quit()
+			if _, ok := err.(*textproto.Error); ok {
+				return nil, ErrInvalidAuthentication
+			}
+			return nil, err
 		}
-		loggedIn = true
+		return con, nil
+	})
+
+	// check the connection and credentials right away
+	if err := pool.do(func(c *ftp.ServerConn) error { return nil }); err != nil {
+		return &FTPStorage{}, err
 	}
 
 	backend := FTPStorage{
-		url:   u,
-		ftp:   con,
-		login: loggedIn,
+		url:  u,
+		pool: pool,
 	}
 
 	fs, err := knoxite.NewStorageFilesystem(u.Path, &backend)
@@ -82,6 +141,30 @@ func (*FTPStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// newTLSConfig returns the TLS config for verifying a server, with the CA
+// certificates from caFile if it's not empty.
+func newTLSConfig(host, caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: host,
+		// many servers require data connections to resume the session of
+		// the control connection
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCA
+		}
+	}
+
+	return config, nil
+}
+
 // Location returns the type and location of the repository.
 func (backend *FTPStorage) Location() string {
 	return backend.url.String()
@@ -89,17 +172,12 @@ func (backend *FTPStorage) Location() string {
 
 // Close the backend.
 func (backend *FTPStorage) Close() error {
-	if backend.login {
-		if err := backend.ftp.Logout(); err != nil {
-			return err
-		}
-	}
-	return backend.ftp.Quit()
+	return backend.pool.close()
 }
 
 // Protocols returns the Protocol Schemes supported by this backend.
 func (backend *FTPStorage) Protocols() []string {
-	return []string{"ftp"}
+	return []string{"ftp", "ftps", "ftpes"}
 }
 
 // Description returns a user-friendly description for this backend.
@@ -113,85 +191,111 @@ func (backend *FTPStorage) AvailableSpace() (uint64, error) {
 }
 
 // CreatePath creates a dir including all its parent dirs, when required.
-func (backend *FTPStorage) CreatePath(path string) error {
-	slicedPath := strings.Split(path, "/")
-	for i := range slicedPath {
-		if i == 0 {
-			// don't try to create root-dir
-			continue
+func (backend *FTPStorage) CreatePath(p string) error {
+	return backend.pool.do(func(c *ftp.ServerConn) error {
+		slicedPath := strings.Split(p, "/")
+		for i := range slicedPath {
+			if i == 0 {
+				// don't try to create root-dir
+				continue
+			}
+			_ = c.MakeDir(path.Join(slicedPath[:i+1]...))
 		}
-		_ = backend.ftp.MakeDir(filepath.Join(slicedPath[:i+1]...))
-	}
-
-	return nil
+		return nil
+	})
 }
 
 // Stat returns the size of a file on ftp.
-func (backend *FTPStorage) Stat(path string) (uint64, error) {
-	size, err := backend.ftp.FileSize(path)
-	return uint64(size), err
+func (backend *FTPStorage) Stat(p string) (uint64, error) {
+	var size int64
+	err := backend.pool.do(func(c *ftp.ServerConn) error {
+		var err error
+		size, err = c.FileSize(p)
+		return err
+	})
+	return uint64(size), notFound("stat", p, err)
 }
 
 // ReadFile reads a file from ftp.
-func (backend *FTPStorage) ReadFile(path string) ([]byte, error) {
-	file, err := backend.ftp.Retr(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+func (backend *FTPStorage) ReadFile(p string) ([]byte, error) {
+	var data []byte
+	err := backend.pool.do(func(c *ftp.ServerConn) error {
+		file, err := c.Retr(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
 
-	return ioutil.ReadAll(file)
+		data, err = ioutil.ReadAll(file)
+		return err
+	})
+	return data, notFound("open", p, err)
 }
 
 // WriteFile writes file to ftp.
-func (backend *FTPStorage) WriteFile(path string, data []byte) (size uint64, err error) {
-	err = backend.ftp.Stor(path, bytes.NewReader(data))
+func (backend *FTPStorage) WriteFile(p string, data []byte) (size uint64, err error) {
+	err = backend.pool.do(func(c *ftp.ServerConn) error {
+		return c.Stor(p, bytes.NewReader(data))
+	})
 	return uint64(len(data)), err
 }
 
 // DeleteFile deletes a file from ftp.
-func (backend *FTPStorage) DeleteFile(path string) error {
-	return backend.ftp.Delete(path)
+func (backend *FTPStorage) DeleteFile(p string) error {
+	return backend.pool.do(func(c *ftp.ServerConn) error {
+		return c.Delete(p)
+	})
+}
+
+// ListFiles returns the sizes of all files in a dir on ftp.
+func (backend *FTPStorage) ListFiles(p string) (map[string]uint64, error) {
+	var entries []*ftp.Entry
+	err := backend.pool.do(func(c *ftp.ServerConn) error {
+		var err error
+		entries, err = c.List(p)
+		return err
+	})
+	if err != nil {
+		return nil, notFound("list", p, err)
+	}
+
+	files := make(map[string]uint64)
+	for _, e := range entries {
+		if e.Type == ftp.EntryTypeFile {
+			files[e.Name] = e.Size
+		}
+	}
+	return files, nil
 }
 
-// DeletePath deletes a directory including all its content from ftp.
-func (backend *FTPStorage) DeletePath(path string) error {
-	fmt.Println("Deleting path", path)
-	list, err := backend.ftp.List("")
+// DeletePath deletes all the content of a directory from ftp.
+func (backend *FTPStorage) DeletePath(p string) error {
+	return backend.pool.do(func(c *ftp.ServerConn) error {
+		return deletePath(c, p)
+	})
+}
+
+func deletePath(c *ftp.ServerConn, p string) error {
+	list, err := c.List(p)
 	if err != nil {
 		return err
 	}
 	for _, l := range list {
-		fpath := filepath.Join(path, l.Name)
-
-		if l.Type == ftp.EntryTypeFolder {
-			if len(l.Name) == 0 ||
-				strings.HasPrefix(l.Name, ".") ||
-				l.Name == "virtual" {
-				continue
-			}
+		if len(l.Name) == 0 || l.Name == "." || l.Name == ".." {
+			continue
+		}
+		fpath := path.Join(p, l.Name)
 
-			err = backend.ftp.ChangeDir(l.Name)
-			if err != nil {
-				return err
-			}
-			err = backend.DeletePath(fpath)
-			if err != nil {
-				return err
-			}
-			err = backend.ftp.ChangeDirToParent()
-			if err != nil {
+		switch l.Type {
+		case ftp.EntryTypeFolder:
+			if err := deletePath(c, fpath); err != nil {
 				return err
 			}
-			err = backend.ftp.RemoveDir(fpath)
-			if err != nil {
+			if err := c.RemoveDir(fpath); err != nil {
 				return err
 			}
-		}
-
-		if l.Type == ftp.EntryTypeFile {
-			err = backend.ftp.Delete(fpath)
-			if err != nil {
+		case ftp.EntryTypeFile:
+			if err := c.Delete(fpath); err != nil {
 				return err
 			}
 		}
@@ -199,3 +303,12 @@ func (backend *FTPStorage) DeletePath(path string) error {
 
 	return nil
 }
+
+// notFound turns the server's reply for missing files into an error
+// satisfying os.IsNotExist.
+func notFound(op, p string, err error) error {
+	if terr, ok := err.(*textproto.Error); ok && terr.Code == ftp.StatusFileUnavailable {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package ftp
+
+import (
+	"errors"
+	"net/textproto"
+	"sync"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// Error declarations
+var (
+	ErrPoolClosed = errors.New("FTP connections have been closed")
+)
+
+// connPool holds the connections to an FTP server. As every connection can
+// only run one command at a time, each running operation gets a connection of
+// its own.
+type connPool struct {
+	dial func() (*ftp.ServerConn, error)
+
+	// slots limits the number of open connections
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*ftp.ServerConn
+	closed bool
+}
+
+func newConnPool(size int, dial func() (*ftp.ServerConn, error)) *connPool {
+	return &connPool{
+		dial:  dial,
+		slots: make(chan struct{}, size),
+	}
+}
+
+// do runs op with a connection of its own. Connections which failed for any
+// other reason than an error reply from the server get closed, and op gets
+// run once more on a new connection, as servers drop idle connections.
+func (p *connPool) do(op func(c *ftp.ServerConn) error) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	c, reused, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	err = op(c)
+	if err != nil && reused && broken(err) {
+		_ = c.Quit()
+		if c, err = p.dial(); err != nil {
+			return err
+		}
+		err = op(c)
+	}
+
+	if err != nil && broken(err) {
+		_ = c.Quit()
+		return err
+	}
+	p.put(c)
+	return err
+}
+
+// get returns an idle connection, or a new one if there are none. reused is
+// true for idle connections.
+func (p *connPool) get() (c *ftp.ServerConn, reused bool, err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, false, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, true, nil
+	}
+	p.mu.Unlock()
+
+	c, err = p.dial()
+	return c, false, err
+}
+
+// put makes a connection available to other operations.
+func (p *connPool) put(c *ftp.ServerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		_ = c.Quit()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// close closes all idle connections. Connections still in use get closed
+// once they're done.
+func (p *connPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for _, c := range p.idle {
+		if qerr := c.Quit(); qerr != nil && err == nil {
+			err = qerr
+		}
+	}
+	p.idle = nil
+	p.closed = true
+	return err
+}
+
+// broken returns true if err wasn't a reply from the server, so the
+// connection can't be used anymore.
+func broken(err error) bool {
+	_, ok := err.(*textproto.Error)
+	return !ok
+}
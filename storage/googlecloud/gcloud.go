@@ -11,6 +11,7 @@ package googlecloud
 import (
 	"context"
 	"errors"
+	"hash/crc32"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -127,6 +128,20 @@ func (backend *GoogleCloudStorage) AvailableSpace() (uint64, error) {
 	return 0, knoxite.ErrAvailableSpaceUnlimited
 }
 
+// VerifyChunk compares the CRC32C checksum Google Cloud Storage keeps for a
+// Chunk with data's.
+func (backend *GoogleCloudStorage) VerifyChunk(shasum string, part, totalParts uint, data []byte) error {
+	attrs, err := backend.bucket.Object(backend.ChunkPath(shasum, part, totalParts)).Attrs(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if attrs.CRC32C != crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)) {
+		return knoxite.ErrChunkMismatch
+	}
+	return nil
+}
+
 // CreatePath is not needed in Google Cloud Storage backend
 // because paths are automatically created when writing a file.
 func (backend *GoogleCloudStorage) CreatePath(path string) error {
@@ -0,0 +1,235 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package googledrive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	gap "github.com/muesli/go-app-paths"
+	"golang.org/x/oauth2"
+)
+
+// Error declarations
+var (
+	ErrAuthorizationDenied  = errors.New("Access to Google Drive was denied")
+	ErrAuthorizationExpired = errors.New("Authorization code expired, please try again")
+)
+
+// The OAuth2 endpoints, overridden by tests.
+var (
+	oauthEndpoint = oauth2.Endpoint{
+		AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+		TokenURL: "https://oauth2.googleapis.com/token",
+	}
+	deviceAuthURL       = "https://oauth2.googleapis.com/device/code"
+	defaultPollInterval = 5 * time.Second
+)
+
+// deviceCode is the response of the device authorization endpoint.
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	// Google uses a non-standard name for the verification uri
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// tokenResponse is the response of the token endpoint.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// tokenPath returns the path the OAuth2 token gets cached at. It can be set
+// with the environment variable KNOXITE_GDRIVE_TOKEN.
+func tokenPath() (string, error) {
+	if path := os.Getenv("KNOXITE_GDRIVE_TOKEN"); path != "" {
+		return path, nil
+	}
+
+	userScope := gap.NewScope(gap.User, "knoxite")
+	return userScope.ConfigPath("gdrive_token.json")
+}
+
+// tokenSource returns a TokenSource using the cached token, or authorizes
+// knoxite with the OAuth2 device flow if no token has been cached yet.
+// Refreshed tokens get written back to the cache.
+func tokenSource(conf *oauth2.Config) (oauth2.TokenSource, error) {
+	path, err := tokenPath()
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := loadToken(path)
+	if err != nil {
+		if tok, err = deviceAuth(conf); err != nil {
+			return nil, err
+		}
+		if err = saveToken(path, tok); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cachingTokenSource{
+		src:  conf.TokenSource(context.Background(), tok),
+		path: path,
+		last: tok,
+	}, nil
+}
+
+// cachingTokenSource writes refreshed tokens to the token cache.
+type cachingTokenSource struct {
+	src  oauth2.TokenSource
+	path string
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+// Token returns a valid token.
+func (ts *cachingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := ts.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if tok.AccessToken != ts.last.AccessToken {
+		ts.last = tok
+		if err = saveToken(ts.path, tok); err != nil {
+			return nil, err
+		}
+	}
+
+	return tok, nil
+}
+
+func loadToken(path string) (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tok := &oauth2.Token{}
+	err = json.Unmarshal(b, tok)
+	return tok, err
+}
+
+func saveToken(path string, tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// the token grants access to the user's Drive
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// deviceAuth runs the OAuth2 device flow, asking the user to authorize
+// knoxite on another device.
+func deviceAuth(conf *oauth2.Config) (*oauth2.Token, error) {
+	resp, err := http.PostForm(deviceAuthURL, url.Values{
+		"client_id": {conf.ClientID},
+		"scope":     {strings.Join(conf.Scopes, " ")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device authorization failed: %s", resp.Status)
+	}
+
+	var code deviceCode
+	if err = json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return nil, err
+	}
+	verificationURL := code.VerificationURI
+	if verificationURL == "" {
+		verificationURL = code.VerificationURL
+	}
+	fmt.Fprintf(os.Stderr, "To allow knoxite to access your Google Drive, visit %s and enter the code %s\n",
+		verificationURL, code.UserCode)
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		tok, err := pollToken(conf, code.DeviceCode)
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok.Error {
+		case "":
+			return &oauth2.Token{
+				AccessToken:  tok.AccessToken,
+				RefreshToken: tok.RefreshToken,
+				TokenType:    tok.TokenType,
+				Expiry:       time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
+			}, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return nil, ErrAuthorizationDenied
+		case "expired_token":
+			return nil, ErrAuthorizationExpired
+		default:
+			return nil, fmt.Errorf("device authorization failed: %s", tok.Error)
+		}
+	}
+
+	return nil, ErrAuthorizationExpired
+}
+
+// pollToken asks the token endpoint whether the user authorized knoxite.
+func pollToken(conf *oauth2.Config, deviceCode string) (*tokenResponse, error) {
+	resp, err := http.PostForm(conf.Endpoint.TokenURL, url.Values{
+		"client_id":     {conf.ClientID},
+		"client_secret": {conf.ClientSecret},
+		"device_code":   {deviceCode},
+		"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// pending authorizations are reported with an error status
+	tok := &tokenResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(tok); err != nil {
+		return nil, fmt.Errorf("device authorization failed: %s", resp.Status)
+	}
+	return tok, nil
+}
@@ -0,0 +1,483 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package googledrive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+
+	"github.com/knoxite/knoxite"
+)
+
+// fakeDrive is a local fake of the Drive v3 API and Google's OAuth2 device
+// flow, holding all files in memory.
+type fakeDrive struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	files   map[string]*fakeFile
+	nextID  int
+	polls   int // polls of the token endpoint for the device code
+	limit   int64
+	tokens  map[string]bool // issued access tokens
+	current string
+	lists   int // queries for files
+}
+
+type fakeFile struct {
+	drive.File
+	data []byte
+}
+
+var queryRe = regexp.MustCompile(`^name = '((?:[^'\\]|\\.)*)' and '((?:[^'\\]|\\.)*)' in parents and trashed = false$`)
+
+func newFakeDrive() *fakeDrive {
+	fd := &fakeDrive{
+		files:  make(map[string]*fakeFile),
+		limit:  1 << 30,
+		tokens: make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/code", fd.deviceCode)
+	mux.HandleFunc("/token", fd.token)
+	mux.HandleFunc("/drive/v3/about", fd.authorized(fd.about))
+	mux.HandleFunc("/drive/v3/files", fd.authorized(fd.list))
+	mux.HandleFunc("/drive/v3/files/", fd.authorized(fd.file))
+	mux.HandleFunc("/upload/drive/v3/files", fd.authorized(fd.upload))
+	mux.HandleFunc("/upload/drive/v3/files/", fd.authorized(fd.upload))
+	fd.Server = httptest.NewServer(mux)
+
+	return fd
+}
+
+// use points the backend at the fake and caches tokens in dir.
+func (fd *fakeDrive) use(dir string) func() {
+	oldDrive, oldOAuth, oldDevice, oldInterval := driveEndpoint, oauthEndpoint, deviceAuthURL, defaultPollInterval
+	driveEndpoint = fd.URL + "/drive/v3/"
+	oauthEndpoint.TokenURL = fd.URL + "/token"
+	deviceAuthURL = fd.URL + "/device/code"
+	defaultPollInterval = 10 * time.Millisecond
+
+	env := map[string]string{
+		"KNOXITE_GDRIVE_CLIENT_ID":     "client",
+		"KNOXITE_GDRIVE_CLIENT_SECRET": "secret",
+		"KNOXITE_GDRIVE_TOKEN":         filepath.Join(dir, "token.json"),
+	}
+	oldEnv := make(map[string]string)
+	for k, v := range env {
+		oldEnv[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+
+	return func() {
+		driveEndpoint, oauthEndpoint, deviceAuthURL, defaultPollInterval = oldDrive, oldOAuth, oldDevice, oldInterval
+		for k, v := range oldEnv {
+			os.Setenv(k, v)
+		}
+		fd.Close()
+	}
+}
+
+func (fd *fakeDrive) deviceCode(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":      "device-code",
+		"user_code":        "ABCD-EFGH",
+		"verification_url": fd.URL + "/device",
+		"expires_in":       60,
+	})
+}
+
+func (fd *fakeDrive) token(w http.ResponseWriter, r *http.Request) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	_ = r.ParseForm()
+	switch r.Form.Get("grant_type") {
+	case "urn:ietf:params:oauth:grant-type:device_code":
+		// the user authorizes knoxite while it polls the second time
+		fd.polls++
+		if fd.polls < 2 {
+			writeJSON(w, http.StatusPreconditionRequired, map[string]string{"error": "authorization_pending"})
+			return
+		}
+	case "refresh_token":
+		if r.Form.Get("refresh_token") != "refresh-token" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	fd.current = "access-token-" + strconv.Itoa(len(fd.tokens)+1)
+	fd.tokens[fd.current] = true
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  fd.current,
+		"refresh_token": "refresh-token",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func (fd *fakeDrive) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fd.mu.Lock()
+		defer fd.mu.Unlock()
+
+		if !fd.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+			writeError(w, http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (fd *fakeDrive) about(w http.ResponseWriter, r *http.Request) {
+	usage := int64(0)
+	for _, f := range fd.files {
+		usage += int64(len(f.data))
+	}
+	writeJSON(w, http.StatusOK, &drive.About{
+		StorageQuota: &drive.AboutStorageQuota{Limit: fd.limit, Usage: usage},
+	})
+}
+
+func (fd *fakeDrive) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		// folders get created without any media
+		f := &drive.File{}
+		if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+		created := fd.create(f, nil)
+		if created == nil {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, created)
+		return
+	}
+
+	fd.lists++
+	m := queryRe.FindStringSubmatch(r.URL.Query().Get("q"))
+	if m == nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	name, parent := unescape(m[1]), unescape(m[2])
+
+	list := &drive.FileList{Files: []*drive.File{}}
+	for _, f := range fd.files {
+		if f.Name == name && f.Parents[0] == parent {
+			file := f.File
+			list.Files = append(list.Files, &file)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (fd *fakeDrive) file(w http.ResponseWriter, r *http.Request) {
+	f, ok := fd.files[strings.TrimPrefix(r.URL.Path, "/drive/v3/files/")]
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodDelete:
+		delete(fd.files, f.Id)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+		_, _ = w.Write(f.data)
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, &f.File)
+	default:
+		writeError(w, http.StatusMethodNotAllowed)
+	}
+}
+
+// upload handles multipart uploads, creating or updating a file.
+func (fd *fakeDrive) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.URL.Query().Get("uploadType") != "multipart" {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	meta := &drive.File{}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(meta)
+	}
+	var data []byte
+	if err == nil {
+		if part, err = mr.NextPart(); err == nil {
+			data, err = ioutil.ReadAll(part)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/upload/drive/v3/files")
+	if id == "" {
+		f := fd.create(meta, data)
+		if f == nil {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, f)
+		return
+	}
+
+	f, ok := fd.files[strings.TrimPrefix(id, "/")]
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+	f.data = data
+	f.Size = int64(len(data))
+	writeJSON(w, http.StatusOK, &f.File)
+}
+
+// create adds a file, returning nil if its parent doesn't exist.
+func (fd *fakeDrive) create(meta *drive.File, data []byte) *drive.File {
+	for _, parent := range meta.Parents {
+		if _, ok := fd.files[parent]; !ok && parent != "root" {
+			return nil
+		}
+	}
+
+	fd.nextID++
+	f := &fakeFile{File: *meta, data: data}
+	f.Id = "file-" + strconv.Itoa(fd.nextID)
+	f.Size = int64(len(data))
+	if len(f.Parents) == 0 {
+		f.Parents = []string{"root"}
+	}
+	fd.files[f.Id] = f
+
+	file := f.File
+	return &file
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": http.StatusText(status)},
+	})
+}
+
+func TestGoogleDriveStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite.gdrive")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fd := newFakeDrive()
+	defer fd.use(dir)()
+
+	// the first backend authorizes knoxite with the device flow
+	be, err := knoxite.BackendFromURL("gdrive://backups/knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+	if fd.polls != 2 {
+		t.Errorf("Expected the token endpoint to be polled twice, got %d", fd.polls)
+	}
+	if err = be.InitRepository(); err != nil {
+		t.Fatalf("Failed initializing repository: %s", err)
+	}
+	if err = be.InitRepository(); err != knoxite.ErrRepositoryExists {
+		t.Errorf("Expected %v, got %v", knoxite.ErrRepositoryExists, err)
+	}
+
+	data := []byte("this is an encrypted chunk")
+	shasum := knoxite.Hash(data, knoxite.HashHighway256)
+	if _, err = be.StoreChunk(shasum, 0, 1, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if err = be.SaveRepository([]byte("repository")); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+	if err = be.SaveRepository([]byte("updated repository")); err != nil {
+		t.Fatalf("Failed updating repository: %s", err)
+	}
+
+	space, err := be.AvailableSpace()
+	if err != nil {
+		t.Fatalf("Failed getting available space: %s", err)
+	}
+	if expected := uint64(fd.limit) - uint64(len(data)+len("updated repository")); space != expected {
+		t.Errorf("Expected %d bytes of available space, got %d", expected, space)
+	}
+
+	// a second backend uses the cached token and sees the same folders
+	be, err = knoxite.BackendFromURL("gdrive://backups/knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+	if fd.polls != 2 {
+		t.Errorf("Expected the cached token to be used, got %d polls", fd.polls)
+	}
+	b, err := be.LoadRepository()
+	if err != nil || string(b) != "updated repository" {
+		t.Errorf("Failed loading repository: %v %q", err, b)
+	}
+	b, err = be.LoadChunk(shasum, 0, 1)
+	if err != nil || string(b) != string(data) {
+		t.Errorf("Failed loading chunk: %v %q", err, b)
+	}
+
+	if err = be.DeleteChunk(shasum, 0, 1); err != nil {
+		t.Fatalf("Failed deleting chunk: %s", err)
+	}
+	if _, err = be.LoadChunk(shasum, 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected deleted chunk to be missing, got %v", err)
+	}
+}
+
+func TestGoogleDriveTokenRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite.gdrive")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fd := newFakeDrive()
+	defer fd.use(dir)()
+
+	// cache an expired token, which has to be refreshed
+	path := filepath.Join(dir, "token.json")
+	expired := `{"access_token":"expired","refresh_token":"refresh-token","token_type":"Bearer","expiry":"2000-01-01T00:00:00Z"}`
+	if err = ioutil.WriteFile(path, []byte(expired), 0600); err != nil {
+		t.Fatalf("Failed writing token: %s", err)
+	}
+
+	be, err := knoxite.BackendFromURL("gdrive://knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+	if err = be.InitRepository(); err != nil {
+		t.Fatalf("Failed initializing repository: %s", err)
+	}
+	if fd.polls != 0 {
+		t.Errorf("Expected no device authorization, got %d polls", fd.polls)
+	}
+
+	tok, err := loadToken(path)
+	if err != nil {
+		t.Fatalf("Failed loading token: %s", err)
+	}
+	if tok.AccessToken != fd.current {
+		t.Errorf("Expected refreshed token %s to be cached, got %s", fd.current, tok.AccessToken)
+	}
+}
+
+func TestGoogleDriveRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite.gdrive")
+	if err != nil {
+		t.Fatalf("Failed creating temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fd := newFakeDrive()
+	defer fd.use(dir)()
+
+	be, err := knoxite.BackendFromURL("gdrive://backups/knoxite")
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+	if err = be.InitRepository(); err != nil {
+		t.Fatalf("Failed initializing repository: %s", err)
+	}
+
+	// a new part only gets looked up once, before it's uploaded
+	data := []byte("this is an encrypted chunk")
+	shasum := knoxite.Hash(data, knoxite.HashHighway256)
+	if _, err = be.StoreChunk(shasum, 0, 2, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	fd.lists = 0
+	if _, err = be.StoreChunk(shasum, 1, 2, data); err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if fd.lists != 1 {
+		t.Errorf("Expected 1 lookup storing a new part, got %d", fd.lists)
+	}
+
+	// known files get updated without looking them up again
+	if err = be.SaveRepository([]byte("repository")); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+	fd.lists = 0
+	if err = be.SaveRepository([]byte("updated repository")); err != nil {
+		t.Fatalf("Failed updating repository: %s", err)
+	}
+	if b, err := be.LoadRepository(); err != nil || string(b) != "updated repository" {
+		t.Errorf("Failed loading repository: %v %q", err, b)
+	}
+	if fd.lists != 0 {
+		t.Errorf("Expected no lookups for a known file, got %d", fd.lists)
+	}
+
+	// concurrent callers create a folder only once
+	gd := be.(*GoogleDriveStorage)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := gd.CreatePath("backups/knoxite/a/b"); err != nil {
+				t.Errorf("Failed creating path: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	folders := 0
+	for _, f := range fd.files {
+		if f.Name == "b" {
+			folders++
+		}
+	}
+	if folders != 1 {
+		t.Errorf("Expected the folder to be created once, got %d folders", folders)
+	}
+}
@@ -9,23 +9,114 @@
 package googledrive
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 
 	"github.com/knoxite/knoxite"
 )
 
 // GoogleDriveStorage stores data on a remote Google Drive.
 type GoogleDriveStorage struct {
-	url url.URL
+	url     url.URL
+	service *drive.Service
+
+	mu      sync.Mutex
+	folders map[string]string        // IDs of the folders by their path
+	pending map[string]chan struct{} // folders being looked up or created
+	// IDs of the files by their path, empty for files known to be missing
+	files map[string]string
+
+	knoxite.StorageFilesystem
 }
 
+// Error declarations
+var (
+	ErrMissingClientCredentials = errors.New("Missing OAuth2 client ID and secret, set KNOXITE_GDRIVE_CLIENT_ID and KNOXITE_GDRIVE_CLIENT_SECRET")
+)
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// driveEndpoint overrides the endpoint of the Drive API, if set.
+var driveEndpoint = ""
+
 func init() {
 	knoxite.RegisterStorageBackend(&GoogleDriveStorage{})
 }
 
-// NewBackend returns a GoogleDriveStorage backend.
+// NewBackend returns a GoogleDriveStorage backend. URLs have the form
+// gdrive://[client_id:client_secret@]folder/path. The client credentials can
+// also be provided via the environment variables KNOXITE_GDRIVE_CLIENT_ID and
+// KNOXITE_GDRIVE_CLIENT_SECRET.
+//
+// Unless a token has been cached before, the user gets asked to authorize
+// knoxite's access to Google Drive on another device.
 func (*GoogleDriveStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
-	return &GoogleDriveStorage{}, knoxite.ErrInvalidRepositoryURL
+	root := strings.Trim(u.Host+u.Path, "/")
+	if root == "" {
+		return &GoogleDriveStorage{}, knoxite.ErrInvalidRepositoryURL
+	}
+
+	clientID := os.Getenv("KNOXITE_GDRIVE_CLIENT_ID")
+	clientSecret := os.Getenv("KNOXITE_GDRIVE_CLIENT_SECRET")
+	if u.User != nil && u.User.Username() != "" {
+		clientID = u.User.Username()
+		clientSecret, _ = u.User.Password()
+	}
+	if clientID == "" || clientSecret == "" {
+		return &GoogleDriveStorage{}, ErrMissingClientCredentials
+	}
+
+	conf := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     oauthEndpoint,
+		Scopes:       []string{drive.DriveFileScope},
+	}
+	ts, err := tokenSource(conf)
+	if err != nil {
+		return &GoogleDriveStorage{}, err
+	}
+
+	ctx := context.Background()
+	opts := []option.ClientOption{option.WithHTTPClient(oauth2.NewClient(ctx, ts))}
+	if driveEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(driveEndpoint))
+	}
+	service, err := drive.NewService(ctx, opts...)
+	if err != nil {
+		return &GoogleDriveStorage{}, err
+	}
+
+	backend := GoogleDriveStorage{
+		url:     u,
+		service: service,
+		folders: map[string]string{"": "root"},
+		pending: make(map[string]chan struct{}),
+		files:   make(map[string]string),
+	}
+
+	fs, err := knoxite.NewStorageFilesystem(root, &backend)
+	if err != nil {
+		return &GoogleDriveStorage{}, err
+	}
+	backend.StorageFilesystem = fs
+
+	return &backend, nil
 }
 
 // Location returns the type and location of the repository.
@@ -50,56 +141,301 @@ func (backend *GoogleDriveStorage) Description() string {
 
 // AvailableSpace returns the free space on this backend.
 func (backend *GoogleDriveStorage) AvailableSpace() (uint64, error) {
-	return 0, knoxite.ErrAvailableSpaceUnknown
+	about, err := backend.service.About.Get().Fields("storageQuota").Do()
+	if err != nil {
+		return 0, err
+	}
+
+	quota := about.StorageQuota
+	if quota == nil || quota.Limit == 0 {
+		// accounts with unlimited storage have no limit
+		return 0, knoxite.ErrAvailableSpaceUnlimited
+	}
+	if quota.Usage >= quota.Limit {
+		return 0, nil
+	}
+	return uint64(quota.Limit - quota.Usage), nil
+}
+
+// CreatePath creates a dir including all its parent dirs, when required.
+func (backend *GoogleDriveStorage) CreatePath(p string) error {
+	_, err := backend.folder(p, true)
+	return err
 }
 
-// LoadChunk loads a Chunk from Google Drive.
-func (backend *GoogleDriveStorage) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
-	return []byte{}, knoxite.ErrLoadChunkFailed
+// Stat returns the size of a file.
+func (backend *GoogleDriveStorage) Stat(p string) (uint64, error) {
+	f, err := backend.file(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(f.Size), nil
 }
 
-// StoreChunk stores a single Chunk on Google Drive.
-func (backend *GoogleDriveStorage) StoreChunk(shasum string, part, totalParts uint, data []byte) (size uint64, err error) {
-	return 0, knoxite.ErrStoreChunkFailed
+// ReadFile reads a file from Google Drive.
+func (backend *GoogleDriveStorage) ReadFile(p string) ([]byte, error) {
+	id, err := backend.fileID(p)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := backend.service.Files.Get(id).Download()
+	if err != nil {
+		backend.forget(p)
+		return nil, notFound(p, err)
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
 }
 
-// DeleteChunk deletes a single Chunk.
-func (backend *GoogleDriveStorage) DeleteChunk(shasum string, parts, totalParts uint) error {
-	// FIXME: implement this
-	return knoxite.ErrDeleteChunkFailed
+// WriteFile writes a file to Google Drive, replacing an existing file. The
+// file only gets looked up if it's unknown whether it already exists.
+func (backend *GoogleDriveStorage) WriteFile(p string, data []byte) (uint64, error) {
+	dir, name := split(p)
+	parent, err := backend.folder(dir, true)
+	if err != nil {
+		return 0, err
+	}
+
+	id, known := backend.cached(p)
+	if !known {
+		f, err := backend.find(parent, name)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if f != nil {
+			id = f.Id
+		}
+	}
+
+	// upload the data in a single request
+	if id != "" {
+		_, err = backend.service.Files.Update(id, &drive.File{}).Media(bytes.NewReader(data), googleapi.ChunkSize(0)).Do()
+		if os.IsNotExist(notFound(p, err)) {
+			// deleted in the meantime
+			id = ""
+		} else if err != nil {
+			backend.forget(p)
+			return 0, err
+		}
+	}
+	if id == "" {
+		f, err := backend.service.Files.Create(&drive.File{
+			Name:    name,
+			Parents: []string{parent},
+		}).Media(bytes.NewReader(data), googleapi.ChunkSize(0)).Fields("id").Do()
+		if err != nil {
+			backend.forget(p)
+			return 0, err
+		}
+		id = f.Id
+	}
+
+	backend.remember(p, id)
+	return uint64(len(data)), nil
 }
 
-// LoadSnapshot loads a snapshot.
-func (backend *GoogleDriveStorage) LoadSnapshot(id string) ([]byte, error) {
-	return []byte{}, knoxite.ErrSnapshotNotFound
+// DeleteFile deletes a file from Google Drive.
+func (backend *GoogleDriveStorage) DeleteFile(p string) error {
+	id, err := backend.fileID(p)
+	if err != nil {
+		return err
+	}
+
+	err = notFound(p, backend.service.Files.Delete(id).Do())
+	if err != nil {
+		backend.forget(p)
+		return err
+	}
+	backend.remember(p, "")
+	return nil
 }
 
-// SaveSnapshot stores a snapshot.
-func (backend *GoogleDriveStorage) SaveSnapshot(id string, data []byte) error {
-	return knoxite.ErrStoreSnapshotFailed
+// file looks up the file or folder at path.
+func (backend *GoogleDriveStorage) file(p string) (*drive.File, error) {
+	dir, name := split(p)
+	parent, err := backend.folder(dir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := backend.find(parent, name)
+	switch {
+	case err == nil:
+		backend.remember(p, f.Id)
+	case os.IsNotExist(err):
+		backend.remember(p, "")
+	default:
+		backend.forget(p)
+	}
+	if err != nil {
+		return nil, notFound(p, err)
+	}
+	return f, nil
 }
 
-// LoadChunkIndex reads the chunk-index.
-func (backend *GoogleDriveStorage) LoadChunkIndex() ([]byte, error) {
-	return []byte{}, knoxite.ErrLoadChunkIndexFailed
+// fileID returns the ID of the file at path, looking it up if necessary.
+func (backend *GoogleDriveStorage) fileID(p string) (string, error) {
+	if id, known := backend.cached(p); known && id != "" {
+		return id, nil
+	}
+
+	f, err := backend.file(p)
+	if err != nil {
+		return "", err
+	}
+	return f.Id, nil
+}
+
+// cached returns the cached ID of a file and whether it's known at all. The
+// knowledge of a missing file is only used once, as another client could
+// create it.
+func (backend *GoogleDriveStorage) cached(p string) (string, bool) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	p = clean(p)
+	id, ok := backend.files[p]
+	if ok && id == "" {
+		delete(backend.files, p)
+	}
+	return id, ok
+}
+
+// remember caches the ID of a file, or that it's missing if id is empty.
+func (backend *GoogleDriveStorage) remember(p, id string) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	backend.files[clean(p)] = id
+}
+
+// forget drops a file from the cache, e.g. after a failed request.
+func (backend *GoogleDriveStorage) forget(p string) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	delete(backend.files, clean(p))
+}
+
+// folder returns the ID of the folder at path, creating it and its parents
+// if create is true. Folder IDs get cached and each folder is only looked up
+// or created by one caller at a time, without blocking other requests.
+func (backend *GoogleDriveStorage) folder(p string, create bool) (string, error) {
+	backend.mu.Lock()
+	id := backend.folders[""]
+	backend.mu.Unlock()
+
+	p = clean(p)
+	if p == "" {
+		return id, nil
+	}
+
+	walked := ""
+	for _, name := range strings.Split(p, "/") {
+		walked = path.Join(walked, name)
+		for {
+			backend.mu.Lock()
+			if cached, ok := backend.folders[walked]; ok {
+				backend.mu.Unlock()
+				id = cached
+				break
+			}
+			if wait, ok := backend.pending[walked]; ok {
+				// another caller is busy with this folder
+				backend.mu.Unlock()
+				<-wait
+				continue
+			}
+			done := make(chan struct{})
+			backend.pending[walked] = done
+			backend.mu.Unlock()
+
+			folderID, err := backend.lookupFolder(id, name, create)
+
+			backend.mu.Lock()
+			delete(backend.pending, walked)
+			if err == nil {
+				backend.folders[walked] = folderID
+			}
+			backend.mu.Unlock()
+			close(done)
+
+			if err != nil {
+				return "", notFound(walked, err)
+			}
+			id = folderID
+			break
+		}
+	}
+
+	return id, nil
+}
+
+// lookupFolder returns the ID of the folder named name within the folder
+// parent, creating it if create is true.
+func (backend *GoogleDriveStorage) lookupFolder(parent, name string, create bool) (string, error) {
+	f, err := backend.find(parent, name)
+	if err == nil {
+		return f.Id, nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return "", err
+	}
+
+	f, err = backend.service.Files.Create(&drive.File{
+		Name:     name,
+		MimeType: folderMimeType,
+		Parents:  []string{parent},
+	}).Fields("id").Do()
+	if err != nil {
+		return "", err
+	}
+	return f.Id, nil
+}
+
+// find returns the file named name within the folder parent.
+func (backend *GoogleDriveStorage) find(parent, name string) (*drive.File, error) {
+	q := fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false", escape(name), escape(parent))
+	list, err := backend.service.Files.List().Q(q).Fields("files(id, name, mimeType, size)").Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Files) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	return list.Files[0], nil
 }
 
-// SaveChunkIndex stores the chunk-index.
-func (backend *GoogleDriveStorage) SaveChunkIndex(data []byte) error {
-	return knoxite.ErrStoreChunkIndexFailed
+// split splits a path into its dir and file name.
+func split(p string) (string, string) {
+	p = clean(p)
+	dir, name := path.Split(p)
+	return strings.TrimSuffix(dir, "/"), name
 }
 
-// InitRepository creates a new repository.
-func (backend *GoogleDriveStorage) InitRepository() error {
-	return knoxite.ErrInvalidRepositoryURL
+// clean returns the canonical form of a path, relative to the Drive's root.
+func clean(p string) string {
+	p = strings.Trim(path.Clean(filepath.ToSlash(p)), "/")
+	if p == "." {
+		return ""
+	}
+	return p
 }
 
-// LoadRepository reads the metadata for a repository.
-func (backend *GoogleDriveStorage) LoadRepository() ([]byte, error) {
-	return []byte{}, knoxite.ErrLoadRepositoryFailed
+// escape escapes a value for use in a Drive query.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
 }
 
-// SaveRepository stores the metadata for a repository.
-func (backend *GoogleDriveStorage) SaveRepository(data []byte) error {
-	return knoxite.ErrStoreRepositoryFailed
+// notFound converts a Drive API error for a missing file into an error
+// satisfying os.IsNotExist.
+func notFound(p string, err error) error {
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	return err
 }
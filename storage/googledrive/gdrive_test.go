@@ -0,0 +1,102 @@
+// +build backend
+
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package googledrive
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/knoxite/knoxite/storage"
+)
+
+var (
+	backendTest *storage.BackendTest
+)
+
+func TestMain(m *testing.M) {
+	// without a real Drive configured, the tests run against a local fake.
+	// RunBackendTester exits, so it gets cleaned up in TearDown.
+	cleanup := func() {}
+	gdriveurl := os.Getenv("KNOXITE_GDRIVE_URL")
+	if len(gdriveurl) == 0 {
+		dir, err := ioutil.TempDir("", "knoxite.gdrive")
+		if err != nil {
+			panic(err)
+		}
+
+		restore := newFakeDrive().use(dir)
+		cleanup = func() {
+			restore()
+			os.RemoveAll(dir)
+		}
+		gdriveurl = "gdrive://knoxite-" + storage.RandomSuffix()
+	}
+
+	backendTest = &storage.BackendTest{
+		URL:         gdriveurl,
+		Protocols:   []string{"gdrive"},
+		Description: "Google Drive Storage",
+		TearDown: func(tb *storage.BackendTest) {
+			defer cleanup()
+
+			db := tb.Backend.(*GoogleDriveStorage)
+			id, err := db.folder(db.Path, false)
+			if err != nil {
+				panic(err)
+			}
+			if err = db.service.Files.Delete(id).Do(); err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	storage.RunBackendTester(backendTest, m)
+}
+
+func TestStorageNewBackend(t *testing.T) {
+	backendTest.NewBackendTest(t)
+}
+
+func TestStorageLocation(t *testing.T) {
+	backendTest.LocationTest(t)
+}
+
+func TestStorageProtocols(t *testing.T) {
+	backendTest.ProtocolsTest(t)
+}
+
+func TestStorageDescription(t *testing.T) {
+	backendTest.DescriptionTest(t)
+}
+
+func TestStorageInitRepository(t *testing.T) {
+	backendTest.InitRepositoryTest(t)
+}
+
+func TestStorageSaveRepository(t *testing.T) {
+	backendTest.SaveRepositoryTest(t)
+}
+
+func TestAvailableSpace(t *testing.T) {
+	backendTest.AvailableSpaceTest(t)
+}
+
+func TestStorageSaveSnapshot(t *testing.T) {
+	backendTest.SaveSnapshotTest(t)
+}
+
+func TestStorageStoreChunk(t *testing.T) {
+	backendTest.StoreChunkTest(t)
+}
+
+func TestStorageDeleteChunk(t *testing.T) {
+	backendTest.DeleteChunkTest(t)
+}
@@ -0,0 +1,385 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package http
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/knoxite/knoxite"
+)
+
+// testServer stores uploaded files in memory, like knoxite's server without
+// any of its restrictions. Requests to a path in status get answered with
+// that status and header instead.
+type testServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	files  map[string][]byte
+	status map[string]int
+	header http.Header
+	auth   []string
+	conns  int32
+	delay  time.Duration
+}
+
+func newTestServer(tlsConfig *tls.Config) *testServer {
+	s := &testServer{
+		files:  make(map[string][]byte),
+		status: make(map[string]int),
+		header: make(http.Header),
+	}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	// failed handshakes are expected
+	s.Server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.Server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&s.conns, 1)
+		}
+	}
+	if tlsConfig != nil {
+		s.Server.TLS = tlsConfig
+		s.StartTLS()
+	} else {
+		s.Start()
+	}
+	return s
+}
+
+func (s *testServer) url(query string) string {
+	u := strings.Replace(s.URL, "://", "://alice:secret@", 1) + "/repo"
+	if query != "" {
+		u += "?" + query
+	}
+	return u
+}
+
+func (s *testServer) handle(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.auth = append(s.auth, r.Header.Get("Authorization"))
+	if status, ok := s.status[r.URL.Path]; ok {
+		for k, v := range s.header {
+			w.Header()[k] = v
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := s.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodPost:
+		f, fh, err := r.FormFile("uploadfile")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		data, _ := ioutil.ReadAll(f)
+
+		p := r.URL.Path
+		if strings.HasSuffix(p, "/upload") {
+			p = strings.TrimSuffix(p, "/upload") + "/download/" + fh.Filename
+			w.WriteHeader(http.StatusCreated)
+		} else if strings.HasSuffix(p, "/snapshot") {
+			p += "/" + fh.Filename
+		}
+		s.files[p] = data
+	case http.MethodDelete:
+		if _, ok := s.files[r.URL.Path]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.files, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newBackend(t *testing.T, rawurl string) *HTTPStorage {
+	be, err := knoxite.BackendFromURL(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return be.(*HTTPStorage)
+}
+
+func testRepository(t *testing.T, be *HTTPStorage) {
+	data := make([]byte, 4096)
+	_, _ = rand.Read(data)
+	if size, err := be.StoreChunk("abcd", 0, 1, data); err != nil || size != uint64(len(data)) {
+		t.Fatalf("Expected to store %d bytes, got %d: %v", len(data), size, err)
+	}
+	if err := be.SaveSnapshot("0123abcd", []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SaveChunkIndex([]byte("index")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		load     func() ([]byte, error)
+		expected []byte
+	}{
+		{be.LoadRepository, []byte("repository")},
+		{be.LoadChunkIndex, []byte("index")},
+		{func() ([]byte, error) { return be.LoadSnapshot("0123abcd") }, []byte("snapshot")},
+		{func() ([]byte, error) { return be.LoadChunk("abcd", 0, 1) }, data},
+	} {
+		if loaded, err := tt.load(); err != nil || !bytes.Equal(loaded, tt.expected) {
+			t.Errorf("Expected to load %q, got %q: %v", tt.expected, loaded, err)
+		}
+	}
+
+	if err := be.DeleteChunk("abcd", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.LoadChunk("abcd", 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected deleted chunk not to exist, got %v", err)
+	}
+	if err := be.DeleteChunk("abcd", 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected deleting a missing chunk to fail, got %v", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	be := newBackend(t, s.url("timeout=1m"))
+	testRepository(t, be)
+	if err := be.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every request got authenticated, even with a query in the URL
+	for _, auth := range s.auth {
+		if auth != "Basic YWxpY2U6c2VjcmV0" {
+			t.Fatalf("Expected basic auth for every request, got %q", auth)
+		}
+	}
+	if s.conns != 1 {
+		t.Errorf("Expected connection to be reused, got %d connections", s.conns)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "knoxite-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	be := newBackend(t, s.url("tokenfile="+tokenFile))
+	if err := be.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	if s.auth[0] != "Bearer s3cr3t" {
+		t.Errorf("Expected bearer token, got %q", s.auth[0])
+	}
+
+	if err := ioutil.WriteFile(tokenFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := knoxite.BackendFromURL(s.url("tokenfile=" + tokenFile)); err != ErrEmptyToken {
+		t.Errorf("Expected %v, got %v", ErrEmptyToken, err)
+	}
+
+	// tokens are scoped to the URL, the environment doesn't leak one to
+	// other servers
+	os.Setenv("KNOXITE_HTTP_TOKEN", "s3cr3t")
+	defer os.Unsetenv("KNOXITE_HTTP_TOKEN")
+	if err := newBackend(t, s.url("")).SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	if auth := s.auth[len(s.auth)-1]; strings.HasPrefix(auth, "Bearer") {
+		t.Errorf("Expected no token to be sent, got %q", auth)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+	be := newBackend(t, s.url(""))
+
+	for _, tt := range []struct {
+		status int
+		header string
+		op     func() error
+		check  func(error) bool
+	}{
+		{http.StatusUnauthorized, "", func() error { _, err := be.LoadRepository(); return err },
+			func(err error) bool { return err == knoxite.ErrUnauthorized }},
+		{http.StatusForbidden, "", func() error { _, err := be.LoadRepository(); return err },
+			os.IsPermission},
+		// only the knoxite server's refusals mean append-only mode, e.g. a
+		// proxy may forbid changes for other reasons
+		{http.StatusForbidden, "", func() error { return be.SaveRepository(nil) },
+			os.IsPermission},
+		{http.StatusForbidden, appendOnlyHeader, func() error { return be.SaveRepository(nil) },
+			func(err error) bool { return err == knoxite.ErrAppendOnly }},
+		{http.StatusInsufficientStorage, "", func() error { return be.SaveRepository(nil) },
+			func(err error) bool { return err == knoxite.ErrInsufficientStorage }},
+		{http.StatusInternalServerError, "", func() error { _, err := be.LoadRepository(); return err },
+			func(err error) bool { return errors.Is(err, knoxite.ErrLoadRepositoryFailed) }},
+		{http.StatusBadGateway, "", func() error { return be.SaveRepository(nil) },
+			func(err error) bool { return errors.Is(err, knoxite.ErrStoreRepositoryFailed) }},
+	} {
+		s.status["/repo/repository"] = tt.status
+		s.header = make(http.Header)
+		if tt.header != "" {
+			s.header.Set(tt.header, "true")
+		}
+		if err := tt.op(); !tt.check(err) {
+			t.Errorf("Unexpected error for status %d: %v", tt.status, err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+	s.delay = 200 * time.Millisecond
+
+	be := newBackend(t, s.url("timeout=50ms"))
+	if _, err := be.LoadRepository(); err == nil || os.IsNotExist(err) {
+		t.Errorf("Expected the request to time out, got %v", err)
+	}
+}
+
+func testCertificates(t *testing.T, dir string) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "knoxite"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, certFile, keyFile := testCertificates(t, dir)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	s := newTestServer(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	defer s.Close()
+
+	testRepository(t, newBackend(t, s.url("ca="+certFile+"&cert="+certFile+"&key="+keyFile)))
+
+	// without a client certificate the handshake fails
+	be := newBackend(t, s.url("ca="+certFile))
+	if _, err := be.LoadRepository(); err == nil {
+		t.Errorf("Expected the server to require a client certificate")
+	}
+	// without the CA the server can't be verified
+	be = newBackend(t, s.url("cert="+certFile+"&key="+keyFile))
+	if _, err := be.LoadRepository(); err == nil {
+		t.Errorf("Expected the server's certificate not to be trusted")
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, rawurl := range []string{
+		"http:///repo",
+		"http://127.0.0.1/repo?timeout=soon",
+		"https://127.0.0.1/repo?ca=/does/not/exist",
+		"https://127.0.0.1/repo?key=/tmp/key.pem",
+		"http://127.0.0.1/repo?tokenfile=/does/not/exist",
+	} {
+		if _, err := knoxite.BackendFromURL(rawurl); err == nil {
+			t.Errorf("Expected an error for %s", rawurl)
+		}
+	}
+}
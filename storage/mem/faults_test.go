@@ -0,0 +1,111 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package mem
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+)
+
+func TestRepositoryInMemory(t *testing.T) {
+	defer Delete("repository")
+
+	r, err := knoxite.NewRepository("mem://repository", "this_is_a_password")
+	if err != nil {
+		t.Fatalf("Failed creating repository: %s", err)
+	}
+	vol, _ := knoxite.NewVolume("test_name", "test_description")
+	_ = r.AddVolume(vol)
+	if err = r.Save(); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+
+	// the repository can be opened again within the same process
+	r, err = knoxite.OpenRepository("mem://repository", "this_is_a_password")
+	if err != nil {
+		t.Fatalf("Failed opening repository: %s", err)
+	}
+	if _, err = r.FindVolume(vol.ID); err != nil {
+		t.Errorf("Failed finding volume: %s", err)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	defer Delete("concurrent")
+
+	be, err := knoxite.BackendFromURL("mem://concurrent")
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			data := bytes.Repeat([]byte{byte(i)}, 64)
+			shasum := knoxite.Hash(data, knoxite.HashHighway256)
+			for j := 0; j < 50; j++ {
+				if _, err := be.StoreChunk(shasum, 0, 1, data); err != nil {
+					t.Errorf("Failed storing chunk: %s", err)
+				}
+				b, err := be.LoadChunk(shasum, 0, 1)
+				if err != nil || !bytes.Equal(b, data) {
+					t.Errorf("Failed loading chunk: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestFaultInjection(t *testing.T) {
+	defer Delete("faults")
+
+	be, err := knoxite.BackendFromURL("mem://faults?fail=50&seed=1")
+	if err != nil {
+		t.Fatalf("Failed creating backend: %s", err)
+	}
+
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if err := be.SaveRepository([]byte("data")); err == ErrInjectedFault {
+			failed++
+		} else if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if failed < 400 || failed > 600 {
+		t.Errorf("Expected about half of the operations to fail, got %d", failed)
+	}
+
+	// corrupted writes succeed, but don't store the original data
+	mem := be.(*MemStorage)
+	mem.SetFaults(Faults{CorruptRate: 100})
+	data := []byte("this is an encrypted chunk")
+	if err = be.SaveRepository(data); err != nil {
+		t.Fatalf("Failed saving repository: %s", err)
+	}
+	mem.SetFaults(Faults{})
+	b, err := be.LoadRepository()
+	if err != nil {
+		t.Fatalf("Failed loading repository: %s", err)
+	}
+	if bytes.Equal(b, data) || len(b) != len(data) {
+		t.Errorf("Expected corrupted data of the same length, got %q", b)
+	}
+
+	// a backend with invalid fault parameters can't be created
+	if _, err = knoxite.BackendFromURL("mem://faults?latency=fast"); err != knoxite.ErrInvalidRepositoryURL {
+		t.Errorf("Expected %v, got %v", knoxite.ErrInvalidRepositoryURL, err)
+	}
+}
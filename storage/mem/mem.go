@@ -0,0 +1,329 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+// Package mem implements a storage backend keeping all data in memory.
+//
+// Repositories are identified by the host and path of their URL, e.g.
+// mem://name/path, so a repository can be opened again within the same process.
+// Faults can be injected with the URL's query parameters:
+//
+//	fail=10       fails 10% of all file operations
+//	corrupt=5     silently corrupts 5% of all written files
+//	latency=20ms  adds latency to every operation
+//	seed=42       seeds the randomness of injected faults
+package mem
+
+import (
+	"errors"
+	"math/rand"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/knoxite/knoxite"
+)
+
+// Error declarations
+var (
+	ErrInjectedFault = errors.New("Injected fault")
+)
+
+// Faults configures the faults injected into the operations of a MemStorage.
+type Faults struct {
+	// FailRate is the percentage of operations which fail
+	FailRate float64
+	// CorruptRate is the percentage of writes which silently store
+	// corrupted data
+	CorruptRate float64
+	// Latency gets added to every operation
+	Latency time.Duration
+}
+
+// MemStorage stores data in memory.
+type MemStorage struct {
+	url   url.URL
+	store *memStore
+
+	mu     sync.Mutex
+	faults Faults
+	rand   *rand.Rand
+
+	knoxite.StorageFilesystem
+}
+
+// memStore holds the files and dirs of a repository.
+type memStore struct {
+	sync.RWMutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = make(map[string]*memStore)
+)
+
+func init() {
+	knoxite.RegisterStorageBackend(&MemStorage{})
+}
+
+// NewBackend returns a MemStorage backend.
+func (*MemStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
+	q := u.Query()
+	faults := Faults{}
+	seed := time.Now().UnixNano()
+
+	var err error
+	if v := q.Get("fail"); v != "" {
+		if faults.FailRate, err = strconv.ParseFloat(v, 64); err != nil {
+			return &MemStorage{}, knoxite.ErrInvalidRepositoryURL
+		}
+	}
+	if v := q.Get("corrupt"); v != "" {
+		if faults.CorruptRate, err = strconv.ParseFloat(v, 64); err != nil {
+			return &MemStorage{}, knoxite.ErrInvalidRepositoryURL
+		}
+	}
+	if v := q.Get("latency"); v != "" {
+		if faults.Latency, err = time.ParseDuration(v); err != nil {
+			return &MemStorage{}, knoxite.ErrInvalidRepositoryURL
+		}
+	}
+	if v := q.Get("seed"); v != "" {
+		if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return &MemStorage{}, knoxite.ErrInvalidRepositoryURL
+		}
+	}
+
+	backend := MemStorage{
+		url:    u,
+		store:  openStore(u.Host + u.Path),
+		faults: faults,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+
+	fs, err := knoxite.NewStorageFilesystem("/", &backend)
+	if err != nil {
+		return &MemStorage{}, err
+	}
+	backend.StorageFilesystem = fs
+
+	return &backend, nil
+}
+
+// openStore returns the store named name, creating it when required.
+func openStore(name string) *memStore {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	s, ok := stores[name]
+	if !ok {
+		s = &memStore{
+			files: make(map[string][]byte),
+			dirs:  make(map[string]bool),
+		}
+		stores[name] = s
+	}
+
+	return s
+}
+
+// Delete frees the repository identified by the host and path of a mem://
+// URL, e.g. "name/path". Backends still using it keep their data.
+func Delete(name string) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	delete(stores, name)
+}
+
+// SetFaults changes the faults injected into the backend's operations.
+func (backend *MemStorage) SetFaults(faults Faults) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	backend.faults = faults
+}
+
+// chance returns true with a probability of percent.
+func (backend *MemStorage) chance(percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	return backend.rand.Float64()*100 < percent
+}
+
+// inject delays an operation and returns ErrInjectedFault if it should fail.
+func (backend *MemStorage) inject() error {
+	backend.mu.Lock()
+	latency := backend.faults.Latency
+	fail := backend.chance(backend.faults.FailRate)
+	backend.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fail {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// corrupt flips a random byte of data, if a write should be corrupted.
+func (backend *MemStorage) corrupt(data []byte) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if len(data) > 0 && backend.chance(backend.faults.CorruptRate) {
+		data[backend.rand.Intn(len(data))] ^= 0xff
+	}
+}
+
+// clean returns the canonical form of a path.
+func clean(p string) string {
+	return path.Clean(filepath.ToSlash(p))
+}
+
+// Location returns the type and location of the repository.
+func (backend *MemStorage) Location() string {
+	return backend.url.String()
+}
+
+// Close the backend.
+func (backend *MemStorage) Close() error {
+	return nil
+}
+
+// Protocols returns the Protocol Schemes supported by this backend.
+func (backend *MemStorage) Protocols() []string {
+	return []string{"mem"}
+}
+
+// Description returns a user-friendly description for this backend.
+func (backend *MemStorage) Description() string {
+	return "Memory Storage"
+}
+
+// AvailableSpace returns the free space on this backend.
+func (backend *MemStorage) AvailableSpace() (uint64, error) {
+	return 0, knoxite.ErrAvailableSpaceUnknown
+}
+
+// CreatePath creates a dir including all its parent dirs, when required.
+func (backend *MemStorage) CreatePath(p string) error {
+	if err := backend.inject(); err != nil {
+		return err
+	}
+
+	backend.store.Lock()
+	defer backend.store.Unlock()
+
+	for p = clean(p); p != "/" && p != "."; p = path.Dir(p) {
+		backend.store.dirs[p] = true
+	}
+	return nil
+}
+
+// Stat returns the size of a file.
+func (backend *MemStorage) Stat(p string) (uint64, error) {
+	if err := backend.inject(); err != nil {
+		return 0, err
+	}
+
+	backend.store.RLock()
+	defer backend.store.RUnlock()
+
+	p = clean(p)
+	if b, ok := backend.store.files[p]; ok {
+		return uint64(len(b)), nil
+	}
+	if backend.store.dirs[p] {
+		return 0, nil
+	}
+	return 0, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+}
+
+// ReadFile reads a file from memory.
+func (backend *MemStorage) ReadFile(p string) ([]byte, error) {
+	if err := backend.inject(); err != nil {
+		return nil, err
+	}
+
+	backend.store.RLock()
+	defer backend.store.RUnlock()
+
+	p = clean(p)
+	b, ok := backend.store.files[p]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	return data, nil
+}
+
+// WriteFile writes a file to memory.
+func (backend *MemStorage) WriteFile(p string, data []byte) (uint64, error) {
+	if err := backend.inject(); err != nil {
+		return 0, err
+	}
+
+	b := make([]byte, len(data))
+	copy(b, data)
+	backend.corrupt(b)
+
+	backend.store.Lock()
+	defer backend.store.Unlock()
+
+	backend.store.files[clean(p)] = b
+	return uint64(len(data)), nil
+}
+
+// DeleteFile deletes a file from memory.
+func (backend *MemStorage) DeleteFile(p string) error {
+	if err := backend.inject(); err != nil {
+		return err
+	}
+
+	backend.store.Lock()
+	defer backend.store.Unlock()
+
+	p = clean(p)
+	if _, ok := backend.store.files[p]; !ok {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	delete(backend.store.files, p)
+	return nil
+}
+
+// ListFiles returns the sizes of all files in a dir.
+func (backend *MemStorage) ListFiles(p string) (map[string]uint64, error) {
+	if err := backend.inject(); err != nil {
+		return nil, err
+	}
+
+	backend.store.RLock()
+	defer backend.store.RUnlock()
+
+	p = clean(p)
+	if !backend.store.dirs[p] {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+
+	files := make(map[string]uint64)
+	for name, b := range backend.store.files {
+		if path.Dir(name) == p {
+			files[path.Base(name)] = uint64(len(b))
+		}
+	}
+	return files, nil
+}
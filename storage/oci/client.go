@@ -0,0 +1,502 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package oci
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Error declarations
+var (
+	ErrUnauthorized      = errors.New("Registry refused the credentials")
+	ErrDeleteUnsupported = errors.New("Registry doesn't permit deleting, it has to be enabled in its configuration")
+	ErrDigestMismatch    = errors.New("Blob doesn't match its digest")
+	ErrMissingLocation   = errors.New("Registry didn't return an upload location")
+)
+
+// registryError is an error reported by the registry.
+type registryError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *registryError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("registry responded with %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("registry responded with %s: %s", e.Code, e.Message)
+}
+
+// registry talks to a repository on a registry with the OCI distribution API.
+type registry struct {
+	base   url.URL
+	name   string
+	user   *url.Userinfo
+	client *http.Client
+
+	mu      sync.Mutex
+	basic   bool
+	token   string
+	actions map[string]bool
+}
+
+func newRegistry(base url.URL, name string, user *url.Userinfo) *registry {
+	return &registry{
+		base:    base,
+		name:    name,
+		user:    user,
+		client:  &http.Client{},
+		actions: make(map[string]bool),
+	}
+}
+
+// do sends a request to the registry, authenticating as requested by the
+// registry's challenge. ref is either a path below the repository or an
+// absolute URL.
+func (r *registry) do(method, ref string, header http.Header, body []byte) (*http.Response, error) {
+	u, err := r.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticated := false
+	for {
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		r.authorize(req)
+
+		res, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusUnauthorized {
+			return res, nil
+		}
+
+		challenge := res.Header.Get("WWW-Authenticate")
+		drain(res)
+		if authenticated {
+			return nil, ErrUnauthorized
+		}
+		if err := r.authenticate(challenge); err != nil {
+			return nil, err
+		}
+		authenticated = true
+	}
+}
+
+// resolve returns the URL of ref.
+func (r *registry) resolve(ref string) (*url.URL, error) {
+	if !strings.Contains(ref, "://") && !strings.HasPrefix(ref, "/") {
+		ref = "/v2/" + r.name + "/" + ref
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	return r.base.ResolveReference(u), nil
+}
+
+func (r *registry) authorize(req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case r.token != "":
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	case r.basic && r.user != nil:
+		password, _ := r.user.Password()
+		req.SetBasicAuth(r.user.Username(), password)
+	}
+}
+
+// authenticate answers a challenge of the registry, either by sending the
+// credentials with every request, or by fetching a token for them.
+func (r *registry) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.user == nil {
+			return ErrUnauthorized
+		}
+		r.mu.Lock()
+		r.basic = true
+		r.mu.Unlock()
+		return nil
+	case "bearer":
+		return r.fetchToken(params)
+	}
+	return ErrUnauthorized
+}
+
+// fetchToken gets a token from the registry's authorization service. The
+// token covers all actions requested so far, so it doesn't have to be
+// fetched again whenever an operation needs different permissions.
+func (r *registry) fetchToken(params map[string]string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return ErrUnauthorized
+	}
+
+	r.mu.Lock()
+	r.actions["pull"] = true
+	prefix := "repository:" + r.name + ":"
+	for _, scope := range strings.Fields(params["scope"]) {
+		if strings.HasPrefix(scope, prefix) {
+			for _, action := range strings.Split(strings.TrimPrefix(scope, prefix), ",") {
+				r.actions[action] = true
+			}
+		}
+	}
+	var actions []string
+	for action := range r.actions {
+		actions = append(actions, action)
+	}
+	r.mu.Unlock()
+	sort.Strings(actions)
+
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", prefix+strings.Join(actions, ","))
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.user != nil {
+		password, _ := r.user.Password()
+		req.SetBasicAuth(r.user.Username(), password)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drain(res)
+
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return ErrUnauthorized
+	}
+	if res.StatusCode != http.StatusOK {
+		return &registryError{Status: res.StatusCode}
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header. Its parameters' values
+// may be quoted and contain commas.
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i < 0 {
+		return header, params
+	}
+	scheme, header = header[:i], header[i+1:]
+
+	for header != "" {
+		header = strings.TrimLeft(header, " ,")
+		eq := strings.IndexByte(header, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(header[:eq]))
+		header = header[eq+1:]
+
+		var value string
+		if strings.HasPrefix(header, "\"") {
+			var b strings.Builder
+			j := 1
+			for ; j < len(header) && header[j] != '"'; j++ {
+				if header[j] == '\\' && j+1 < len(header) {
+					j++
+				}
+				b.WriteByte(header[j])
+			}
+			value = b.String()
+			header = header[min(j+1, len(header)):]
+		} else {
+			end := strings.IndexByte(header, ',')
+			if end < 0 {
+				end = len(header)
+			}
+			value = strings.TrimSpace(header[:end])
+			header = header[end:]
+		}
+		params[key] = value
+	}
+
+	return scheme, params
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// digest returns the OCI digest of data.
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// hasBlob returns true if the blob is stored in the repository.
+func (r *registry) hasBlob(dgst string) (bool, error) {
+	res, err := r.do(http.MethodHead, "blobs/"+dgst, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	drain(res)
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, &registryError{Status: res.StatusCode}
+}
+
+// pushBlob uploads data as a blob, unless it's already stored, and returns
+// its descriptor.
+func (r *registry) pushBlob(mediaType string, data []byte) (descriptor, error) {
+	desc := descriptor{
+		MediaType: mediaType,
+		Digest:    digest(data),
+		Size:      int64(len(data)),
+	}
+	if ok, err := r.hasBlob(desc.Digest); err != nil || ok {
+		return desc, err
+	}
+
+	res, err := r.do(http.MethodPost, "blobs/uploads/", nil, nil)
+	if err != nil {
+		return desc, err
+	}
+	if res.StatusCode != http.StatusAccepted {
+		return desc, responseError(res)
+	}
+	drain(res)
+
+	location, err := r.resolve(res.Header.Get("Location"))
+	if err != nil || res.Header.Get("Location") == "" {
+		return desc, ErrMissingLocation
+	}
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+
+	res, err = r.do(http.MethodPut, location.String(), http.Header{
+		"Content-Type": {"application/octet-stream"},
+	}, data)
+	if err != nil {
+		return desc, err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return desc, responseError(res)
+	}
+	drain(res)
+
+	return desc, nil
+}
+
+// pullBlob downloads a blob and verifies its digest.
+func (r *registry) pullBlob(dgst string) ([]byte, error) {
+	res, err := r.do(http.MethodGet, "blobs/"+dgst, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, notFound(dgst, responseError(res))
+	}
+	defer drain(res)
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if digest(data) != dgst {
+		return nil, ErrDigestMismatch
+	}
+	return data, nil
+}
+
+// pullManifest returns the manifest tagged with tag.
+func (r *registry) pullManifest(tag string) (manifest, error) {
+	var m manifest
+	res, err := r.do(http.MethodGet, "manifests/"+tag, http.Header{
+		"Accept": {mediaTypeManifest},
+	}, nil)
+	if err != nil {
+		return m, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return m, notFound(tag, responseError(res))
+	}
+	defer drain(res)
+
+	err = json.NewDecoder(res.Body).Decode(&m)
+	return m, err
+}
+
+// pushManifest tags a manifest with tag.
+func (r *registry) pushManifest(tag string, m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.do(http.MethodPut, "manifests/"+tag, http.Header{
+		"Content-Type": {mediaTypeManifest},
+	}, data)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return responseError(res)
+	}
+	drain(res)
+	return nil
+}
+
+// manifestDigest returns the digest of the manifest tagged with tag.
+func (r *registry) manifestDigest(tag string) (string, error) {
+	res, err := r.do(http.MethodHead, "manifests/"+tag, http.Header{
+		"Accept": {mediaTypeManifest},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	drain(res)
+	if res.StatusCode != http.StatusOK {
+		return "", notFound(tag, &registryError{Status: res.StatusCode})
+	}
+
+	if dgst := res.Header.Get("Docker-Content-Digest"); dgst != "" {
+		return dgst, nil
+	}
+
+	// the digest header is optional, fall back to hashing the manifest
+	res, err = r.do(http.MethodGet, "manifests/"+tag, http.Header{
+		"Accept": {mediaTypeManifest},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", notFound(tag, responseError(res))
+	}
+	defer drain(res)
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return digest(data), nil
+}
+
+// deleteManifest deletes the manifest tagged with tag. Registries only
+// delete manifests by their digest, which removes all their tags.
+func (r *registry) deleteManifest(tag string) error {
+	dgst, err := r.manifestDigest(tag)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.do(http.MethodDelete, "manifests/"+dgst, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	switch res.StatusCode {
+	case http.StatusAccepted:
+		drain(res)
+		return nil
+	case http.StatusMethodNotAllowed:
+		drain(res)
+		return ErrDeleteUnsupported
+	}
+	return notFound(tag, responseError(res))
+}
+
+// responseError returns the first error reported in the response's body and
+// closes it.
+func responseError(res *http.Response) error {
+	defer drain(res)
+
+	var body struct {
+		Errors []registryError `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || len(body.Errors) == 0 {
+		return &registryError{Status: res.StatusCode}
+	}
+
+	err := body.Errors[0]
+	err.Status = res.StatusCode
+	if err.Code == "UNSUPPORTED" {
+		return ErrDeleteUnsupported
+	}
+	return &err
+}
+
+// notFound turns the registry's errors for missing manifests and blobs into
+// errors satisfying os.IsNotExist.
+func notFound(name string, err error) error {
+	if rerr, ok := err.(*registryError); ok && rerr.Status == http.StatusNotFound {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// drain reads the rest of a response's body, so its connection can be
+// reused, and closes it.
+func drain(res *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
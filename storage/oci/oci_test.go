@@ -0,0 +1,97 @@
+// +build backend
+
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package oci
+
+import (
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/knoxite/knoxite/storage"
+)
+
+var (
+	backendTest *storage.BackendTest
+)
+
+// TestMain runs the tests against the registry in KNOXITE_OCI_URL, e.g. for
+// a local registry:2 with deleting enabled:
+//
+//	docker run -p 5000:5000 -e REGISTRY_STORAGE_DELETE_ENABLED=true registry:2
+//	KNOXITE_OCI_URL=oci://localhost:5000/knoxite?plainhttp=true
+func TestMain(m *testing.M) {
+	// create a random repository to avoid collisions
+	rnd := storage.RandomSuffix()
+
+	ociurl := os.Getenv("KNOXITE_OCI_URL")
+	if len(ociurl) == 0 {
+		panic("no backend configured")
+	}
+	u, err := url.Parse(ociurl)
+	if err != nil {
+		panic(err)
+	}
+	u.Path += "/" + rnd
+
+	backendTest = &storage.BackendTest{
+		URL:         u.String(),
+		Protocols:   []string{"oci"},
+		Description: "OCI registry storage",
+		TearDown: func(tb *storage.BackendTest) {
+			// registries don't delete repositories, their garbage collection
+			// removes the blobs once the manifests are gone
+			be := tb.Backend.(*OCIStorage)
+			_ = be.registry.deleteManifest(tagRepository)
+			_ = be.registry.deleteManifest(tagChunkIndex)
+		},
+	}
+
+	storage.RunBackendTester(backendTest, m)
+}
+
+func TestStorageNewBackend(t *testing.T) {
+	backendTest.NewBackendTest(t)
+}
+
+func TestStorageLocation(t *testing.T) {
+	backendTest.LocationTest(t)
+}
+
+func TestStorageProtocols(t *testing.T) {
+	backendTest.ProtocolsTest(t)
+}
+
+func TestStorageDescription(t *testing.T) {
+	backendTest.DescriptionTest(t)
+}
+
+func TestStorageInitRepository(t *testing.T) {
+	backendTest.InitRepositoryTest(t)
+}
+
+func TestStorageSaveRepository(t *testing.T) {
+	backendTest.SaveRepositoryTest(t)
+}
+
+func TestAvailableSpace(t *testing.T) {
+	backendTest.AvailableSpaceTest(t)
+}
+
+func TestStorageSaveSnapshot(t *testing.T) {
+	backendTest.SaveSnapshotTest(t)
+}
+
+func TestStorageStoreChunk(t *testing.T) {
+	backendTest.StoreChunkTest(t)
+}
+
+func TestStorageDeleteChunk(t *testing.T) {
+	backendTest.DeleteChunkTest(t)
+}
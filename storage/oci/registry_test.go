@@ -0,0 +1,351 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/storage"
+)
+
+// testRegistry is a minimal in-memory registry, authenticating clients
+// either with basic auth or with tokens.
+type testRegistry struct {
+	*httptest.Server
+
+	bearer        bool
+	deleteEnabled bool
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	tags      map[string]string
+	uploads   int
+	scopes    []string
+}
+
+func newTestRegistry(bearer bool) *testRegistry {
+	r := &testRegistry{
+		bearer:        bearer,
+		deleteEnabled: true,
+		blobs:         make(map[string][]byte),
+		manifests:     make(map[string][]byte),
+		tags:          make(map[string]string),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.handle))
+	return r
+}
+
+func (r *testRegistry) url(user string, name string) string {
+	u := url.URL{
+		Scheme:   "oci",
+		Host:     strings.TrimPrefix(r.Server.URL, "http://"),
+		Path:     "/" + name,
+		RawQuery: "plainhttp=true",
+	}
+	if user != "" {
+		u.User = url.UserPassword(user, "secret")
+	}
+	return u.String()
+}
+
+func registryErr(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, strings.ToLower(code))
+}
+
+// authorized checks the request's credentials for action and challenges the
+// client if they're missing.
+func (r *testRegistry) authorized(w http.ResponseWriter, req *http.Request, name, action string) bool {
+	if !r.bearer {
+		if user, password, ok := req.BasicAuth(); ok && user == "knoxite" && password == "secret" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		registryErr(w, http.StatusUnauthorized, "UNAUTHORIZED")
+		return false
+	}
+
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		scope := strings.TrimPrefix(auth, "Bearer ")
+		if strings.HasPrefix(scope, "repository:"+name+":") {
+			for _, a := range strings.Split(scope[strings.LastIndex(scope, ":")+1:], ",") {
+				if a == action {
+					return true
+				}
+			}
+		}
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:%s"`,
+		r.Server.URL, name, action))
+	registryErr(w, http.StatusUnauthorized, "UNAUTHORIZED")
+	return false
+}
+
+func (r *testRegistry) handle(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		if user, password, ok := req.BasicAuth(); !ok || user != "knoxite" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		scope := req.URL.Query().Get("scope")
+		r.scopes = append(r.scopes, scope)
+		// the token simply is the granted scope
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": scope})
+		return
+	}
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	var name, kind, ref string
+	for _, k := range []string{"/blobs/uploads/", "/blobs/", "/manifests/"} {
+		if i := strings.LastIndex(p, k); i >= 0 {
+			name, kind, ref = p[:i], strings.Trim(k, "/"), p[i+len(k):]
+			break
+		}
+	}
+	if kind == "" {
+		registryErr(w, http.StatusNotFound, "NAME_UNKNOWN")
+		return
+	}
+
+	action := "pull"
+	switch req.Method {
+	case http.MethodPost, http.MethodPut:
+		action = "push"
+	case http.MethodDelete:
+		action = "delete"
+	}
+	if !r.authorized(w, req, name, action) {
+		return
+	}
+
+	switch {
+	case kind == "blobs/uploads" && req.Method == http.MethodPost:
+		r.uploads++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d?_state=test", name, r.uploads))
+		w.WriteHeader(http.StatusAccepted)
+
+	case kind == "blobs/uploads" && req.Method == http.MethodPut:
+		if req.URL.Query().Get("_state") != "test" {
+			registryErr(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID")
+			return
+		}
+		data, _ := ioutil.ReadAll(req.Body)
+		if dgst := req.URL.Query().Get("digest"); dgst != digest(data) {
+			registryErr(w, http.StatusBadRequest, "DIGEST_INVALID")
+			return
+		}
+		r.blobs[digest(data)] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case kind == "blobs" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		data, ok := r.blobs[ref]
+		if !ok {
+			registryErr(w, http.StatusNotFound, "BLOB_UNKNOWN")
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", ref)
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+
+	case kind == "manifests" && req.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(req.Body)
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil || req.Header.Get("Content-Type") != mediaTypeManifest {
+			registryErr(w, http.StatusBadRequest, "MANIFEST_INVALID")
+			return
+		}
+		for _, d := range append(m.Layers, m.Config) {
+			if _, ok := r.blobs[d.Digest]; !ok {
+				registryErr(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN")
+				return
+			}
+		}
+		dgst := digest(data)
+		r.manifests[dgst] = data
+		r.tags[ref] = dgst
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+
+	case kind == "manifests" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		dgst := ref
+		if d, ok := r.tags[ref]; ok {
+			dgst = d
+		}
+		data, ok := r.manifests[dgst]
+		if !ok {
+			registryErr(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeManifest)
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+
+	case kind == "manifests" && req.Method == http.MethodDelete:
+		if !r.deleteEnabled {
+			registryErr(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+			return
+		}
+		if _, ok := r.manifests[ref]; !ok {
+			registryErr(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		delete(r.manifests, ref)
+		for tag, dgst := range r.tags {
+			if dgst == ref {
+				delete(r.tags, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		registryErr(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+	}
+}
+
+func newBackend(t *testing.T, rawurl string) *OCIStorage {
+	be, err := knoxite.BackendFromURL(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return be.(*OCIStorage)
+}
+
+func testRepository(t *testing.T, be *OCIStorage) {
+	rt := storage.NewRoundTrip(1024)
+	rt.Store(t, be)
+	rt.Load(t, be)
+
+	// overwriting the chunk-index retags it
+	if err := be.SaveChunkIndex([]byte("updated index")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := be.LoadChunkIndex(); err != nil || string(data) != "updated index" {
+		t.Errorf("Expected to load the updated chunk-index, got %q: %v", data, err)
+	}
+
+	rt.Delete(t, be)
+}
+
+func TestTokenAuth(t *testing.T) {
+	r := newTestRegistry(true)
+	defer r.Close()
+
+	be := newBackend(t, r.url("knoxite", "backups/knoxite"))
+	defer be.Close()
+	testRepository(t, be)
+
+	// the token gets extended with new actions instead of being replaced
+	expected := []string{
+		"repository:backups/knoxite:pull",
+		"repository:backups/knoxite:pull,push",
+		"repository:backups/knoxite:delete,pull,push",
+	}
+	if !reflect.DeepEqual(r.scopes, expected) {
+		t.Errorf("Expected tokens for %v, got %v", expected, r.scopes)
+	}
+
+	if _, err := newBackend(t, r.url("intruder", "backups/knoxite")).LoadRepository(); err != ErrUnauthorized {
+		t.Errorf("Expected %v, got %v", ErrUnauthorized, err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	r := newTestRegistry(false)
+	defer r.Close()
+
+	testRepository(t, newBackend(t, r.url("knoxite", "knoxite")))
+
+	if _, err := newBackend(t, r.url("", "knoxite")).LoadRepository(); err != ErrUnauthorized {
+		t.Errorf("Expected %v, got %v", ErrUnauthorized, err)
+	}
+}
+
+func TestDeleteUnsupported(t *testing.T) {
+	r := newTestRegistry(false)
+	defer r.Close()
+	r.deleteEnabled = false
+
+	be := newBackend(t, r.url("knoxite", "knoxite"))
+	if _, err := be.StoreChunk("abc", 0, 1, []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.DeleteChunk("abc", 0, 1); err != ErrDeleteUnsupported {
+		t.Errorf("Expected %v, got %v", ErrDeleteUnsupported, err)
+	}
+}
+
+func TestDeleteSharedBlob(t *testing.T) {
+	r := newTestRegistry(false)
+	defer r.Close()
+
+	// parts with the same content share their blob
+	be := newBackend(t, r.url("knoxite", "knoxite"))
+	for _, part := range []uint{0, 1} {
+		if _, err := be.StoreChunk("abc", part, 2, []byte("chunk")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := be.DeleteChunk("abc", 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := be.LoadChunk("abc", 1, 2); err != nil || string(data) != "chunk" {
+		t.Errorf("Expected the other part to remain, got %q: %v", data, err)
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, rawurl := range []string{
+		"oci://registry.example.com/",
+		"oci://registry.example.com/Knoxite",
+		"oci://registry.example.com/knoxite//backups",
+		"oci:///knoxite",
+		"oci://registry.example.com/knoxite?plainhttp=maybe",
+	} {
+		if _, err := knoxite.BackendFromURL(rawurl); err == nil {
+			t.Errorf("Expected an error for %s", rawurl)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull,push"`)
+	expected := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:a/b:pull,push",
+	}
+	if scheme != "Bearer" || !reflect.DeepEqual(params, expected) {
+		t.Errorf("Expected Bearer %v, got %s %v", expected, scheme, params)
+	}
+
+	scheme, params = parseChallenge(`Basic realm=test`)
+	if scheme != "Basic" || params["realm"] != "test" {
+		t.Errorf("Expected Basic realm test, got %s %v", scheme, params)
+	}
+}
@@ -0,0 +1,252 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package rest
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+const (
+	// flushThreshold is how many changes get collected before the catalog
+	// gets written, even if no snapshot got saved yet
+	flushThreshold = 4096
+	// compactThreshold is how many index objects may accumulate before
+	// they get merged into one
+	compactThreshold = 32
+)
+
+// catalogEntry references the object a file is stored in.
+type catalogEntry struct {
+	ID   string `json:"id"`
+	Size uint64 `json:"size"`
+}
+
+// catalogDelta is a change to the catalog, stored as an index object. A
+// full delta replaces all earlier ones.
+type catalogDelta struct {
+	Seq     uint64                  `json:"seq"`
+	Full    bool                    `json:"full,omitempty"`
+	Set     map[string]catalogEntry `json:"set,omitempty"`
+	Deleted []string                `json:"deleted,omitempty"`
+}
+
+// objectRef identifies an object on the server.
+type objectRef struct {
+	Type string
+	ID   string
+}
+
+// catalog maps the names of knoxite's files to the content-addressed
+// objects they're stored in. Changes get collected and written as a new
+// index object when flushed.
+type catalog struct {
+	loaded  bool
+	seq     uint64
+	entries map[string]catalogEntry
+	deltas  []string
+
+	// pending changes, nil entries are deletions
+	pending map[string]*catalogEntry
+	// objects which are no longer referenced once the pending changes are
+	// written
+	garbage []objectRef
+}
+
+// objectType returns the type of the objects a file gets stored in.
+func objectType(name string) string {
+	switch {
+	case name == catalogRepository:
+		return "keys"
+	case strings.HasPrefix(name, "snapshots/"):
+		return "snapshots"
+	}
+	return "data"
+}
+
+// loadCatalog reads all index objects and replays their changes. Callers
+// must hold backend.mu.
+func (backend *RESTStorage) loadCatalog() error {
+	c := &backend.catalog
+	if c.loaded {
+		return nil
+	}
+
+	ids, err := backend.list("index")
+	if err != nil {
+		return err
+	}
+
+	deltas := make([]catalogDelta, 0, len(ids))
+	for _, id := range ids {
+		data, err := backend.load("index", id)
+		if err != nil {
+			return err
+		}
+		var d catalogDelta
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		deltas = append(deltas, d)
+	}
+
+	sort.Slice(deltas, func(i, j int) bool {
+		return deltas[i].Seq < deltas[j].Seq
+	})
+	c.entries = make(map[string]catalogEntry)
+	for _, d := range deltas {
+		if d.Full {
+			c.entries = make(map[string]catalogEntry)
+		}
+		for _, name := range d.Deleted {
+			delete(c.entries, name)
+		}
+		for name, e := range d.Set {
+			c.entries[name] = e
+		}
+		c.seq = d.Seq
+	}
+
+	c.deltas = ids
+	c.pending = make(map[string]*catalogEntry)
+	c.loaded = true
+	return nil
+}
+
+// lookup returns the entry of a file. Callers must hold backend.mu.
+func (backend *RESTStorage) lookup(name string) (catalogEntry, bool, error) {
+	if err := backend.loadCatalog(); err != nil {
+		return catalogEntry{}, false, err
+	}
+	e, ok := backend.catalog.entries[name]
+	return e, ok, nil
+}
+
+// set records that a file got stored in an object, or got deleted if e is
+// nil. Callers must hold backend.mu.
+func (backend *RESTStorage) set(name string, e *catalogEntry) error {
+	if err := backend.loadCatalog(); err != nil {
+		return err
+	}
+	c := &backend.catalog
+
+	if old, ok := c.entries[name]; ok && (e == nil || old.ID != e.ID) {
+		c.garbage = append(c.garbage, objectRef{objectType(name), old.ID})
+	}
+	if e == nil {
+		delete(c.entries, name)
+	} else {
+		c.entries[name] = *e
+	}
+	c.pending[name] = e
+
+	if len(c.pending) >= flushThreshold {
+		return backend.flush()
+	}
+	return nil
+}
+
+// flush writes the pending changes as a new index object. Afterwards,
+// objects no longer referenced get deleted, unless the server is
+// append-only. Callers must hold backend.mu.
+func (backend *RESTStorage) flush() error {
+	c := &backend.catalog
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	d := catalogDelta{
+		Seq: c.seq + 1,
+		Set: make(map[string]catalogEntry),
+	}
+	for name, e := range c.pending {
+		if e == nil {
+			d.Deleted = append(d.Deleted, name)
+		} else {
+			d.Set[name] = *e
+		}
+	}
+	sort.Strings(d.Deleted)
+
+	id, err := backend.storeDelta(d)
+	if err != nil {
+		return err
+	}
+	c.seq = d.Seq
+	c.deltas = append(c.deltas, id)
+	c.pending = make(map[string]*catalogEntry)
+
+	if backend.AppendOnly() {
+		c.garbage = nil
+		return nil
+	}
+	if err := backend.collectGarbage(); err != nil {
+		return err
+	}
+	return backend.compact()
+}
+
+// collectGarbage deletes objects which are no longer referenced by any
+// file. Callers must hold backend.mu.
+func (backend *RESTStorage) collectGarbage() error {
+	c := &backend.catalog
+	referenced := make(map[string]bool, len(c.entries))
+	for _, e := range c.entries {
+		referenced[e.ID] = true
+	}
+
+	for len(c.garbage) > 0 {
+		ref := c.garbage[0]
+		if !referenced[ref.ID] {
+			if err := backend.delete(ref.Type, ref.ID); err != nil {
+				return err
+			}
+		}
+		c.garbage = c.garbage[1:]
+	}
+	return nil
+}
+
+// compact merges all index objects into one, once enough of them
+// accumulated. Callers must hold backend.mu.
+func (backend *RESTStorage) compact() error {
+	c := &backend.catalog
+	if len(c.deltas) < compactThreshold {
+		return nil
+	}
+
+	id, err := backend.storeDelta(catalogDelta{
+		Seq:  c.seq + 1,
+		Full: true,
+		Set:  c.entries,
+	})
+	if err != nil {
+		return err
+	}
+	c.seq++
+
+	for len(c.deltas) > 0 {
+		if c.deltas[0] != id {
+			if err := backend.delete("index", c.deltas[0]); err != nil {
+				return err
+			}
+		}
+		c.deltas = c.deltas[1:]
+	}
+	c.deltas = []string{id}
+	return nil
+}
+
+func (backend *RESTStorage) storeDelta(d catalogDelta) (string, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return backend.store("index", data)
+}
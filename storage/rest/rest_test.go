@@ -0,0 +1,99 @@
+// +build backend
+
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package rest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/knoxite/knoxite/storage"
+)
+
+var (
+	backendTest *storage.BackendTest
+)
+
+// TestMain runs the tests against the REST server in KNOXITE_REST_URL, e.g.
+// for a local rest-server:
+//
+//	rest-server --path /tmp/restic --no-auth
+//	KNOXITE_REST_URL=rest://127.0.0.1:8000/
+func TestMain(m *testing.M) {
+	// create a random repository to avoid collisions
+	rnd := storage.RandomSuffix()
+
+	resturl := os.Getenv("KNOXITE_REST_URL")
+	if len(resturl) == 0 {
+		panic("no backend configured")
+	}
+
+	backendTest = &storage.BackendTest{
+		URL:         resturl + rnd,
+		Protocols:   []string{"rest", "rests"},
+		Description: "restic REST server",
+		TearDown: func(tb *storage.BackendTest) {
+			be := tb.Backend.(*RESTStorage)
+			if be.AppendOnly() {
+				return
+			}
+			for _, typ := range []string{"data", "index", "keys", "snapshots"} {
+				ids, err := be.list(typ)
+				if err != nil {
+					panic(err)
+				}
+				for _, id := range ids {
+					_ = be.delete(typ, id)
+				}
+			}
+		},
+	}
+
+	storage.RunBackendTester(backendTest, m)
+}
+
+func TestStorageNewBackend(t *testing.T) {
+	backendTest.NewBackendTest(t)
+}
+
+func TestStorageLocation(t *testing.T) {
+	backendTest.LocationTest(t)
+}
+
+func TestStorageProtocols(t *testing.T) {
+	backendTest.ProtocolsTest(t)
+}
+
+func TestStorageDescription(t *testing.T) {
+	backendTest.DescriptionTest(t)
+}
+
+func TestStorageInitRepository(t *testing.T) {
+	backendTest.InitRepositoryTest(t)
+}
+
+func TestStorageSaveRepository(t *testing.T) {
+	backendTest.SaveRepositoryTest(t)
+}
+
+func TestAvailableSpace(t *testing.T) {
+	backendTest.AvailableSpaceTest(t)
+}
+
+func TestStorageSaveSnapshot(t *testing.T) {
+	backendTest.SaveSnapshotTest(t)
+}
+
+func TestStorageStoreChunk(t *testing.T) {
+	backendTest.StoreChunkTest(t)
+}
+
+func TestStorageDeleteChunk(t *testing.T) {
+	backendTest.DeleteChunkTest(t)
+}
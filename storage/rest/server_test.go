@@ -0,0 +1,366 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package rest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/storage"
+)
+
+var objectRegexp = regexp.MustCompile(`^/repo/(data|index|keys|locks|snapshots)/([0-9a-f]{64})?$`)
+
+// testServer behaves like restic's REST server for a single repository at
+// /repo: objects are immutable and their names have to match their content.
+type testServer struct {
+	*httptest.Server
+
+	appendOnly bool
+
+	mu      sync.Mutex
+	created bool
+	config  []byte
+	objects map[string][]byte
+}
+
+func newTestServer(tlsConfig *tls.Config) *testServer {
+	s := &testServer{
+		objects: make(map[string][]byte),
+	}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	// failed handshakes are expected
+	s.Server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if tlsConfig != nil {
+		s.Server.TLS = tlsConfig
+		s.Server.StartTLS()
+	} else {
+		s.Server.Start()
+	}
+	return s
+}
+
+func (s *testServer) url(scheme, query string) string {
+	u := url.URL{
+		Scheme:   scheme,
+		User:     url.UserPassword("knoxite", "secret"),
+		Host:     s.Listener.Addr().String(),
+		Path:     "/repo",
+		RawQuery: query,
+	}
+	return u.String()
+}
+
+func (s *testServer) count(typ string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for p := range s.objects {
+		if strings.HasPrefix(p, typ+"/") {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *testServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "knoxite" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/repo/" && r.Method == http.MethodPost:
+		if r.URL.Query().Get("create") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.created = true
+		return
+
+	case r.URL.Path == "/repo/config":
+		switch r.Method {
+		case http.MethodHead, http.MethodGet:
+			if s.config == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(s.config)
+		case http.MethodPost:
+			if s.config != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			s.config, _ = ioutil.ReadAll(r.Body)
+		}
+		return
+	}
+
+	m := objectRegexp.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	typ, id := m[1], m[2]
+	p := typ + "/" + id
+
+	if id == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.created {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		names := []string{}
+		for k := range s.objects {
+			if strings.HasPrefix(k, typ+"/") {
+				names = append(names, strings.TrimPrefix(k, typ+"/"))
+			}
+		}
+		w.Header().Set("Content-Type", "application/vnd.x.restic.rest.v1")
+		_ = json.NewEncoder(w).Encode(names)
+		return
+	}
+
+	data, ok := s.objects[p]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodPost:
+		if ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, _ = ioutil.ReadAll(r.Body)
+		if hash(data) != id {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[p] = data
+	case http.MethodDelete:
+		if s.appendOnly && typ != "locks" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		delete(s.objects, p)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newBackend(t *testing.T, rawurl string) *RESTStorage {
+	be, err := knoxite.BackendFromURL(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return be.(*RESTStorage)
+}
+
+func testRepository(t *testing.T, rawurl string) *storage.RoundTrip {
+	rt := storage.NewRoundTrip(1024)
+	be := newBackend(t, rawurl)
+	rt.Store(t, be)
+	if err := be.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new backend finds everything through the catalog
+	be = newBackend(t, rawurl)
+	defer be.Close()
+	rt.Load(t, be)
+	return rt
+}
+
+func TestREST(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	rt := testRepository(t, s.url("rest", ""))
+	if n := s.count("keys"); n != 1 {
+		t.Errorf("Expected the replaced repository to be deleted, found %d versions", n)
+	}
+
+	be := newBackend(t, s.url("rest", ""))
+	if be.AppendOnly() {
+		t.Errorf("Expected server not to be append-only")
+	}
+	rt.Delete(t, be)
+	if err := be.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count("data"); n != 1 {
+		t.Errorf("Expected only the chunk-index to be left, found %d data objects", n)
+	}
+
+	if _, err := newBackend(t, strings.Replace(s.url("rest", ""), "secret", "wrong", 1)).LoadRepository(); err != ErrUnauthorized {
+		t.Errorf("Expected %v, got %v", ErrUnauthorized, err)
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+	s.appendOnly = true
+
+	rt := testRepository(t, s.url("rest", ""))
+	if n := s.count("keys"); n != 2 {
+		t.Errorf("Expected both versions of the repository to be kept, found %d", n)
+	}
+
+	be := newBackend(t, s.url("rest", ""))
+	defer be.Close()
+	if !be.AppendOnly() {
+		t.Errorf("Expected server to be append-only")
+	}
+	if err := be.DeleteChunk(rt.Shasum, 0, 1); err != knoxite.ErrAppendOnly {
+		t.Errorf("Expected %v, got %v", knoxite.ErrAppendOnly, err)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	be := newBackend(t, s.url("rest", ""))
+	if err := be.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < compactThreshold+2; i++ {
+		if err := be.SaveRepository([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.count("index"); n >= compactThreshold {
+		t.Errorf("Expected index objects to be merged, found %d", n)
+	}
+
+	be = newBackend(t, s.url("rest", ""))
+	if data, err := be.LoadRepository(); err != nil || !bytes.Equal(data, []byte{compactThreshold + 1}) {
+		t.Errorf("Expected to load the latest repository, got %v: %v", data, err)
+	}
+}
+
+// testCertificates writes a self-signed certificate, usable by both the
+// server and the client, to dir.
+func testCertificates(t *testing.T, dir string) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "knoxite"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite-rest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, certFile, keyFile := testCertificates(t, dir)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	s := newTestServer(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	defer s.Close()
+
+	testRepository(t, s.url("rests", "ca="+certFile+"&cert="+certFile+"&key="+keyFile))
+
+	// without a client certificate the handshake fails
+	be := newBackend(t, s.url("rests", "ca="+certFile))
+	if _, err := be.LoadRepository(); err == nil {
+		t.Errorf("Expected the server to require a client certificate")
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, rawurl := range []string{
+		"rest:///repo",
+		"rests://127.0.0.1/repo?ca=/does/not/exist",
+		"rests://127.0.0.1/repo?key=/tmp/key.pem",
+	} {
+		if _, err := knoxite.BackendFromURL(rawurl); err == nil {
+			t.Errorf("Expected an error for %s", rawurl)
+		}
+	}
+}
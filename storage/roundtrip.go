@@ -0,0 +1,133 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+)
+
+// RoundTrip checks that the data stored on a backend can be loaded again.
+// Unlike BackendTest it doesn't need a configured backend, so backends can
+// run it against a fake service in their regular tests.
+type RoundTrip struct {
+	Shasum string
+	Chunk  []byte
+}
+
+// NewRoundTrip returns a RoundTrip storing a random chunk of the given size.
+func NewRoundTrip(size int) *RoundTrip {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+
+	return &RoundTrip{
+		Shasum: knoxite.Hash(data, knoxite.HashHighway256),
+		Chunk:  data,
+	}
+}
+
+// Store initializes a repository on be and stores the chunk, a snapshot, the
+// chunk-index and the repository's metadata.
+func (rt *RoundTrip) Store(t *testing.T, be knoxite.Backend) {
+	t.Helper()
+
+	if err := be.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.LoadRepository(); !os.IsNotExist(err) {
+		t.Errorf("Expected the repository not to exist yet, got %v", err)
+	}
+
+	size, err := be.StoreChunk(rt.Shasum, 0, 1, rt.Chunk)
+	if err != nil || size != uint64(len(rt.Chunk)) {
+		t.Fatalf("Expected to store %d bytes, got %d: %v", len(rt.Chunk), size, err)
+	}
+	if size, err := be.StoreChunk(rt.Shasum, 0, 1, rt.Chunk); err != nil || size != 0 {
+		t.Errorf("Expected existing chunk not to be stored again, got %d: %v", size, err)
+	}
+
+	if v, ok := be.(knoxite.ChunkVerifier); ok {
+		err := v.VerifyChunk(rt.Shasum, 0, 1, rt.Chunk)
+		if err != knoxite.ErrChecksumUnavailable {
+			if err != nil {
+				t.Errorf("Expected chunk to verify, got %v", err)
+			}
+			if err := v.VerifyChunk(rt.Shasum, 0, 1, append([]byte{}, rt.Chunk[1:]...)); err != knoxite.ErrChunkMismatch {
+				t.Errorf("Expected %v, got %v", knoxite.ErrChunkMismatch, err)
+			}
+		}
+	}
+	if q, ok := be.(knoxite.ChunkQuerier); ok {
+		found, err := q.HasChunks([]knoxite.ChunkPart{
+			{Shasum: rt.Shasum, Part: 0, TotalParts: 1, Size: uint64(len(rt.Chunk))},
+			{Shasum: rt.Shasum, Part: 0, TotalParts: 1, Size: 1},
+			{Shasum: knoxite.Hash([]byte("missing"), knoxite.HashHighway256), Part: 0, TotalParts: 1, Size: 1},
+		})
+		if err != nil || len(found) != 3 || !found[0] || found[1] || found[2] {
+			t.Errorf("Expected only the stored chunk to be found, got %v: %v", found, err)
+		}
+	}
+
+	if err := be.SaveSnapshot("0123abcd", []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SaveChunkIndex([]byte("index")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SaveRepository([]byte("updated repository")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.InitRepository(); err != knoxite.ErrRepositoryExists {
+		t.Errorf("Expected %v, got %v", knoxite.ErrRepositoryExists, err)
+	}
+}
+
+// Load checks that be returns everything Store stored. be may be a new
+// backend for the same repository.
+func (rt *RoundTrip) Load(t *testing.T, be knoxite.Backend) {
+	t.Helper()
+
+	for _, tt := range []struct {
+		load     func() ([]byte, error)
+		expected []byte
+	}{
+		{be.LoadRepository, []byte("updated repository")},
+		{be.LoadChunkIndex, []byte("index")},
+		{func() ([]byte, error) { return be.LoadSnapshot("0123abcd") }, []byte("snapshot")},
+		{func() ([]byte, error) { return be.LoadChunk(rt.Shasum, 0, 1) }, rt.Chunk},
+	} {
+		if loaded, err := tt.load(); err != nil || !bytes.Equal(loaded, tt.expected) {
+			t.Errorf("Expected to load %.32q, got %.32q: %v", tt.expected, loaded, err)
+		}
+	}
+	if _, err := be.LoadSnapshot("missing"); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing snapshot not to exist, got %v", err)
+	}
+}
+
+// Delete deletes the chunk Store stored and checks it's gone.
+func (rt *RoundTrip) Delete(t *testing.T, be knoxite.Backend) {
+	t.Helper()
+
+	if err := be.DeleteChunk(rt.Shasum, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := be.LoadChunk(rt.Shasum, 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected deleted chunk not to exist, got %v", err)
+	}
+	if err := be.DeleteChunk(rt.Shasum, 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected deleting a missing chunk to fail, got %v", err)
+	}
+}
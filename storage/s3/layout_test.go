@@ -0,0 +1,152 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package s3
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/knoxite/knoxite"
+)
+
+// fakeS3 serves the objects of path-style requests for HEAD and GET. The
+// retain-until date of an object's lock is kept under its key followed by
+// "?retention" and can be set with PUT.
+type fakeS3 map[string][]byte
+
+func (objects fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if _, ok := r.URL.Query()["retention"]; ok && r.Method == http.MethodPut {
+		var retention struct {
+			RetainUntilDate string
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&retention); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		objects[key+"?retention"] = []byte(retention.RetainUntilDate)
+		return
+	}
+
+	data, ok := objects[key]
+	if !ok || (r.Method != http.MethodHead && r.Method != http.MethodGet) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			_, _ = w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", "\"knoxite\"")
+	if until, ok := objects[key+"?retention"]; ok {
+		w.Header().Set("X-Amz-Object-Lock-Retain-Until-Date", string(until))
+	}
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func newFakeBackend(t *testing.T, srv *httptest.Server) *S3Storage {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an URL as used by the old layout, its region now being the bucket
+	u.Scheme = "s3"
+	u.User = url.UserPassword("key", "secret")
+	u.Path = "/us-east-1/knoxite"
+	u.RawQuery = "region=us-east-1"
+
+	be, err := (&S3Storage{}).NewBackend(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return be.(*S3Storage)
+}
+
+func TestLegacyLayout(t *testing.T) {
+	srv := httptest.NewServer(fakeS3{
+		"knoxite-repository/repository.knoxite": []byte("legacy"),
+		"knoxite-chunks/index":                  []byte("index"),
+	})
+	defer srv.Close()
+
+	be := newFakeBackend(t, srv)
+	if _, err := be.LoadRepository(); !errors.Is(err, ErrLegacyLayout) {
+		t.Errorf("Expected %v, got %v", ErrLegacyLayout, err)
+	} else if !strings.Contains(err.Error(), "us-east-1/knoxite/repository.knoxite") {
+		t.Errorf("Expected the error to explain the migration, got %v", err)
+	}
+	if err := be.InitRepository(); !errors.Is(err, ErrLegacyLayout) {
+		t.Errorf("Expected %v, got %v", ErrLegacyLayout, err)
+	}
+
+	// repositories in the new layout and missing ones aren't affected
+	srv = httptest.NewServer(fakeS3{
+		"us-east-1/knoxite/" + knoxite.RepoFilename: []byte("repository"),
+	})
+	defer srv.Close()
+	if b, err := newFakeBackend(t, srv).LoadRepository(); err != nil || string(b) != "repository" {
+		t.Errorf("Expected repository to be loaded, got %q, error %v", b, err)
+	}
+
+	srv = httptest.NewServer(fakeS3{})
+	defer srv.Close()
+	if _, err := newFakeBackend(t, srv).LoadRepository(); !os.IsNotExist(err) {
+		t.Errorf("Expected missing repository, got %v", err)
+	}
+}
+
+func TestStoreChunkRetention(t *testing.T) {
+	extended := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	longer := time.Now().Add(10000 * time.Hour).UTC().Format(time.RFC3339)
+	objects := fakeS3{
+		"us-east-1/knoxite/chunks/a.0_1":           []byte("a"),
+		"us-east-1/knoxite/chunks/a.0_1?retention": []byte(extended),
+		"us-east-1/knoxite/chunks/b.0_1":           []byte("b"),
+		"us-east-1/knoxite/chunks/b.0_1?retention": []byte(longer),
+	}
+	srv := httptest.NewServer(objects)
+	defer srv.Close()
+
+	be := newFakeBackend(t, srv)
+	be.options.LockMode = minio.Governance
+	be.options.Retention = 720 * time.Hour
+
+	for _, shasum := range []string{"a", "b"} {
+		if size, err := be.StoreChunk(shasum, 0, 1, []byte(shasum)); err != nil || size != 0 {
+			t.Fatalf("Expected existing chunk not to be stored again, got %d: %v", size, err)
+		}
+	}
+
+	// reused chunks are locked as long as new ones
+	until, err := time.Parse(time.RFC3339, string(objects["us-east-1/knoxite/chunks/a.0_1?retention"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until.Before(time.Now().Add(719 * time.Hour)) {
+		t.Errorf("Expected the retention to be extended, got %s", until)
+	}
+	// but never shortened
+	if b := string(objects["us-east-1/knoxite/chunks/b.0_1?retention"]); b != longer {
+		t.Errorf("Expected the retention to remain %s, got %s", longer, b)
+	}
+}
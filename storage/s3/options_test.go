@@ -0,0 +1,119 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package s3
+
+import (
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+
+	"github.com/knoxite/knoxite"
+)
+
+func parseOptions(t *testing.T, rawurl string) (Options, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ParseOptions(*u)
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions(t, "s3s://s3.example.com/bucket/some/prefix?region=eu-west-1&class=standard_ia&chunkclass=GLACIER_IR&partsize=64MiB&quota=1GB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Bucket != "bucket" || opts.Prefix != "some/prefix" || opts.Region != "eu-west-1" {
+		t.Errorf("Unexpected location: %+v", opts)
+	}
+	if opts.ChunkClass != "GLACIER_IR" || opts.SnapshotClass != "STANDARD_IA" || opts.MetaClass != "STANDARD_IA" {
+		t.Errorf("Unexpected storage classes: %+v", opts)
+	}
+	if opts.PartSize != 64*1024*1024 {
+		t.Errorf("Expected a part size of 64MiB, got %d", opts.PartSize)
+	}
+	if opts.Quota != 1000*1000*1000 {
+		t.Errorf("Expected a quota of 1GB, got %d", opts.Quota)
+	}
+
+	opts, err = parseOptions(t, "s3://localhost:9000/bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Bucket != "bucket" || opts.Prefix != "" || opts.Encryption != nil || opts.LockMode != "" {
+		t.Errorf("Unexpected options: %+v", opts)
+	}
+}
+
+func TestParseOptionsEncryption(t *testing.T) {
+	opts, err := parseOptions(t, "s3://localhost/bucket?sse=kms&kmskey=knoxite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Encryption == nil || opts.Encryption.Type() != encrypt.KMS {
+		t.Errorf("Expected SSE-KMS, got %v", opts.Encryption)
+	}
+
+	defer os.Unsetenv("KNOXITE_S3_SSEC_KEY")
+	os.Setenv("KNOXITE_S3_SSEC_KEY", "c2hvcnQ=")
+	if _, err := parseOptions(t, "s3://localhost/bucket?sse=c"); err != ErrInvalidSSECKey {
+		t.Errorf("Expected %v, got %v", ErrInvalidSSECKey, err)
+	}
+	os.Setenv("KNOXITE_S3_SSEC_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	opts, err = parseOptions(t, "s3://localhost/bucket?sse=c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Encryption == nil || opts.Encryption.Type() != encrypt.SSEC {
+		t.Errorf("Expected SSE-C, got %v", opts.Encryption)
+	}
+
+	if _, err := parseOptions(t, "s3://localhost/bucket?sse=foo"); err != ErrInvalidEncryption {
+		t.Errorf("Expected %v, got %v", ErrInvalidEncryption, err)
+	}
+}
+
+func TestParseOptionsLock(t *testing.T) {
+	opts, err := parseOptions(t, "s3://localhost/bucket?lock=compliance&retention=720h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.LockMode != minio.Compliance || opts.Retention != 720*time.Hour {
+		t.Errorf("Unexpected object lock: %+v", opts)
+	}
+
+	if _, err := parseOptions(t, "s3://localhost/bucket?lock=governance"); err != ErrMissingRetention {
+		t.Errorf("Expected %v, got %v", ErrMissingRetention, err)
+	}
+	if _, err := parseOptions(t, "s3://localhost/bucket?lock=forever&retention=1h"); err != ErrInvalidLockMode {
+		t.Errorf("Expected %v, got %v", ErrInvalidLockMode, err)
+	}
+}
+
+func TestParseOptionsInvalid(t *testing.T) {
+	for _, u := range []string{
+		"s3://localhost",
+		"s3://localhost/",
+		"s3://localhost/bucket?partsize=1MiB",
+		"s3://localhost/bucket?partsize=lots",
+		"s3://localhost/bucket?quota=lots",
+		"s3://localhost/bucket?retention=-1h",
+	} {
+		if _, err := parseOptions(t, u); err == nil {
+			t.Errorf("Expected an error for %s", u)
+		}
+	}
+
+	if _, err := parseOptions(t, "s3://localhost"); err != knoxite.ErrInvalidRepositoryURL {
+		t.Errorf("Expected %v, got %v", knoxite.ErrInvalidRepositoryURL, err)
+	}
+}
@@ -10,9 +10,13 @@
 package s3
 
 import (
+	"context"
+	"net/url"
 	"os"
 	"testing"
 
+	"github.com/minio/minio-go/v7"
+
 	"github.com/knoxite/knoxite/storage"
 )
 
@@ -20,20 +24,40 @@ var (
 	backendTest *storage.BackendTest
 )
 
+// TestMain runs the tests against the bucket in KNOXITE_AMAZONS3_URL, e.g.
+// for a local MinIO:
+//
+//	KNOXITE_AMAZONS3_URL=s3://key:secret@localhost:9000/knoxite/test
 func TestMain(m *testing.M) {
-	// create a random bucket name to avoid collisions
+	// create a random prefix to avoid collisions
 	rnd := storage.RandomSuffix()
 
 	amazons3url := os.Getenv("KNOXITE_AMAZONS3_URL")
 	if len(amazons3url) == 0 {
 		panic("no backend configured")
 	}
+	u, err := url.Parse(amazons3url)
+	if err != nil {
+		panic(err)
+	}
+	u.Path += rnd
 
 	backendTest = &storage.BackendTest{
-		URL:         amazons3url + rnd,
+		URL:         u.String(),
 		Protocols:   []string{"s3", "s3s"},
 		Description: "Amazon S3 Storage",
-		TearDown:    func(tb *storage.BackendTest) {},
+		TearDown: func(tb *storage.BackendTest) {
+			be := tb.Backend.(*S3Storage)
+			ctx := context.Background()
+			for obj := range be.client.ListObjects(ctx, be.options.Bucket, minio.ListObjectsOptions{
+				Prefix:    be.options.Prefix + "/",
+				Recursive: true,
+			}) {
+				if obj.Err == nil {
+					_ = be.client.RemoveObject(ctx, be.options.Bucket, obj.Key, minio.RemoveObjectOptions{})
+				}
+			}
+		},
 	}
 
 	storage.RunBackendTester(backendTest, m)
@@ -0,0 +1,241 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/knoxite/knoxite"
+)
+
+// Error declarations
+var (
+	ErrPassphraseRequired = errors.New("SSH key is protected by a passphrase, set KNOXITE_SSH_PASSPHRASE")
+	ErrInvalidProxyJump   = errors.New("Invalid ProxyJump host")
+)
+
+// defaultIdentities are the identity files used when neither the URL nor the
+// ssh config name any.
+var defaultIdentities = []string{"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519"}
+
+// sshHost is a host to connect to, with the settings from the ssh config.
+type sshHost struct {
+	addr     string
+	user     string
+	password string
+	signers  []ssh.Signer
+	// useAgent allows authenticating with the keys of a running ssh-agent
+	useAgent bool
+	hostKeys *hostKeys
+}
+
+// hostOptions are the settings of the repository URL, which take precedence
+// over the ssh config.
+type hostOptions struct {
+	user       string
+	password   string
+	port       string
+	identities []string
+	knownHosts []string
+	tofu       bool
+}
+
+// resolveHost looks up an alias in the ssh config.
+func resolveHost(cfg *sshConfig, alias string, opts hostOptions) (sshHost, error) {
+	hostname := cfg.Get(alias, "HostName")
+	if hostname == "" {
+		hostname = alias
+	}
+	hostname = strings.Replace(hostname, "%h", alias, -1)
+
+	port := opts.port
+	if port == "" {
+		port = cfg.Get(alias, "Port")
+	}
+	if port == "" {
+		port = "22"
+	}
+
+	username := opts.user
+	if username == "" {
+		username = cfg.Get(alias, "User")
+	}
+	if username == "" {
+		username = localUser()
+	}
+
+	expand := func(s string) string {
+		return expandHome(strings.NewReplacer(
+			"%%", "%",
+			"%d", homeDir(),
+			"%h", hostname,
+			"%r", username,
+			"%u", localUser(),
+		).Replace(s))
+	}
+
+	// identity files from the URL have to be usable, others get skipped like
+	// ssh does
+	var signers []ssh.Signer
+	var err error
+	if len(opts.identities) > 0 {
+		for _, f := range opts.identities {
+			signer, err := loadIdentity(expand(f))
+			if err != nil {
+				return sshHost{}, err
+			}
+			signers = append(signers, signer)
+		}
+	} else {
+		identities := cfg.GetAll(alias, "IdentityFile")
+		if len(identities) == 0 {
+			identities = defaultIdentities
+		}
+		for _, f := range identities {
+			signer, lerr := loadIdentity(expand(f))
+			if lerr == ErrPassphraseRequired {
+				err = lerr
+			}
+			if lerr != nil {
+				continue
+			}
+			signers = append(signers, signer)
+		}
+	}
+
+	knownHosts := opts.knownHosts
+	if len(knownHosts) == 0 {
+		knownHosts = strings.Fields(cfg.Get(alias, "UserKnownHostsFile"))
+	}
+	if len(knownHosts) == 0 {
+		knownHosts = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"}
+	}
+	for i, f := range knownHosts {
+		knownHosts[i] = expand(f)
+	}
+	knownHosts = append(knownHosts, "/etc/ssh/ssh_known_hosts")
+
+	host := sshHost{
+		addr:     net.JoinHostPort(hostname, port),
+		user:     username,
+		password: opts.password,
+		signers:  signers,
+		useAgent: !strings.EqualFold(cfg.Get(alias, "IdentitiesOnly"), "yes") && os.Getenv("SSH_AUTH_SOCK") != "",
+		hostKeys: &hostKeys{
+			files: knownHosts,
+			tofu:  opts.tofu || strings.EqualFold(cfg.Get(alias, "StrictHostKeyChecking"), "accept-new"),
+		},
+	}
+
+	if len(host.signers) == 0 && !host.useAgent && host.password == "" {
+		if err != nil {
+			return sshHost{}, err
+		}
+		return sshHost{}, knoxite.ErrInvalidPassword
+	}
+	return host, nil
+}
+
+// resolveJumps returns the hosts listed in the ProxyJump option of alias, in
+// the order they have to be connected to.
+func resolveJumps(cfg *sshConfig, alias string, tofu bool) ([]sshHost, error) {
+	jumps := cfg.Get(alias, "ProxyJump")
+	if jumps == "" || strings.EqualFold(jumps, "none") {
+		return nil, nil
+	}
+
+	var hosts []sshHost
+	for _, jump := range strings.Split(jumps, ",") {
+		u, err := url.Parse("ssh://" + strings.TrimSpace(jump))
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidProxyJump, jump)
+		}
+
+		host, err := resolveHost(cfg, u.Hostname(), hostOptions{
+			user: u.User.Username(),
+			port: u.Port(),
+			tofu: tofu,
+		})
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// loadIdentity reads a private key, decrypting it with the passphrase from
+// KNOXITE_SSH_PASSPHRASE if required.
+func loadIdentity(path string) (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		passphrase := os.Getenv("KNOXITE_SSH_PASSPHRASE")
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	return signer, nil
+}
+
+// clientConfig returns the ssh config for connecting to the host.
+func (h sshHost) clientConfig(ag agent.Agent) (*ssh.ClientConfig, error) {
+	callback, algos, err := h.hostKeys.callback(h.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		signers := h.signers
+		if ag != nil && h.useAgent {
+			if s, err := ag.Signers(); err == nil {
+				signers = append(s, signers...)
+			}
+		}
+		return signers, nil
+	}))
+	if h.password != "" {
+		auth = append(auth, ssh.Password(h.password))
+	}
+
+	return &ssh.ClientConfig{
+		User:              h.user,
+		Auth:              auth,
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: algos,
+		Timeout:           dialTimeout,
+	}, nil
+}
+
+// localUser returns the name of the user running knoxite.
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,124 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package sftp
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	kh "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Error declarations
+var (
+	ErrUnknownHostKey  = errors.New("Unknown SSH host key, add it to your known_hosts or enable trust on first use with tofu=true")
+	ErrHostKeyMismatch = errors.New("SSH host key mismatch, the host might be impersonated")
+	ErrHostKeyRevoked  = errors.New("SSH host key has been revoked")
+)
+
+// hostKeys verifies host keys against known_hosts files.
+type hostKeys struct {
+	files []string
+	// tofu adds the keys of unknown hosts to the first file
+	tofu bool
+
+	mu sync.Mutex
+}
+
+// callback returns a HostKeyCallback for the current content of the
+// known_hosts files, and the algorithms of the keys known for hostport.
+func (h *hostKeys) callback(hostport string) (ssh.HostKeyCallback, []string, error) {
+	var existing []string
+	for _, f := range h.files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+
+	check := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return &kh.KeyError{}
+	}
+	if len(existing) > 0 {
+		var err error
+		if check, err = kh.New(existing...); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cb := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		switch e := err.(type) {
+		case nil:
+			return nil
+		case *kh.RevokedError:
+			return fmt.Errorf("%w: %s %s", ErrHostKeyRevoked, hostname, ssh.FingerprintSHA256(key))
+		case *kh.KeyError:
+			if len(e.Want) > 0 {
+				return fmt.Errorf("%w: %s %s", ErrHostKeyMismatch, hostname, ssh.FingerprintSHA256(key))
+			}
+			if !h.tofu || len(h.files) == 0 {
+				return fmt.Errorf("%w: %s %s", ErrUnknownHostKey, hostname, ssh.FingerprintSHA256(key))
+			}
+			return h.add(hostname, key)
+		default:
+			return err
+		}
+	}
+	return cb, knownAlgorithms(check, hostport), nil
+}
+
+// add appends a host key to the first known_hosts file.
+func (h *hostKeys) add(hostname string, key ssh.PublicKey) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(h.files[0]), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.files[0], os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(f, kh.Line([]string{kh.Normalize(hostname)}, key))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// knownAlgorithms returns the algorithms of the known keys of a host, so the
+// host gets asked for a key which can be verified.
+func knownAlgorithms(check ssh.HostKeyCallback, hostport string) []string {
+	// verifying a key nobody knows reveals the known keys
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+
+	var keyErr *kh.KeyError
+	if !errors.As(check(hostport, &net.TCPAddr{IP: net.IPv4zero}, probe), &keyErr) {
+		return nil
+	}
+
+	var algos []string
+	for _, k := range keyErr.Want {
+		algos = append(algos, k.Key.Type())
+	}
+	return algos
+}
@@ -0,0 +1,551 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package sftp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	kh "golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/knoxite/knoxite"
+)
+
+// testServer is an SSH server offering SFTP and port forwarding, like
+// OpenSSH does.
+type testServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	config   *ssh.ServerConfig
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+	forwards int
+}
+
+func newTestServer(t *testing.T, authorized ...ssh.PublicKey) *testServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		listener: l,
+		hostKey:  hostKey,
+		config: &ssh.ServerConfig{
+			PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if c.User() == "knoxite" && string(password) == "secret" {
+					return nil, nil
+				}
+				return nil, errors.New("wrong password")
+			},
+			PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				for _, k := range authorized {
+					if c.User() == "knoxite" && bytes.Equal(k.Marshal(), key.Marshal()) {
+						return nil, nil
+					}
+				}
+				return nil, errors.New("unknown key")
+			},
+		},
+	}
+	s.config.AddHostKey(hostKey)
+
+	go s.serve()
+	return s
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.accepted++
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			go s.session(nc)
+		case "direct-tcpip":
+			go s.forward(nc)
+		default:
+			_ = nc.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func (s *testServer) session(nc ssh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "subsystem" || !bytes.HasSuffix(req.Payload, []byte("sftp")) {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		_ = req.Reply(true, nil)
+
+		srv, err := sftp.NewServer(ch)
+		if err != nil {
+			return
+		}
+		_ = srv.Serve()
+		return
+	}
+}
+
+func (s *testServer) forward(nc ssh.NewChannel) {
+	var target struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	s.mu.Lock()
+	s.forwards++
+	s.mu.Unlock()
+
+	go func() {
+		_, _ = io.Copy(ch, conn)
+		ch.Close()
+	}()
+	_, _ = io.Copy(conn, ch)
+	conn.Close()
+}
+
+func (s *testServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) port() string {
+	_, port, _ := net.SplitHostPort(s.addr())
+	return port
+}
+
+func (s *testServer) knownHostsLine() string {
+	return kh.Line([]string{kh.Normalize(s.addr())}, s.hostKey.PublicKey())
+}
+
+// drop closes all client connections.
+func (s *testServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) close() {
+	s.listener.Close()
+	s.drop()
+}
+
+// testHome sets up an empty home dir with an .ssh dir.
+func testHome(t *testing.T) (string, func()) {
+	home, err := ioutil.TempDir("", "knoxite-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{}
+	for _, k := range []string{"HOME", "SSH_AUTH_SOCK", "KNOXITE_SSH_PASSPHRASE"} {
+		env[k] = os.Getenv(k)
+		os.Unsetenv(k)
+	}
+	os.Setenv("HOME", home)
+
+	return home, func() {
+		for k, v := range env {
+			if v == "" {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, v)
+			}
+		}
+		os.RemoveAll(home)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeIdentity writes a new private key, encrypted if passphrase isn't
+// empty, and returns its public key.
+func writeIdentity(t *testing.T, path, passphrase string) ssh.PublicKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if passphrase != "" {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, path, string(pem.EncodeToMemory(block)))
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func newBackend(rawurl string) (*SFTPStorage, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	be, err := (&SFTPStorage{}).NewBackend(*u)
+	if err != nil {
+		return nil, err
+	}
+	return be.(*SFTPStorage), nil
+}
+
+func TestHostKeyVerification(t *testing.T) {
+	home, restore := testHome(t)
+	defer restore()
+
+	s := newTestServer(t)
+	defer s.close()
+	rawurl := fmt.Sprintf("sftp://knoxite:secret@%s%s/repo", s.addr(), home)
+	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+
+	// unknown hosts get rejected
+	if _, err := newBackend(rawurl); !errors.Is(err, ErrUnknownHostKey) {
+		t.Fatalf("Expected %v, got %v", ErrUnknownHostKey, err)
+	}
+
+	// unless they are trusted on first use
+	be, err := newBackend(rawurl + "?tofu=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+	data, err := ioutil.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(data)) != s.knownHostsLine() {
+		t.Errorf("Expected known_hosts to contain %q, got %q", s.knownHostsLine(), data)
+	}
+
+	be, err = newBackend(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+
+	// a changed host key never gets trusted
+	other := newTestServer(t)
+	defer other.close()
+	writeFile(t, knownHosts, kh.Line([]string{kh.Normalize(s.addr())}, other.hostKey.PublicKey())+"\n")
+	if _, err := newBackend(rawurl + "?tofu=true"); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("Expected %v, got %v", ErrHostKeyMismatch, err)
+	}
+}
+
+func TestIdentityFile(t *testing.T) {
+	home, restore := testHome(t)
+	defer restore()
+
+	identity := filepath.Join(home, "id_backup")
+	pub := writeIdentity(t, identity, "knoxite")
+
+	s := newTestServer(t, pub)
+	defer s.close()
+	writeFile(t, filepath.Join(home, ".ssh", "known_hosts"), s.knownHostsLine()+"\n")
+	rawurl := fmt.Sprintf("sftp://knoxite@%s%s/repo?identity=%s", s.addr(), home, identity)
+
+	if _, err := newBackend(rawurl); err != ErrPassphraseRequired {
+		t.Fatalf("Expected %v, got %v", ErrPassphraseRequired, err)
+	}
+
+	os.Setenv("KNOXITE_SSH_PASSPHRASE", "wrong")
+	if _, err := newBackend(rawurl); err == nil {
+		t.Fatal("Expected an error for a wrong passphrase")
+	}
+
+	os.Setenv("KNOXITE_SSH_PASSPHRASE", "knoxite")
+	be, err := newBackend(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	if _, err := be.WriteFile(filepath.Join(home, "test"), []byte("knoxite")); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a usable key or password there's no way in
+	os.Unsetenv("KNOXITE_SSH_PASSPHRASE")
+	if _, err := newBackend(fmt.Sprintf("sftp://knoxite@%s%s/repo", s.addr(), home)); err != knoxite.ErrInvalidPassword {
+		t.Errorf("Expected %v, got %v", knoxite.ErrInvalidPassword, err)
+	}
+}
+
+func TestSSHConfigProxyJump(t *testing.T) {
+	home, restore := testHome(t)
+	defer restore()
+
+	pub := writeIdentity(t, filepath.Join(home, ".ssh", "id_backup"), "")
+	jump := newTestServer(t, pub)
+	defer jump.close()
+	target := newTestServer(t, pub)
+	defer target.close()
+
+	writeFile(t, filepath.Join(home, ".ssh", "known_hosts"), jump.knownHostsLine()+"\n"+target.knownHostsLine()+"\n")
+	writeFile(t, filepath.Join(home, ".ssh", "config"), `
+Host backup
+    HostName 127.0.0.1
+    Port `+target.port()+`
+    ProxyJump jump
+
+Host jump
+    HostName 127.0.0.1
+    Port=`+jump.port()+`
+
+Host *
+    User knoxite
+    IdentityFile ~/.ssh/id_backup
+`)
+
+	be, err := newBackend("sftp://backup" + home + "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	path := filepath.Join(home, "test")
+	if _, err := be.WriteFile(path, []byte("knoxite")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := be.ReadFile(path); err != nil || string(data) != "knoxite" {
+		t.Errorf("Expected to read back the written file, got %q: %v", data, err)
+	}
+
+	jump.mu.Lock()
+	defer jump.mu.Unlock()
+	if jump.forwards != 1 {
+		t.Errorf("Expected one connection to be forwarded by the jump host, got %d", jump.forwards)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	home, restore := testHome(t)
+	defer restore()
+
+	s := newTestServer(t)
+	defer s.close()
+	writeFile(t, filepath.Join(home, ".ssh", "known_hosts"), s.knownHostsLine()+"\n")
+
+	be, err := newBackend(fmt.Sprintf("sftp://knoxite:secret@%s%s/repo", s.addr(), home))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	path := filepath.Join(home, "test")
+	for i := 0; i < 3; i++ {
+		s.drop()
+
+		data := []byte("knoxite " + strconv.Itoa(i))
+		if _, err := be.WriteFile(path, data); err != nil {
+			t.Fatal(err)
+		}
+		read, err := be.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("Expected %q, got %q", data, read)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accepted != 4 {
+		t.Errorf("Expected 4 connections, got %d", s.accepted)
+	}
+
+	be.Close()
+	if _, err := be.ReadFile(path); err != ErrBackendClosed {
+		t.Errorf("Expected %v, got %v", ErrBackendClosed, err)
+	}
+}
+
+func TestSSHConfig(t *testing.T) {
+	home, restore := testHome(t)
+	defer restore()
+
+	writeFile(t, filepath.Join(home, ".ssh", "extra"), `
+Host included
+    HostName included.example.com
+`)
+	writeFile(t, filepath.Join(home, ".ssh", "config"), `
+# comment
+Include extra
+
+Host *.example.com !secret.example.com
+    User alice
+    IdentityFile ~/.ssh/id_example
+
+Match exec "true"
+    User mallory
+
+Host backup.example.com
+    User bob
+    IdentityFile ~/.ssh/id_backup
+    HostName="10.0.0.1"
+
+Host *
+    User carol
+`)
+
+	cfg, err := loadSSHConfig(filepath.Join(home, ".ssh", "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		alias, key string
+		expected   string
+	}{
+		{"backup.example.com", "user", "alice"},
+		{"backup.example.com", "HostName", "10.0.0.1"},
+		{"secret.example.com", "User", "carol"},
+		{"other", "User", "carol"},
+		{"included", "HostName", "included.example.com"},
+		{"other", "HostName", ""},
+	}
+	for _, tt := range tests {
+		if v := cfg.Get(tt.alias, tt.key); v != tt.expected {
+			t.Errorf("Expected %s of %s to be %q, got %q", tt.key, tt.alias, tt.expected, v)
+		}
+	}
+
+	ids := cfg.GetAll("backup.example.com", "IdentityFile")
+	if len(ids) != 2 || ids[0] != "~/.ssh/id_example" || ids[1] != "~/.ssh/id_backup" {
+		t.Errorf("Unexpected identity files: %v", ids)
+	}
+
+	// a missing config is just empty
+	cfg, err = loadSSHConfig(filepath.Join(home, "missing"))
+	if err != nil || cfg.Get("backup", "User") != "" {
+		t.Errorf("Expected an empty config, got %v", err)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	home, restore := testHome(t)
+	defer restore()
+
+	s := newTestServer(t)
+	defer s.close()
+	writeFile(t, filepath.Join(home, ".ssh", "known_hosts"), s.knownHostsLine()+"\n")
+	if err := os.Mkdir(filepath.Join(home, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(home, "dir", "file"), "knoxite")
+
+	be, err := newBackend(fmt.Sprintf("sftp://knoxite:secret@%s%s/repo", s.addr(), home))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.Close()
+
+	files, err := be.ListFiles(filepath.Join(home, "dir"))
+	if err != nil || len(files) != 1 || files["file"] != 7 {
+		t.Errorf("Expected to list a single file, got %v: %v", files, err)
+	}
+	if _, err := be.ListFiles(filepath.Join(home, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing dir not to exist, got %v", err)
+	}
+}
@@ -6,86 +6,117 @@
  *   For license see LICENSE
  */
 
+// Package sftp implements a storage backend for SSH servers supporting SFTP.
+//
+// Hosts get looked up in ~/.ssh/config, so aliases, ports, users, identity
+// files and ProxyJump work like they do for ssh. Host keys have to be listed
+// in ~/.ssh/known_hosts, unless trust on first use is enabled. The URL's
+// query parameters take precedence over the ssh config:
+//
+//	identity=~/.ssh/id_backup  identity file, can be repeated
+//	known_hosts=path           known_hosts file to verify host keys with
+//	tofu=true                  adds the keys of unknown hosts to known_hosts
+//
+// Passphrase protected identity files get decrypted with the passphrase in
+// KNOXITE_SSH_PASSPHRASE.
 package sftp
 
 import (
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
-	"os/user"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	kh "golang.org/x/crypto/ssh/knownhosts"
 
 	"github.com/knoxite/knoxite"
 )
 
+// Error declarations
+var (
+	ErrBackendClosed = errors.New("SFTP backend has been closed")
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	// keepaliveInterval is how often an idle connection gets checked
+	keepaliveInterval = 30 * time.Second
+	// keepaliveTimeout is how long the server may take to respond to a
+	// keepalive, before the connection is considered lost
+	keepaliveTimeout = 15 * time.Second
+
+	// status codes of servers reporting a missing file or directory
+	statusNoSuchFile = 2
+	statusNoSuchPath = 10
+)
+
 type SFTPStorage struct {
-	url  url.URL
-	ssh  *ssh.Client
-	sftp *sftp.Client
+	url   url.URL
+	hosts []sshHost
+
+	mu     sync.Mutex
+	conn   *connection
+	closed bool
+
 	knoxite.StorageFilesystem
 }
 
+// connection is an SFTP session, possibly running through jump hosts.
+type connection struct {
+	clients []*ssh.Client
+	sftp    *sftp.Client
+	agent   net.Conn
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
 func init() {
 	knoxite.RegisterStorageBackend(&SFTPStorage{})
 }
 
 func (*SFTPStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
-	_, port, err := net.SplitHostPort(u.Host)
-	if err != nil || len(port) == 0 {
-		port = "22"
-		u.Host = net.JoinHostPort(u.Host, port)
-	}
-	username := u.User.Username()
-	password, isSet := u.User.Password()
-
-	auth := []ssh.AuthMethod{}
-	if isSet {
-		auth = append(auth, ssh.Password(password))
-	} else {
-		socket := os.Getenv("SSH_AUTH_SOCK")
-		agent_conn, err := net.Dial("unix", socket)
-		if err != nil {
-			return &SFTPStorage{}, knoxite.ErrInvalidPassword
-		} else {
-			agentClient := agent.NewClient(agent_conn)
-			auth = append(auth, ssh.PublicKeysCallback(agentClient.Signers))
-		}
-	}
-
-	usr, _ := user.Current()
-
-	hostKeyCallback, err := kh.New(filepath.Join(usr.HomeDir, ".ssh/known_hosts"))
+	cfg, err := loadSSHConfig(filepath.Join(homeDir(), ".ssh", "config"))
 	if err != nil {
-		// If no hostkey can be found, ignore it for now...
-		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return &SFTPStorage{}, err
 	}
 
-	config := &ssh.ClientConfig{
-		User:            username,
-		Auth:            auth,
-		HostKeyCallback: hostKeyCallback,
+	q := u.Query()
+	password, _ := u.User.Password()
+	tofu, _ := strconv.ParseBool(q.Get("tofu"))
+	opts := hostOptions{
+		user:       u.User.Username(),
+		password:   password,
+		port:       u.Port(),
+		identities: q["identity"],
+		tofu:       tofu,
+	}
+	if kh := q.Get("known_hosts"); kh != "" {
+		opts.knownHosts = []string{kh}
 	}
 
-	conn, err := ssh.Dial("tcp", u.Hostname()+":"+u.Port(), config)
+	hosts, err := resolveJumps(cfg, u.Hostname(), tofu)
 	if err != nil {
 		return &SFTPStorage{}, err
 	}
-
-	client, err := sftp.NewClient(conn)
+	target, err := resolveHost(cfg, u.Hostname(), opts)
 	if err != nil {
 		return &SFTPStorage{}, err
 	}
 
 	backend := SFTPStorage{
-		url:  u,
-		sftp: client,
-		ssh:  conn,
+		url:   u,
+		hosts: append(hosts, target),
+	}
+	if backend.conn, err = backend.connect(); err != nil {
+		return &SFTPStorage{}, err
 	}
 
 	fs, err := knoxite.NewStorageFilesystem(u.Path, &backend)
@@ -97,12 +128,203 @@ func (*SFTPStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
 	return &backend, nil
 }
 
+// connect opens an SFTP session, connecting through all jump hosts.
+func (backend *SFTPStorage) connect() (*connection, error) {
+	c := &connection{
+		done: make(chan struct{}),
+	}
+
+	var ag agent.Agent
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			c.agent = conn
+			ag = agent.NewClient(conn)
+		}
+	}
+
+	var client *ssh.Client
+	for _, host := range backend.hosts {
+		config, err := host.clientConfig(ag)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		// the handshake hides why a host key got rejected
+		var keyErr error
+		verify := config.HostKeyCallback
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			keyErr = verify(hostname, remote, key)
+			return keyErr
+		}
+
+		var conn net.Conn
+		if client == nil {
+			conn, err = net.DialTimeout("tcp", host.addr, dialTimeout)
+		} else {
+			conn, err = client.Dial("tcp", host.addr)
+		}
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+		sc, chans, reqs, err := ssh.NewClientConn(conn, host.addr, config)
+		if err != nil {
+			conn.Close()
+			c.close()
+			if keyErr != nil {
+				return nil, keyErr
+			}
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+
+		client = ssh.NewClient(sc, chans, reqs)
+		c.clients = append(c.clients, client)
+	}
+
+	var err error
+	if c.sftp, err = sftp.NewClient(client); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	go func() {
+		_ = client.Wait()
+		c.close()
+	}()
+	go c.keepalive()
+
+	return c, nil
+}
+
+// client returns the current connection, or a new one if failed is the
+// current connection or it has been lost.
+func (backend *SFTPStorage) client(failed *connection) (*connection, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if backend.closed {
+		return nil, ErrBackendClosed
+	}
+	if backend.conn != nil && backend.conn != failed && !backend.conn.isClosed() {
+		return backend.conn, nil
+	}
+
+	if backend.conn != nil {
+		backend.conn.close()
+	}
+	var err error
+	backend.conn, err = backend.connect()
+	return backend.conn, err
+}
+
+// do runs op with an SFTP client. If the connection got lost while running op,
+// it reconnects and runs op once more.
+func (backend *SFTPStorage) do(op func(c *sftp.Client) error) error {
+	conn, err := backend.client(nil)
+	if err != nil {
+		return err
+	}
+
+	err = op(conn.sftp)
+	if err == nil || !conn.lost(err) {
+		return err
+	}
+
+	if conn, err = backend.client(conn); err != nil {
+		return err
+	}
+	return op(conn.sftp)
+}
+
+// lost returns true if err got caused by losing the connection.
+func (c *connection) lost(err error) bool {
+	if _, ok := err.(*sftp.StatusError); ok || os.IsNotExist(err) || os.IsPermission(err) {
+		// the server responded
+		return false
+	}
+	return !c.alive()
+}
+
+// alive checks whether the server still responds.
+func (c *connection) alive() bool {
+	if c.isClosed() {
+		return false
+	}
+
+	client := c.clients[len(c.clients)-1]
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		return err == nil
+	case <-time.After(keepaliveTimeout):
+		c.close()
+		return false
+	}
+}
+
+// keepalive closes the connection once the server stops responding.
+func (c *connection) keepalive() {
+	t := time.NewTicker(keepaliveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if !c.alive() {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *connection) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *connection) close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		if c.sftp != nil {
+			err = c.sftp.Close()
+		}
+		for i := len(c.clients) - 1; i >= 0; i-- {
+			c.clients[i].Close()
+		}
+		if c.agent != nil {
+			c.agent.Close()
+		}
+		close(c.done)
+	})
+	return err
+}
+
 func (backend *SFTPStorage) Protocols() []string {
 	return []string{"sftp"}
 }
 
 func (backend *SFTPStorage) AvailableSpace() (uint64, error) {
-	stat, err := backend.sftp.StatVFS(backend.url.Path)
+	var stat *sftp.StatVFS
+	err := backend.do(func(c *sftp.Client) error {
+		var err error
+		stat, err = c.StatVFS(backend.url.Path)
+		return err
+	})
 	if err != nil || stat == nil {
 		return 0, knoxite.ErrAvailableSpaceUnknown
 	}
@@ -111,7 +333,14 @@ func (backend *SFTPStorage) AvailableSpace() (uint64, error) {
 }
 
 func (backend *SFTPStorage) Close() error {
-	return backend.sftp.Close()
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	backend.closed = true
+	if backend.conn == nil {
+		return nil
+	}
+	return backend.conn.close()
 }
 
 func (backend *SFTPStorage) Description() string {
@@ -123,29 +352,38 @@ func (backend *SFTPStorage) Location() string {
 }
 
 func (backend *SFTPStorage) CreatePath(path string) error {
-	return backend.sftp.MkdirAll(path)
+	return backend.do(func(c *sftp.Client) error {
+		return c.MkdirAll(path)
+	})
 }
 
 func (backend *SFTPStorage) DeleteFile(path string) error {
-	return backend.sftp.Remove(path)
+	return backend.do(func(c *sftp.Client) error {
+		return c.Remove(path)
+	})
 }
 
 func (backend *SFTPStorage) DeletePath(path string) error {
-	// fmt.Println("Deleting path", path)
-	files, err := backend.sftp.ReadDir(path)
+	return backend.do(func(c *sftp.Client) error {
+		return deletePath(c, path)
+	})
+}
+
+func deletePath(c *sftp.Client, path string) error {
+	files, err := c.ReadDir(path)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
-		fpath := backend.sftp.Join(path, file.Name())
+		fpath := c.Join(path, file.Name())
 		if file.IsDir() {
-			err = backend.DeletePath(fpath)
+			err = deletePath(c, fpath)
 			if err != nil {
 				return err
 			}
-			err = backend.sftp.Remove(fpath)
+			err = c.Remove(fpath)
 		} else {
-			err = backend.DeleteFile(fpath)
+			err = c.Remove(fpath)
 		}
 		if err != nil {
 			return err
@@ -156,30 +394,76 @@ func (backend *SFTPStorage) DeletePath(path string) error {
 }
 
 func (backend *SFTPStorage) ReadFile(path string) ([]byte, error) {
-	file, err := backend.sftp.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+	var data []byte
+	err := backend.do(func(c *sftp.Client) error {
+		file, err := c.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
 
-	return ioutil.ReadAll(file)
+		data, err = ioutil.ReadAll(file)
+		return err
+	})
+	return data, err
 }
 
 func (backend *SFTPStorage) WriteFile(path string, data []byte) (size uint64, err error) {
-	file, err := backend.sftp.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
-	if err != nil {
-		return 0, err
-	}
-	defer file.Close()
+	err = backend.do(func(c *sftp.Client) error {
+		file, err := c.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
 
-	length, err := file.Write(data)
-	return uint64(length), err
+		length, err := file.Write(data)
+		size = uint64(length)
+		return err
+	})
+	return size, err
 }
 
 func (backend *SFTPStorage) Stat(path string) (uint64, error) {
-	stat, err := backend.sftp.Stat(path)
+	var size uint64
+	err := backend.do(func(c *sftp.Client) error {
+		stat, err := c.Stat(path)
+		if err != nil {
+			return err
+		}
+		size = uint64(stat.Size())
+		return nil
+	})
+	return size, err
+}
+
+// ListFiles returns the sizes of all files in a dir on the SFTP server.
+func (backend *SFTPStorage) ListFiles(path string) (map[string]uint64, error) {
+	files := make(map[string]uint64)
+	err := backend.do(func(c *sftp.Client) error {
+		fis, err := c.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		for _, fi := range fis {
+			if !fi.IsDir() {
+				files[fi.Name()] = uint64(fi.Size())
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return 0, err
+		return nil, notFound("list", path, err)
+	}
+	return files, nil
+}
+
+// notFound turns the errors of servers reporting a missing file or directory
+// into errors satisfying os.IsNotExist.
+func notFound(op, p string, err error) error {
+	if serr, ok := err.(*sftp.StatusError); err == os.ErrNotExist ||
+		ok && (serr.Code == statusNoSuchFile || serr.Code == statusNoSuchPath) {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
 	}
-	return uint64(stat.Size()), err
+	return err
 }
@@ -0,0 +1,191 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package sftp
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth limits how deeply ssh config files may include each other.
+const maxIncludeDepth = 16
+
+// sshConfig holds the host blocks of an ssh config file, as described in
+// ssh_config(5). Match blocks are not supported and get skipped.
+type sshConfig struct {
+	hosts []sshConfigHost
+}
+
+type sshConfigHost struct {
+	patterns []string
+	options  []sshConfigOption
+}
+
+type sshConfigOption struct {
+	key   string
+	value string
+}
+
+// loadSSHConfig parses an ssh config file. A missing file results in an empty
+// config.
+func loadSSHConfig(filename string) (*sshConfig, error) {
+	c := &sshConfig{}
+	err := c.parse(filename, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sshConfig) parse(filename string, depth int) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// options before the first Host line apply to all hosts
+	c.hosts = append(c.hosts, sshConfigHost{patterns: []string{"*"}})
+	host := &c.hosts[len(c.hosts)-1]
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value := splitSSHConfigLine(scanner.Text())
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			c.hosts = append(c.hosts, sshConfigHost{patterns: strings.Fields(value)})
+			host = &c.hosts[len(c.hosts)-1]
+		case "match":
+			c.hosts = append(c.hosts, sshConfigHost{})
+			host = &c.hosts[len(c.hosts)-1]
+		case "include":
+			if depth >= maxIncludeDepth {
+				continue
+			}
+			for _, pattern := range strings.Fields(value) {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(filename), pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				for _, m := range matches {
+					inc := &sshConfig{}
+					if err := inc.parse(m, depth+1); err != nil {
+						continue
+					}
+					// included options belong to the current block
+					for _, h := range inc.hosts {
+						if len(h.patterns) == 1 && h.patterns[0] == "*" {
+							host.options = append(host.options, h.options...)
+							continue
+						}
+						c.hosts = append(c.hosts, h)
+						host = &c.hosts[len(c.hosts)-1]
+					}
+				}
+			}
+		default:
+			host.options = append(host.options, sshConfigOption{key, value})
+		}
+	}
+
+	return scanner.Err()
+}
+
+// splitSSHConfigLine returns the lower-cased keyword and the value of a line.
+func splitSSHConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+	key := strings.ToLower(line[:i])
+	value := strings.TrimLeft(line[i:], " \t")
+	value = strings.TrimPrefix(value, "=")
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	return key, value
+}
+
+// Get returns the first value of key for the host alias, as ssh uses the
+// first value it finds.
+func (c *sshConfig) Get(alias, key string) string {
+	key = strings.ToLower(key)
+	for _, h := range c.hosts {
+		if !h.matches(alias) {
+			continue
+		}
+		for _, o := range h.options {
+			if o.key == key {
+				return o.value
+			}
+		}
+	}
+	return ""
+}
+
+// GetAll returns all values of key for the host alias.
+func (c *sshConfig) GetAll(alias, key string) []string {
+	var values []string
+	key = strings.ToLower(key)
+	for _, h := range c.hosts {
+		if !h.matches(alias) {
+			continue
+		}
+		for _, o := range h.options {
+			if o.key == key {
+				values = append(values, o.value)
+			}
+		}
+	}
+	return values
+}
+
+// matches returns true if alias matches one of the host's patterns and none
+// of its negated patterns.
+func (h sshConfigHost) matches(alias string) bool {
+	matched := false
+	for _, p := range h.patterns {
+		negated := strings.HasPrefix(p, "!")
+		if ok, _ := path.Match(strings.TrimPrefix(p, "!"), alias); !ok {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// expandHome replaces a leading ~ with the user's home dir.
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return filepath.Join(homeDir(), p[1:])
+	}
+	return p
+}
+
+// homeDir returns the user's home dir.
+func homeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return home
+}
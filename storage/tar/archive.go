@@ -0,0 +1,427 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package tar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// indexName is the member holding the index of all files
+	indexName = ".knoxite-index"
+	// trailerName is the member at the end of the last volume, pointing at
+	// the index
+	trailerName = ".knoxite-trailer"
+	// whiteoutPrefix marks members recording the deletion of a file
+	whiteoutPrefix = ".wh."
+
+	blockSize = 512
+	// endSize is the size of the end-of-archive marker
+	endSize = 2 * blockSize
+	// locatorSize is the size of the trailer member, including its header
+	locatorSize = 2 * blockSize
+)
+
+// errNoTrailer is returned when a volume doesn't end with a trailer.
+var errNoTrailer = errors.New("volume doesn't end with a trailer")
+
+// member locates the content of a file within the archive.
+type member struct {
+	Volume int    `json:"volume"`
+	Offset int64  `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+// indexEntry is a line of the index.
+type indexEntry struct {
+	Name string `json:"name"`
+	Dir  bool   `json:"dir,omitempty"`
+	member
+}
+
+// offsetWriter writes to a file at increasing offsets.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read. It deliberately doesn't implement
+// io.Seeker, so tar.Reader reads over skipped content.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// pad returns n rounded up to a multiple of the tar block size.
+func pad(n int64) int64 {
+	return (n + blockSize - 1) &^ (blockSize - 1)
+}
+
+// headerSize returns the size of the header blocks for a member. Long names
+// require an additional PAX header.
+func headerSize(name string) int64 {
+	if len(name) < 100 {
+		return blockSize
+	}
+	return 2*blockSize + pad(int64(len(name))+64)
+}
+
+// trailerSize returns the space required to finish the last volume with an
+// index of the given size.
+func trailerSize(indexSize int64) int64 {
+	return headerSize(indexName) + pad(indexSize) + locatorSize + endSize
+}
+
+// indexLine returns the line of the index describing a file or dir.
+func indexLine(e indexEntry) []byte {
+	b, _ := json.Marshal(e)
+	return append(b, '\n')
+}
+
+// volumePath returns the path of the n-th volume: repo.tar, repo.1.tar,
+// repo.2.tar and so on.
+func (backend *TarStorage) volumePath(n int) string {
+	if n == 0 {
+		return backend.path
+	}
+	ext := filepath.Ext(backend.path)
+	return strings.TrimSuffix(backend.path, ext) + "." + strconv.Itoa(n) + ext
+}
+
+// volume returns the opened n-th volume. Callers must hold backend.mu.
+func (backend *TarStorage) volume(n int) (*os.File, error) {
+	if f, ok := backend.files[n]; ok {
+		return f, nil
+	}
+
+	f, err := os.Open(backend.volumePath(n))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrMissingVolume, backend.volumePath(n))
+	}
+	if err != nil {
+		return nil, err
+	}
+	backend.files[n] = f
+	return f, nil
+}
+
+// load finds all volumes and reads the index from the trailer of the last
+// one. Without a valid trailer, e.g. after a crash, the index gets rebuilt
+// by reading all volumes.
+func (backend *TarStorage) load() error {
+	last := -1
+	for {
+		if _, err := os.Stat(backend.volumePath(last + 1)); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		last++
+	}
+	if last < 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(backend.volumePath(last), os.O_RDWR, 0600)
+	if os.IsPermission(err) {
+		// read-only media can still be read from
+		f, err = os.Open(backend.volumePath(last))
+	}
+	if err != nil {
+		return err
+	}
+	backend.files[last] = f
+	backend.last = last
+
+	err = backend.readTrailer(f)
+	if err == errNoTrailer {
+		return backend.scan()
+	}
+	return err
+}
+
+// readTrailer reads the index the trailer of the last volume points at.
+func (backend *TarStorage) readTrailer(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size < locatorSize+endSize {
+		return errNoTrailer
+	}
+
+	tr := tar.NewReader(io.NewSectionReader(f, size-locatorSize-endSize, locatorSize))
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != trailerName {
+		return errNoTrailer
+	}
+	b, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return errNoTrailer
+	}
+	off, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || off < 0 || off >= size {
+		return errNoTrailer
+	}
+
+	tr = tar.NewReader(io.NewSectionReader(f, off, size-off))
+	hdr, err = tr.Next()
+	if err != nil || hdr.Name != indexName {
+		return errNoTrailer
+	}
+	s := bufio.NewScanner(tr)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var e indexEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptIndex, err)
+		}
+		if e.Dir {
+			backend.addDir(e.Name)
+		} else {
+			backend.setFile(e.Name, &e.member)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptIndex, err)
+	}
+
+	backend.pos = off
+	backend.trailer = true
+	return nil
+}
+
+// scan rebuilds the index by reading the members of all volumes. Anything
+// following the last complete member gets overwritten by the next write.
+func (backend *TarStorage) scan() error {
+	for n := 0; n <= backend.last; n++ {
+		f, err := backend.volume(n)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		cr := &countingReader{r: io.NewSectionReader(f, 0, fi.Size())}
+		tr := tar.NewReader(cr)
+		next := int64(0)
+		for {
+			hdr, err := tr.Next()
+			if err != nil || hdr.Name == indexName || hdr.Name == trailerName {
+				// the end of the volume, a truncated member or a stale
+				// index
+				break
+			}
+			if cr.n+hdr.Size > fi.Size() {
+				break
+			}
+
+			name := strings.TrimSuffix(hdr.Name, "/")
+			switch {
+			case hdr.Typeflag == tar.TypeDir:
+				backend.addDir(name)
+			case strings.HasPrefix(path.Base(name), whiteoutPrefix):
+				backend.setFile(path.Join(path.Dir(name), strings.TrimPrefix(path.Base(name), whiteoutPrefix)), nil)
+			case hdr.Typeflag == tar.TypeReg:
+				backend.setFile(name, &member{Volume: n, Offset: cr.n, Size: uint64(hdr.Size)})
+			}
+			next = cr.n + pad(hdr.Size)
+		}
+		backend.pos = next
+	}
+
+	backend.dirty = true
+	return nil
+}
+
+// reserve makes room for n more bytes in the last volume, keeping enough
+// space for a trailer with an index of indexSize bytes. A new volume gets
+// started when required. Callers must hold backend.mu.
+func (backend *TarStorage) reserve(n, indexSize int64) (*os.File, error) {
+	if backend.last < 0 {
+		if err := backend.createVolume(0); err != nil {
+			return nil, err
+		}
+	}
+	f := backend.files[backend.last]
+
+	if backend.trailer {
+		// the trailer gets written again on the next flush
+		if err := f.Truncate(backend.pos); err != nil {
+			return nil, err
+		}
+		backend.trailer = false
+	}
+
+	if backend.volumeSize == 0 || backend.pos+n+trailerSize(indexSize) <= backend.volumeSize {
+		return f, nil
+	}
+	if backend.pos == 0 {
+		return nil, ErrVolumeTooSmall
+	}
+
+	// finish the current volume and continue in the next one
+	if _, err := f.WriteAt(make([]byte, endSize), backend.pos); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := backend.createVolume(backend.last + 1); err != nil {
+		return nil, err
+	}
+	if n+trailerSize(indexSize) > backend.volumeSize {
+		return nil, ErrVolumeTooSmall
+	}
+	return backend.files[backend.last], nil
+}
+
+// createVolume creates the n-th volume and makes it the last one. Callers
+// must hold backend.mu.
+func (backend *TarStorage) createVolume(n int) error {
+	f, err := os.OpenFile(backend.volumePath(n), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	backend.files[n] = f
+	backend.last = n
+	backend.pos = 0
+	return nil
+}
+
+// writeMember appends a member to the last volume. Callers must hold
+// backend.mu.
+func (backend *TarStorage) writeMember(hdr *tar.Header, data []byte, indexSize int64) (member, error) {
+	f, err := backend.reserve(headerSize(hdr.Name)+pad(int64(len(data))), indexSize)
+	if err != nil {
+		return member{}, err
+	}
+
+	w := &offsetWriter{f: f, off: backend.pos}
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return member{}, err
+	}
+	m := member{Volume: backend.last, Offset: w.off, Size: uint64(len(data))}
+	if _, err := tw.Write(data); err != nil {
+		return member{}, err
+	}
+	// pads the member, but unlike Close doesn't end the archive
+	if err := tw.Flush(); err != nil {
+		return member{}, err
+	}
+
+	backend.pos = w.off
+	backend.dirty = true
+	return m, nil
+}
+
+// flush finishes the last volume with the index and a trailer pointing at
+// it. The next write overwrites them again. Callers must hold backend.mu.
+func (backend *TarStorage) flush() error {
+	if !backend.dirty {
+		return nil
+	}
+	if _, err := backend.reserve(0, backend.indexSize); err != nil {
+		return err
+	}
+	f := backend.files[backend.last]
+
+	var index bytes.Buffer
+	dirs := make([]string, 0, len(backend.dirs))
+	for dir := range backend.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if dir != "" {
+			index.Write(indexLine(indexEntry{Name: dir, Dir: true}))
+		}
+	}
+	for _, dir := range dirs {
+		names := make([]string, 0, len(backend.entries[dir]))
+		for name := range backend.entries[dir] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			index.Write(indexLine(indexEntry{Name: path.Join(dir, name), member: backend.entries[dir][name]}))
+		}
+	}
+
+	w := &offsetWriter{f: f, off: backend.pos}
+	tw := tar.NewWriter(w)
+	for _, m := range []struct {
+		name string
+		data []byte
+	}{
+		{indexName, index.Bytes()},
+		{trailerName, []byte(fmt.Sprintf("%020d\n", backend.pos))},
+	} {
+		if err := tw.WriteHeader(fileHeader(m.name, int64(len(m.data)))); err != nil {
+			return err
+		}
+		if _, err := tw.Write(m.data); err != nil {
+			return err
+		}
+	}
+	// writes the end-of-archive marker
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := f.Truncate(w.off); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	backend.trailer = true
+	backend.dirty = false
+	return nil
+}
+
+// fileHeader returns the header of a regular file member.
+func fileHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0600,
+		ModTime:  time.Now(),
+	}
+}
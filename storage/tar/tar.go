@@ -0,0 +1,364 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+// Package tar implements a storage backend keeping a repository in a single
+// tar archive, e.g. for offline copies on removable disks or optical media:
+//
+//	tar:///media/disk/repository.tar
+//
+// The archive only ever gets appended to: files are written as members in
+// the repository's usual layout, deleting a file appends a whiteout member
+// (.wh.<name>) and the newest member of a file wins. The last volume ends
+// with an index of all files and a trailer pointing at it, so files can be
+// read by seeking directly to their members. If the trailer is missing, e.g.
+// after a crash, the index gets rebuilt by reading the whole archive.
+//
+// The archive can span multiple volumes of a limited size, e.g. to fit on
+// several discs. The volumes are named repository.tar, repository.1.tar,
+// repository.2.tar and so on. Each of them is a valid tar archive on its
+// own. The URL's query parameters configure the archive:
+//
+//	volumesize=4.7GB  maximum size of a volume, unlimited by default
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/knoxite/knoxite"
+)
+
+// Error declarations
+var (
+	ErrVolumeTooSmall = errors.New("volume size is too small for the file")
+	ErrMissingVolume  = errors.New("volume of the archive is missing")
+	ErrCorruptIndex   = errors.New("index of the archive is corrupt")
+)
+
+// TarStorage stores data in a tar archive.
+type TarStorage struct {
+	url        url.URL
+	path       string
+	volumeSize int64
+
+	mu    sync.Mutex
+	files map[int]*os.File
+	// last is the volume being written to, -1 before the first one exists
+	last int
+	// pos is the offset the next member gets written at
+	pos int64
+	// trailer is set while the last volume ends with an index and trailer
+	// following pos
+	trailer bool
+	// dirty is set when the index of the last volume is outdated
+	dirty bool
+
+	dirs      map[string]bool
+	entries   map[string]map[string]member
+	indexSize int64
+
+	knoxite.StorageFilesystem
+}
+
+func init() {
+	knoxite.RegisterStorageBackend(&TarStorage{})
+}
+
+// NewBackend opens a tar archive and returns a TarStorage backend. The
+// archive gets created when the first file is written to it.
+func (*TarStorage) NewBackend(u url.URL) (knoxite.Backend, error) {
+	p := filepath.FromSlash(u.Host + u.Path)
+	if p == "" || strings.HasSuffix(p, string(filepath.Separator)) {
+		return &TarStorage{}, knoxite.ErrInvalidRepositoryURL
+	}
+
+	backend := TarStorage{
+		url:     u,
+		path:    p,
+		files:   make(map[int]*os.File),
+		last:    -1,
+		dirs:    map[string]bool{"": true},
+		entries: make(map[string]map[string]member),
+	}
+	if v := u.Query().Get("volumesize"); v != "" {
+		size, err := humanize.ParseBytes(v)
+		if err != nil || size == 0 {
+			return &TarStorage{}, knoxite.ErrInvalidRepositoryURL
+		}
+		backend.volumeSize = int64(size)
+	}
+
+	if err := backend.load(); err != nil {
+		_ = backend.closeFiles()
+		return &TarStorage{}, err
+	}
+
+	fs, err := knoxite.NewStorageFilesystem("", &backend)
+	if err != nil {
+		return &TarStorage{}, err
+	}
+	backend.StorageFilesystem = fs
+
+	return &backend, nil
+}
+
+// Location returns the type and location of the repository.
+func (backend *TarStorage) Location() string {
+	return backend.url.String()
+}
+
+// Close writes the index and closes the archive.
+func (backend *TarStorage) Close() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	err := backend.flush()
+	if cerr := backend.closeFiles(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (backend *TarStorage) closeFiles() error {
+	var err error
+	for n, f := range backend.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		delete(backend.files, n)
+	}
+	return err
+}
+
+// Protocols returns the Protocol Schemes supported by this backend.
+func (backend *TarStorage) Protocols() []string {
+	return []string{"tar"}
+}
+
+// Description returns a user-friendly description for this backend.
+func (backend *TarStorage) Description() string {
+	return "tar archive"
+}
+
+// AvailableSpace returns the free space on this backend.
+func (backend *TarStorage) AvailableSpace() (uint64, error) {
+	return 0, knoxite.ErrAvailableSpaceUnknown
+}
+
+// SaveRepository stores the metadata for a repository and writes the index.
+func (backend *TarStorage) SaveRepository(b []byte) error {
+	if err := backend.StorageFilesystem.SaveRepository(b); err != nil {
+		return err
+	}
+	return backend.Flush()
+}
+
+// SaveSnapshot stores a snapshot and writes the index.
+func (backend *TarStorage) SaveSnapshot(id string, b []byte) error {
+	if err := backend.StorageFilesystem.SaveSnapshot(id, b); err != nil {
+		return err
+	}
+	return backend.Flush()
+}
+
+// SaveChunkIndex stores the chunk-index and writes the index.
+func (backend *TarStorage) SaveChunkIndex(b []byte) error {
+	if err := backend.StorageFilesystem.SaveChunkIndex(b); err != nil {
+		return err
+	}
+	return backend.Flush()
+}
+
+// Flush writes the index and the trailer, so the archive can be read
+// without scanning it.
+func (backend *TarStorage) Flush() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	return backend.flush()
+}
+
+// CreatePath creates a dir including all its parent dirs, when required.
+func (backend *TarStorage) CreatePath(p string) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	p = memberName(p)
+	var missing []string
+	for dir := p; !backend.dirs[dir]; dir = parent(dir) {
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     missing[i] + "/",
+			Mode:     0700,
+			ModTime:  time.Now(),
+		}
+		size := backend.indexSize + int64(len(indexLine(indexEntry{Name: missing[i], Dir: true})))
+		if _, err := backend.writeMember(hdr, nil, size); err != nil {
+			return err
+		}
+		backend.addDir(missing[i])
+	}
+	return nil
+}
+
+// Stat returns the size of a file or dir in the archive.
+func (backend *TarStorage) Stat(p string) (uint64, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	name := memberName(p)
+	if m, ok := backend.entries[parent(name)][path.Base(name)]; ok {
+		return m.Size, nil
+	}
+	if backend.dirs[name] {
+		return 0, nil
+	}
+	return 0, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+}
+
+// ReadFile reads a file from its member in the archive.
+func (backend *TarStorage) ReadFile(p string) ([]byte, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	name := memberName(p)
+	m, ok := backend.entries[parent(name)][path.Base(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	f, err := backend.volume(m.Volume)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, m.Size)
+	if _, err := f.ReadAt(b, m.Offset); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WriteFile appends a file to the archive.
+func (backend *TarStorage) WriteFile(p string, data []byte) (size uint64, err error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	name := memberName(p)
+	size = uint64(len(data))
+	// the member ends up at most in the next volume and right after its
+	// header, so its index line can't get any longer than this
+	indexSize := backend.indexSize + int64(len(indexLine(indexEntry{Name: name, member: member{
+		Volume: backend.last + 1,
+		Offset: backend.pos + headerSize(name),
+		Size:   size,
+	}})))
+	if old, ok := backend.entries[parent(name)][path.Base(name)]; ok {
+		indexSize -= int64(len(indexLine(indexEntry{Name: name, member: old})))
+	}
+
+	m, err := backend.writeMember(fileHeader(name, int64(len(data))), data, indexSize)
+	if err != nil {
+		return 0, err
+	}
+	backend.setFile(name, &m)
+	return size, nil
+}
+
+// DeleteFile appends a whiteout member for a file to the archive. Its
+// content remains in the archive.
+func (backend *TarStorage) DeleteFile(p string) error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	name := memberName(p)
+	if _, ok := backend.entries[parent(name)][path.Base(name)]; !ok {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+
+	whiteout := path.Join(parent(name), whiteoutPrefix+path.Base(name))
+	if _, err := backend.writeMember(fileHeader(whiteout, 0), nil, backend.indexSize); err != nil {
+		return err
+	}
+	backend.setFile(name, nil)
+	return nil
+}
+
+// ListFiles returns the sizes of all files in a dir of the archive.
+func (backend *TarStorage) ListFiles(p string) (map[string]uint64, error) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	dir := memberName(p)
+	if !backend.dirs[dir] {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+
+	files := make(map[string]uint64, len(backend.entries[dir]))
+	for name, m := range backend.entries[dir] {
+		files[name] = m.Size
+	}
+	return files, nil
+}
+
+// addDir records a dir of the archive. Callers must hold backend.mu.
+func (backend *TarStorage) addDir(name string) {
+	for ; !backend.dirs[name]; name = parent(name) {
+		backend.dirs[name] = true
+		backend.indexSize += int64(len(indexLine(indexEntry{Name: name, Dir: true})))
+	}
+}
+
+// setFile records the member of a file, or its deletion if m is nil.
+// Callers must hold backend.mu.
+func (backend *TarStorage) setFile(name string, m *member) {
+	dir, base := parent(name), path.Base(name)
+	if old, ok := backend.entries[dir][base]; ok {
+		backend.indexSize -= int64(len(indexLine(indexEntry{Name: name, member: old})))
+		delete(backend.entries[dir], base)
+	}
+	if m == nil {
+		return
+	}
+
+	backend.addDir(dir)
+	if backend.entries[dir] == nil {
+		backend.entries[dir] = make(map[string]member)
+	}
+	backend.entries[dir][base] = *m
+	backend.indexSize += int64(len(indexLine(indexEntry{Name: name, member: *m})))
+}
+
+// memberName returns the name of the member stored at path p.
+func memberName(p string) string {
+	p = strings.Trim(filepath.ToSlash(p), "/")
+	if p == "." {
+		return ""
+	}
+	return p
+}
+
+// parent returns the dir of a member, or an empty string for the archive's
+// root.
+func parent(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
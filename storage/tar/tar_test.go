@@ -0,0 +1,270 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/storage"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "knoxite-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newBackend(t *testing.T, rawurl string) *TarStorage {
+	be, err := knoxite.BackendFromURL(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return be.(*TarStorage)
+}
+
+// members returns the names of all members of a tar archive, failing if it
+// isn't a valid one.
+func members(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("Expected %s to be a valid tar archive: %v", path, err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func chunk(t *testing.T, size int) ([]byte, string) {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	return data, knoxite.Hash(data, knoxite.HashHighway256)
+}
+
+func TestArchive(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rawurl := "tar://" + filepath.ToSlash(dir) + "/repository.tar"
+
+	be := newBackend(t, rawurl)
+	rt := storage.NewRoundTrip(1024)
+	rt.Store(t, be)
+
+	deleted, deletedSum := chunk(t, 512)
+	if _, err := be.StoreChunk(deletedSum, 0, 1, deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.DeleteChunk(deletedSum, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.DeleteChunk(deletedSum, 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected deleting a missing chunk to fail, got %v", err)
+	}
+	if err := be.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := members(t, filepath.Join(dir, "repository.tar"))
+	if last := names[len(names)-2:]; last[0] != indexName || last[1] != trailerName {
+		t.Errorf("Expected the archive to end with the index, got %v", names)
+	}
+
+	// a new backend reads the index from the trailer
+	be = newBackend(t, rawurl)
+	defer be.Close()
+	if !be.trailer {
+		t.Errorf("Expected the index to be read from the trailer")
+	}
+	rt.Load(t, be)
+	if _, err := be.LoadChunk(deletedSum, 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected deleted chunk not to exist, got %v", err)
+	}
+	found, err := be.HasChunks([]knoxite.ChunkPart{
+		{Shasum: rt.Shasum, Part: 0, TotalParts: 1, Size: uint64(len(rt.Chunk))},
+		{Shasum: deletedSum, Part: 0, TotalParts: 1, Size: uint64(len(deleted))},
+	})
+	if err != nil || found[0] != true || found[1] != false {
+		t.Errorf("Expected only the stored chunk to be found, got %v: %v", found, err)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rawurl := "tar://" + filepath.ToSlash(dir) + "/repository.tar"
+
+	be := newBackend(t, rawurl)
+	if err := be.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	data, shasum := chunk(t, 1024)
+	if _, err := be.StoreChunk(shasum, 0, 1, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.DeleteFile(knoxite.RepoFilename); err != nil {
+		t.Fatal(err)
+	}
+	lost, lostSum := chunk(t, 1024)
+	if _, err := be.StoreChunk(lostSum, 0, 1, lost); err != nil {
+		t.Fatal(err)
+	}
+
+	// crash while writing the last chunk, without a trailer
+	path := filepath.Join(dir, "repository.tar")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fi.Size()-100); err != nil {
+		t.Fatal(err)
+	}
+
+	be = newBackend(t, rawurl)
+	if be.trailer {
+		t.Errorf("Expected the index to be rebuilt")
+	}
+	if b, err := be.LoadChunk(shasum, 0, 1); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("Expected to load the chunk, got %v", err)
+	}
+	if _, err := be.LoadChunk(lostSum, 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected the incomplete chunk not to exist, got %v", err)
+	}
+	if _, err := be.LoadRepository(); !os.IsNotExist(err) {
+		t.Errorf("Expected the deleted repository not to exist, got %v", err)
+	}
+
+	// the incomplete member gets overwritten
+	if _, err := be.StoreChunk(lostSum, 0, 1, lost); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.Close(); err != nil {
+		t.Fatal(err)
+	}
+	members(t, path)
+
+	be = newBackend(t, rawurl)
+	defer be.Close()
+	if b, err := be.LoadChunk(lostSum, 0, 1); err != nil || !bytes.Equal(b, lost) {
+		t.Errorf("Expected to load the chunk, got %v", err)
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rawurl := "tar://" + filepath.ToSlash(dir) + "/repository.tar?volumesize=16KiB"
+
+	be := newBackend(t, rawurl)
+	if err := be.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	chunks := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		data, shasum := chunk(t, 3000)
+		if _, err := be.StoreChunk(shasum, 0, 1, data); err != nil {
+			t.Fatal(err)
+		}
+		chunks[shasum] = data
+	}
+	if err := be.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	data, shasum := chunk(t, 16*1024)
+	if _, err := be.StoreChunk(shasum, 0, 1, data); err != ErrVolumeTooSmall {
+		t.Errorf("Expected %v, got %v", ErrVolumeTooSmall, err)
+	}
+	if err := be.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	volumes, _ := filepath.Glob(filepath.Join(dir, "repository.*tar"))
+	if len(volumes) < 4 {
+		t.Errorf("Expected the archive to span several volumes, got %v", volumes)
+	}
+	for n := range volumes {
+		path := filepath.Join(dir, "repository.tar")
+		if n > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("repository.%d.tar", n))
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 16*1024 {
+			t.Errorf("Expected %s not to exceed the volume size, got %d bytes", path, fi.Size())
+		}
+		members(t, path)
+	}
+
+	be = newBackend(t, rawurl)
+	for shasum, data := range chunks {
+		if b, err := be.LoadChunk(shasum, 0, 1); err != nil || !bytes.Equal(b, data) {
+			t.Errorf("Expected to load chunk %s, got %v", shasum, err)
+		}
+	}
+	if err := be.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reading from a missing volume fails, but doesn't claim the file
+	// doesn't exist
+	if err := os.Rename(filepath.Join(dir, "repository.1.tar"), filepath.Join(dir, "offline.tar")); err != nil {
+		t.Fatal(err)
+	}
+	be = newBackend(t, rawurl)
+	defer be.Close()
+	if _, err := be.ReadFile("chunks"); !os.IsNotExist(err) {
+		t.Errorf("Expected a dir not to be readable, got %v", err)
+	}
+	for shasum := range chunks {
+		if be.entries[parent(memberName(be.ChunkPath(shasum, 0, 1)))][shasum+".0_1"].Volume != 1 {
+			continue
+		}
+		if _, err := be.LoadChunk(shasum, 0, 1); !errors.Is(err, ErrMissingVolume) {
+			t.Errorf("Expected %v, got %v", ErrMissingVolume, err)
+		}
+		break
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, rawurl := range []string{
+		"tar://",
+		"tar:///tmp/",
+		"tar:///tmp/repository.tar?volumesize=large",
+	} {
+		if _, err := knoxite.BackendFromURL(rawurl); err == nil {
+			t.Errorf("Expected an error for %s", rawurl)
+		}
+	}
+}
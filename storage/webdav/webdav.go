@@ -124,3 +124,19 @@ func (backend *WebDAVStorage) Stat(path string) (uint64, error) {
 	}
 	return uint64(stat.Size()), nil
 }
+
+// ListFiles returns the sizes of all files in a remote dir.
+func (backend *WebDAVStorage) ListFiles(path string) (map[string]uint64, error) {
+	fis, err := backend.Client.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]uint64)
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			files[fi.Name()] = uint64(fi.Size())
+		}
+	}
+	return files, nil
+}
@@ -44,7 +44,8 @@ type StorageFilesystem struct {
 	chunkIndexPath string
 	repositoryPath string
 
-	storage *BackendFilesystem
+	storage  *BackendFilesystem
+	listings *fileListings
 }
 
 // NewStorageFilesystem returns a StorageFilesystem object.
@@ -56,26 +57,36 @@ func NewStorageFilesystem(path string, storage BackendFilesystem) (StorageFilesy
 		chunkIndexPath: filepath.Join(path, chunksDirname, ChunkIndexFilename),
 		repositoryPath: filepath.Join(path, RepoFilename),
 		storage:        &storage,
+		listings:       newFileListings(),
 	}
 	return s, nil
 }
 
+// ChunkPath returns the path a Chunk is stored at.
+func (backend StorageFilesystem) ChunkPath(shasum string, part, totalParts uint) string {
+	return filepath.Join(backend.chunkPath, SubDirForChunk(shasum),
+		shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
+}
+
 // LoadChunk loads a Chunk from disk.
 func (backend StorageFilesystem) LoadChunk(shasum string, part, totalParts uint) ([]byte, error) {
-	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
-	fileName := filepath.Join(path, shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
-
-	return (*backend.storage).ReadFile(fileName)
+	return (*backend.storage).ReadFile(backend.ChunkPath(shasum, part, totalParts))
 }
 
 // StoreChunk stores a single Chunk on disk.
 func (backend StorageFilesystem) StoreChunk(shasum string, part, totalParts uint, data []byte) (size uint64, err error) {
 	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
-	fileName := filepath.Join(path, shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
+	fileName := backend.ChunkPath(shasum, part, totalParts)
 
-	n, err := (*backend.storage).Stat(fileName)
-	if err == nil && n == uint64(len(data)) {
-		return 0, nil
+	if n, exists, ok := backend.listings.lookup(path, filepath.Base(fileName)); ok {
+		if exists && n == uint64(len(data)) {
+			return 0, nil
+		}
+	} else {
+		n, err := (*backend.storage).Stat(fileName)
+		if err == nil && n == uint64(len(data)) {
+			return 0, nil
+		}
 	}
 
 	err = (*backend.storage).CreatePath(path)
@@ -83,15 +94,51 @@ func (backend StorageFilesystem) StoreChunk(shasum string, part, totalParts uint
 		return 0, err
 	}
 
-	return (*backend.storage).WriteFile(fileName, data)
+	size, err = (*backend.storage).WriteFile(fileName, data)
+	if err == nil {
+		backend.listings.set(path, filepath.Base(fileName), int64(size))
+	}
+	return size, err
+}
+
+// HasChunks reports for each part whether it is stored with the given size.
+// Every chunk dir gets listed only once instead of checking each part on its
+// own. If the BackendFilesystem can't list dirs, all parts get reported as
+// missing: StoreChunk checks them on its own anyway, and checking them here
+// as well would only double the requests for new chunks.
+func (backend StorageFilesystem) HasChunks(parts []ChunkPart) ([]bool, error) {
+	found := make([]bool, len(parts))
+	lister, ok := (*backend.storage).(BackendFilesystemLister)
+	if !ok {
+		return found, nil
+	}
+
+	for i, p := range parts {
+		path := filepath.Join(backend.chunkPath, SubDirForChunk(p.Shasum))
+		fileName := backend.ChunkPath(p.Shasum, p.Part, p.TotalParts)
+
+		if backend.listings.list(lister, path) == nil {
+			if n, exists, ok := backend.listings.lookup(path, filepath.Base(fileName)); ok {
+				found[i] = exists && n == p.Size
+				continue
+			}
+		}
+
+		n, err := (*backend.storage).Stat(fileName)
+		found[i] = err == nil && n == p.Size
+	}
+
+	return found, nil
 }
 
 // DeleteChunk deletes a single Chunk.
 func (backend StorageFilesystem) DeleteChunk(shasum string, part, totalParts uint) error {
-	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
-	fileName := filepath.Join(path, shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
-
-	return (*backend.storage).DeleteFile(fileName)
+	fileName := backend.ChunkPath(shasum, part, totalParts)
+	err := (*backend.storage).DeleteFile(fileName)
+	if err == nil || isNotFound(err) {
+		backend.listings.set(filepath.Dir(fileName), filepath.Base(fileName), -1)
+	}
+	return err
 }
 
 // LoadSnapshot loads a snapshot.
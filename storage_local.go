@@ -88,3 +88,19 @@ func (backend StorageLocal) DeleteFile(path string) error {
 	// fmt.Println("Deleting:", path)
 	return os.Remove(path)
 }
+
+// ListFiles returns the sizes of all files in a dir on disk.
+func (backend StorageLocal) ListFiles(path string) (map[string]uint64, error) {
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]uint64)
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			files[fi.Name()] = uint64(fi.Size())
+		}
+	}
+	return files, nil
+}
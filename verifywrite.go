@@ -0,0 +1,81 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+)
+
+// Error declarations
+var (
+	ErrChunkMismatch       = errors.New("Stored chunk does not match the uploaded data")
+	ErrChecksumUnavailable = errors.New("Storage backend can't provide a checksum for this chunk")
+)
+
+// maxReuploads is how often a part gets uploaded again after a mismatch,
+// before the backend is considered to be failing.
+const maxReuploads = 2
+
+// ChunkVerifier is implemented by storage backends which can verify a stored
+// chunk without downloading it, e.g. by comparing a server-side checksum.
+type ChunkVerifier interface {
+	// VerifyChunk returns ErrChunkMismatch if the stored part differs from
+	// data, or ErrChecksumUnavailable if it can't be verified this way
+	VerifyChunk(shasum string, part, totalParts uint, data []byte) error
+}
+
+// VerifyStoredChunk checks that a part stored on be matches data. Backends
+// implementing ChunkVerifier verify it on their own, otherwise the part gets
+// read back.
+func VerifyStoredChunk(be Backend, shasum string, part, totalParts uint, data []byte) error {
+	if v, ok := be.(ChunkVerifier); ok {
+		err := v.VerifyChunk(shasum, part, totalParts, data)
+		if err != ErrChecksumUnavailable {
+			return err
+		}
+	}
+
+	return readBackChunk(be, shasum, part, totalParts, data)
+}
+
+// readBackChunk loads a stored part and compares its hash with data's.
+func readBackChunk(be Backend, shasum string, part, totalParts uint, data []byte) error {
+	b, err := be.LoadChunk(shasum, part, totalParts)
+	if err != nil {
+		return err
+	}
+	if Hash(b, HashHighway256) != Hash(data, HashHighway256) {
+		return ErrChunkMismatch
+	}
+
+	return nil
+}
+
+// storeVerifiedChunk stores a part on be and verifies it afterwards. Parts
+// which don't match get deleted and uploaded again.
+func storeVerifiedChunk(be Backend, shasum string, part, totalParts uint, data []byte) (n uint64, reuploads uint64, err error) {
+	for {
+		n, err = be.StoreChunk(shasum, part, totalParts, data)
+		if err != nil {
+			return
+		}
+
+		err = VerifyStoredChunk(be, shasum, part, totalParts, data)
+		if err != ErrChunkMismatch || reuploads >= maxReuploads {
+			return
+		}
+		reuploads++
+		currentMetrics().Inc(MetricBackendReuploads, "backend", be.Location())
+
+		// backends skip parts which are already stored, so the broken part
+		// must be removed first
+		if derr := be.DeleteChunk(shasum, part, totalParts); derr != nil && !isNotFound(derr) {
+			return n, reuploads, derr
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016-2020, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"testing"
+)
+
+// truncatingBackend silently truncates a number of uploaded chunks.
+type truncatingBackend struct {
+	Backend
+	truncate int
+}
+
+func (backend *truncatingBackend) StoreChunk(shasum string, part, totalParts uint, data []byte) (uint64, error) {
+	if backend.truncate > 0 {
+		backend.truncate--
+		_, err := backend.Backend.StoreChunk(shasum, part, totalParts, data[:len(data)/2])
+		return uint64(len(data)), err
+	}
+
+	return backend.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+func TestVerifyWrites(t *testing.T) {
+	bm, _, cleanup := newTestBackendManager(t, 1)
+	defer cleanup()
+
+	tb := &truncatingBackend{truncate: 1}
+	bm.Wrap(func(be Backend) Backend {
+		tb.Backend = be
+		return tb
+	})
+	bm.VerifyWrites = true
+
+	data := []byte("this is an encrypted chunk")
+	chunk := Chunk{
+		Data:      &[][]byte{data},
+		DataParts: 1,
+		Size:      len(data),
+		Hash:      Hash(data, HashHighway256),
+	}
+	_, reuploads, err := bm.storeChunk(&chunk)
+	if err != nil {
+		t.Fatalf("Failed storing chunk: %s", err)
+	}
+	if reuploads != 1 {
+		t.Errorf("Expected 1 re-upload, got %d", reuploads)
+	}
+
+	b, err := bm.LoadChunk(chunk, 0)
+	if err != nil {
+		t.Fatalf("Failed loading chunk: %s", err)
+	}
+	if string(b) != string(data) {
+		t.Errorf("Data mismatch: expected %s, got %s", data, b)
+	}
+
+	// a backend which keeps corrupting the upload fails the write
+	tb.truncate = 100
+	data = []byte("this is another encrypted chunk")
+	chunk = Chunk{
+		Data:      &[][]byte{data},
+		DataParts: 1,
+		Size:      len(data),
+		Hash:      Hash(data, HashHighway256),
+	}
+	if _, err = bm.StoreChunk(&chunk); err != ErrChunkMismatch {
+		t.Errorf("Expected %v, got %v", ErrChunkMismatch, err)
+	}
+}